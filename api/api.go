@@ -0,0 +1,236 @@
+package api
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "mime"
+  "net/http"
+  "net/url"
+  "reflect"
+  "strconv"
+  "strings"
+)
+
+//
+// Package Api
+// The versioned /v1 api, served alongside the original /new-ct routes
+// /v1 takes GET parameters from the query string, negotiates the response type from Accept,
+// and reports every error as a json ErrorResponse with a machine readable code
+// /new-ct keeps its json bodies on GETs and plain text errors, for existing clients
+//
+
+const Version = "v1"
+
+// Set on every /v1 response, error writers use it to pick the error format
+const VersionHeader = "Api-Version"
+
+// Response types offered by /v1 endpoints
+const (
+  ContentJson = "application/json"
+  ContentCrl = "application/pkix-crl" //DER
+  ContentPem = "application/x-pem-file"
+  ContentOcsp = "application/ocsp-response"
+  ContentEvents = "text/event-stream" //server-sent events
+)
+
+// Machine readable error codes, stable across releases
+const (
+  CodeBadRequest = "bad_request" //malformed body or parameters
+  CodeInvalidSubmission = "invalid_submission" //one or more serials can't be queued, Details lists them
+  CodeBatchTooLarge = "batch_too_large"
+  CodeBodyTooLarge = "body_too_large"
+  CodeUnauthenticated = "unauthenticated"
+  CodeForbidden = "forbidden"
+  CodeNotFound = "not_found"
+  CodeNotEnabled = "not_enabled" //the endpoint needs a feature the server wasn't started with
+  CodeMethodNotAllowed = "method_not_allowed"
+  CodeNotAcceptable = "not_acceptable"
+  CodeRateLimited = "rate_limited"
+  CodeQueueFull = "queue_full" //the revocation queue is at max_queue, retry later
+  CodeUnavailable = "unavailable" //the server can't answer right now, retry later
+  CodeChallengesFull = "challenges_full" //too many self revocation challenges are outstanding, retry after Retry-After
+  CodeShuttingDown = "shutting_down" //submissions are no longer accepted, retry later
+  CodeIntegrationFailed = "integration_failed" //a new root couldn't be signed, the last good one is still served
+  CodeNotLeader = "not_leader" //another replica is sequencing, Details has its url if known
+  CodeNotPublished = "not_published" //the submission couldn't be shared with the other replicas, so wasn't queued, retry
+  CodeInternal = "internal"
+)
+
+// Returned reading a request body that limit.Body cut off, answered with 413 and CodeBodyTooLarge
+var ErrBodyTooLarge = errors.New("request body too large")
+
+type Error struct {
+  Code string
+  Message string
+  Details interface{} `json:",omitempty"`
+}
+
+// Body of every /v1 error
+type ErrorResponse struct {
+  Error Error
+}
+
+type contextKey int
+
+const contentTypeKey contextKey = 0
+
+// Serve next under /v1, responding with the first of offers the client accepts (application/json if none are given)
+// Clients accepting none of them get 406
+func V1(next http.HandlerFunc, offers ...string) http.HandlerFunc {
+  if(len(offers) == 0) {
+    offers = []string{ContentJson}
+  }
+  return func(rw http.ResponseWriter, req *http.Request) {
+    rw.Header().Set(VersionHeader, Version)
+    ct, ok := Negotiate(req.Header.Get("Accept"), offers)
+    if(!ok) {
+      WriteError(rw, http.StatusNotAcceptable, CodeNotAcceptable, fmt.Sprintf("Endpoint responds with %v", strings.Join(offers, ", ")), nil)
+      return
+    }
+    rw.Header().Set("Content-Type", ct)
+    next(rw, req.WithContext(context.WithValue(req.Context(), contentTypeKey, ct)))
+  }
+}
+
+// Whether req came in on /v1
+func IsV1(req *http.Request) bool {
+  _, ok := req.Context().Value(contentTypeKey).(string)
+  return ok
+}
+
+// Response type negotiated for req, empty for /new-ct requests
+func ContentType(req *http.Request) string {
+  ct, _ := req.Context().Value(contentTypeKey).(string)
+  return ct
+}
+
+// First of offers with the highest quality in accept (RFC 7231 5.3.2), an empty accept takes the first offer
+func Negotiate(accept string, offers []string) (string, bool) {
+  if(strings.TrimSpace(accept) == "") {
+    return offers[0], true
+  }
+  best, bestQ := "", 0.0
+  for _, offer := range(offers) {
+    if q := quality(accept, offer); q > bestQ {
+      best, bestQ = offer, q
+    }
+  }
+  return best, bestQ > 0
+}
+
+// Quality accept gives offer, from the most specific range matching it
+func quality(accept string, offer string) float64 {
+  q, specificity := 0.0, -1
+  for _, r := range(strings.Split(accept, ",")) {
+    mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(r))
+    if err != nil {
+      continue
+    }
+    s := -1
+    switch {
+    case mediaType == offer:
+      s = 2
+    case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediaType, "*")):
+      s = 1
+    case mediaType == "*/*" || mediaType == "*":
+      s = 0
+    }
+    if(s <= specificity) {
+      continue
+    }
+    specificity, q = s, 1.0
+    if v, ok := params["q"]; ok {
+      if q, err = strconv.ParseFloat(v, 64); err != nil {
+        q = 0
+      }
+    }
+  }
+  return q
+}
+
+// Write an error, as an ErrorResponse on /v1
+// On /new-ct it is the plain text message, or details as json when there are any
+func WriteError(rw http.ResponseWriter, status int, code string, msg string, details interface{}) {
+  if(rw.Header().Get(VersionHeader) == Version) {
+    rw.Header().Set("Content-Type", ContentJson)
+    rw.Header().Del("Content-Length")
+    rw.WriteHeader(status)
+    json.NewEncoder(rw).Encode(ErrorResponse{Error{code, msg, details}})
+    return
+  }
+  if(details != nil) {
+    rw.Header().Set("Content-Type", ContentJson)
+    rw.WriteHeader(status)
+    json.NewEncoder(rw).Encode(details)
+    return
+  }
+  rw.WriteHeader(status)
+  rw.Write([]byte(msg))
+}
+
+// Error code for a status, for errors without a more specific one
+func CodeFor(status int) string {
+  switch status {
+  case http.StatusBadRequest:
+    return CodeBadRequest
+  case http.StatusUnauthorized:
+    return CodeUnauthenticated
+  case http.StatusForbidden:
+    return CodeForbidden
+  case http.StatusNotFound:
+    return CodeNotFound
+  case http.StatusMethodNotAllowed:
+    return CodeMethodNotAllowed
+  case http.StatusNotAcceptable:
+    return CodeNotAcceptable
+  case http.StatusRequestEntityTooLarge:
+    return CodeBodyTooLarge
+  case http.StatusTooManyRequests:
+    return CodeRateLimited
+  case http.StatusServiceUnavailable:
+    return CodeUnavailable
+  default:
+    return CodeInternal
+  }
+}
+
+// Fill the fields of the struct v points to from query parameters, named by each field's query tag
+// Fields may be strings or unsigned integers, or pointers to them for parameters that can be left out
+// Unknown parameters are an error so typos don't go unnoticed
+func DecodeQuery(values url.Values, v interface{}) error {
+  s := reflect.ValueOf(v).Elem()
+  fields := make(map[string]reflect.Value)
+  for i := 0; i < s.NumField(); i++ {
+    if name := s.Type().Field(i).Tag.Get("query"); name != "" {
+      fields[name] = s.Field(i)
+    }
+  }
+  for name, vals := range(values) {
+    f, ok := fields[name]
+    if(!ok) {
+      return fmt.Errorf("unknown parameter %v", name)
+    }
+    if(len(vals) != 1) {
+      return fmt.Errorf("parameter %v given %v times", name, len(vals))
+    }
+    if(f.Kind() == reflect.Ptr) {
+      f.Set(reflect.New(f.Type().Elem()))
+      f = f.Elem()
+    }
+    switch f.Kind() {
+    case reflect.String:
+      f.SetString(vals[0])
+    case reflect.Uint64:
+      n, err := strconv.ParseUint(vals[0], 10, 64)
+      if err != nil {
+        return fmt.Errorf("parameter %v: %v", name, err)
+      }
+      f.SetUint(n)
+    default:
+      return fmt.Errorf("parameter %v has unsupported type %v", name, f.Kind())
+    }
+  }
+  return nil
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+func TestNegotiate(t *testing.T) {
+  offers := []string{ContentCrl, ContentPem, ContentJson}
+  tests := []struct {
+    accept string
+    want string
+    ok bool
+  }{
+    {"", ContentCrl, true},
+    {"  ", ContentCrl, true},
+    {"*/*", ContentCrl, true},
+    {"application/json", ContentJson, true},
+    {"application/x-pem-file, application/json", ContentPem, true},
+    {"application/pkix-crl;q=0.5, application/x-pem-file", ContentPem, true},
+    {"application/*;q=0.2, application/json", ContentJson, true},
+    // The most specific range decides, even with a lower quality
+    {"application/*, application/pkix-crl;q=0.1", ContentPem, true},
+    {"*/*;q=0.1, application/json;q=0", ContentCrl, true},
+    {"text/*", "", false},
+    {"text/html, application/json;q=0", "", false},
+    {"application/json;q=oops, text/html", "", false},
+    {"not a type, application/json", ContentJson, true},
+  }
+  for _, test := range(tests) {
+    got, ok := Negotiate(test.accept, offers)
+    if(got != test.want || ok != test.ok) {
+      t.Errorf("Negotiate(%q) = %q, %v, want %q, %v", test.accept, got, ok, test.want, test.ok)
+    }
+  }
+}
+
+func TestV1(t *testing.T) {
+  var negotiated string
+  var v1 bool
+  h := V1(func(rw http.ResponseWriter, req *http.Request) {
+    negotiated, v1 = ContentType(req), IsV1(req)
+  }, ContentCrl, ContentPem)
+
+  req := httptest.NewRequest("GET", "/v1/crl", nil)
+  req.Header.Set("Accept", "application/x-pem-file")
+  rw := httptest.NewRecorder()
+  h(rw, req)
+  if(rw.Code != http.StatusOK || negotiated != ContentPem || !v1 || rw.Header().Get("Content-Type") != ContentPem || rw.Header().Get(VersionHeader) != Version) {
+    t.Errorf("V1 answered %v with %v, handler saw %q on /v1 %v", rw.Code, rw.Header(), negotiated, v1)
+  }
+
+  req.Header.Set("Accept", "application/json")
+  rw = httptest.NewRecorder()
+  h(rw, req)
+  var resp ErrorResponse
+  if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {t.Fatal(err)}
+  if(rw.Code != http.StatusNotAcceptable || resp.Error.Code != CodeNotAcceptable || !strings.Contains(resp.Error.Message, ContentPem)) {
+    t.Errorf("V1 answered %v with %+v, want 406 listing the offers", rw.Code, resp)
+  }
+
+  if(IsV1(httptest.NewRequest("GET", "/new-ct/crl", nil))) {
+    t.Errorf("IsV1 is true outside V1")
+  }
+}
+
+func TestWriteError(t *testing.T) {
+  details := map[string]int{"Serial": 4}
+  tests := []struct {
+    name string
+    v1 bool
+    details interface{}
+    contentType string
+    body string
+  }{
+    {"v1", true, nil, ContentJson, `{"Error":{"Code":"bad_request","Message":"bad serial"}}`},
+    {"v1 with details", true, details, ContentJson, `{"Error":{"Code":"bad_request","Message":"bad serial","Details":{"Serial":4}}}`},
+    {"new-ct", false, nil, "", "bad serial"},
+    {"new-ct with details", false, details, ContentJson, `{"Serial":4}`},
+  }
+  for _, test := range(tests) {
+    rw := httptest.NewRecorder()
+    if(test.v1) {
+      rw.Header().Set(VersionHeader, Version)
+      rw.Header().Set("Content-Type", ContentCrl)
+    }
+    WriteError(rw, http.StatusBadRequest, CodeBadRequest, "bad serial", test.details)
+    if(rw.Code != http.StatusBadRequest || rw.Header().Get("Content-Type") != test.contentType || strings.TrimSpace(rw.Body.String()) != test.body) {
+      t.Errorf("%v: WriteError wrote %v %q with %q, want %q with %q", test.name, rw.Code, rw.Header().Get("Content-Type"), rw.Body.String(), test.contentType, test.body)
+    }
+  }
+}
+
+// Only errors without a more specific code fall back to CodeFor, so a 503 can't claim the queue is full
+func TestCodeFor(t *testing.T) {
+  tests := map[int]string{
+    http.StatusBadRequest: CodeBadRequest,
+    http.StatusTooManyRequests: CodeRateLimited,
+    http.StatusServiceUnavailable: CodeUnavailable,
+    http.StatusInternalServerError: CodeInternal,
+    http.StatusTeapot: CodeInternal,
+  }
+  for status, want := range(tests) {
+    if got := CodeFor(status); got != want {
+      t.Errorf("CodeFor(%v) = %q, want %q", status, got, want)
+    }
+  }
+}
+
+func TestDecodeQuery(t *testing.T) {
+  type query struct {
+    Name string `query:"name"`
+    From uint64 `query:"from"`
+    To *uint64 `query:"to"`
+    Ignored string
+    Bad int `query:"bad"`
+  }
+  to := uint64(9)
+  tests := []struct {
+    query string
+    want query
+    err string //empty if it decodes
+  }{
+    {"", query{}, ""},
+    {"name=crl&from=3", query{Name: "crl", From: 3}, ""},
+    {"to=9", query{To: &to}, ""},
+    {"from=-1", query{}, "parameter from"},
+    {"from=ten", query{}, "parameter from"},
+    {"Ignored=x", query{}, "unknown parameter Ignored"},
+    {"form=3", query{}, "unknown parameter form"},
+    {"from=1&from=2", query{}, "given 2 times"},
+    {"bad=1", query{}, "unsupported type int"},
+  }
+  for _, test := range(tests) {
+    values, err := url.ParseQuery(test.query)
+    if err != nil {t.Fatal(err)}
+    var got query
+    err = DecodeQuery(values, &got)
+    if(test.err != "") {
+      if(err == nil || !strings.Contains(err.Error(), test.err)) {
+        t.Errorf("DecodeQuery(%q) = %v, want an error containing %q", test.query, err, test.err)
+      }
+      continue
+    }
+    if(err != nil || !reflect.DeepEqual(got, test.want)) {
+      t.Errorf("DecodeQuery(%q) = %+v, %v, want %+v", test.query, got, err, test.want)
+    }
+  }
+}
@@ -0,0 +1,216 @@
+package audit
+
+import (
+  "bufio"
+  "bytes"
+  "crypto/sha256"
+  "encoding/json"
+  "fmt"
+  "io"
+  "os"
+  "sync"
+  "time"
+)
+
+//
+// Package Audit
+// Append-only record of state changing requests and of every change to the trees, one json object per line
+// Kept separate from glog so it can be reviewed on its own
+// Entries are hash chained: each carries the hash of the one before, so editing, dropping or reordering
+// entries breaks the chain from that point on, see Verify
+//
+
+// Kinds of entry
+const (
+  TypeRequest = "request" //a state changing api request, Request is set
+  TypeSubmission = "submission" //revocations passed to AddNodes, Submissions is set
+  TypeBatch = "batch" //an IntegrateQueue, Batch is set
+  TypeRoot = "root" //a signed root, Root is set
+)
+
+type Record struct {
+  Time time.Time
+  Client string //name of the authenticated client, empty if submissions are unauthenticated
+  AuthMethod string //how the client was authenticated: mtls, jws or none
+  Endpoint string
+  Status int //http status returned to the client, or grpc code for grpc calls
+  Body json.RawMessage `json:",omitempty"` //request body, when it is json
+  BodySha256 []byte `json:",omitempty"` //hash of the request body, when it is not json
+  Error string `json:",omitempty"` //why the request was refused with 401 or 403, empty if it reached the endpoint
+}
+
+// Outcome of one revocation passed to AddNodes, as in tree.Submission
+type Submission struct {
+  ReceiptID string
+  Serial uint64
+  Reason int
+  Status string //queued, duplicate or already-revoked
+}
+
+// One leaf changed by IntegrateQueue, states as in tree.LeafState
+type Change struct {
+  Serial uint64
+  Old string
+  New string
+  Reason int
+}
+
+type Batch struct {
+  Revision uint64 //revision of the root signed after the batch
+  OldRoot []byte
+  NewRoot []byte
+  Changes []Change
+  Rejected []string `json:",omitempty"` //receipt ids of queued changes dropped as no longer allowed
+}
+
+// A signed types.LogRootV1
+type Root struct {
+  Revision uint64
+  RootHash []byte
+  TreeSize uint64
+  TimestampNanos uint64
+  Signature []byte
+}
+
+// One line of the log
+// Hash is the sha256 of the entry's json encoding with Hash left out, PrevHash the Hash of the entry before
+type Entry struct {
+  Seq uint64
+  Time time.Time
+  Type string
+  Tree string `json:",omitempty"` //tree a submission, batch or root belongs to: revocations or issuance-registry
+  Request *Record `json:",omitempty"`
+  Submissions []Submission `json:",omitempty"`
+  Batch *Batch `json:",omitempty"`
+  Root *Root `json:",omitempty"`
+  PrevHash []byte
+  Hash []byte `json:",omitempty"`
+}
+
+type Logger struct {
+  f *os.File
+  seq uint64 //of the next entry
+  prev []byte //hash of the last entry
+  sync.Mutex
+}
+
+// Open (or create) the audit log at path, entries are appended to the end continuing its chain
+// A log written before entries were chained starts its chain from the hash of its last line
+func Open(path string) (*Logger,error) {
+  f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+  if err != nil {return nil,err}
+  l := &Logger{f: f}
+  last, err := lastLine(f)
+  if err != nil {
+    f.Close()
+    return nil,err
+  }
+  if(last != nil) {
+    var e Entry
+    if err := json.Unmarshal(last, &e); err == nil && e.Hash != nil {
+      l.seq, l.prev = e.Seq+1, e.Hash
+    } else {
+      h := sha256.Sum256(last)
+      l.prev = h[:]
+    }
+  }
+  return l,nil
+}
+
+// Write a request record and sync it to disk before returning
+func (l *Logger) Log(r Record) error {
+  return l.append(Entry{Time: r.Time, Type: TypeRequest, Request: &r})
+}
+
+func (l *Logger) LogSubmissions(tree string, subs []Submission) error {
+  return l.append(Entry{Time: time.Now().UTC(), Type: TypeSubmission, Tree: tree, Submissions: subs})
+}
+
+func (l *Logger) LogBatch(tree string, b Batch) error {
+  return l.append(Entry{Time: time.Now().UTC(), Type: TypeBatch, Tree: tree, Batch: &b})
+}
+
+func (l *Logger) LogRoot(tree string, r Root) error {
+  return l.append(Entry{Time: time.Now().UTC(), Type: TypeRoot, Tree: tree, Root: &r})
+}
+
+// Chain e onto the log, then write it and sync it to disk
+func (l *Logger) append(e Entry) error {
+  l.Lock()
+  defer l.Unlock()
+  e.Seq, e.PrevHash = l.seq, l.prev
+  hash, err := e.hash()
+  if err != nil {return err}
+  e.Hash = hash
+  b, err := json.Marshal(e)
+  if err != nil {return err}
+  if _, err := l.f.Write(append(b, '\n')); err != nil {return err}
+  l.seq, l.prev = l.seq+1, hash
+  return l.f.Sync()
+}
+
+func (e Entry) hash() ([]byte,error) {
+  e.Hash = nil
+  b, err := json.Marshal(e)
+  if err != nil {return nil,err}
+  h := sha256.Sum256(b)
+  return h[:],nil
+}
+
+func (l *Logger) Close() error {
+  l.Lock()
+  defer l.Unlock()
+  return l.f.Close()
+}
+
+// Check the chain of the log read from r, returning the number of chained entries
+// Lines from before entries were chained may only come first, the first entry is then chained to the last of them
+func Verify(r io.Reader) (uint64,error) {
+  scanner := bufio.NewScanner(r)
+  scanner.Buffer(nil, 64<<20)
+  var prev []byte
+  var n, line uint64
+  for scanner.Scan() {
+    line++
+    if(len(bytes.TrimSpace(scanner.Bytes())) == 0) {
+      continue
+    }
+    var e Entry
+    if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.Hash == nil {
+      if(n > 0) {
+        return n,fmt.Errorf("line %v: not a chained entry", line)
+      }
+      h := sha256.Sum256(scanner.Bytes())
+      prev = h[:]
+      continue
+    }
+    if(e.Seq != n) {
+      return n,fmt.Errorf("line %v: entry %v found where %v was expected", line, e.Seq, n)
+    }
+    if(!bytes.Equal(e.PrevHash, prev)) {
+      return n,fmt.Errorf("line %v: entry %v does not follow the entry before it", line, e.Seq)
+    }
+    hash, err := e.hash()
+    if err != nil {return n,err}
+    if(!bytes.Equal(e.Hash, hash)) {
+      return n,fmt.Errorf("line %v: entry %v has been modified", line, e.Seq)
+    }
+    prev = hash
+    n++
+  }
+  return n,scanner.Err()
+}
+
+// Last non-empty line of f, nil if there is none
+func lastLine(f *os.File) ([]byte,error) {
+  if _, err := f.Seek(0, io.SeekStart); err != nil {return nil,err}
+  scanner := bufio.NewScanner(f)
+  scanner.Buffer(nil, 64<<20)
+  var last []byte
+  for scanner.Scan() {
+    if(len(bytes.TrimSpace(scanner.Bytes())) > 0) {
+      last = append(last[:0], scanner.Bytes()...)
+    }
+  }
+  return last,scanner.Err()
+}
@@ -0,0 +1,122 @@
+package audit
+
+import (
+  "bytes"
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+// Write a few entries of each kind to a new log in dir, closing and reopening it halfway, and return its lines
+func writeLog(t *testing.T, dir string, legacy string) []string {
+  path := filepath.Join(dir, "audit.log")
+  if err := ioutil.WriteFile(path, []byte(legacy), 0600); err != nil {t.Fatal(err)}
+  l, err := Open(path)
+  if err != nil {t.Fatal(err)}
+  if err := l.Log(Record{Time: time.Now().UTC(), Client: "ca", AuthMethod: "jws", Endpoint: "/v1/revoke", Status: 200, Body: json.RawMessage(`{"Serial":4}`)}); err != nil {t.Fatal(err)}
+  if err := l.LogSubmissions("revocations", []Submission{{ReceiptID: "r1", Serial: 4, Status: "queued"}}); err != nil {t.Fatal(err)}
+  if err := l.Close(); err != nil {t.Fatal(err)}
+  // Reopened, the chain carries on
+  l, err = Open(path)
+  if err != nil {t.Fatal(err)}
+  if err := l.LogBatch("revocations", Batch{Revision: 1, OldRoot: []byte{1}, NewRoot: []byte{2}, Changes: []Change{{Serial: 4, Old: "absent", New: "revoked"}}}); err != nil {t.Fatal(err)}
+  if err := l.LogRoot("revocations", Root{Revision: 1, RootHash: []byte{2}, TreeSize: 1}); err != nil {t.Fatal(err)}
+  if err := l.Close(); err != nil {t.Fatal(err)}
+  b, err := ioutil.ReadFile(path)
+  if err != nil {t.Fatal(err)}
+  return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+// Decode line, let edit change the entry, and encode it again, with its hash redone if rehash
+func editEntry(t *testing.T, line string, rehash bool, edit func(e *Entry)) string {
+  var e Entry
+  if err := json.Unmarshal([]byte(line), &e); err != nil {t.Fatal(err)}
+  edit(&e)
+  if(rehash) {
+    hash, err := e.hash()
+    if err != nil {t.Fatal(err)}
+    e.Hash = hash
+  }
+  b, err := json.Marshal(e)
+  if err != nil {t.Fatal(err)}
+  return string(b)
+}
+
+func TestVerify(t *testing.T) {
+  dir, err := ioutil.TempDir("", "audit")
+  if err != nil {t.Fatal(err)}
+  defer os.RemoveAll(dir)
+  lines := writeLog(t, dir, "")
+  if(len(lines) != 4) {
+    t.Fatalf("log has %v lines, want 4", len(lines))
+  }
+  legacyLines := writeLog(t, dir, "{\"Endpoint\":\"/new-ct/revoke\"}\n\n{\"Endpoint\":\"/new-ct/revoke\",\"Status\":200}\n")
+
+  // Lines with some replaced, in order
+  with := func(replace map[int]string) []string {
+    edited := append([]string{}, lines...)
+    for i, line := range(replace) {
+      edited[i] = line
+    }
+    return edited
+  }
+
+  tests := []struct {
+    name string
+    lines []string
+    n uint64
+    err string //empty if the chain holds
+  }{
+    {"as written", lines, 4, ""},
+    {"after unchained lines", legacyLines, 4, ""},
+    {"blank lines", append(append([]string{""}, lines[:2]...), append([]string{"  "}, lines[2:]...)...), 4, ""},
+    {"empty", nil, 0, ""},
+    {"entry edited", with(map[int]string{1: editEntry(t, lines[1], false, func(e *Entry) {e.Submissions[0].Serial = 5})}), 1, "entry 1 has been modified"},
+    {"entry edited and hashed again", with(map[int]string{1: editEntry(t, lines[1], true, func(e *Entry) {e.Submissions[0].Serial = 5})}), 2, "entry 2 does not follow"},
+    {"entry dropped", append(append([]string{}, lines[:1]...), lines[2:]...), 1, "entry 2 found where 1 was expected"},
+    {"entries swapped", with(map[int]string{2: lines[3], 3: lines[2]}), 2, "entry 3 found where 2 was expected"},
+    {"first entry dropped", lines[1:], 0, "entry 1 found where 0 was expected"},
+    {"unchained line after the chain starts", append(append([]string{}, lines...), `{"Endpoint":"/new-ct/revoke"}`), 4, "line 5: not a chained entry"},
+    {"unchained line dropped", append(append([]string{}, legacyLines[:2]...), legacyLines[3:]...), 0, "entry 0 does not follow"},
+  }
+  for _, test := range(tests) {
+    n, err := Verify(strings.NewReader(strings.Join(test.lines, "\n")))
+    if(test.err == "") {
+      if(err != nil || n != test.n) {
+        t.Errorf("%v: Verify = %v, %v, want %v entries", test.name, n, err, test.n)
+      }
+      continue
+    }
+    if(err == nil || !strings.Contains(err.Error(), test.err) || n != test.n) {
+      t.Errorf("%v: Verify = %v, %v, want %v entries and an error containing %q", test.name, n, err, test.n, test.err)
+    }
+  }
+}
+
+func TestOpenContinuesChain(t *testing.T) {
+  dir, err := ioutil.TempDir("", "audit")
+  if err != nil {t.Fatal(err)}
+  defer os.RemoveAll(dir)
+  lines := writeLog(t, dir, "")
+  var entries []Entry
+  for _, line := range(lines) {
+    var e Entry
+    if err := json.Unmarshal([]byte(line), &e); err != nil {t.Fatal(err)}
+    entries = append(entries, e)
+  }
+  for i, e := range(entries) {
+    if(e.Seq != uint64(i)) {
+      t.Errorf("entry %v numbered %v", i, e.Seq)
+    }
+    if(i > 0 && !bytes.Equal(e.PrevHash, entries[i-1].Hash)) {
+      t.Errorf("entry %v isn't chained to entry %v", i, i-1)
+    }
+  }
+  if(entries[0].PrevHash != nil || entries[0].Type != TypeRequest || entries[2].Type != TypeBatch || entries[3].Tree != "revocations") {
+    t.Errorf("entries written as %+v", entries)
+  }
+}
@@ -0,0 +1,400 @@
+package auth
+
+import (
+  "bytes"
+  "context"
+  "crypto"
+  "crypto/ecdsa"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha256"
+  "crypto/x509"
+  "encoding/asn1"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/json"
+  "encoding/pem"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "math/big"
+  "net/http"
+  "strings"
+  "time"
+  "github.com/golang/glog"
+  "revocation-server/api"
+  "revocation-server/audit"
+)
+
+//
+// Package Auth
+// Authentication and authorization for the submission endpoints
+// A client proves who it is with either
+//   - an mTLS client certificate, matched by the sha256 of its DER encoding
+//   - a JWS (RFC 7515) over the request body, sent detached in the JWS-Signature header, each accepted only once
+// Each client is allowed a set of scopes, and every request, including those rejected with 401 or 403, is written to the audit log
+//
+
+// Scopes a client can be granted
+const (
+  ScopeRevoke = "revoke" //post-revocation, post-release, post-multiple-revocations, post-revocation-by-hash
+  ScopeIssue = "issue" //post-issuance
+  ScopeAdmin = "admin" //admin endpoints such as import-crl
+)
+
+// Header carrying the detached JWS, <base64url protected header>..<base64url signature>
+const SignatureHeader = "JWS-Signature"
+
+// Signed requests older (or newer) than this are rejected, so their jti only needs remembering this long
+const maxClockSkew = 5*time.Minute
+
+// Longest jti accepted, a random 128 bit value as Sign makes is 32 characters
+const maxJtiLength = 64
+
+// Entry in the clients file
+// CertSha256 is the hex sha256 of the client's DER certificate, PublicKey is a PEM public key for JWS
+// Either may be empty
+type ClientConfig struct {
+  Name string
+  Scopes []string
+  CertSha256 string
+  PublicKey string
+}
+
+type ClientsFile struct {
+  Clients []ClientConfig
+}
+
+type Client struct {
+  Name string
+  scopes map[string]bool //nil for the anonymous client of an open Authenticator
+  pub crypto.PublicKey
+}
+
+// protected header of a request signature
+// Url must be the path of the endpoint the request is sent to, so a signature can't be replayed against another endpoint
+// Jti must be unique to the request, a signature is refused once its jti has been used by the same client
+type jwsHeader struct {
+  Alg string `json:"alg"`
+  Kid string `json:"kid"`
+  Iat int64 `json:"iat"`
+  Url string `json:"url"`
+  Jti string `json:"jti"`
+}
+
+type Authenticator struct {
+  open bool //no clients registered, every request is allowed (but still audited)
+  byName map[string]*Client
+  byCert map[[sha256.Size]byte]*Client
+  replay *replayCache //jti of every signature accepted in the last maxClockSkew
+  audit *audit.Logger //may be nil
+}
+
+type contextKey int
+
+const clientKey contextKey = 0
+
+// Load the registered clients from a json ClientsFile
+func Load(path string, auditLog *audit.Logger) (*Authenticator,error) {
+  b, err := ioutil.ReadFile(path)
+  if err != nil {return nil,err}
+  var cf ClientsFile
+  if err := json.Unmarshal(b,&cf); err != nil {
+    return nil,fmt.Errorf("Invalid clients file: %v",err)
+  }
+
+  a := &Authenticator{
+    byName: make(map[string]*Client),
+    byCert: make(map[[sha256.Size]byte]*Client),
+    replay: newReplayCache(),
+    audit: auditLog,
+  }
+  for _,cc := range(cf.Clients) {
+    if(cc.Name == "") {
+      return nil,errors.New("Client with empty name in clients file")
+    }
+    if _, ok := a.byName[cc.Name]; ok {
+      return nil,fmt.Errorf("Client %v registered twice",cc.Name)
+    }
+    c := &Client{Name: cc.Name, scopes: make(map[string]bool)}
+    for _,s := range(cc.Scopes) {
+      c.scopes[s] = true
+    }
+
+    if(cc.CertSha256 != "") {
+      h, err := hex.DecodeString(cc.CertSha256)
+      if(err != nil || len(h) != sha256.Size) {
+        return nil,fmt.Errorf("Client %v has invalid CertSha256",cc.Name)
+      }
+      var fp [sha256.Size]byte
+      copy(fp[:],h)
+      a.byCert[fp] = c
+    }
+    if(cc.PublicKey != "") {
+      block, _ := pem.Decode([]byte(cc.PublicKey))
+      if(block == nil) {
+        return nil,fmt.Errorf("Client %v PublicKey is not pem encoded",cc.Name)
+      }
+      c.pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+      if err != nil {
+        return nil,fmt.Errorf("Client %v has invalid PublicKey: %v",cc.Name,err)
+      }
+    }
+    a.byName[cc.Name] = c
+  }
+  glog.V(2).Infof("Loaded %v clients\n",len(a.byName))
+  return a,nil
+}
+
+// Authenticator for servers without a clients file
+// Anyone can call every endpoint, requests are audited as coming from an anonymous client
+func Open(auditLog *audit.Logger) *Authenticator {
+  return &Authenticator{open: true, audit: auditLog}
+}
+
+// The client that made req, set by Require
+func ClientFromContext(ctx context.Context) (*Client,bool) {
+  c, ok := ctx.Value(clientKey).(*Client)
+  return c, ok
+}
+
+func (c *Client) HasScope(scope string) bool {
+  return c.scopes == nil || c.scopes[scope]
+}
+
+// Wrap a handler so only clients holding scope can call it
+// The request is audited once the wrapped handler has responded, or once it is rejected
+func (a *Authenticator) Require(scope string, next http.HandlerFunc) http.HandlerFunc {
+  return func(rw http.ResponseWriter, req *http.Request) {
+    body, err := ioutil.ReadAll(req.Body)
+    if err == api.ErrBodyTooLarge {
+      api.WriteError(rw, http.StatusRequestEntityTooLarge, api.CodeBodyTooLarge, "Request body is too large", nil)
+      return
+    } else if err != nil {
+      api.WriteError(rw, http.StatusBadRequest, api.CodeBadRequest, fmt.Sprintf("error reading body: %v", err), nil)
+      return
+    }
+    req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+    c, method, err := a.authenticate(req, body)
+    if err != nil {
+      glog.V(1).Infof("Rejected request to %v: %v\n", req.URL.Path, err)
+      api.WriteError(rw, http.StatusUnauthorized, api.CodeUnauthenticated, fmt.Sprintf("Unauthenticated: %v", err), nil)
+      a.RecordRejection("", "", req.URL.Path, http.StatusUnauthorized, body, err)
+      return
+    }
+    if(!c.HasScope(scope)) {
+      glog.V(1).Infof("Client %v lacks scope %v for %v\n", c.Name, scope, req.URL.Path)
+      api.WriteError(rw, http.StatusForbidden, api.CodeForbidden, fmt.Sprintf("Client %v is not authorized for %v", c.Name, scope), nil)
+      a.RecordRejection(c.Name, method, req.URL.Path, http.StatusForbidden, body, fmt.Errorf("client lacks scope %v", scope))
+      return
+    }
+
+    sw := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+    next(sw, req.WithContext(context.WithValue(req.Context(), clientKey, c)))
+    a.Record(c.Name, method, req.URL.Path, sw.status, body)
+  }
+}
+
+// Write an audit record of a request to endpoint, status is the http status (or grpc code) returned
+func (a *Authenticator) Record(client string, method string, endpoint string, status int, body []byte) {
+  a.record(client, method, endpoint, status, body, nil)
+}
+
+// Write an audit record of a request refused before it reached the endpoint, client is empty if it couldn't be authenticated
+func (a *Authenticator) RecordRejection(client string, method string, endpoint string, status int, body []byte, reason error) {
+  a.record(client, method, endpoint, status, body, reason)
+}
+
+func (a *Authenticator) record(client string, method string, endpoint string, status int, body []byte, reason error) {
+  if(a.audit == nil) {
+    return
+  }
+  r := audit.Record{
+    Time: time.Now().UTC(),
+    Client: client,
+    AuthMethod: method,
+    Endpoint: endpoint,
+    Status: status,
+  }
+  if(json.Valid(body)) {
+    var compact bytes.Buffer
+    json.Compact(&compact, body)
+    r.Body = compact.Bytes()
+  } else {
+    h := sha256.Sum256(body)
+    r.BodySha256 = h[:]
+  }
+  if(reason != nil) {
+    r.Error = reason.Error()
+  }
+  if err := a.audit.Log(r); err != nil {
+    glog.Errorf("Failed to write audit record for %v: %v\n", endpoint, err)
+  }
+}
+
+// mTLS is checked first, then the request signature
+func (a *Authenticator) authenticate(req *http.Request, body []byte) (*Client,string,error) {
+  var certs []*x509.Certificate
+  if(req.TLS != nil) {
+    certs = req.TLS.PeerCertificates
+  }
+  return a.identify(certs, req.Header.Get(SignatureHeader), req.URL.Path, body)
+}
+
+// Authenticate a grpc call holding scope, by the peer's mTLS certificates or a request signature
+// sig is the JWS-Signature metadata, over the marshalled request with the full method name as url
+// Callers record the outcome with Record
+func (a *Authenticator) AuthenticateCall(scope string, certs []*x509.Certificate, sig string, method string, body []byte) (*Client,string,error) {
+  c, how, err := a.identify(certs, sig, method, body)
+  if err != nil {
+    return nil,"",err
+  }
+  if(!c.HasScope(scope)) {
+    return nil,"",fmt.Errorf("client %v is not authorized for %v", c.Name, scope)
+  }
+  return c,how,nil
+}
+
+func (a *Authenticator) identify(certs []*x509.Certificate, sig string, path string, body []byte) (*Client,string,error) {
+  if(a.open) {
+    return &Client{},"none",nil
+  }
+  if(len(certs) > 0) {
+    fp := sha256.Sum256(certs[0].Raw)
+    if c, ok := a.byCert[fp]; ok {
+      return c,"mtls",nil
+    }
+  }
+
+  if(sig == "") {
+    return nil,"",errors.New("no registered client certificate or request signature")
+  }
+  c, err := a.verifyJws(sig, path, body)
+  if err != nil {
+    return nil,"",err
+  }
+  return c,"jws",nil
+}
+
+func (a *Authenticator) verifyJws(sig string, path string, body []byte) (*Client,error) {
+  parts := strings.Split(sig, ".")
+  if(len(parts) != 3 || parts[1] != "") {
+    return nil,errors.New("request signature must be a detached compact JWS")
+  }
+  hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+  if err != nil {return nil,fmt.Errorf("bad protected header encoding: %v",err)}
+  var hdr jwsHeader
+  if err := json.Unmarshal(hb, &hdr); err != nil {
+    return nil,fmt.Errorf("bad protected header: %v",err)
+  }
+  signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+  if err != nil {return nil,fmt.Errorf("bad signature encoding: %v",err)}
+
+  c, ok := a.byName[hdr.Kid]
+  if(!ok || c.pub == nil) {
+    return nil,fmt.Errorf("unknown signing client %q",hdr.Kid)
+  }
+  if(hdr.Url != path) {
+    return nil,fmt.Errorf("signature is for %v, not %v",hdr.Url,path)
+  }
+  if skew := time.Since(time.Unix(hdr.Iat,0)); skew > maxClockSkew || skew < -maxClockSkew {
+    return nil,errors.New("signature iat is too far from current time")
+  }
+  if(hdr.Jti == "" || len(hdr.Jti) > maxJtiLength) {
+    return nil,fmt.Errorf("signature needs a jti of at most %v characters, unique to the request",maxJtiLength)
+  }
+
+  signingInput := parts[0] + "." + base64.RawURLEncoding.EncodeToString(body)
+  if err := verify(c.pub, hdr.Alg, []byte(signingInput), signature); err != nil {
+    return nil,err
+  }
+  // The signature can't be replayed once iat is too old, so its jti is only kept until then
+  if(!a.replay.use(c.Name, hdr.Jti, time.Unix(hdr.Iat,0).Add(maxClockSkew))) {
+    return nil,errors.New("signature has already been used, sign each request with a new jti")
+  }
+  return c,nil
+}
+
+// ES256 signatures are the raw r||s encoding from RFC 7518 3.4, not asn.1
+func verify(pub crypto.PublicKey, alg string, data []byte, sig []byte) error {
+  digest := sha256.Sum256(data)
+  switch k := pub.(type) {
+  case *ecdsa.PublicKey:
+    if(alg != "ES256" || len(sig) != 64) {
+      return errors.New("ecdsa clients must sign with ES256")
+    }
+    r := new(big.Int).SetBytes(sig[:32])
+    s := new(big.Int).SetBytes(sig[32:])
+    if(!ecdsa.Verify(k, digest[:], r, s)) {
+      return errors.New("invalid request signature")
+    }
+    return nil
+  case *rsa.PublicKey:
+    if(alg != "RS256") {
+      return errors.New("rsa clients must sign with RS256")
+    }
+    if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+      return errors.New("invalid request signature")
+    }
+    return nil
+  default:
+    return fmt.Errorf("unsupported client key type %T",pub)
+  }
+}
+
+// Records the status written by the wrapped handler, for the audit log
+type statusWriter struct {
+  http.ResponseWriter
+  status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+  w.status = status
+  w.ResponseWriter.WriteHeader(status)
+}
+
+// Client side: sign body as a request from client name to path, setting the JWS-Signature header on req
+// key must be a P-256 ecdsa key or an rsa key
+func SignRequest(req *http.Request, body []byte, name string, key crypto.Signer) error {
+  sig, err := Sign(body, name, req.URL.Path, key)
+  if err != nil {return err}
+  req.Header.Set(SignatureHeader, sig)
+  return nil
+}
+
+// Client side: detached JWS over body as a request from client name to url
+// For grpc calls url is the full method name and body the marshalled request, see AuthenticateCall
+func Sign(body []byte, name string, url string, key crypto.Signer) (string,error) {
+  var alg string
+  switch key.Public().(type) {
+  case *ecdsa.PublicKey:
+    alg = "ES256"
+  case *rsa.PublicKey:
+    alg = "RS256"
+  default:
+    return "",fmt.Errorf("unsupported client key type %T",key.Public())
+  }
+  jti := make([]byte,16)
+  if _, err := rand.Read(jti); err != nil {return "",err}
+  hb, err := json.Marshal(jwsHeader{alg, name, time.Now().Unix(), url, hex.EncodeToString(jti)})
+  if err != nil {return "",err}
+  protected := base64.RawURLEncoding.EncodeToString(hb)
+  signingInput := protected + "." + base64.RawURLEncoding.EncodeToString(body)
+  digest := sha256.Sum256([]byte(signingInput))
+
+  sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+  if err != nil {return "",err}
+  if(alg == "ES256") {
+    // convert the asn.1 signature to r||s
+    var esig struct {
+      R, S *big.Int
+    }
+    if _, err := asn1.Unmarshal(sig, &esig); err != nil {return "",err}
+    r, s := esig.R.Bytes(), esig.S.Bytes()
+    sig = make([]byte,64)
+    copy(sig[32-len(r):32], r)
+    copy(sig[64-len(s):], s)
+  }
+  return protected + ".." + base64.RawURLEncoding.EncodeToString(sig),nil
+}
@@ -0,0 +1,176 @@
+package auth
+
+import (
+  "bytes"
+  "crypto"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha256"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/hex"
+  "encoding/json"
+  "encoding/pem"
+  "io/ioutil"
+  "math/big"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+const path = "/new-ct/post-revocation"
+
+func pemPublicKey(t *testing.T, key crypto.Signer) string {
+  der, err := x509.MarshalPKIXPublicKey(key.Public())
+  if err != nil {t.Fatal(err)}
+  return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func writeClients(t *testing.T, dir string, clients ...ClientConfig) string {
+  b, err := json.Marshal(ClientsFile{clients})
+  if err != nil {t.Fatal(err)}
+  p := filepath.Join(dir,"clients.json")
+  if err := ioutil.WriteFile(p,b,0600); err != nil {t.Fatal(err)}
+  return p
+}
+
+func selfSigned(t *testing.T) *x509.Certificate {
+  key, err := ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+  if err != nil {t.Fatal(err)}
+  template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "client"}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+  der, err := x509.CreateCertificate(rand.Reader,template,template,&key.PublicKey,key)
+  if err != nil {t.Fatal(err)}
+  cert, err := x509.ParseCertificate(der)
+  if err != nil {t.Fatal(err)}
+  return cert
+}
+
+func TestRequire(t *testing.T) {
+  dir, err := ioutil.TempDir("","auth")
+  if err != nil {t.Fatal(err)}
+  defer os.RemoveAll(dir)
+  ecKey, err := ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+  if err != nil {t.Fatal(err)}
+  rsaKey, err := rsa.GenerateKey(rand.Reader,2048)
+  if err != nil {t.Fatal(err)}
+  cert := selfSigned(t)
+  fp := sha256.Sum256(cert.Raw)
+  a, err := Load(writeClients(t,dir,
+    ClientConfig{Name: "ec", Scopes: []string{ScopeRevoke}, PublicKey: pemPublicKey(t,ecKey)},
+    ClientConfig{Name: "rsa", Scopes: []string{ScopeRevoke}, PublicKey: pemPublicKey(t,rsaKey)},
+    ClientConfig{Name: "issuer", Scopes: []string{ScopeIssue}, PublicKey: pemPublicKey(t,ecKey)},
+    ClientConfig{Name: "mtls", Scopes: []string{ScopeRevoke}, CertSha256: hex.EncodeToString(fp[:])},
+  ),nil)
+  if err != nil {t.Fatal(err)}
+
+  body := []byte(`{"Serial":5}`)
+  sign := func(name string, key crypto.Signer, url string, body []byte) string {
+    sig, err := Sign(body,name,url,key)
+    if err != nil {t.Fatal(err)}
+    return sig
+  }
+  used := sign("ec",ecKey,path,body)
+  var client string
+  h := a.Require(ScopeRevoke,func(rw http.ResponseWriter, req *http.Request) {
+    c, _ := ClientFromContext(req.Context())
+    client = c.Name
+  })
+
+  tests := []struct {
+    name string
+    sig string
+    body []byte
+    certs []*x509.Certificate
+    status int
+    client string //who the handler sees, if it is reached
+  }{
+    {"no credentials", "", body, nil, http.StatusUnauthorized, ""},
+    {"ES256 signature", used, body, nil, http.StatusOK, "ec"},
+    {"signature replayed", used, body, nil, http.StatusUnauthorized, ""},
+    {"RS256 signature", sign("rsa",rsaKey,path,body), body, nil, http.StatusOK, "rsa"},
+    {"signed for another endpoint", sign("ec",ecKey,"/new-ct/post-release",body), body, nil, http.StatusUnauthorized, ""},
+    {"body changed", sign("ec",ecKey,path,body), []byte(`{"Serial":6}`), nil, http.StatusUnauthorized, ""},
+    {"signed by another client's key", sign("rsa",ecKey,path,body), body, nil, http.StatusUnauthorized, ""},
+    {"unregistered client", sign("stranger",ecKey,path,body), body, nil, http.StatusUnauthorized, ""},
+    {"not a detached jws", "a.b.c", body, nil, http.StatusUnauthorized, ""},
+    {"client without the scope", sign("issuer",ecKey,path,body), body, nil, http.StatusForbidden, ""},
+    {"registered client certificate", "", body, []*x509.Certificate{cert}, http.StatusOK, "mtls"},
+    {"unregistered client certificate", "", body, []*x509.Certificate{selfSigned(t)}, http.StatusUnauthorized, ""},
+  }
+  for _,test := range(tests) {
+    client = ""
+    req := httptest.NewRequest("POST",path,bytes.NewReader(test.body))
+    if(test.sig != "") {
+      req.Header.Set(SignatureHeader,test.sig)
+    }
+    if(test.certs != nil) {
+      req.TLS = &tls.ConnectionState{PeerCertificates: test.certs}
+    }
+    rw := httptest.NewRecorder()
+    h(rw,req)
+    if(rw.Code != test.status || client != test.client) {
+      t.Errorf("%v: %v %s reaching client %q, want %v reaching %q",test.name,rw.Code,rw.Body.Bytes(),client,test.status,test.client)
+    }
+  }
+
+  // Without a clients file anyone is let through
+  rw := httptest.NewRecorder()
+  Open(nil).Require(ScopeAdmin,func(rw http.ResponseWriter, req *http.Request) {})(rw,httptest.NewRequest("POST",path,bytes.NewReader(body)))
+  if(rw.Code != http.StatusOK) {
+    t.Errorf("open authenticator = %v %s, want 200",rw.Code,rw.Body.Bytes())
+  }
+}
+
+func TestReplayCache(t *testing.T) {
+  c := newReplayCache()
+  later := time.Now().Add(time.Minute)
+  tests := []struct {
+    name string
+    client string
+    jti string
+    expires time.Time
+    want bool
+  }{
+    {"first use", "a", "1", later, true},
+    {"same jti again", "a", "1", later, false},
+    {"same jti from another client", "b", "1", later, true},
+    {"another jti", "a", "2", later, true},
+    {"already expired", "a", "3", time.Now().Add(-time.Second), true},
+    {"used again once expired", "a", "3", later, true},
+    {"still remembered", "a", "2", later, false},
+  }
+  for _,test := range(tests) {
+    if got := c.use(test.client,test.jti,test.expires); got != test.want {
+      t.Errorf("%v: use(%v,%v) = %v, want %v",test.name,test.client,test.jti,got,test.want)
+    }
+  }
+}
+
+func TestLoadErrors(t *testing.T) {
+  dir, err := ioutil.TempDir("","auth")
+  if err != nil {t.Fatal(err)}
+  defer os.RemoveAll(dir)
+  tests := []struct {
+    name string
+    clients []ClientConfig
+    err string
+  }{
+    {"no name", []ClientConfig{{Scopes: []string{ScopeRevoke}}}, "empty name"},
+    {"registered twice", []ClientConfig{{Name: "a"},{Name: "a"}}, "registered twice"},
+    {"bad cert hash", []ClientConfig{{Name: "a", CertSha256: "abcd"}}, "invalid CertSha256"},
+    {"key not pem", []ClientConfig{{Name: "a", PublicKey: "key"}}, "not pem encoded"},
+  }
+  for _,test := range(tests) {
+    _, err := Load(writeClients(t,dir,test.clients...),nil)
+    if(err == nil || !strings.Contains(err.Error(),test.err)) {
+      t.Errorf("%v: Load = %v, want an error containing %q",test.name,err,test.err)
+    }
+  }
+}
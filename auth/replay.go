@@ -0,0 +1,56 @@
+package auth
+
+import (
+  "container/heap"
+  "sync"
+  "time"
+)
+
+// Request signatures seen in the last maxClockSkew, by client and jti, so each one is only accepted once
+// Only signatures that verified are remembered, so unauthenticated callers can't fill it
+// Entries leave in order of expiry, through a heap, so checking a signature never walks the whole cache
+type replayCache struct {
+  sync.Mutex
+  seen map[string]time.Time
+  expiries expiryHeap
+}
+
+type expiry struct {
+  key string
+  at time.Time
+}
+
+type expiryHeap []expiry
+
+func (h expiryHeap) Len() int {return len(h)}
+func (h expiryHeap) Less(i, j int) bool {return h[i].at.Before(h[j].at)}
+func (h expiryHeap) Swap(i, j int) {h[i], h[j] = h[j], h[i]}
+func (h *expiryHeap) Push(x interface{}) {*h = append(*h, x.(expiry))}
+func (h *expiryHeap) Pop() interface{} {
+  old := *h
+  e := old[len(old)-1]
+  *h = old[:len(old)-1]
+  return e
+}
+
+func newReplayCache() *replayCache {
+  return &replayCache{seen: make(map[string]time.Time)}
+}
+
+// Remember client's jti until expires, returning false if it has already been used
+func (c *replayCache) use(client string, jti string, expires time.Time) bool {
+  now := time.Now()
+  key := client+"\x00"+jti
+  c.Lock()
+  defer c.Unlock()
+  for c.expiries.Len() > 0 && !c.expiries[0].at.After(now) {
+    e := heap.Pop(&c.expiries).(expiry)
+    delete(c.seen, e.key)
+  }
+  if _, ok := c.seen[key]; ok {
+    return false
+  }
+  c.seen[key] = expires
+  heap.Push(&c.expiries, expiry{key, expires})
+  return true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+  "flag"
+  "github.com/golang/glog"
+  "revocation-server/handler"
+  "revocation-server/srt"
+  "revocation-server/tree"
+  "revocation-server/types"
+  "crypto/x509"
+  "encoding/pem"
+  "encoding/json"
+  "io/ioutil"
+  "net/http"
+  "bytes"
+)
+
+var (
+  srtFile = flag.String("srt","","Path to a json signed revocation timestamp, as returned by post-revocation")
+  serverUrl = flag.String("url","http://localhost:8080","Base url of the revocation server")
+  logKeyFile = flag.String("log_key","","PEM encoded public key of the revocation server")
+  maxCerts = flag.Uint64("max_certs", 1000000, "max_certs the server was started with, sets the tree height")
+  evidenceFile = flag.String("evidence","misbehaviour.json","Where to write the evidence if the promise was broken")
+)
+
+func main() {
+  flag.Parse()
+  defer glog.Flush()
+
+  if(*srtFile=="" || *logKeyFile=="") {
+    glog.Exitf("--srt and --log_key are required, check --help for details")
+  }
+
+  b, err := ioutil.ReadFile(*logKeyFile)
+  if(err!=nil) {glog.Exitf("failed to read file: %v\n",err)}
+  block, _ := pem.Decode(b)
+  if(block==nil) {glog.Exitf("no pem block found in %v\n",*logKeyFile)}
+  pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+  if(err!=nil) {glog.Exitf("Failed to parse public key: %v\n",err)}
+
+  b, err = ioutil.ReadFile(*srtFile)
+  if(err!=nil) {glog.Exitf("failed to read file: %v\n",err)}
+  var t srt.SignedRevocationTimestamp
+  if err := json.Unmarshal(b,&t); err != nil {
+    glog.Exitf("Could not decode revocation timestamp: %v\n",err)
+  }
+  if err := t.Verify(pub); err != nil {glog.Exitf("%v\n",err)}
+  glog.Infof("Timestamp for serial %v verified, promised by %v\n",t.Serial,t.IntegrateBy)
+
+  var slr types.SignedLogRoot
+  getJson(*serverUrl+"/new-ct/get-sth",nil,&slr)
+  var proof handler.GetInclusionProofResponse
+  getJson(*serverUrl+"/new-ct/get-inclusion-proof",handler.GetInclusionProofRequest{Serial: t.Serial},&proof)
+
+  m, err := srt.CheckPromise(pub,tree.HeightForMaxCerts(*maxCerts),&t,&slr,proof.Proof)
+  if(err!=nil) {glog.Exitf("Could not check promise: %v\n",err)}
+  if(m==nil) {
+    glog.Infof("Promise kept, serial %v is in the tree\n\n",t.Serial)
+    return
+  }
+
+  evidence, err := json.Marshal(m)
+  if(err!=nil) {glog.Exitf("Could not encode evidence: %v\n",err)}
+  if err := ioutil.WriteFile(*evidenceFile,evidence,0644); err != nil {
+    glog.Exitf("Could not write evidence: %v\n",err)
+  }
+  glog.Exitf("Promise broken, serial %v is missing from a root signed after the deadline. Evidence written to %v\n",t.Serial,*evidenceFile)
+}
+
+// get-inclusion-proof takes a json body on a GET
+func getJson(url string, body interface{}, v interface{}) {
+  var reqBody bytes.Buffer
+  if(body!=nil) {
+    if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+      glog.Exitf("Could not encode request to %v: %v\n",url,err)
+    }
+  }
+  req, err := http.NewRequest("GET",url,&reqBody)
+  if(err!=nil) {glog.Exitf("Failed to create request: %v\n",err)}
+  resp, err := http.DefaultClient.Do(req)
+  if(err!=nil) {glog.Exitf("Request to %v failed: %v\n",url,err)}
+  defer resp.Body.Close()
+  if(resp.StatusCode!=http.StatusOK) {
+    msg, _ := ioutil.ReadAll(resp.Body)
+    glog.Exitf("Request to %v failed (%v): %s\n",url,resp.Status,msg)
+  }
+  if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+    glog.Exitf("Could not decode response from %v: %v\n",url,err)
+  }
+}
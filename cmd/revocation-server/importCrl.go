@@ -0,0 +1,83 @@
+package main
+
+import (
+  "flag"
+  "github.com/golang/glog"
+  "revocation-server/crypto/crl"
+  "revocation-server/handler"
+  "revocation-server/auth"
+  "crypto"
+  "crypto/x509"
+  "encoding/pem"
+  "encoding/json"
+  "io/ioutil"
+  "net/http"
+  "bytes"
+)
+
+var (
+  crlFile = flag.String("crl","","Path to DER or PEM encoded crl to import")
+  issuerCertFile = flag.String("cert","testdata/root.cert","Location of issuer(CA) cert the crl is signed by")
+  serverUrl = flag.String("url","http://localhost:8080","Base url of the revocation server")
+  clientName = flag.String("client_name","","Name the server knows this client by, needed if the server has a clients file")
+  clientKey = flag.String("client_key","","PKCS8 PEM private key used to sign the request as client_name")
+)
+
+func main() {
+  flag.Parse()
+  defer glog.Flush()
+
+  if(*crlFile=="") {
+    glog.Exitf("Path to crl is required, check --help for details")
+  }
+
+  // Parse issuer cert
+  ct, err := ioutil.ReadFile(*issuerCertFile)
+  if(err!=nil) {glog.Exitf("failed to read file: %v\n",err)}
+  block, _ := pem.Decode(ct)
+  if(block==nil) {glog.Exitf("no pem block found in %v\n",*issuerCertFile)}
+  cert, err := x509.ParseCertificate(block.Bytes)
+  if(err!=nil) {glog.Exitf("Failed to parse cert: %v\n",err)}
+
+  // Check the crl before sending it, the server verifies it again against its own issuer cert
+  b, err := ioutil.ReadFile(*crlFile)
+  if(err!=nil) {glog.Exitf("Could not read crl file: %v\n",err)}
+  list, err := crl.ParseCRL(b,cert)
+  if(err!=nil) {glog.Exitf("Could not parse crl: %v\n",err)}
+  glog.Infof("crl number %v contains %v entries\n",list.Number,len(list.Entries))
+
+  req, err := http.NewRequest("POST",*serverUrl+"/new-ct/admin/import-crl",bytes.NewReader(b))
+  if(err!=nil) {glog.Exitf("Failed to create request: %v\n",err)}
+  req.Header.Set("Content-Type","application/pkix-crl")
+  if(*clientKey!="") {
+    kb, err := ioutil.ReadFile(*clientKey)
+    if(err!=nil) {glog.Exitf("failed to read file: %v\n",err)}
+    kblock, _ := pem.Decode(kb)
+    if(kblock==nil) {glog.Exitf("no pem block found in %v\n",*clientKey)}
+    k, err := x509.ParsePKCS8PrivateKey(kblock.Bytes)
+    if(err!=nil) {glog.Exitf("Failed to parse client key: %v\n",err)}
+    signer, ok := k.(crypto.Signer)
+    if(!ok) {glog.Exitf("Client key can't be used for signing\n")}
+    if err := auth.SignRequest(req,b,*clientName,signer); err != nil {
+      glog.Exitf("Failed to sign request: %v\n",err)
+    }
+  }
+
+  resp, err := http.DefaultClient.Do(req)
+  if(err!=nil) {glog.Exitf("Failed to post crl to server: %v\n",err)}
+  defer resp.Body.Close()
+  if(resp.StatusCode!=http.StatusOK) {
+    msg, _ := ioutil.ReadAll(resp.Body)
+    glog.Exitf("Server rejected crl (%v): %s\n",resp.Status,msg)
+  }
+
+  var result handler.ImportCrlResponse
+  if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+    glog.Exitf("Could not decode server response: %v\n",err)
+  }
+  glog.Infof("Imported %v revocations and %v releases, %v already revoked, skipped %v removeFromCRL entries\n",result.Imported,result.Released,result.AlreadyRevoked,result.Skipped)
+  for _,e := range(result.Invalid) {
+    glog.Warningf("Entry %v for serial %v was left out: %v\n",e.Index,e.Serial,e.Err)
+  }
+  glog.Infof("They will be integrated into the tree at the next mmd\n")
+}
@@ -55,6 +55,9 @@ func main() {
   if(resp.Status==1) {
     glog.Infof("Status is Revoked\n\n")
   }
+  if(resp.Status==2) {
+    glog.Infof("Status is Unknown (never issued)\n\n")
+  }
 
   // Parse extension for proof
   // Proof was json encoded with asn1 id for ietf certificate transparency object "TransItem"
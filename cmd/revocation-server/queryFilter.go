@@ -0,0 +1,80 @@
+package main
+
+import (
+  "flag"
+  "github.com/golang/glog"
+  "revocation-server/filter"
+  "revocation-server/types"
+  "crypto/x509"
+  "encoding/pem"
+  "encoding/json"
+  "io/ioutil"
+  "net/http"
+  "strconv"
+  "bytes"
+)
+
+var (
+  serverUrl = flag.String("url","http://localhost:8080","Base url of the revocation server")
+  logKeyFile = flag.String("log_key","","PEM encoded public key of the revocation server, used to check the filter signature")
+  serialStr = flag.String("serial","","Serial to check against the filter")
+)
+
+func main() {
+  flag.Parse()
+  defer glog.Flush()
+
+  if(*logKeyFile=="" || *serialStr=="") {
+    glog.Exitf("--log_key and --serial are required, check --help for details")
+  }
+  serial, err := strconv.ParseUint(*serialStr,10,64)
+  if(err!=nil) {glog.Exitf("Failed to parse serial to uint64 format: %v\n",err)}
+
+  b, err := ioutil.ReadFile(*logKeyFile)
+  if(err!=nil) {glog.Exitf("failed to read file: %v\n",err)}
+  block, _ := pem.Decode(b)
+  if(block==nil) {glog.Exitf("no pem block found in %v\n",*logKeyFile)}
+  pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+  if(err!=nil) {glog.Exitf("Failed to parse public key: %v\n",err)}
+
+  var f filter.SignedFilter
+  getJson(*serverUrl+"/new-ct/get-filter",&f)
+  c, err := f.Verify(pub)
+  if(err!=nil) {glog.Exitf("%v\n",err)}
+  glog.Infof("Filter for revision %v verified, %v levels, %v bytes\n",f.Revision,len(c.Levels),len(f.Filter))
+
+  // Bind the filter to the current sth if it is for the same revision
+  var slr types.SignedLogRoot
+  getJson(*serverUrl+"/new-ct/get-sth",&slr)
+  var root types.LogRootV1
+  if err := root.UnmarshalBinary(slr.LogRoot); err != nil {
+    glog.Exitf("Could not parse log root: %v\n",err)
+  }
+  if(root.Revision==f.Revision) {
+    if(!bytes.Equal(root.RootHash,f.RootHash)) {
+      glog.Exitf("Filter root hash does not match sth for revision %v\n",f.Revision)
+    }
+    glog.Infof("Filter root hash matches sth\n")
+  } else {
+    glog.Warningf("Sth is at revision %v, filter is at %v, not comparing root hashes\n",root.Revision,f.Revision)
+  }
+
+  if(c.Contains(serial)) {
+    glog.Infof("Status is Revoked\n\n")
+  } else {
+    glog.Infof("Status is Good (nonRevoked)\n\n")
+  }
+}
+
+func getJson(url string, v interface{}) {
+  resp, err := http.Get(url)
+  if(err!=nil) {glog.Exitf("Request to %v failed: %v\n",url,err)}
+  defer resp.Body.Close()
+  if(resp.StatusCode!=http.StatusOK) {
+    msg, _ := ioutil.ReadAll(resp.Body)
+    glog.Exitf("Request to %v failed (%v): %s\n",url,resp.Status,msg)
+  }
+  if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+    glog.Exitf("Could not decode response from %v: %v\n",url,err)
+  }
+}
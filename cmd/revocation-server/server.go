@@ -4,54 +4,234 @@ import (
   "context"
   "os"
   "os/signal"
+  "path/filepath"
+  "syscall"
   "time"
   "flag"
   "github.com/golang/glog"
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/credentials"
   "net/http"
   "revocation-server/tree"
   "revocation-server/sequencer"
+  "revocation-server/registry"
+  "revocation-server/ctfeed"
+  "revocation-server/auth"
+  "revocation-server/audit"
+  "revocation-server/limit"
+  "revocation-server/api"
+  "revocation-server/rpc"
+  "revocation-server/metrics"
+  "revocation-server/health"
+  "revocation-server/config"
+  "revocation-server/tlsconfig"
+  "revocation-server/election"
   rev "revocation-server/handler"
 )
 
 var (
   listenAddress = flag.String("listen", ":8080", "Listen address:port for HTTP server")
   maxCerts = flag.Uint64("max_certs", 1000000, "Highest serial number the server can store, affects tree height")
-// could add support for this later  configFile = flag.String("config", "", "Config file containing flags, file contents can be overridden by command line flags")
+  configFile = flag.String("config", "", "YAML or JSON file of settings named after these flags. Environment variables (REVOCATION_MAX_CERTS for max_certs) override it, and flags given on the command line override both")
   certFile = flag.String("cert_file","testdata/root.cert","File containing pem-encoded SSL certificate")
   mmd = flag.String("mmd","24h","Duration corresponding to mmd for log, valid time units are ns,us,ms,s,m,h")
+  integrationInterval = flag.Duration("integration_interval", 0, "How often queued changes are integrated and a root signed, at most the mmd. 0 for the mmd")
+  resignInterval = flag.Duration("resign_interval", 0, "Sign the latest root again with a new timestamp once it is this old, even if nothing was integrated. 0 to only sign roots when integrating")
+  integrationQueueSize = flag.Int("integration_queue_size", 0, "Integrate early once this many changes are queued, 0 to only integrate every integration_interval")
   key = flag.String("key","testdata/key.pem","Private key for revocation server")
+  issuanceRegistry = flag.Bool("issuance_registry", false, "Track issued serials so ocsp responds unknown for serials that were never issued")
+  registryInterval = flag.Duration("registry_interval", time.Minute, "How often the issuance registry is integrated, so newly issued serials stop being unknown. Never less often than integration_interval, 0 for the same")
+  ctLogUri = flag.String("ct_log_uri", "", "Base uri of a ct log to follow for certificates issued by cert_file and each of the issuers in the config file, disabled if empty")
+  ctPollInterval = flag.Duration("ct_poll_interval", time.Minute, "How often to fetch new entries from the ct log")
+  ctBatchSize = flag.Int64("ct_batch_size", 256, "Number of entries to request per get-entries call")
+  clientsFile = flag.String("clients_file", "", "JSON file of clients allowed to submit, with their scopes and mTLS cert hash or JWS public key. Submissions are open to anyone if empty")
+  auditFile = flag.String("audit_file", "", "File to append the hash chained audit log of submissions, batches and signed roots to, disabled if empty")
+  receiptRetention = flag.Duration("receipt_retention", tree.DefaultReceiptRetention, "How long a receipt can be looked up once its submission is integrated or rejected, 0 to keep them forever")
+  maxQueue = flag.Int("max_queue", 1000000, "Most changes waiting to be integrated, submissions get 503 once the queue is full. 0 for no limit")
+  maxBatch = flag.Int("max_batch", 10000, "Most serials in one post-multiple-revocations or import-crl request. 0 for no limit")
+  maxBodyBytes = flag.Int64("max_body_bytes", 1<<20, "Largest request body accepted by submission endpoints (import-crl allows 64 times this). 0 for no limit")
+  tlsListen = flag.String("tls_listen", "", "Listen address:port for HTTPS. When set, submission and admin endpoints are only served here and listen serves the public read endpoints such as OCSP")
+  tlsCert = flag.String("tls_cert", "", "PEM certificate chain for HTTPS and grpc, reloaded on SIGHUP")
+  tlsKey = flag.String("tls_key", "", "PEM private key for tls_cert, reloaded on SIGHUP")
+  tlsMinVersion = flag.String("tls_min_version", "1.2", "Oldest TLS version accepted: 1.0, 1.1, 1.2 or 1.3")
+  tlsCiphers = flag.String("tls_ciphers", "", "Comma separated cipher suites allowed below TLS 1.3, Go's defaults if empty")
+  tlsClientAuth = flag.String("tls_client_auth", "none", "Client certificates: none, request (optional) or require")
+  tlsClientCa = flag.String("tls_client_ca", "", "PEM CAs client certificates must chain to. If empty any client certificate is accepted, and matched against clients_file by hash")
+  grpcListen = flag.String("grpc_listen", "", "Listen address:port for the RevocationLog grpc service, disabled if empty")
+  stateDir = flag.String("state_dir", "", "Directory the trees are saved to on shutdown and restored from on startup, state is lost on shutdown if empty")
+  leaseBackend = flag.String("lease_backend", "", "Share the trees between replicas through file (a shared directory) or mysql, only the replica holding the lease sequences. Disabled if empty")
+  leaseDsn = flag.String("lease_dsn", "", "Directory for the file lease backend, or go-sql-driver dsn (user:password@tcp(host:3306)/db) for mysql")
+  leaseTtl = flag.Duration("lease_ttl", 15*time.Second, "How long the sequencer lease lasts without renewal, it is renewed every third of this")
+  replicaId = flag.String("replica_id", "", "Name of this replica in the lease, unique among replicas. Defaults to the hostname and listen address")
+  advertiseUrl = flag.String("advertise_url", "", "Url of this replica's submission endpoints, returned by standby replicas so clients can resubmit to the leader")
+  drainTimeout = flag.Duration("drain_timeout", 30*time.Second, "How long shutdown waits for open http and grpc requests to finish")
+  healthGrace = flag.Duration("health_grace", 5*time.Minute, "How far past the mmd the sth may age before /readyz fails")
+  clientRate = flag.Float64("client_rate", 0, "Submission requests a second each client may make, 0 for no limit")
+  clientBurst = flag.Int("client_burst", 0, "Submission requests each client may make at once before client_rate applies, 0 for a second's worth")
+  addressRate = flag.Float64("address_rate", 100, "Submission requests a second each address may make, checked before authenticating them, 0 for no limit")
+  addressBurst = flag.Int("address_burst", 0, "Submission requests each address may make at once before address_rate applies, 0 for a second's worth")
+  challengeRate = flag.Float64("challenge_rate", 1, "Self revocation challenges a second each address may fetch, 0 for no limit")
+  trustedProxies = flag.String("trusted_proxies", "", "Comma separated CIDRs of proxies whose X-Forwarded-For names the client, for rate limits")
 )
 
 func main() {
   flag.Parse()
   defer glog.Flush()
 
+  settings, err := config.Load(*configFile,flag.CommandLine)
+  if err != nil {
+    glog.Exitf("Failed to load configuration: %v",err)
+  }
+
+  var certs *tlsconfig.Reloader
+  if(*tlsListen != "") {
+    certs, err = tlsconfig.New(settings.TLSOptions())
+    if err != nil {
+      glog.Exitf("Failed to set up tls: %v",err)
+    }
+  }
+
   glog.Infoln("Starting revocation server.")
 
-  cfg := tree.Config{
+  // cert_file's issuer is served at the top level, each of the issuers section under /issuers/<name>/
+  issuers := []*issuer{newIssuer("",tree.Config{
     MaxCerts: *maxCerts,
     KeyPath: *key,
     CertPath: *certFile,
     Mmd: *mmd,
+  })}
+  for _,is := range(settings.Issuers) {
+    issuers = append(issuers,newIssuer(is.Name,tree.Config{
+      MaxCerts: is.MaxCerts,
+      KeyPath: is.Key,
+      CertPath: is.CertFile,
+      Mmd: is.Mmd,
+      Metadata: []byte(is.Name+"-revocations"),
+    }))
   }
-  t, key, cert, mmdDuration, err := tree.Initialize(cfg)
-  if err != nil {
-    glog.Exitf("Failed to initialize tree: %v",err)
+  var trees []*tree.MerkleTree
+  for _,is := range(issuers) {
+    trees = append(trees,is.trees()...)
+  }
+
+  var elector *election.Elector
+  if(*leaseBackend != "") {
+    backend, err := election.Open(*leaseBackend,*leaseDsn)
+    if err != nil {
+      glog.Exitf("Failed to open lease backend: %v",err)
+    }
+    defer backend.Close()
+    elector = election.New(backend,replicaID(),*advertiseUrl,*leaseTtl)
+    for _,is := range(issuers) {
+      elector.Add(is.t,is.seq)
+      if(is.issued != nil) {
+        elector.Add(is.issued.GetTree(),is.regseq)
+      }
+    }
+  } else {
+    metrics.Leader.Set(1)
+    // Sign restored roots again so the sth is fresh. With a lease only the leader signs, once it takes over
+    for _,tr := range(trees) {
+      if err := tr.SignRoot(); err != nil {
+        glog.Exitf("Failed to sign the root of %v: %v",tr.GetName(),err)
+      }
+    }
+  }
+
+  var auditLog *audit.Logger
+  if(*auditFile != "") {
+    auditLog, err = audit.Open(*auditFile)
+    if err != nil {
+      glog.Exitf("Failed to open audit log: %v",err)
+    }
+    defer auditLog.Close()
+    for _,tr := range(trees) {
+      tr.SetAuditLog(auditLog)
+    }
+  }
+
+  var authn *auth.Authenticator
+  if(*clientsFile != "") {
+    authn, err = auth.Load(*clientsFile,auditLog)
+    if err != nil {
+      glog.Exitf("Failed to load clients file: %v",err)
+    }
+  } else {
+    glog.Warningln("No clients file given, anyone can submit revocations")
+    authn = auth.Open(auditLog)
   }
 
   stop := make(chan os.Signal, 1)
-  signal.Notify(stop, os.Interrupt)
+  signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
   glog.Infoln("Setting up handlers")
-  handler := rev.NewHandler(t,cert,key)
+  if(elector != nil) {
+    for _,is := range(issuers) {
+      is.handler.SetLeader(elector.LeaderURL)
+    }
+  }
+  proxies, err := limit.ParseProxies(*trustedProxies)
+  if err != nil {
+    glog.Exitf("Invalid trusted_proxies: %v",err)
+  }
+  limiter := limit.NewLimiter(*clientRate,*clientBurst,proxies)
+  addressLimiter := limit.NewLimiter(*addressRate,*addressBurst,proxies)
+  challengeLimiter := limit.NewLimiter(*challengeRate,0,proxies)
+  // With tls, endpoints that change state are refused over plain http
+  private := func(h http.HandlerFunc) http.HandlerFunc {
+    if(certs == nil) {
+      return h
+    }
+    return tlsconfig.RequireTLS(h)
+  }
+  // Body limits go outside Require, which reads the body to check signatures, client rate limits inside it to know the client
+  // Addresses are limited outside it too, so floods are turned away before their signatures are checked
+  authenticated := func(scope string, max int64, h http.HandlerFunc) http.HandlerFunc {
+    return private(limit.Body(max,addressLimiter.LimitAddress(authn.Require(scope,h))))
+  }
+  submit := func(scope string, max int64, h http.HandlerFunc) http.HandlerFunc {
+    return authenticated(scope,max,limiter.Limit(h))
+  }
   serveMux := http.NewServeMux()
-  serveMux.HandleFunc("/new-ct/get-sth", handler.GetSth)
-  serveMux.HandleFunc("/new-ct/get-inclusion-proof", handler.GetInclusionProof)
-  serveMux.HandleFunc("/new-ct/get-ocsp", handler.GetOcsp)
-  serveMux.HandleFunc("/new-ct/post-revocation", handler.PostRevocation)
-  serveMux.HandleFunc("/new-ct/post-multiple-revocations", handler.PostMultipleRevocations)
+  // Every endpoint is served under /v1, and under /new-ct for existing clients (see package api)
+  // offers are the response types /v1 negotiates between, json if none are given
+  // Latency of both is recorded under the endpoint name, whichever issuer it is for
+  for _,is := range(issuers) {
+    prefix, handler := is.prefix(), is.handler
+    route := func(name string, h http.HandlerFunc, offers ...string) {
+      serveMux.HandleFunc(prefix+"/new-ct/"+name, metrics.Instrument(name, h))
+      serveMux.HandleFunc(prefix+"/"+api.Version+"/"+name, metrics.Instrument(name, api.V1(h, offers...)))
+    }
+    route("get-sth", handler.GetSth)
+    route("watch-roots", handler.WatchRoots, api.ContentJson, api.ContentEvents)
+    route("get-inclusion-proof", handler.GetInclusionProof)
+    route("get-consistency-proof", handler.GetConsistencyProof)
+    route("get-ocsp", handler.GetOcsp, api.ContentOcsp)
+    route("post-revocation", submit(auth.ScopeRevoke,*maxBodyBytes,handler.PostRevocation))
+    route("post-release", submit(auth.ScopeRevoke,*maxBodyBytes,handler.PostRelease))
+    route("get-revocation-status", handler.GetRevocationStatus)
+    route("post-multiple-revocations", submit(auth.ScopeRevoke,*maxBodyBytes,handler.PostMultipleRevocations))
+    route("get-crl", handler.GetCrl, api.ContentCrl, api.ContentPem)
+    route("get-delta-crl", handler.GetDeltaCrl, api.ContentCrl, api.ContentPem)
+    route("get-filter", handler.GetFilter)
+    route("post-issuance", submit(auth.ScopeIssue,*maxBodyBytes,handler.PostIssuance))
+    route("post-revocation-by-hash", submit(auth.ScopeRevoke,*maxBodyBytes,handler.PostRevocationByHash))
+    route("get-revocation-challenge", challengeLimiter.Limit(handler.GetRevocationChallenge))
+    route("post-self-revocation", private(limit.Body(*maxBodyBytes,limiter.Limit(handler.PostSelfRevocation))))
+    route("get-issuance-sth", handler.GetIssuanceSth)
+    route("get-issuance-proof", handler.GetIssuanceProof)
+    route("admin/import-crl", authenticated(auth.ScopeAdmin,*maxBodyBytes*64,handler.ImportCrl))
+    route("admin/integrate", authenticated(auth.ScopeAdmin,*maxBodyBytes,handler.Integrate))
+    serveMux.HandleFunc(prefix+"/"+api.Version+"/", api.V1(func(resp http.ResponseWriter, req *http.Request) {
+      api.WriteError(resp, http.StatusNotFound, api.CodeNotFound, "No such endpoint "+req.URL.Path, nil)
+    }))
+  }
+  serveMux.Handle("/metrics", metrics.Handler())
+  checker := health.New()
+  serveMux.HandleFunc("/healthz", checker.Healthz)
+  serveMux.HandleFunc("/readyz", checker.Readyz)
 
-  // Return a 200 on the root so clients can easily check if server is up
+  // Return a 200 on the root so clients can easily check if server is up, /healthz and /readyz tell if it is working
   serveMux.HandleFunc("/", func(resp http.ResponseWriter, req *http.Request) {
     if req.URL.Path == "/" {
       resp.WriteHeader(http.StatusOK)
@@ -64,33 +244,299 @@ func main() {
     Addr: *listenAddress,
     Handler: serveMux,
   }
+  for _,is := range(issuers) {
+    server.RegisterOnShutdown(is.handler.CloseWatches)
+  }
 
   // start up handles
   go func() {
-    if err := server.ListenAndServe(); err != nil {
+    if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
       glog.Exitf("Problem serving: %v\n",err)
     }
   }()
 
-  // start up sequencer
-  glog.Infoln("Starting sequencer")
-  seqdone := make(chan bool)
-  go func() {
-    if err := sequencer.Run(seqdone,t,*mmdDuration); err != nil {
-      glog.Exitf("Problem integrating queued nodes to merkle tree: %v",err)
+  // Same handlers over https, with HTTP/2
+  var tlsServer *http.Server
+  if(certs != nil) {
+    tlsServer = &http.Server {
+      Addr: *tlsListen,
+      Handler: serveMux,
+      TLSConfig: certs.Config(),
     }
-  }()
-  glog.Infoln("Sequencer started")
+    for _,is := range(issuers) {
+      tlsServer.RegisterOnShutdown(is.handler.CloseWatches)
+    }
+    go func() {
+      if err := tlsServer.ListenAndServeTLS("",""); err != nil && err != http.ErrServerClosed {
+        glog.Exitf("Problem serving https: %v\n",err)
+      }
+    }()
+    glog.Infof("Serving https on %v\n",*tlsListen)
 
-  
-  <-stop
-  glog.Infoln("Received stop signal")
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    go func() {
+      for range(hup) {
+        if err := certs.Reload(); err != nil {
+          glog.Errorf("Keeping the current tls certificate: %v\n",err)
+        }
+      }
+    }()
+  }
 
-  // Might have to wait for this to shutdown safely
-  seqdone <- true
+  var rpcServer *rpc.Server
+  var grpcServer *grpc.Server
+  if(*grpcListen != "") {
+    // The grpc service is a single log, cert_file's
+    rpcServer = rpc.NewServer(issuers[0].t,authn,addressLimiter,limiter,*maxBatch)
+    var opts []grpc.ServerOption
+    if(certs != nil) {
+      opts = append(opts,grpc.Creds(credentials.NewTLS(certs.Config())))
+    }
+    grpcServer, err = rpc.Serve(*grpcListen,rpcServer,opts...)
+    if err != nil {
+      glog.Exitf("Problem serving grpc: %v\n",err)
+    }
+    glog.Infof("Serving grpc on %v\n",*grpcListen)
+  }
 
-  ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+  // start up sequencer
+  glog.Infoln("Starting sequencers")
+  for _,is := range(issuers) {
+    is.start(checker)
+  }
+  glog.Infoln("Sequencers started")
 
-  server.Shutdown(ctx)
+  // Until it holds the lease the sequencers are on standby, and the trees follow the leader's
+  electiondone := make(chan bool)
+  if(elector != nil) {
+    checker.AddElection(elector)
+    go elector.Run(electiondone)
+  }
+
+  sig := <-stop
+  glog.Infof("Received %v, shutting down\n",sig)
+
+  // Stop taking submissions, anything already queued goes into a final root
+  for _,is := range(issuers) {
+    if(is.feed != nil) {
+      is.feeddone <- true
+    }
+  }
+  for _,tr := range(trees) {
+    tr.Close()
+  }
+  // Each waits for an integration in progress to finish
+  for _,is := range(issuers) {
+    is.stop()
+  }
+  // A standby replica only has the leader's state, which it must not sign roots over
+  leader := true
+  if(elector != nil) {
+    electiondone <- true
+    leader = elector.Status().Leader
+  }
+  for _,tr := range(trees) {
+    if(leader) {
+      glog.Infof("Integrating the %v queue one last time\n",tr.GetName())
+      if err := tr.IntegrateQueue(); err != nil {
+        glog.Errorf("Final integration of %v failed, its queue is saved for the next start: %v\n",tr.GetName(),err)
+      }
+    }
+    saveTree(tr)
+  }
+  // Another replica can take over as soon as the final roots are published
+  if(elector != nil) {
+    elector.Resign()
+  }
+
+  // Reads were still served while integrating, so clients could fetch the final roots
+  ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+  defer cancel()
+  if err := server.Shutdown(ctx); err != nil {
+    glog.Warningf("Closed http connections still open after %v: %v\n",*drainTimeout,err)
+  }
+  if(tlsServer != nil) {
+    if err := tlsServer.Shutdown(ctx); err != nil {
+      glog.Warningf("Closed https connections still open after %v: %v\n",*drainTimeout,err)
+    }
+  }
+  if(rpcServer != nil) {
+    rpcServer.Shutdown()
+    stopped := make(chan struct{})
+    go func() {
+      grpcServer.GracefulStop()
+      close(stopped)
+    }()
+    select {
+    case <-stopped:
+    case <-ctx.Done():
+      glog.Warningf("Closed grpc calls still open after %v\n",*drainTimeout)
+      grpcServer.Stop()
+    }
+  }
   glog.Infoln("Graceful shutdown")
 }
+
+// Trees, sequencers and handler of one issuer, cert_file's or one of the issuers section
+type issuer struct {
+  name string //empty for cert_file's issuer
+  mmd time.Duration
+  t *tree.MerkleTree
+  seq *sequencer.Sequencer
+  issued *registry.Registry
+  regseq *sequencer.Sequencer
+  feed *ctfeed.Follower
+  handler *rev.Handler
+  seqdone, regdone, feeddone chan bool
+}
+
+// Set up cfg's issuer, restoring its trees from state_dir, with a registry and ct feed if they are enabled
+func newIssuer(name string, cfg tree.Config) *issuer {
+  t, key, cert, mmdDuration, err := tree.Initialize(cfg)
+  if err != nil {
+    glog.Exitf("Failed to initialize tree %v: %v",name,err)
+  }
+  is := &issuer{name: name, mmd: *mmdDuration, t: t, seqdone: make(chan bool), regdone: make(chan bool), feeddone: make(chan bool)}
+  t.SetMaxQueue(*maxQueue)
+  t.SetReceiptRetention(*receiptRetention)
+  restoreTree(t)
+  metrics.Track(t)
+  is.seq = newSequencer(t,is.mmd,0)
+  sequencers := []*sequencer.Sequencer{is.seq}
+
+  if(*issuanceRegistry) {
+    glog.Infof("Creating issuance registry %v\n",t.GetName())
+    is.issued = registry.NewFor(name,cfg.MaxCerts,is.mmd,t.GetSigner())
+    is.issued.GetTree().SetMaxQueue(*maxQueue)
+    is.issued.GetTree().SetReceiptRetention(*receiptRetention)
+    restoreTree(is.issued.GetTree())
+    metrics.Track(is.issued.GetTree())
+    is.regseq = newSequencer(is.issued.GetTree(),is.mmd,*registryInterval)
+    sequencers = append(sequencers,is.regseq)
+  }
+
+  if(*ctLogUri != "") {
+    glog.Infof("Following ct log at %v for %v\n",*ctLogUri,t.GetName())
+    is.feed, err = ctfeed.New(*ctLogUri,cert,is.issued,*ctBatchSize)
+    if err != nil {
+      glog.Exitf("Failed to create ct log client: %v",err)
+    }
+    if(*stateDir != "") {
+      state := "ctfeed.json"
+      if(name != "") {
+        state = "ctfeed-"+name+".json"
+      }
+      if err := is.feed.SetStateFile(filepath.Join(*stateDir,state)); err != nil {
+        glog.Exitf("Failed to restore the ct feed: %v",err)
+      }
+    }
+  }
+
+  handler := rev.NewHandler(t,is.issued,is.feed,cert,key)
+  handler.SetMaxBatch(*maxBatch)
+  handler.SetSequencers(sequencers...)
+  is.handler = &handler
+  return is
+}
+
+// Where the issuer's endpoints are served, the top level for cert_file's
+func (is *issuer) prefix() string {
+  if(is.name == "") {
+    return ""
+  }
+  return "/issuers/"+is.name
+}
+
+func (is *issuer) trees() []*tree.MerkleTree {
+  if(is.issued == nil) {
+    return []*tree.MerkleTree{is.t}
+  }
+  return []*tree.MerkleTree{is.t,is.issued.GetTree()}
+}
+
+// Run the sequencers and feed, with the trees' health checked
+func (is *issuer) start(checker *health.Checker) {
+  checker.AddTree(is.t,is.seq,is.mmd,*healthGrace)
+  go is.seq.Run(is.seqdone)
+  if(is.issued != nil) {
+    checker.AddTree(is.issued.GetTree(),is.regseq,is.mmd,*healthGrace)
+    go is.regseq.Run(is.regdone)
+  }
+  if(is.feed != nil) {
+    go is.feed.Run(is.feeddone,*ctPollInterval)
+  }
+}
+
+// Stop the sequencers, once the feed is stopped and the trees are closed
+func (is *issuer) stop() {
+  is.seqdone <- true
+  if(is.issued != nil) {
+    is.regdone <- true
+  }
+}
+
+// Name in the sequencer lease, --replica_id or the hostname and listen address
+func replicaID() string {
+  if(*replicaId != "") {
+    return *replicaId
+  }
+  host, err := os.Hostname()
+  if err != nil {
+    host = "localhost"
+  }
+  return host+*listenAddress
+}
+
+// Sequencer for t, integrating every integration_interval (or every, if that is sooner and not 0) and once the queue reaches integration_queue_size,
+// and re-signing every resign_interval. t's roots are current until whichever of those comes first
+func newSequencer(t *tree.MerkleTree, mmd time.Duration, every time.Duration) *sequencer.Sequencer {
+  s := sequencer.New(t,mmd)
+  update := mmd
+  if(*integrationInterval > 0) {
+    update = *integrationInterval
+  }
+  if(every > 0 && every < update) {
+    update = every
+  }
+  if(update != mmd) {
+    s.SetInterval(update)
+  }
+  if(*resignInterval > 0) {
+    s.SetResignInterval(*resignInterval)
+    if(*resignInterval < update) {
+      update = *resignInterval
+    }
+  }
+  t.SetUpdateInterval(update)
+  t.SetBatchTrigger(*integrationQueueSize)
+  return s
+}
+
+// Load t's saved state from state_dir, its root is signed again once it is known whether this replica may sign
+func restoreTree(t *tree.MerkleTree) {
+  if(*stateDir == "") {
+    return
+  }
+  path := filepath.Join(*stateDir,t.GetName()+".json")
+  restored, err := t.RestoreFile(path)
+  if err != nil {
+    glog.Exitf("Failed to restore %v from %v: %v",t.GetName(),path,err)
+  }
+  if(!restored) {
+    glog.Infof("Nothing saved at %v, starting %v empty\n",path,t.GetName())
+  }
+}
+
+func saveTree(t *tree.MerkleTree) {
+  if(*stateDir == "") {
+    glog.Warningf("No state_dir, %v is not saved\n",t.GetName())
+    return
+  }
+  path := filepath.Join(*stateDir,t.GetName()+".json")
+  if err := t.SaveFile(path); err != nil {
+    glog.Errorf("Failed to save %v to %v: %v\n",t.GetName(),path,err)
+    return
+  }
+  glog.Infof("Saved %v at revision %v to %v\n",t.GetName(),t.GetRevision(),path)
+}
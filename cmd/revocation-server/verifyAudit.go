@@ -0,0 +1,29 @@
+package main
+
+import (
+  "flag"
+  "os"
+  "github.com/golang/glog"
+  "revocation-server/audit"
+)
+
+var (
+  auditFile = flag.String("audit_file","","Audit log written by the server's --audit_file")
+)
+
+// Check the hash chain of an audit log, reporting the first entry that was modified, dropped or reordered
+func main() {
+  flag.Parse()
+  defer glog.Flush()
+
+  if(*auditFile == "") {
+    glog.Exitf("--audit_file is required, check --help for details")
+  }
+  f, err := os.Open(*auditFile)
+  if(err!=nil) {glog.Exitf("failed to open file: %v\n",err)}
+  defer f.Close()
+
+  n, err := audit.Verify(f)
+  if(err!=nil) {glog.Exitf("Audit log chain broken after %v entries: %v\n",n,err)}
+  glog.Infof("Audit log chain verified, %v entries\n",n)
+}
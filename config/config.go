@@ -0,0 +1,403 @@
+package config
+
+import (
+  "bytes"
+  "encoding/json"
+  "flag"
+  "fmt"
+  "io/ioutil"
+  "math"
+  "net"
+  "net/url"
+  "os"
+  "reflect"
+  "regexp"
+  "strings"
+  "time"
+  "github.com/ghodss/yaml"
+  "github.com/kelseyhightower/envconfig"
+  "revocation-server/limit"
+  "revocation-server/tlsconfig"
+)
+
+//
+// Package Config
+// Server settings from a YAML or JSON file and the environment, as well as flags
+// Every setting is named after its flag, so the file and flags can't drift apart
+// Flags given on the command line win, then environment variables (REVOCATION_ and the flag name in upper case), then the file
+// Whatever is left comes from the flag defaults, and the result is validated before the server starts
+// Issuers besides cert_file's are only set in the file, under issuers, each with its own cert, key and tree settings
+//
+
+// Prefix of environment variables, REVOCATION_MAX_CERTS sets max_certs
+const EnvPrefix = "revocation"
+
+// Settings left out of the file or environment are nil until Load fills them in from the flags
+type Config struct {
+  Listen *string `json:"listen,omitempty" envconfig:"LISTEN"`
+  GrpcListen *string `json:"grpc_listen,omitempty" envconfig:"GRPC_LISTEN"`
+  TlsListen *string `json:"tls_listen,omitempty" envconfig:"TLS_LISTEN"`
+  TlsCert *string `json:"tls_cert,omitempty" envconfig:"TLS_CERT"`
+  TlsKey *string `json:"tls_key,omitempty" envconfig:"TLS_KEY"`
+  TlsMinVersion *string `json:"tls_min_version,omitempty" envconfig:"TLS_MIN_VERSION"`
+  TlsCiphers *string `json:"tls_ciphers,omitempty" envconfig:"TLS_CIPHERS"`
+  TlsClientAuth *string `json:"tls_client_auth,omitempty" envconfig:"TLS_CLIENT_AUTH"`
+  TlsClientCa *string `json:"tls_client_ca,omitempty" envconfig:"TLS_CLIENT_CA"`
+  MaxCerts *uint64 `json:"max_certs,omitempty" envconfig:"MAX_CERTS"`
+  Mmd *string `json:"mmd,omitempty" envconfig:"MMD"`
+  IntegrationInterval *Duration `json:"integration_interval,omitempty" envconfig:"INTEGRATION_INTERVAL"`
+  ResignInterval *Duration `json:"resign_interval,omitempty" envconfig:"RESIGN_INTERVAL"`
+  IntegrationQueueSize *int `json:"integration_queue_size,omitempty" envconfig:"INTEGRATION_QUEUE_SIZE"`
+  CertFile *string `json:"cert_file,omitempty" envconfig:"CERT_FILE"`
+  Key *string `json:"key,omitempty" envconfig:"KEY"`
+  IssuanceRegistry *bool `json:"issuance_registry,omitempty" envconfig:"ISSUANCE_REGISTRY"`
+  RegistryInterval *Duration `json:"registry_interval,omitempty" envconfig:"REGISTRY_INTERVAL"`
+  CtLogUri *string `json:"ct_log_uri,omitempty" envconfig:"CT_LOG_URI"`
+  CtPollInterval *Duration `json:"ct_poll_interval,omitempty" envconfig:"CT_POLL_INTERVAL"`
+  CtBatchSize *int64 `json:"ct_batch_size,omitempty" envconfig:"CT_BATCH_SIZE"`
+  ClientsFile *string `json:"clients_file,omitempty" envconfig:"CLIENTS_FILE"`
+  AuditFile *string `json:"audit_file,omitempty" envconfig:"AUDIT_FILE"`
+  ReceiptRetention *Duration `json:"receipt_retention,omitempty" envconfig:"RECEIPT_RETENTION"`
+  MaxQueue *int `json:"max_queue,omitempty" envconfig:"MAX_QUEUE"`
+  MaxBatch *int `json:"max_batch,omitempty" envconfig:"MAX_BATCH"`
+  MaxBodyBytes *int64 `json:"max_body_bytes,omitempty" envconfig:"MAX_BODY_BYTES"`
+  ClientRate *float64 `json:"client_rate,omitempty" envconfig:"CLIENT_RATE"`
+  ClientBurst *int `json:"client_burst,omitempty" envconfig:"CLIENT_BURST"`
+  AddressRate *float64 `json:"address_rate,omitempty" envconfig:"ADDRESS_RATE"`
+  AddressBurst *int `json:"address_burst,omitempty" envconfig:"ADDRESS_BURST"`
+  ChallengeRate *float64 `json:"challenge_rate,omitempty" envconfig:"CHALLENGE_RATE"`
+  TrustedProxies *string `json:"trusted_proxies,omitempty" envconfig:"TRUSTED_PROXIES"`
+  HealthGrace *Duration `json:"health_grace,omitempty" envconfig:"HEALTH_GRACE"`
+  StateDir *string `json:"state_dir,omitempty" envconfig:"STATE_DIR"`
+  DrainTimeout *Duration `json:"drain_timeout,omitempty" envconfig:"DRAIN_TIMEOUT"`
+  LeaseBackend *string `json:"lease_backend,omitempty" envconfig:"LEASE_BACKEND"`
+  LeaseDsn *string `json:"lease_dsn,omitempty" envconfig:"LEASE_DSN"`
+  LeaseTtl *Duration `json:"lease_ttl,omitempty" envconfig:"LEASE_TTL"`
+  ReplicaId *string `json:"replica_id,omitempty" envconfig:"REPLICA_ID"`
+  AdvertiseUrl *string `json:"advertise_url,omitempty" envconfig:"ADVERTISE_URL"`
+  Issuers []Issuer `json:"issuers,omitempty" ignored:"true"`
+}
+
+// Another issuer served alongside cert_file's, under /issuers/<name>/ with trees of its own
+// max_certs and mmd default to the server's, every other setting is shared
+type Issuer struct {
+  Name string `json:"name"`
+  CertFile string `json:"cert_file"`
+  Key string `json:"key"`
+  MaxCerts uint64 `json:"max_certs,omitempty"`
+  Mmd string `json:"mmd,omitempty"`
+}
+
+// Issuer names go in urls, tree names and state files
+var issuerName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// A time.Duration written as in flags, such as "90s" or "1h30m"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+  var s string
+  if err := json.Unmarshal(b, &s); err != nil {
+    return fmt.Errorf("durations are strings such as \"90s\": %v", err)
+  }
+  return d.Decode(s)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+  return json.Marshal(d.String())
+}
+
+// Parse an environment variable, see envconfig.Decoder
+func (d *Duration) Decode(s string) error {
+  v, err := time.ParseDuration(s)
+  if err != nil {
+    return err
+  }
+  *d = Duration(v)
+  return nil
+}
+
+func (d Duration) String() string {
+  return time.Duration(d).String()
+}
+
+// Settings for the flags in fs from the file at path (none if path is empty) and the environment
+// Flags set on the command line are kept, the rest are set from the file and environment,
+// then every setting is read back from fs so the Config is complete, and validated
+func Load(path string, fs *flag.FlagSet) (*Config, error) {
+  cfg := &Config{}
+  if(path != "") {
+    if err := cfg.readFile(path); err != nil {
+      return nil, err
+    }
+  }
+  if err := envconfig.Process(EnvPrefix, cfg); err != nil {
+    return nil, fmt.Errorf("environment: %v", err)
+  }
+
+  set := make(map[string]bool)
+  fs.Visit(func(f *flag.Flag) {
+    set[f.Name] = true
+  })
+  err := cfg.each(func(name string, field reflect.Value) error {
+    f := fs.Lookup(name)
+    if(f == nil) {
+      return fmt.Errorf("setting %v has no flag", name)
+    }
+    if(!field.IsNil() && !set[name]) {
+      if err := fs.Set(name, fmt.Sprint(field.Elem().Interface())); err != nil {
+        return fmt.Errorf("%v: %v", name, err)
+      }
+    }
+    getter, ok := f.Value.(flag.Getter)
+    if(!ok) {
+      return fmt.Errorf("flag %v can't be read back", name)
+    }
+    v := reflect.New(field.Type().Elem())
+    v.Elem().Set(reflect.ValueOf(getter.Get()).Convert(field.Type().Elem()))
+    field.Set(v)
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  for i := range(cfg.Issuers) {
+    if(cfg.Issuers[i].MaxCerts == 0) {
+      cfg.Issuers[i].MaxCerts = *cfg.MaxCerts
+    }
+    if(cfg.Issuers[i].Mmd == "") {
+      cfg.Issuers[i].Mmd = *cfg.Mmd
+    }
+  }
+  if err := cfg.Validate(); err != nil {
+    return nil, err
+  }
+  return cfg, nil
+}
+
+// YAML, or JSON which is also YAML, unknown settings are an error
+func (cfg *Config) readFile(path string) error {
+  b, err := ioutil.ReadFile(path)
+  if err != nil {
+    return err
+  }
+  j, err := yaml.YAMLToJSON(b)
+  if err != nil {
+    return fmt.Errorf("%v: %v", path, err)
+  }
+  dec := json.NewDecoder(bytes.NewReader(j))
+  dec.DisallowUnknownFields()
+  if err := dec.Decode(cfg); err != nil {
+    return fmt.Errorf("%v: %v", path, err)
+  }
+  return nil
+}
+
+// Call fn with each setting's name and field, but not issuers which has no flag
+func (cfg *Config) each(fn func(name string, field reflect.Value) error) error {
+  v := reflect.ValueOf(cfg).Elem()
+  for i := 0; i < v.NumField(); i++ {
+    if(v.Field(i).Kind() != reflect.Ptr) {
+      continue
+    }
+    name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+    if err := fn(name, v.Field(i)); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// TLS settings, for tlsconfig.New
+func (cfg *Config) TLSOptions() tlsconfig.Options {
+  return tlsconfig.Options{
+    CertFile: *cfg.TlsCert,
+    KeyFile: *cfg.TlsKey,
+    MinVersion: *cfg.TlsMinVersion,
+    Ciphers: *cfg.TlsCiphers,
+    ClientAuth: *cfg.TlsClientAuth,
+    ClientCAFile: *cfg.TlsClientCa,
+  }
+}
+
+// An mmd must be a positive duration, at least the integration_interval
+func (cfg *Config) checkMmd(fail func(string, ...interface{}), name string, s string) {
+  if mmd, err := time.ParseDuration(s); err != nil {
+    fail("%v %q is not a duration: %v", name, s, err)
+  } else if(mmd <= 0) {
+    fail("%v must be positive", name)
+  } else if(time.Duration(*cfg.IntegrationInterval) > mmd) {
+    fail("integration_interval %v is longer than the %v %v, roots would miss the mmd", *cfg.IntegrationInterval, name, mmd)
+  }
+}
+
+// Every problem with a complete Config, so they can all be fixed at once
+type ValidationError struct {
+  Problems []string
+}
+
+func (e *ValidationError) Error() string {
+  return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+func (cfg *Config) Validate() error {
+  var problems []string
+  fail := func(format string, args ...interface{}) {
+    problems = append(problems, fmt.Sprintf(format, args...))
+  }
+
+  if _, _, err := net.SplitHostPort(*cfg.Listen); err != nil {
+    fail("listen %q is not an address:port: %v", *cfg.Listen, err)
+  }
+  if(*cfg.GrpcListen != "") {
+    if _, _, err := net.SplitHostPort(*cfg.GrpcListen); err != nil {
+      fail("grpc_listen %q is not an address:port: %v", *cfg.GrpcListen, err)
+    } else if(*cfg.GrpcListen == *cfg.Listen) {
+      fail("grpc_listen and listen are both %v", *cfg.Listen)
+    }
+  }
+  if(*cfg.TlsListen != "") {
+    if _, _, err := net.SplitHostPort(*cfg.TlsListen); err != nil {
+      fail("tls_listen %q is not an address:port: %v", *cfg.TlsListen, err)
+    } else if(*cfg.TlsListen == *cfg.Listen || *cfg.TlsListen == *cfg.GrpcListen) {
+      fail("tls_listen %v is already used by listen or grpc_listen", *cfg.TlsListen)
+    }
+    for _, f := range([]struct{name, path string}{{"tls_cert", *cfg.TlsCert}, {"tls_key", *cfg.TlsKey}, {"tls_client_ca", *cfg.TlsClientCa}}) {
+      if(f.path == "") {
+        if(f.name != "tls_client_ca") {
+          fail("%v is required with tls_listen", f.name)
+        }
+      } else if _, err := os.Stat(f.path); err != nil {
+        fail("%v: %v", f.name, err)
+      }
+    }
+    if err := cfg.TLSOptions().Check(); err != nil {
+      fail("%v", err)
+    }
+  }
+  if(*cfg.MaxCerts == 0) {
+    fail("max_certs must be at least 1")
+  }
+  cfg.checkMmd(fail, "mmd", *cfg.Mmd)
+  if(*cfg.IntegrationInterval < 0) {
+    fail("integration_interval can't be negative, 0 is the mmd")
+  }
+  if(*cfg.ResignInterval < 0) {
+    fail("resign_interval can't be negative, 0 is never")
+  }
+  if(*cfg.ReceiptRetention < 0) {
+    fail("receipt_retention can't be negative, 0 is forever")
+  }
+  if(*cfg.RegistryInterval < 0) {
+    fail("registry_interval can't be negative, 0 is integration_interval")
+  }
+  if _, err := os.Stat(*cfg.CertFile); err != nil {
+    fail("cert_file: %v", err)
+  }
+  if _, err := os.Stat(*cfg.Key); err != nil {
+    fail("key: %v", err)
+  }
+  names := make(map[string]bool)
+  for i, is := range(cfg.Issuers) {
+    if(!issuerName.MatchString(is.Name)) {
+      fail("issuers[%v] name %q must be lower case letters, digits, - and _", i, is.Name)
+    } else if(names[is.Name]) {
+      fail("issuers[%v] name %v is already used by another issuer", i, is.Name)
+    }
+    names[is.Name] = true
+    for _, f := range([]struct{name, path string}{{"cert_file", is.CertFile}, {"key", is.Key}}) {
+      if(f.path == "") {
+        fail("issuers[%v] %v is required", i, f.name)
+      } else if _, err := os.Stat(f.path); err != nil {
+        fail("issuers[%v] %v: %v", i, f.name, err)
+      }
+    }
+    if(is.MaxCerts == 0) {
+      fail("issuers[%v] max_certs must be at least 1", i)
+    }
+    cfg.checkMmd(fail, fmt.Sprintf("issuers[%v] mmd", i), is.Mmd)
+  }
+  if(*cfg.ClientsFile != "") {
+    if _, err := os.Stat(*cfg.ClientsFile); err != nil {
+      fail("clients_file: %v", err)
+    }
+  }
+  if(*cfg.CtLogUri != "") {
+    if u, err := url.Parse(*cfg.CtLogUri); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+      fail("ct_log_uri %q is not an http or https url", *cfg.CtLogUri)
+    }
+    if(*cfg.CtPollInterval <= 0) {
+      fail("ct_poll_interval must be positive")
+    }
+    if(*cfg.CtBatchSize <= 0) {
+      fail("ct_batch_size must be positive")
+    }
+  }
+  limits := []struct {
+    name string
+    n int64
+  }{
+    {"max_queue", int64(*cfg.MaxQueue)},
+    {"max_batch", int64(*cfg.MaxBatch)},
+    {"max_body_bytes", *cfg.MaxBodyBytes},
+    {"client_burst", int64(*cfg.ClientBurst)},
+    {"address_burst", int64(*cfg.AddressBurst)},
+    {"integration_queue_size", int64(*cfg.IntegrationQueueSize)},
+  }
+  for _, l := range(limits) {
+    if(l.n < 0) {
+      fail("%v can't be negative, 0 is no limit", l.name)
+    }
+  }
+  for _, r := range([]struct{name string; rate float64}{{"client_rate", *cfg.ClientRate}, {"address_rate", *cfg.AddressRate}, {"challenge_rate", *cfg.ChallengeRate}}) {
+    if(r.rate < 0 || math.IsNaN(r.rate) || math.IsInf(r.rate,0)) {
+      fail("%v must be a number of requests a second, 0 is no limit", r.name)
+    }
+  }
+  if _, err := limit.ParseProxies(*cfg.TrustedProxies); err != nil {
+    fail("trusted_proxies: %v", err)
+  }
+  if(*cfg.MaxQueue > 0 && *cfg.IntegrationQueueSize > *cfg.MaxQueue) {
+    fail("integration_queue_size %v is over max_queue %v, the queue would never reach it", *cfg.IntegrationQueueSize, *cfg.MaxQueue)
+  }
+  if(*cfg.HealthGrace < 0) {
+    fail("health_grace can't be negative")
+  }
+  if(*cfg.StateDir != "") {
+    if info, err := os.Stat(*cfg.StateDir); err != nil {
+      fail("state_dir: %v", err)
+    } else if(!info.IsDir()) {
+      fail("state_dir %v is not a directory", *cfg.StateDir)
+    }
+  }
+  if(*cfg.DrainTimeout < 0) {
+    fail("drain_timeout can't be negative")
+  }
+  switch *cfg.LeaseBackend {
+  case "":
+  case "file", "mysql":
+    if(*cfg.LeaseDsn == "") {
+      fail("lease_dsn is required with lease_backend %v", *cfg.LeaseBackend)
+    } else if(*cfg.LeaseBackend == "file") {
+      if info, err := os.Stat(*cfg.LeaseDsn); err != nil {
+        fail("lease_dsn: %v", err)
+      } else if(!info.IsDir()) {
+        fail("lease_dsn %v is not a directory", *cfg.LeaseDsn)
+      }
+    }
+    if(*cfg.LeaseTtl < Duration(3*time.Second)) {
+      fail("lease_ttl must be at least 3s, it is renewed every third of it")
+    }
+    if(*cfg.AdvertiseUrl != "") {
+      if u, err := url.Parse(*cfg.AdvertiseUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+        fail("advertise_url %q is not an http or https url", *cfg.AdvertiseUrl)
+      }
+    }
+  default:
+    fail("lease_backend %q is not file or mysql", *cfg.LeaseBackend)
+  }
+
+  if(len(problems) > 0) {
+    return &ValidationError{problems}
+  }
+  return nil
+}
@@ -0,0 +1,199 @@
+package config
+
+import (
+  "flag"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+)
+
+// Defaults of the server's flags that the zero value doesn't match, or that must point at real files
+var flagDefaults = map[string]string{
+  "listen": ":8080",
+  "max_certs": "1000",
+  "mmd": "24h",
+  "cert_file": "../testdata/root.cert",
+  "key": "../testdata/key.pem",
+  "tls_min_version": "1.2",
+  "tls_client_auth": "none",
+  "ct_poll_interval": "1m",
+  "ct_batch_size": "256",
+  "lease_ttl": "15s",
+}
+
+// A flag for every setting, like the server defines, parsed from args
+func newFlags(t *testing.T, args ...string) *flag.FlagSet {
+  fs := flag.NewFlagSet("test", flag.ContinueOnError)
+  err := (&Config{}).each(func(name string, field reflect.Value) error {
+    switch typ := field.Type().Elem(); {
+    case typ == reflect.TypeOf(Duration(0)):
+      fs.Duration(name, 0, "")
+    case typ.Kind() == reflect.String:
+      fs.String(name, "", "")
+    case typ.Kind() == reflect.Uint64:
+      fs.Uint64(name, 0, "")
+    case typ.Kind() == reflect.Int:
+      fs.Int(name, 0, "")
+    case typ.Kind() == reflect.Int64:
+      fs.Int64(name, 0, "")
+    case typ.Kind() == reflect.Float64:
+      fs.Float64(name, 0, "")
+    case typ.Kind() == reflect.Bool:
+      fs.Bool(name, false, "")
+    default:
+      t.Fatalf("no flag type for setting %v of type %v", name, typ)
+    }
+    if v, ok := flagDefaults[name]; ok {
+      f := fs.Lookup(name)
+      if err := f.Value.Set(v); err != nil {
+        return err
+      }
+      f.DefValue = v
+    }
+    return nil
+  })
+  if err != nil {t.Fatal(err)}
+  if err := fs.Parse(args); err != nil {t.Fatal(err)}
+  return fs
+}
+
+func writeConfig(t *testing.T, dir string, contents string) string {
+  path := filepath.Join(dir, "server.yaml")
+  if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {t.Fatal(err)}
+  return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+  dir, err := ioutil.TempDir("", "config")
+  if err != nil {t.Fatal(err)}
+  defer os.RemoveAll(dir)
+  path := writeConfig(t, dir, "mmd: 1h\nmax_queue: 5\nclient_rate: 2.5\nhealth_grace: 90s\ngrpc_listen: \":9090\"\n")
+  os.Setenv("REVOCATION_MMD", "2h")
+  os.Setenv("REVOCATION_CLIENT_RATE", "4")
+  defer os.Unsetenv("REVOCATION_MMD")
+  defer os.Unsetenv("REVOCATION_CLIENT_RATE")
+
+  cfg, err := Load(path, newFlags(t, "--client_rate", "8"))
+  if err != nil {t.Fatal(err)}
+  tests := []struct {
+    name string
+    got interface{}
+    want interface{}
+  }{
+    {"mmd from the environment over the file", *cfg.Mmd, "2h"},
+    {"max_queue from the file", *cfg.MaxQueue, 5},
+    {"client_rate from the flag over both", *cfg.ClientRate, 8.0},
+    {"health_grace from the file", *cfg.HealthGrace, Duration(90*time.Second)},
+    {"grpc_listen from the file", *cfg.GrpcListen, ":9090"},
+    {"listen from the flag default", *cfg.Listen, ":8080"},
+    {"lease_ttl from the flag default", *cfg.LeaseTtl, Duration(15*time.Second)},
+  }
+  for _, test := range(tests) {
+    if(!reflect.DeepEqual(test.got, test.want)) {
+      t.Errorf("%v: got %v, want %v", test.name, test.got, test.want)
+    }
+  }
+}
+
+func TestLoadErrors(t *testing.T) {
+  dir, err := ioutil.TempDir("", "config")
+  if err != nil {t.Fatal(err)}
+  defer os.RemoveAll(dir)
+
+  tests := []struct {
+    name string
+    file string
+    args []string
+    want []string //each must be in the error
+  }{
+    {"unknown setting", "max_cert: 5\n", nil, []string{"max_cert"}},
+    {"unknown issuer setting", "issuers:\n  - name: a\n    cert_file: ../testdata/root.cert\n    key: ../testdata/key.pem\n    crl: a.crl\n", nil, []string{"crl"}},
+    {"duration that isn't a string", "health_grace: 5\n", nil, []string{"durations are strings"}},
+    {"every problem at once", "mmd: soon\nmax_queue: -1\nlease_backend: etcd\n", nil, []string{"mmd \"soon\"", "max_queue can't be negative", "lease_backend \"etcd\""}},
+    {"integration slower than the mmd", "mmd: 1h\n", []string{"--integration_interval", "2h"}, []string{"integration_interval 2h0m0s is longer than the mmd"}},
+    {"missing key", "", []string{"--key", "missing.pem"}, []string{"key: "}},
+    {"listen clash", "grpc_listen: \":8080\"\n", nil, []string{"grpc_listen and listen are both"}},
+    {"lease without a dsn", "lease_backend: file\n", nil, []string{"lease_dsn is required"}},
+    {"lease ttl too short", "lease_backend: mysql\nlease_dsn: db\nlease_ttl: 1s\n", nil, []string{"lease_ttl must be at least 3s"}},
+    {"bad proxy", "trusted_proxies: 10.0.0.0/8,proxy\n", nil, []string{"trusted_proxies"}},
+    {"negative rate", "challenge_rate: -1\n", nil, []string{"challenge_rate must be"}},
+  }
+  for _, test := range(tests) {
+    path := writeConfig(t, dir, test.file)
+    _, err := Load(path, newFlags(t, test.args...))
+    if(err == nil) {
+      t.Errorf("%v: loaded without error", test.name)
+      continue
+    }
+    for _, want := range(test.want) {
+      if(!strings.Contains(err.Error(), want)) {
+        t.Errorf("%v: error %q doesn't mention %q", test.name, err, want)
+      }
+    }
+  }
+
+  // Problems are reported together
+  _, err = Load(writeConfig(t, dir, "mmd: soon\nmax_queue: -1\n"), newFlags(t))
+  if verr, ok := err.(*ValidationError); !ok || len(verr.Problems) != 2 {
+    t.Errorf("Load = %#v, want a ValidationError with 2 problems", err)
+  }
+}
+
+func TestLoadIssuers(t *testing.T) {
+  dir, err := ioutil.TempDir("", "config")
+  if err != nil {t.Fatal(err)}
+  defer os.RemoveAll(dir)
+  path := writeConfig(t, dir, `max_certs: 500
+mmd: 2h
+issuers:
+  - name: intermediate-1
+    cert_file: ../testdata/root.cert
+    key: ../testdata/key.pem
+  - name: intermediate_2
+    cert_file: ../testdata/root.cert
+    key: ../testdata/key.pem
+    max_certs: 100
+    mmd: 30m
+`)
+  os.Setenv("REVOCATION_ISSUERS", "ignored")
+  defer os.Unsetenv("REVOCATION_ISSUERS")
+
+  // max_certs and mmd the issuer leaves out are the server's, after flags and environment
+  cfg, err := Load(path, newFlags(t, "--mmd", "3h"))
+  if err != nil {t.Fatal(err)}
+  want := []Issuer{
+    {Name: "intermediate-1", CertFile: "../testdata/root.cert", Key: "../testdata/key.pem", MaxCerts: 500, Mmd: "3h"},
+    {Name: "intermediate_2", CertFile: "../testdata/root.cert", Key: "../testdata/key.pem", MaxCerts: 100, Mmd: "30m"},
+  }
+  if(!reflect.DeepEqual(cfg.Issuers, want)) {
+    t.Errorf("issuers = %+v, want %+v", cfg.Issuers, want)
+  }
+
+  tests := []struct {
+    name string
+    issuer string
+    args []string
+    want string
+  }{
+    {"no name", "cert_file: ../testdata/root.cert\n    key: ../testdata/key.pem", nil, `name "" must be`},
+    {"name not fit for a url", "name: Issuer/1\n    cert_file: ../testdata/root.cert\n    key: ../testdata/key.pem", nil, `name "Issuer/1" must be`},
+    {"no cert", "name: a\n    key: ../testdata/key.pem", nil, "issuers[0] cert_file is required"},
+    {"missing key", "name: a\n    cert_file: ../testdata/root.cert\n    key: missing.pem", nil, "issuers[0] key: "},
+    {"bad mmd", "name: a\n    cert_file: ../testdata/root.cert\n    key: ../testdata/key.pem\n    mmd: soon", nil, `issuers[0] mmd "soon"`},
+    {"mmd under the integration interval", "name: a\n    cert_file: ../testdata/root.cert\n    key: ../testdata/key.pem\n    mmd: 1h", []string{"--integration_interval", "2h"}, "longer than the issuers[0] mmd"},
+  }
+  for _, test := range(tests) {
+    _, err := Load(writeConfig(t, dir, "issuers:\n  - "+test.issuer+"\n"), newFlags(t, test.args...))
+    if(err == nil || !strings.Contains(err.Error(), test.want)) {
+      t.Errorf("%v: Load = %v, want an error mentioning %q", test.name, err, test.want)
+    }
+  }
+  _, err = Load(writeConfig(t, dir, "issuers:\n  - name: a\n    cert_file: ../testdata/root.cert\n    key: ../testdata/key.pem\n  - name: a\n    cert_file: ../testdata/root.cert\n    key: ../testdata/key.pem\n"), newFlags(t))
+  if(err == nil || !strings.Contains(err.Error(), "issuers[1] name a is already used")) {
+    t.Errorf("Load with two issuers named a = %v, want a clash", err)
+  }
+}
@@ -0,0 +1,265 @@
+// Package crl creates DER-encoded certificate revocation lists (RFC 5280 section 5)
+// from the revocation values held in the tree, and parses crl's produced by an existing CA
+// Supports complete crl's as well as delta crl's (deltaCRLIndicator) between two revisions
+package crl
+
+import (
+  "bytes"
+  "crypto"
+  "crypto/ecdsa"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/asn1"
+  "encoding/pem"
+  "errors"
+  "fmt"
+  "math/big"
+  "time"
+)
+
+var (
+  oidSignatureSHA256WithRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+  oidSignatureSHA384WithRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+  oidSignatureSHA512WithRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+  oidSignatureECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+  oidSignatureECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+  oidSignatureECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+
+  oidExtensionAuthorityKeyId = asn1.ObjectIdentifier{2, 5, 29, 35}
+  oidExtensionCRLNumber = asn1.ObjectIdentifier{2, 5, 29, 20}
+  oidExtensionDeltaCRLIndicator = asn1.ObjectIdentifier{2, 5, 29, 27}
+  oidExtensionReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+)
+
+// asn.1 structures, see RFC 5280 section 5.1
+// Issuer is kept raw so it is byte-for-byte the subject of the issuer cert
+type certificateList struct {
+  TBSCertList tbsCertList
+  SignatureAlgorithm pkix.AlgorithmIdentifier
+  SignatureValue asn1.BitString
+}
+
+type tbsCertList struct {
+  Raw asn1.RawContent
+  Version int `asn1:"optional,default:0"`
+  Signature pkix.AlgorithmIdentifier
+  Issuer asn1.RawValue
+  ThisUpdate time.Time
+  NextUpdate time.Time `asn1:"optional"`
+  RevokedCertificates []pkix.RevokedCertificate `asn1:"optional"`
+  Extensions []pkix.Extension `asn1:"tag:0,optional,explicit"`
+}
+
+type authKeyId struct {
+  Id []byte `asn1:"optional,tag:0"`
+}
+
+// A single revoked serial in the list
+type Entry struct {
+  Serial uint64
+  RevokedAt time.Time
+  Reason int //one of the reason codes in crypto/ocsp, Unspecified is omitted from the encoding
+}
+
+// A parsed crl
+// Delta is true when the list carries a deltaCRLIndicator, in which case BaseNumber is set
+type RevocationList struct {
+  Number uint64
+  Delta bool
+  BaseNumber uint64
+  ThisUpdate time.Time
+  NextUpdate time.Time
+  Entries []Entry
+}
+
+// Template holds the contents of a crl to be created
+// Number is the crl number, we use the tree revision the list corresponds to
+// If Delta is true, the list is a delta crl containing changes since the complete crl numbered BaseNumber
+type Template struct {
+  Number uint64
+  Delta bool
+  BaseNumber uint64
+  ThisUpdate time.Time
+  NextUpdate time.Time
+  Entries []Entry
+}
+
+// CreateCRL returns a DER-encoded crl (v2) with the specified contents, signed by priv on behalf of issuer
+func CreateCRL(issuer *x509.Certificate, template Template, priv crypto.Signer) ([]byte, error) {
+  hashFunc, sigAlgo, err := signingParamsForPublicKey(priv.Public())
+  if err != nil {
+    return nil, err
+  }
+
+  revoked := make([]pkix.RevokedCertificate, len(template.Entries))
+  for i, e := range(template.Entries) {
+    revoked[i] = pkix.RevokedCertificate{
+      SerialNumber: new(big.Int).SetUint64(e.Serial),
+      RevocationTime: e.RevokedAt.UTC(),
+    }
+    if(e.Reason != 0) {
+      reason, err := asn1.Marshal(asn1.Enumerated(e.Reason))
+      if err != nil {
+        return nil, err
+      }
+      revoked[i].Extensions = []pkix.Extension{{Id: oidExtensionReasonCode, Value: reason}}
+    }
+  }
+
+  var exts []pkix.Extension
+  if(len(issuer.SubjectKeyId) > 0) {
+    aki, err := asn1.Marshal(authKeyId{Id: issuer.SubjectKeyId})
+    if err != nil {
+      return nil, err
+    }
+    exts = append(exts, pkix.Extension{Id: oidExtensionAuthorityKeyId, Value: aki})
+  }
+  number, err := asn1.Marshal(new(big.Int).SetUint64(template.Number))
+  if err != nil {
+    return nil, err
+  }
+  exts = append(exts, pkix.Extension{Id: oidExtensionCRLNumber, Value: number})
+  if(template.Delta) {
+    if(template.BaseNumber >= template.Number) {
+      return nil, errors.New("delta crl base number must be lower than its crl number")
+    }
+    base, err := asn1.Marshal(new(big.Int).SetUint64(template.BaseNumber))
+    if err != nil {
+      return nil, err
+    }
+    // RFC 5280 5.2.4: the delta crl indicator must be critical
+    exts = append(exts, pkix.Extension{Id: oidExtensionDeltaCRLIndicator, Critical: true, Value: base})
+  }
+
+  tbs := tbsCertList{
+    Version: 1, // v2
+    Signature: sigAlgo,
+    Issuer: asn1.RawValue{FullBytes: issuer.RawSubject},
+    ThisUpdate: template.ThisUpdate.UTC(),
+    NextUpdate: template.NextUpdate.UTC(),
+    RevokedCertificates: revoked,
+    Extensions: exts,
+  }
+  tbsDER, err := asn1.Marshal(tbs)
+  if err != nil {
+    return nil, err
+  }
+
+  h := hashFunc.New()
+  h.Write(tbsDER)
+  signature, err := priv.Sign(rand.Reader, h.Sum(nil), hashFunc)
+  if err != nil {
+    return nil, err
+  }
+
+  return asn1.Marshal(certificateList{
+    TBSCertList: tbs,
+    SignatureAlgorithm: sigAlgo,
+    SignatureValue: asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+  })
+}
+
+// Only the key types the server can load are supported, always with SHA256
+func signingParamsForPublicKey(pub crypto.PublicKey) (crypto.Hash, pkix.AlgorithmIdentifier, error) {
+  var sigAlgo pkix.AlgorithmIdentifier
+  switch pub.(type) {
+  case *ecdsa.PublicKey:
+    sigAlgo.Algorithm = oidSignatureECDSAWithSHA256
+  case *rsa.PublicKey:
+    sigAlgo.Algorithm = oidSignatureSHA256WithRSA
+    sigAlgo.Parameters = asn1.NullRawValue
+  default:
+    return 0, sigAlgo, errors.New("crl: only RSA and ECDSA keys supported")
+  }
+  return crypto.SHA256, sigAlgo, nil
+}
+
+// ParseCRL parses a DER or PEM encoded crl and checks that it was signed by issuer
+// Serials must fit in a uint64 since that is all the tree can store
+func ParseCRL(b []byte, issuer *x509.Certificate) (*RevocationList, error) {
+  if block, _ := pem.Decode(b); block != nil {
+    if(block.Type != "X509 CRL") {
+      return nil, fmt.Errorf("crl: unexpected pem block type %v", block.Type)
+    }
+    b = block.Bytes
+  }
+
+  var list certificateList
+  rest, err := asn1.Unmarshal(b, &list)
+  if err != nil {
+    return nil, err
+  }
+  if(len(rest) > 0) {
+    return nil, errors.New("crl: trailing data after crl")
+  }
+  tbs := list.TBSCertList
+
+  if(!bytes.Equal(tbs.Issuer.FullBytes, issuer.RawSubject)) {
+    return nil, errors.New("crl: issuer name does not match issuer certificate")
+  }
+  sigAlgo, ok := signatureAlgorithms[tbs.Signature.Algorithm.String()]
+  if(!ok) {
+    return nil, fmt.Errorf("crl: unsupported signature algorithm %v", tbs.Signature.Algorithm)
+  }
+  if err := issuer.CheckSignature(sigAlgo, tbs.Raw, list.SignatureValue.RightAlign()); err != nil {
+    return nil, fmt.Errorf("crl: bad signature: %v", err)
+  }
+
+  ret := &RevocationList{
+    ThisUpdate: tbs.ThisUpdate,
+    NextUpdate: tbs.NextUpdate,
+  }
+  for _, ext := range(tbs.Extensions) {
+    switch {
+    case ext.Id.Equal(oidExtensionCRLNumber):
+      if ret.Number, err = parseNumber(ext.Value); err != nil {
+        return nil, err
+      }
+    case ext.Id.Equal(oidExtensionDeltaCRLIndicator):
+      ret.Delta = true
+      if ret.BaseNumber, err = parseNumber(ext.Value); err != nil {
+        return nil, err
+      }
+    }
+  }
+
+  ret.Entries = make([]Entry, len(tbs.RevokedCertificates))
+  for i, rc := range(tbs.RevokedCertificates) {
+    if(rc.SerialNumber.Sign() < 0 || !rc.SerialNumber.IsUint64()) {
+      return nil, fmt.Errorf("crl: serial %v does not fit in a uint64", rc.SerialNumber)
+    }
+    ret.Entries[i] = Entry{Serial: rc.SerialNumber.Uint64(), RevokedAt: rc.RevocationTime}
+    for _, ext := range(rc.Extensions) {
+      if(ext.Id.Equal(oidExtensionReasonCode)) {
+        var reason asn1.Enumerated
+        if _, err := asn1.Unmarshal(ext.Value, &reason); err != nil {
+          return nil, fmt.Errorf("crl: bad reason code for serial %v: %v", rc.SerialNumber, err)
+        }
+        ret.Entries[i].Reason = int(reason)
+      }
+    }
+  }
+  return ret, nil
+}
+
+var signatureAlgorithms = map[string]x509.SignatureAlgorithm{
+  oidSignatureSHA256WithRSA.String(): x509.SHA256WithRSA,
+  oidSignatureSHA384WithRSA.String(): x509.SHA384WithRSA,
+  oidSignatureSHA512WithRSA.String(): x509.SHA512WithRSA,
+  oidSignatureECDSAWithSHA256.String(): x509.ECDSAWithSHA256,
+  oidSignatureECDSAWithSHA384.String(): x509.ECDSAWithSHA384,
+  oidSignatureECDSAWithSHA512.String(): x509.ECDSAWithSHA512,
+}
+
+func parseNumber(b []byte) (uint64, error) {
+  n := new(big.Int)
+  if _, err := asn1.Unmarshal(b, &n); err != nil {
+    return 0, fmt.Errorf("crl: bad crl number: %v", err)
+  }
+  if(n.Sign() < 0 || !n.IsUint64()) {
+    return 0, fmt.Errorf("crl: crl number %v does not fit in a uint64", n)
+  }
+  return n.Uint64(), nil
+}
@@ -0,0 +1,167 @@
+package crl
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/pem"
+  "math/big"
+  "reflect"
+  "testing"
+  "time"
+  "revocation-server/crypto/ocsp"
+)
+
+func newIssuer(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {t.Fatal(err)}
+  template := &x509.Certificate{
+    SerialNumber: big.NewInt(1),
+    Subject: pkix.Name{CommonName: "Test CA"},
+    NotBefore: time.Now().Add(-time.Hour),
+    NotAfter: time.Now().Add(time.Hour),
+    IsCA: true,
+    BasicConstraintsValid: true,
+    KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+  }
+  der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+  if err != nil {t.Fatal(err)}
+  cert, err := x509.ParseCertificate(der)
+  if err != nil {t.Fatal(err)}
+  return cert, key
+}
+
+// Create a crl from template and parse it back, with ParseCRL and with the standard library as a second opinion
+func roundTrip(t *testing.T, issuer *x509.Certificate, key *ecdsa.PrivateKey, template Template) (*RevocationList, *x509.RevocationList) {
+  der, err := CreateCRL(issuer, template, key)
+  if err != nil {t.Fatalf("CreateCRL(%+v): %v", template, err)}
+  list, err := ParseCRL(der, issuer)
+  if err != nil {t.Fatalf("ParseCRL: %v", err)}
+  std, err := x509.ParseRevocationList(der)
+  if err != nil {t.Fatalf("x509.ParseRevocationList: %v", err)}
+  if err := std.CheckSignatureFrom(issuer); err != nil {
+    t.Errorf("crl %v isn't signed by the issuer: %v", template.Number, err)
+  }
+  return list, std
+}
+
+func TestRoundTrip(t *testing.T) {
+  issuer, key := newIssuer(t)
+  // Times are encoded to the second
+  thisUpdate := time.Now().UTC().Truncate(time.Second)
+  nextUpdate := thisUpdate.Add(24*time.Hour)
+  revokedAt := thisUpdate.Add(-time.Hour)
+
+  complete := Template{
+    Number: 3,
+    ThisUpdate: thisUpdate,
+    NextUpdate: nextUpdate,
+    Entries: []Entry{
+      {Serial: 4, RevokedAt: revokedAt, Reason: ocsp.Unspecified},
+      {Serial: 5, RevokedAt: revokedAt, Reason: ocsp.KeyCompromise},
+      {Serial: 1<<40, RevokedAt: revokedAt, Reason: ocsp.CertificateHold},
+    },
+  }
+  list, std := roundTrip(t, issuer, key, complete)
+  want := &RevocationList{Number: 3, ThisUpdate: thisUpdate, NextUpdate: nextUpdate, Entries: complete.Entries}
+  if(!reflect.DeepEqual(list, want)) {
+    t.Errorf("complete crl parsed as %+v, want %+v", list, want)
+  }
+  for _, ext := range(std.Extensions) {
+    if(ext.Id.Equal(oidExtensionDeltaCRLIndicator)) {
+      t.Errorf("complete crl has a deltaCRLIndicator")
+    }
+  }
+  // Unspecified is left out of the encoding rather than written as reason 0
+  for i, reason := range([]int{0, ocsp.KeyCompromise, ocsp.CertificateHold}) {
+    if got := std.RevokedCertificateEntries[i].ReasonCode; got != reason {
+      t.Errorf("entry %v encoded with reason %v, want %v", i, got, reason)
+    }
+  }
+  if(len(std.RevokedCertificateEntries[0].Extensions) != 0) {
+    t.Errorf("entry with an unspecified reason has extensions %v", std.RevokedCertificateEntries[0].Extensions)
+  }
+
+  // A delta names its base, critically, and carries releases as removeFromCRL
+  delta := Template{
+    Number: 5,
+    Delta: true,
+    BaseNumber: 3,
+    ThisUpdate: thisUpdate,
+    NextUpdate: nextUpdate,
+    Entries: []Entry{
+      {Serial: 6, RevokedAt: revokedAt, Reason: ocsp.Superseded},
+      {Serial: 1<<40, RevokedAt: thisUpdate, Reason: ocsp.RemoveFromCRL},
+    },
+  }
+  list, std = roundTrip(t, issuer, key, delta)
+  want = &RevocationList{Number: 5, Delta: true, BaseNumber: 3, ThisUpdate: thisUpdate, NextUpdate: nextUpdate, Entries: delta.Entries}
+  if(!reflect.DeepEqual(list, want)) {
+    t.Errorf("delta crl parsed as %+v, want %+v", list, want)
+  }
+  indicators := 0
+  for _, ext := range(std.Extensions) {
+    if(ext.Id.Equal(oidExtensionDeltaCRLIndicator)) {
+      indicators++
+      if(!ext.Critical) {
+        t.Errorf("deltaCRLIndicator isn't critical")
+      }
+      if base, err := parseNumber(ext.Value); err != nil || base != 3 {
+        t.Errorf("deltaCRLIndicator names crl %v,%v, want the base crl 3", base, err)
+      }
+    }
+  }
+  if(indicators != 1) {
+    t.Errorf("delta crl has %v deltaCRLIndicators, want 1", indicators)
+  }
+  if(std.Number.Uint64() != 5 || std.RevokedCertificateEntries[1].ReasonCode != ocsp.RemoveFromCRL) {
+    t.Errorf("delta crl number %v, release reason %v, want 5 and removeFromCRL", std.Number, std.RevokedCertificateEntries[1].ReasonCode)
+  }
+
+  // An empty list is still a valid crl, and PEM parses as well as DER
+  empty := Template{Number: 0, ThisUpdate: thisUpdate, NextUpdate: nextUpdate}
+  list, std = roundTrip(t, issuer, key, empty)
+  if(len(list.Entries) != 0 || len(std.RevokedCertificateEntries) != 0 || list.Number != 0) {
+    t.Errorf("empty crl parsed as %+v", list)
+  }
+  der, err := CreateCRL(issuer, empty, key)
+  if err != nil {t.Fatal(err)}
+  if _, err := ParseCRL(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), issuer); err != nil {
+    t.Errorf("ParseCRL of a pem crl: %v", err)
+  }
+}
+
+// Crl numbers are the tree revision, so each list numbers higher than the one before, and a delta's base is an earlier list
+func TestNumbers(t *testing.T) {
+  issuer, key := newIssuer(t)
+  now := time.Now()
+  var last uint64
+  for i, number := range([]uint64{0, 1, 2, 10, 1<<40}) {
+    list, std := roundTrip(t, issuer, key, Template{Number: number, ThisUpdate: now, NextUpdate: now.Add(time.Hour)})
+    if(list.Number != number || std.Number.Uint64() != number) {
+      t.Errorf("crl %v numbered %v (%v by x509)", number, list.Number, std.Number)
+    }
+    if(i > 0 && list.Number <= last) {
+      t.Errorf("crl number %v after %v", list.Number, last)
+    }
+    last = list.Number
+  }
+  for _, base := range([]uint64{5, 6}) {
+    if _, err := CreateCRL(issuer, Template{Number: 5, Delta: true, BaseNumber: base, ThisUpdate: now, NextUpdate: now.Add(time.Hour)}, key); err == nil {
+      t.Errorf("CreateCRL made delta crl 5 on base %v, want an error", base)
+    }
+  }
+}
+
+func TestParseWrongIssuer(t *testing.T) {
+  issuer, key := newIssuer(t)
+  other, _ := newIssuer(t)
+  der, err := CreateCRL(issuer, Template{Number: 1, ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}, key)
+  if err != nil {t.Fatal(err)}
+  // The same name, but not the same key
+  if _, err := ParseCRL(der, other); err == nil {
+    t.Errorf("ParseCRL accepted a crl signed by another key")
+  }
+}
@@ -0,0 +1,348 @@
+package ctfeed
+
+import (
+  "bytes"
+  "context"
+  "crypto/sha256"
+  "crypto/x509"
+  "encoding/asn1"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "sync"
+  "time"
+  "github.com/golang/glog"
+  ct "github.com/google/certificate-transparency-go"
+  "github.com/google/certificate-transparency-go/client"
+  "github.com/google/certificate-transparency-go/jsonclient"
+  ctx509 "github.com/google/certificate-transparency-go/x509"
+  "revocation-server/registry"
+)
+
+//
+// Package CTFeed
+// Follows the get-entries feed of a CT log the CA submits its certificates to
+// Certificates issued by the configured issuer are recorded in the issuance registry (if enabled),
+// and each certificate is mapped to its serial so revocations can be keyed by certificate
+// An entry only counts if the issuer's signature on it checks out, a name match alone isn't enough
+//
+// Certificates are known by two hashes
+// - the sha256 of the DER certificate, for final certificates logged as x509 entries
+// - the sha256 of the TBSCertificate without the CT poison and SCT list extensions, which a precertificate
+//   and the certificate issued from it share, see LookupCertificate
+//
+
+// Returned by LookupCertificate for certificates the issuer didn't sign
+var ErrNotIssuer = errors.New("Certificate is not signed by the issuer")
+
+// Extended key usage of a precertificate signing cert, RFC 6962 3.1
+var oidPrecertSigning = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 4}
+
+type Follower struct {
+  c *client.LogClient
+  issuer *x509.Certificate
+  issuerKeyHash [sha256.Size]byte //IssuerKeyHash of the issuer's precertificate entries
+  issued *registry.Registry //may be nil, then only certificate hashes are learned
+  batchSize int64
+  statePath string //where the index and hashes are saved after each poll, empty to keep them in memory only
+
+  next int64 //index of the next log entry to fetch
+  hashes map[[sha256.Size]byte]uint64 //sha256 of certificate DER -> serial
+  tbsHashes map[[sha256.Size]byte]uint64 //sha256 of TBSCertificate without ct extensions -> serial
+  sync.RWMutex
+}
+
+// What the state file holds, hashes are hex
+type state struct {
+  Next int64
+  Hashes map[string]uint64
+  TBSHashes map[string]uint64
+}
+
+func New(uri string, issuer *x509.Certificate, issued *registry.Registry, batchSize int64) (*Follower,error) {
+  c, err := client.New(uri, &http.Client{Timeout: 30*time.Second}, jsonclient.Options{})
+  if err != nil {return nil,err}
+  return &Follower{
+    c: c,
+    issuer: issuer,
+    issuerKeyHash: sha256.Sum256(issuer.RawSubjectPublicKeyInfo),
+    issued: issued,
+    batchSize: batchSize,
+    hashes: make(map[[sha256.Size]byte]uint64),
+    tbsHashes: make(map[[sha256.Size]byte]uint64),
+  },nil
+}
+
+// Restore the index and hashes saved at path, if any, and save them there after every poll that gets further
+// so a restart carries on where the feed left off instead of reading the log from the start
+func (f *Follower) SetStateFile(path string) error {
+  f.Lock()
+  f.statePath = path
+  f.Unlock()
+  b, err := ioutil.ReadFile(path)
+  if os.IsNotExist(err) {
+    return nil
+  } else if err != nil {
+    return err
+  }
+  var s state
+  if err := json.Unmarshal(b, &s); err != nil {
+    return fmt.Errorf("Couldn't decode saved ct feed %v: %v",path,err)
+  }
+  hashes, err := decodeHashes(s.Hashes)
+  if err != nil {return err}
+  tbsHashes, err := decodeHashes(s.TBSHashes)
+  if err != nil {return err}
+  f.Lock()
+  f.next, f.hashes, f.tbsHashes = s.Next, hashes, tbsHashes
+  f.Unlock()
+  glog.Infof("Restored ct feed at log index %v, with %v certificates\n",s.Next,len(tbsHashes))
+  return nil
+}
+
+// Poll the log every interval until done, like sequencer.Run
+// Fetch errors are logged and retried at the next interval, the log may just be unreachable for a while
+func (f *Follower) Run(done chan bool, interval time.Duration) {
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+  for {
+    if err := f.Poll(context.Background()); err != nil {
+      glog.Warningf("Problem following ct log: %v\n",err)
+    }
+    select {
+    case <-done:
+      glog.Infoln("Shutting down ct log follower")
+      return
+    case <-ticker.C:
+    }
+  }
+}
+
+// Fetch every entry added to the log since the last poll
+func (f *Follower) Poll(ctx context.Context) error {
+  sth, err := f.c.GetSTH(ctx)
+  if err != nil {return fmt.Errorf("get-sth failed: %v",err)}
+  size := int64(sth.TreeSize)
+
+  start := f.GetIndex()
+  defer func() {
+    if(f.GetIndex() != start) {
+      if err := f.save(); err != nil {
+        glog.Errorf("Couldn't save the ct feed, a restart reads the log again from index %v: %v\n",start,err)
+      }
+    }
+  }()
+  for next := start; next < size; next = f.GetIndex() {
+    end := next + f.batchSize - 1
+    if(end >= size) {
+      end = size-1
+    }
+    resp, err := f.c.GetRawEntries(ctx, next, end)
+    if err != nil {return fmt.Errorf("get-entries %v-%v failed: %v",next,end,err)}
+    if(len(resp.Entries)==0) {
+      return fmt.Errorf("get-entries %v-%v returned no entries",next,end)
+    }
+
+    var serials []uint64
+    for i,e := range(resp.Entries) {
+      index := next + int64(i)
+      cert, ok := f.parseEntry(index, &e)
+      if(!ok) {continue}
+      f.Lock()
+      if(cert.final) {
+        f.hashes[cert.hash] = cert.serial
+      }
+      f.tbsHashes[cert.tbsHash] = cert.serial
+      f.Unlock()
+      serials = append(serials, cert.serial)
+    }
+
+    if(f.issued != nil && len(serials) > 0) {
+      if err := f.issued.AddIssued(serials); err != nil {
+        return fmt.Errorf("Unable to record issued serials: %v",err)
+      }
+    }
+    glog.V(2).Infof("Learned %v serials from ct log entries %v-%v\n",len(serials),next,next+int64(len(resp.Entries))-1)
+    f.Lock()
+    f.next = next + int64(len(resp.Entries))
+    f.Unlock()
+  }
+  return nil
+}
+
+// Index of the next log entry to fetch
+func (f *Follower) GetIndex() int64 {
+  f.RLock()
+  defer f.RUnlock()
+  return f.next
+}
+
+// Serial of the certificate whose DER encoding hashes to hash
+// Only certificates logged as x509 entries are known by this hash, see LookupCertificate for precertificates
+func (f *Follower) LookupSerial(hash []byte) (uint64,bool) {
+  var h [sha256.Size]byte
+  if(len(hash) != sha256.Size) {
+    return 0,false
+  }
+  copy(h[:],hash)
+  f.RLock()
+  serial, ok := f.hashes[h]
+  f.RUnlock()
+  return serial, ok
+}
+
+// Serial of a DER certificate signed by the issuer, found whether the log has it or only its precertificate
+// Returns ErrNotIssuer if the issuer didn't sign it, and false if the log doesn't have it
+func (f *Follower) LookupCertificate(der []byte) (uint64,bool,error) {
+  cert, err := x509.ParseCertificate(der)
+  if err != nil {return 0,false,err}
+  if err := cert.CheckSignatureFrom(f.issuer); err != nil {
+    return 0,false,ErrNotIssuer
+  }
+  f.RLock()
+  serial, ok := f.tbsHashes[tbsHash(cert.RawTBSCertificate)]
+  f.RUnlock()
+  return serial,ok,nil
+}
+
+// A certificate learned from an entry, final is false for precertificates
+type learned struct {
+  serial uint64
+  final bool
+  hash [sha256.Size]byte
+  tbsHash [sha256.Size]byte
+}
+
+// Returns what an entry says about the issuer's certificates, ok is false for entries of other issuers,
+// entries the issuer's signature doesn't check out on, or entries that can't be stored in the tree
+func (f *Follower) parseEntry(index int64, e *ct.LeafEntry) (learned,bool) {
+  var l learned
+  raw, err := ct.RawLogEntryFromLeaf(index, e)
+  if err != nil {
+    glog.V(3).Infof("Skipping ct log entry %v: %v\n",index,err)
+    return l,false
+  }
+  // For a precertificate this is the submitted precertificate, still with its poison extension
+  cert, err := x509.ParseCertificate(raw.Cert.Data)
+  if err != nil {
+    glog.V(3).Infof("Skipping ct log entry %v, could not parse certificate: %v\n",index,err)
+    return l,false
+  }
+  switch raw.Leaf.TimestampedEntry.EntryType {
+  case ct.X509LogEntryType:
+    if(!bytes.Equal(cert.RawIssuer, f.issuer.RawSubject)) {
+      return l,false
+    }
+    if err := cert.CheckSignatureFrom(f.issuer); err != nil {
+      glog.Warningf("Skipping ct log entry %v, it names the issuer but isn't signed by it: %v\n",index,err)
+      return l,false
+    }
+    l.final, l.hash, l.tbsHash = true, sha256.Sum256(raw.Cert.Data), tbsHash(cert.RawTBSCertificate)
+  case ct.PrecertLogEntryType:
+    // A precertificate signed by a precertificate signing cert names that cert as its issuer, so it is matched by the issuer's key instead
+    precert := raw.Leaf.TimestampedEntry.PrecertEntry
+    if(precert.IssuerKeyHash != f.issuerKeyHash) {
+      return l,false
+    }
+    if err := f.checkPrecert(cert, raw.Chain); err != nil {
+      glog.Warningf("Skipping ct log entry %v, the precertificate names the issuer but isn't signed by it: %v\n",index,err)
+      return l,false
+    }
+    // The leaf's TBSCertificate already has the poison removed, and the issuer's name even if a precertificate signing cert was used
+    l.tbsHash = sha256.Sum256(precert.TBSCertificate)
+  default:
+    return l,false
+  }
+
+  if(cert.SerialNumber.Sign() < 0 || !cert.SerialNumber.IsUint64()) {
+    glog.Warningf("Skipping ct log entry %v, serial %v does not fit in a uint64\n",index,cert.SerialNumber)
+    return l,false
+  }
+  l.serial = cert.SerialNumber.Uint64()
+  return l,true
+}
+
+// A precertificate is signed by the issuer, or by a precertificate signing cert (RFC 6962 3.1) the issuer signed,
+// which is then the first cert of the chain
+func (f *Follower) checkPrecert(precert *x509.Certificate, chain []ct.ASN1Cert) error {
+  if err := precert.CheckSignatureFrom(f.issuer); err == nil {
+    return nil
+  }
+  if(len(chain) == 0) {
+    return errors.New("not signed by the issuer, and no precertificate signing cert in the chain")
+  }
+  signing, err := x509.ParseCertificate(chain[0].Data)
+  if err != nil {return err}
+  if err := signing.CheckSignatureFrom(f.issuer); err != nil {return err}
+  isPrecertSigning := false
+  for _,u := range(signing.UnknownExtKeyUsage) {
+    if(u.Equal(oidPrecertSigning)) {
+      isPrecertSigning = true
+    }
+  }
+  if(!isPrecertSigning) {
+    return errors.New("chain[0] is not a precertificate signing cert")
+  }
+  return precert.CheckSignatureFrom(signing)
+}
+
+// Hash of a TBSCertificate without the SCT list extension, which the certificate's precertificate shares
+func tbsHash(tbs []byte) [sha256.Size]byte {
+  if stripped, err := ctx509.RemoveSCTList(tbs); err == nil {
+    return sha256.Sum256(stripped)
+  }
+  // No SCT list to remove, the certificate was logged as it is
+  return sha256.Sum256(tbs)
+}
+
+// Write the index and hashes to the state file, replacing the last save only once this one is written out in full
+func (f *Follower) save() error {
+  f.RLock()
+  path := f.statePath
+  s := state{Next: f.next, Hashes: encodeHashes(f.hashes), TBSHashes: encodeHashes(f.tbsHashes)}
+  f.RUnlock()
+  if(path == "") {
+    return nil
+  }
+  b, err := json.Marshal(s)
+  if err != nil {return err}
+  tmp := path+".tmp"
+  out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+  if err != nil {return err}
+  if _, err := out.Write(b); err != nil {
+    out.Close()
+    return err
+  }
+  if err := out.Sync(); err != nil {
+    out.Close()
+    return err
+  }
+  if err := out.Close(); err != nil {return err}
+  return os.Rename(tmp,path)
+}
+
+func encodeHashes(m map[[sha256.Size]byte]uint64) map[string]uint64 {
+  out := make(map[string]uint64,len(m))
+  for h,serial := range(m) {
+    out[hex.EncodeToString(h[:])] = serial
+  }
+  return out
+}
+
+func decodeHashes(m map[string]uint64) (map[[sha256.Size]byte]uint64,error) {
+  out := make(map[[sha256.Size]byte]uint64,len(m))
+  for s,serial := range(m) {
+    b, err := hex.DecodeString(s)
+    if(err != nil || len(b) != sha256.Size) {
+      return nil,fmt.Errorf("Saved ct feed has a bad hash %q",s)
+    }
+    var h [sha256.Size]byte
+    copy(h[:],b)
+    out[h] = serial
+  }
+  return out,nil
+}
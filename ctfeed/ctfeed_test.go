@@ -0,0 +1,273 @@
+package ctfeed
+
+import (
+  "context"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/asn1"
+  "encoding/json"
+  "io/ioutil"
+  "math/big"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strconv"
+  "sync"
+  "testing"
+  "time"
+  ct "github.com/google/certificate-transparency-go"
+  "github.com/google/certificate-transparency-go/tls"
+  ctx509 "github.com/google/certificate-transparency-go/x509"
+  "revocation-server/registry"
+  "revocation-server/tree/treetest"
+)
+
+var (
+  oidPoison = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+  oidSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+)
+
+// A CT log serving a fixed list of entries, counting the get-entries calls starting at each index
+type stubLog struct {
+  entries []ct.LeafEntry
+  sync.Mutex
+  fetches map[int64]int
+}
+
+func (l *stubLog) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+  switch req.URL.Path {
+  case "/ct/v1/get-sth":
+    sig, _ := tls.Marshal(ct.DigitallySigned{
+      Algorithm: tls.SignatureAndHashAlgorithm{Hash: tls.SHA256, Signature: tls.ECDSA},
+      Signature: []byte{1},
+    })
+    json.NewEncoder(rw).Encode(ct.GetSTHResponse{
+      TreeSize: uint64(len(l.entries)),
+      Timestamp: uint64(time.Now().UnixNano()/1e6),
+      SHA256RootHash: make([]byte,sha256.Size),
+      TreeHeadSignature: sig,
+    })
+  case "/ct/v1/get-entries":
+    start, _ := strconv.ParseInt(req.URL.Query().Get("start"),10,64)
+    end, _ := strconv.ParseInt(req.URL.Query().Get("end"),10,64)
+    if(end >= int64(len(l.entries))) {
+      end = int64(len(l.entries))-1
+    }
+    l.Lock()
+    l.fetches[start]++
+    l.Unlock()
+    json.NewEncoder(rw).Encode(ct.GetEntriesResponse{Entries: l.entries[start:end+1]})
+  default:
+    http.NotFound(rw,req)
+  }
+}
+
+func (l *stubLog) fetchesFrom(start int64) int {
+  l.Lock()
+  defer l.Unlock()
+  return l.fetches[start]
+}
+
+type testCA struct {
+  cert *x509.Certificate
+  key *ecdsa.PrivateKey
+}
+
+func newCA(t *testing.T) testCA {
+  key, err := ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+  if err != nil {t.Fatal(err)}
+  template := &x509.Certificate{
+    SerialNumber: big.NewInt(1),
+    Subject: pkix.Name{CommonName: "Test CA"},
+    NotBefore: time.Now().Add(-time.Hour),
+    NotAfter: time.Now().Add(time.Hour),
+    IsCA: true,
+    BasicConstraintsValid: true,
+    KeyUsage: x509.KeyUsageCertSign,
+  }
+  der, err := x509.CreateCertificate(rand.Reader,template,template,&key.PublicKey,key)
+  if err != nil {t.Fatal(err)}
+  cert, err := x509.ParseCertificate(der)
+  if err != nil {t.Fatal(err)}
+  return testCA{cert,key}
+}
+
+// A precertificate signing cert (RFC 6962 3.1) issued by ca, with a key of its own
+func (ca testCA) precertSigner(t *testing.T) testCA {
+  key, err := ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+  if err != nil {t.Fatal(err)}
+  template := &x509.Certificate{
+    SerialNumber: big.NewInt(2),
+    Subject: pkix.Name{CommonName: "Test CA Precertificate Signing"},
+    NotBefore: time.Now().Add(-time.Hour),
+    NotAfter: time.Now().Add(time.Hour),
+    IsCA: true,
+    BasicConstraintsValid: true,
+    KeyUsage: x509.KeyUsageCertSign,
+    UnknownExtKeyUsage: []asn1.ObjectIdentifier{oidPrecertSigning},
+  }
+  der, err := x509.CreateCertificate(rand.Reader,template,ca.cert,&key.PublicKey,ca.key)
+  if err != nil {t.Fatal(err)}
+  cert, err := x509.ParseCertificate(der)
+  if err != nil {t.Fatal(err)}
+  return testCA{cert,key}
+}
+
+// DER of a leaf certificate with serial, signed by ca, with extra extensions
+// A precertificate and its certificate need the same subject key, so each serial always gets the same one
+var leafKeys = make(map[int64]*ecdsa.PrivateKey)
+
+func (ca testCA) issue(t *testing.T, serial int64, exts ...pkix.Extension) []byte {
+  key, ok := leafKeys[serial]
+  if(!ok) {
+    var err error
+    if key, err = ecdsa.GenerateKey(elliptic.P256(),rand.Reader); err != nil {t.Fatal(err)}
+    leafKeys[serial] = key
+  }
+  template := &x509.Certificate{
+    SerialNumber: big.NewInt(serial),
+    Subject: pkix.Name{CommonName: "leaf "+strconv.FormatInt(serial,10)},
+    NotBefore: time.Unix(1600000000,0),
+    NotAfter: time.Unix(1700000000,0),
+    ExtraExtensions: exts,
+  }
+  der, err := x509.CreateCertificate(rand.Reader,template,ca.cert,&key.PublicKey,ca.key)
+  if err != nil {t.Fatal(err)}
+  return der
+}
+
+func x509Entry(t *testing.T, der []byte, issuer *x509.Certificate) ct.LeafEntry {
+  leaf, err := tls.Marshal(ct.MerkleTreeLeaf{
+    Version: ct.V1,
+    LeafType: ct.TimestampedEntryLeafType,
+    TimestampedEntry: &ct.TimestampedEntry{EntryType: ct.X509LogEntryType, X509Entry: &ct.ASN1Cert{Data: der}},
+  })
+  if err != nil {t.Fatal(err)}
+  extra, err := tls.Marshal(ct.CertificateChain{Entries: []ct.ASN1Cert{{Data: issuer.Raw}}})
+  if err != nil {t.Fatal(err)}
+  return ct.LeafEntry{LeafInput: leaf, ExtraData: extra}
+}
+
+// chain starts with the precertificate's signer, either the issuer or a precertificate signing cert the log replaces with the issuer in the leaf
+func precertEntry(t *testing.T, precert []byte, issuerKeyHash [sha256.Size]byte, chain ...*x509.Certificate) ct.LeafEntry {
+  parsed, err := ctx509.ParseCertificate(precert)
+  if err != nil {t.Fatal(err)}
+  var preIssuer *ctx509.Certificate
+  for _,u := range(chain[0].UnknownExtKeyUsage) {
+    if(u.Equal(oidPrecertSigning)) {
+      if preIssuer, err = ctx509.ParseCertificate(chain[0].Raw); err != nil {t.Fatal(err)}
+    }
+  }
+  tbs, err := ctx509.BuildPrecertTBS(parsed.RawTBSCertificate,preIssuer)
+  if err != nil {t.Fatal(err)}
+  leaf, err := tls.Marshal(ct.MerkleTreeLeaf{
+    Version: ct.V1,
+    LeafType: ct.TimestampedEntryLeafType,
+    TimestampedEntry: &ct.TimestampedEntry{EntryType: ct.PrecertLogEntryType, PrecertEntry: &ct.PreCert{IssuerKeyHash: issuerKeyHash, TBSCertificate: tbs}},
+  })
+  if err != nil {t.Fatal(err)}
+  var certs []ct.ASN1Cert
+  for _,c := range(chain) {
+    certs = append(certs,ct.ASN1Cert{Data: c.Raw})
+  }
+  extra, err := tls.Marshal(ct.PrecertChainEntry{PreCertificate: ct.ASN1Cert{Data: precert}, CertificateChain: certs})
+  if err != nil {t.Fatal(err)}
+  return ct.LeafEntry{LeafInput: leaf, ExtraData: extra}
+}
+
+func TestFollowStubLog(t *testing.T) {
+  ca := newCA(t)
+  // Another CA with the same name, whose certificates must not be taken for ca's
+  impostor := newCA(t)
+  keyHash := sha256.Sum256(ca.cert.RawSubjectPublicKeyInfo)
+
+  final10 := ca.issue(t,10)
+  precert11 := ca.issue(t,11,pkix.Extension{Id: oidPoison, Critical: true, Value: asn1.NullBytes})
+  final11 := ca.issue(t,11,pkix.Extension{Id: oidSCTList, Value: []byte{0x04,0x02,0x00,0x00}})
+  forged12 := impostor.issue(t,12)
+  forgedPrecert13 := impostor.issue(t,13,pkix.Extension{Id: oidPoison, Critical: true, Value: asn1.NullBytes})
+  // Precertificates of a precertificate signing cert name it as their issuer, only one ca issued is trusted
+  signing, forgedSigning := ca.precertSigner(t), impostor.precertSigner(t)
+  precert14 := signing.issue(t,14,pkix.Extension{Id: oidPoison, Critical: true, Value: asn1.NullBytes})
+  final14 := ca.issue(t,14,pkix.Extension{Id: oidSCTList, Value: []byte{0x04,0x02,0x00,0x00}})
+  forgedPrecert15 := forgedSigning.issue(t,15,pkix.Extension{Id: oidPoison, Critical: true, Value: asn1.NullBytes})
+
+  log := &stubLog{fetches: make(map[int64]int)}
+  log.entries = []ct.LeafEntry{
+    x509Entry(t,final10,ca.cert),
+    precertEntry(t,precert11,keyHash,ca.cert),
+    x509Entry(t,forged12,impostor.cert),
+    precertEntry(t,forgedPrecert13,keyHash,impostor.cert),
+    precertEntry(t,precert14,keyHash,signing.cert,ca.cert),
+    precertEntry(t,forgedPrecert15,keyHash,forgedSigning.cert,ca.cert),
+  }
+  srv := httptest.NewServer(log)
+  defer srv.Close()
+
+  issued := registry.New(treetest.MaxCerts,treetest.Mmd,treetest.NewSigner(t))
+  dir, err := ioutil.TempDir("","ctfeed")
+  if err != nil {t.Fatal(err)}
+  defer os.RemoveAll(dir)
+  statePath := filepath.Join(dir,"ctfeed.json")
+
+  f, err := New(srv.URL,ca.cert,issued,3)
+  if err != nil {t.Fatal(err)}
+  if err := f.SetStateFile(statePath); err != nil {t.Fatal(err)}
+  if err := f.Poll(context.Background()); err != nil {t.Fatalf("Poll: %v",err)}
+  if(f.GetIndex() != 6) {
+    t.Fatalf("index after poll = %v, want 6",f.GetIndex())
+  }
+
+  hash := func(der []byte) []byte {
+    h := sha256.Sum256(der)
+    return h[:]
+  }
+  if serial, ok := f.LookupSerial(hash(final10)); !ok || serial != 10 {
+    t.Errorf("LookupSerial(final 10) = %v,%v, want 10,true",serial,ok)
+  }
+  if _, ok := f.LookupSerial(hash(precert11)); ok {
+    t.Errorf("LookupSerial found the precertificate's own hash, which no client has")
+  }
+  if _, ok := f.LookupSerial(hash(forged12)); ok {
+    t.Errorf("LookupSerial found a certificate the issuer didn't sign")
+  }
+  if serial, ok, err := f.LookupCertificate(final11); err != nil || !ok || serial != 11 {
+    t.Errorf("LookupCertificate(final 11) = %v,%v,%v, want 11,true,nil",serial,ok,err)
+  }
+  if serial, ok, err := f.LookupCertificate(final10); err != nil || !ok || serial != 10 {
+    t.Errorf("LookupCertificate(final 10) = %v,%v,%v, want 10,true,nil",serial,ok,err)
+  }
+  if serial, ok, err := f.LookupCertificate(final14); err != nil || !ok || serial != 14 {
+    t.Errorf("LookupCertificate(final 14) = %v,%v,%v, want 14 learned from its precertificate signing cert's precertificate",serial,ok,err)
+  }
+  if _, _, err := f.LookupCertificate(forged12); err != ErrNotIssuer {
+    t.Errorf("LookupCertificate(forged 12) error = %v, want ErrNotIssuer",err)
+  }
+
+  if err := issued.GetTree().IntegrateQueue(); err != nil {t.Fatal(err)}
+  for serial, want := range(map[uint64]bool{10: true, 11: true, 12: false, 13: false, 14: true, 15: false}) {
+    if got, _ := issued.IsIssued(serial); got != want {
+      t.Errorf("IsIssued(%v) = %v, want %v",serial,got,want)
+    }
+  }
+
+  // A restart picks up at the saved index, without fetching the log again
+  restarted, err := New(srv.URL,ca.cert,nil,3)
+  if err != nil {t.Fatal(err)}
+  if err := restarted.SetStateFile(statePath); err != nil {t.Fatal(err)}
+  if(restarted.GetIndex() != 6) {
+    t.Fatalf("restored index = %v, want 6",restarted.GetIndex())
+  }
+  if err := restarted.Poll(context.Background()); err != nil {t.Fatalf("Poll after restart: %v",err)}
+  if n := log.fetchesFrom(0); n != 1 {
+    t.Errorf("log was read from index 0 %v times, want once",n)
+  }
+  if serial, ok, err := restarted.LookupCertificate(final11); err != nil || !ok || serial != 11 {
+    t.Errorf("LookupCertificate(final 11) after restart = %v,%v,%v, want 11,true,nil",serial,ok,err)
+  }
+}
@@ -0,0 +1,523 @@
+package election
+
+import (
+  "bytes"
+  "context"
+  "errors"
+  "fmt"
+  "sync"
+  "time"
+  "github.com/golang/glog"
+  "revocation-server/metrics"
+  "revocation-server/sequencer"
+  "revocation-server/tree"
+)
+
+//
+// Package Election
+// Several replicas share a backend (a directory or a MySQL database), and the one holding its lease is the leader
+// The leader sequences the trees and publishes a record of every change to them (tree.SetPublish) to the backend,
+// the others are on standby: they refuse submissions and replay the records (tree.Apply) to serve OCSP and proofs
+// Every so often the leader also saves a checkpoint of each tree (tree.Checkpoint), which stands in for the records
+// before it, so a replica that starts or falls far behind loads that (tree.Sync) and only replays the records since
+// The lease lasts ttl and is renewed every ttl/3, a leader that can't renew it before it runs out steps down,
+// and publishing only succeeds while the lease is held, so a replica that lost it can't overwrite its successor's state
+// Submissions and roots are published before they are accepted or served, so a successor has every one a client was given,
+// and the leader stops signing roots a third of the ttl before its lease runs out, so it never signs alongside a successor
+// If the backend fails a record it may have stored all the same, the leader publishes nothing more for that tree until it has
+// read the records back and made any change that was stored, so it never signs a second root for a revision a follower has
+//
+
+// Returned by Backend.Save and Append when id doesn't hold the lease
+var ErrNotLeader = errors.New("Lease is not held by this replica")
+
+// Returned by Backend.Records when records after the version asked for were dropped, the checkpoint must be loaded first
+var ErrCompacted = errors.New("Records were dropped, load the latest checkpoint")
+
+// Who holds the lease, and where they take submissions
+type Lease struct {
+  Holder string
+  URL string
+}
+
+// A record of a change to a tree, see tree.SetPublish
+type Record struct {
+  Version uint64
+  Data []byte
+}
+
+// Shared storage for the lease and the trees' records and checkpoints, which share one sequence of versions per tree
+type Backend interface {
+  // Take the lease for id if it is free or expired, or renew it if id holds it, until ttl from now
+  // Returns the holder afterwards, which is id if it got the lease
+  Acquire(ctx context.Context, id string, url string, ttl time.Duration) (Lease, error)
+  // Give up the lease if id holds it, so another replica can take it straight away
+  Release(ctx context.Context, id string) error
+  // Store a checkpoint as the next version of the named tree, only while id holds the lease
+  // Records up to the checkpoint it replaces are dropped, and those since kept for replicas still replaying them,
+  // or with reset every record so far is dropped, so replicas load this checkpoint instead of replaying any
+  Save(ctx context.Context, id string, name string, state []byte, reset bool) (uint64, error)
+  // Latest checkpoint of the named tree if its version is after after, nil if there is none newer
+  Load(ctx context.Context, name string, after uint64) ([]byte, uint64, error)
+  // Store a record as the next version of the named tree, only while id holds the lease
+  Append(ctx context.Context, id string, name string, record []byte) (uint64, error)
+  // Records of the named tree after version after, oldest first, or ErrCompacted if some of them were dropped
+  Records(ctx context.Context, name string, after uint64) ([]Record, error)
+  Close() error
+}
+
+// Backends by --lease_backend name, dsn is a directory for file and a go-sql-driver dsn for mysql
+func Open(backend string, dsn string) (Backend, error) {
+  switch backend {
+  case "file":
+    return OpenFile(dsn)
+  case "mysql":
+    return OpenMySQL(dsn)
+  default:
+    return nil, fmt.Errorf("unknown lease backend %q, use file or mysql", backend)
+  }
+}
+
+// A tree that is sequenced by the leader and followed by the rest
+type member struct {
+  t *tree.MerkleTree
+  s *sequencer.Sequencer
+  version uint64 //of the last checkpoint or record loaded or published, guarded by the Elector's lock
+  records int //published since the last checkpoint, guarded by the Elector's lock
+  stale bool //a record may or may not have been published, nothing more is until it is read back, guarded by the Elector's lock
+}
+
+type Elector struct {
+  b Backend
+  id string
+  url string
+  ttl time.Duration
+  members []*member
+  lost chan struct{} //publishing a record was refused, so the lease is gone
+  stale chan struct{} //a record may or may not have been published, so it must be read back
+  publishing sync.Mutex //held while publishing, so records and checkpoints are stored one at a time
+  sync.RWMutex
+  leader bool
+  deadline time.Time //the lease is held until then, if leader, roots are only signed until a third of the ttl before
+  holder Lease
+  lastErr error
+  lastContact time.Time //of the last backend call that succeeded
+}
+
+// What health checks are told about an Elector
+type Status struct {
+  Leader bool
+  Holder string `json:",omitempty"` //empty if nobody holds the lease
+  LeaderURL string `json:",omitempty"`
+  LastContact time.Time
+  LastError string `json:",omitempty"`
+}
+
+// id must be unique to the replica, url is where it takes submissions while leader
+func New(b Backend, id string, url string, ttl time.Duration) *Elector {
+  return &Elector{b: b, id: id, url: url, ttl: ttl, lost: make(chan struct{}, 1), stale: make(chan struct{}, 1)}
+}
+
+// Sequence t with s while leader, t and s are on standby until Run takes the lease
+// Changes to t are published before they are made, see tree.SetPublish
+// Must be called before Run
+func (e *Elector) Add(t *tree.MerkleTree, s *sequencer.Sequencer) {
+  m := &member{t: t, s: s}
+  t.SetStandby(true)
+  t.SetSignUntil(time.Now())
+  t.SetPublish(func(record []byte) error {
+    return e.publishRecord(m, record)
+  })
+  s.SetStandby(true)
+  e.members = append(e.members, m)
+}
+
+// Take or renew the lease every ttl/3 until done, and follow the trees or save their checkpoints
+// Resign gives the lease up once done
+func (e *Elector) Run(done chan bool) {
+  e.step()
+  ticker := time.NewTicker(e.ttl/3)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-done:
+      glog.Infoln("Shutting down leader election")
+      return
+    case <-ticker.C:
+      e.step()
+    case <-e.lost:
+      e.step()
+    case <-e.stale:
+      e.recoverStale()
+    }
+  }
+}
+
+// Each backend call is bounded by the ttl, a leader stuck longer would lose the lease anyway
+func (e *Elector) context() (context.Context, context.CancelFunc) {
+  return context.WithTimeout(context.Background(), e.ttl/3)
+}
+
+func (e *Elector) step() {
+  ctx, cancel := e.context()
+  defer cancel()
+  start := time.Now()
+  lease, err := e.b.Acquire(ctx, e.id, e.url, e.ttl)
+  if err != nil {
+    e.record(err)
+    glog.Warningf("Couldn't renew or take the sequencer lease: %v\n", err)
+    if st := e.Status(); st.Leader && time.Now().After(e.signUntil()) {
+      e.stepDown(ctx, "the lease ran out before it could be renewed")
+    }
+    return
+  }
+  e.record(nil)
+  e.Lock()
+  e.holder = lease
+  if(lease.Holder == e.id) {
+    e.deadline = start.Add(e.ttl)
+  }
+  leader := e.leader
+  e.Unlock()
+  if(lease.Holder == e.id) {
+    for _, m := range(e.members) {
+      m.t.SetSignUntil(e.signUntil())
+    }
+  }
+
+  switch {
+  case lease.Holder == e.id && !leader:
+    e.takeOver(ctx)
+  case lease.Holder == e.id:
+    if err := e.checkpoint(ctx, false); err == ErrNotLeader {
+      e.stepDown(ctx, "saving a checkpoint was refused")
+    }
+  case leader:
+    e.stepDown(ctx, fmt.Sprintf("%v holds the lease", lease.Holder))
+  default:
+    if err := e.follow(ctx); err != nil {
+      glog.Warningf("Couldn't follow the published records, still serving revision %v: %v\n", e.members[0].t.GetRevision(), err)
+    }
+  }
+}
+
+// Catch up with the published records before sequencing, so nothing the last leader published is lost,
+// then save a checkpoint, so followers have this replica's state to replay its records on
+func (e *Elector) takeOver(ctx context.Context) {
+  if err := e.follow(ctx); err != nil {
+    glog.Errorf("Not taking over sequencing until the published records load: %v\n", err)
+    e.b.Release(ctx, e.id)
+    return
+  }
+  glog.Infof("%v took the sequencer lease, sequencing\n", e.id)
+  e.Lock()
+  e.leader = true
+  e.Unlock()
+  metrics.Leader.Set(1)
+  if err := e.checkpoint(ctx, true); err == ErrNotLeader {
+    e.stepDown(ctx, "saving a checkpoint was refused")
+    return
+  }
+  for _, m := range(e.members) {
+    m.t.SetStandby(false)
+    m.s.SetStandby(false)
+  }
+  // Standby replicas never sign, so the latest root may be the last leader's or one restored at startup: sign it again to freshen the sth
+  for _, m := range(e.members) {
+    if err := m.t.SignRoot(); err != nil {
+      glog.Errorf("Couldn't sign the root of %v again on taking over: %v\n", m.t.GetName(), err)
+    }
+  }
+}
+
+// When the trees stop signing roots: a third of the ttl before the lease runs out,
+// leaving room for a root being signed and for the replicas' clocks to disagree
+func (e *Elector) signUntil() time.Time {
+  e.RLock()
+  defer e.RUnlock()
+  return e.deadline.Add(-e.ttl/3)
+}
+
+// Stop sequencing, and go back to the latest checkpoint and the records since, dropping anything this replica didn't publish
+func (e *Elector) stepDown(ctx context.Context, why string) {
+  glog.Warningf("%v lost the sequencer lease (%v), following\n", e.id, why)
+  e.Lock()
+  e.leader = false
+  for _, m := range(e.members) {
+    m.version = 0
+  }
+  e.Unlock()
+  metrics.Leader.Set(0)
+  for _, m := range(e.members) {
+    m.t.SetSignUntil(time.Now())
+    m.s.SetStandby(true)
+    m.t.SetStandby(true)
+  }
+  if err := e.follow(ctx); err != nil {
+    glog.Errorf("Couldn't go back to the published records, serving this replica's own until they load: %v\n", err)
+  }
+}
+
+// Replay the records published for each tree since it was last followed,
+// loading the latest checkpoint first if the tree has none yet or records it needs were dropped
+func (e *Elector) follow(ctx context.Context) error {
+  for _, m := range(e.members) {
+    if err := e.followMember(ctx, m); err != nil {
+      e.record(err)
+      return fmt.Errorf("following %v: %v", m.t.GetName(), err)
+    }
+  }
+  return nil
+}
+
+func (e *Elector) followMember(ctx context.Context, m *member) error {
+  e.RLock()
+  after := m.version
+  e.RUnlock()
+  var records []Record
+  var err error
+  if(after > 0) {
+    records, err = e.b.Records(ctx, m.t.GetName(), after)
+  }
+  if(after == 0 || err == ErrCompacted) {
+    if after, err = e.load(ctx, m, after); err != nil {
+      return err
+    }
+    records, err = e.b.Records(ctx, m.t.GetName(), after)
+  }
+  if err != nil {
+    return err
+  }
+  for _, r := range(records) {
+    if err := m.t.Apply(r.Data); err != nil {
+      // Load the latest checkpoint next time, rather than replay records onto a tree they don't fit
+      e.Lock()
+      m.version = 0
+      e.Unlock()
+      return fmt.Errorf("replaying version %v: %v", r.Version, err)
+    }
+    e.Lock()
+    m.version = r.Version
+    e.Unlock()
+  }
+  if(len(records) > 0) {
+    glog.V(1).Infof("Replayed %v records of %v up to version %v, revision %v\n", len(records), m.t.GetName(), records[len(records)-1].Version, m.t.GetRevision())
+  }
+  return nil
+}
+
+// Sync m's tree to the latest checkpoint if it is after after, and return the version the tree is then at
+func (e *Elector) load(ctx context.Context, m *member, after uint64) (uint64, error) {
+  state, version, err := e.b.Load(ctx, m.t.GetName(), after)
+  if err != nil || state == nil {
+    return after, err
+  }
+  if err := m.t.Sync(bytes.NewReader(state)); err != nil {
+    return after, fmt.Errorf("syncing to checkpoint version %v: %v", version, err)
+  }
+  glog.V(1).Infof("Synced %v to checkpoint version %v, revision %v\n", m.t.GetName(), version, m.t.GetRevision())
+  e.Lock()
+  m.version = version
+  e.Unlock()
+  return version, nil
+}
+
+// Records published between checkpoints, a follower further behind than this loads the latest checkpoint
+const checkpointRecords = 1024
+
+// Save a checkpoint of each tree that is due one, or of every tree if all
+// A tree is due after checkpointRecords records, and one with a record that may or may not have been stored
+// is only saved once that record is read back, see recoverMember
+// Returns ErrNotLeader if saving was refused, for the caller to step down, other errors are retried at the next renewal
+func (e *Elector) checkpoint(ctx context.Context, all bool) error {
+  for _, m := range(e.members) {
+    e.RLock()
+    stale := m.stale
+    e.RUnlock()
+    if(stale) {
+      if err := e.recoverMember(ctx, m); err == ErrNotLeader {
+        return err
+      } else if err != nil {
+        e.record(err)
+        glog.Errorf("Not publishing to %v until the record that failed is read back: %v\n", m.t.GetName(), err)
+        continue
+      }
+    }
+    e.RLock()
+    due := all || m.records >= checkpointRecords
+    e.RUnlock()
+    if(!due) {
+      continue
+    }
+    if err := e.checkpointMember(ctx, m); err == ErrNotLeader {
+      return err
+    } else if err != nil {
+      // A checkpoint holds what the tree did make, so one stored despite the error leaves followers no different
+      e.record(err)
+      glog.Errorf("Couldn't save a checkpoint of %v: %v\n", m.t.GetName(), err)
+    }
+  }
+  return nil
+}
+
+func (e *Elector) checkpointMember(ctx context.Context, m *member) error {
+  return m.t.Checkpoint(func(state []byte) error {
+    e.publishing.Lock()
+    defer e.publishing.Unlock()
+    e.RLock()
+    reset := m.stale
+    e.RUnlock()
+    version, err := e.b.Save(ctx, e.id, m.t.GetName(), state, reset)
+    if err != nil {
+      return err
+    }
+    glog.V(1).Infof("Saved a checkpoint of %v at revision %v as version %v\n", m.t.GetName(), m.t.GetRevision(), version)
+    e.Lock()
+    m.version, m.records, m.stale = version, 0, false
+    e.Unlock()
+    return nil
+  })
+}
+
+// Publish a record of a change to m's tree, for the tree to make the change once this returns
+// Stepping down is left to Run, as IntegrateQueue waits on AddNodes and stepping down waits on IntegrateQueue,
+// and so is reading back a record that may or may not have been stored, which applies it to the tree
+func (e *Elector) publishRecord(m *member, record []byte) error {
+  if(!e.Status().Leader) {
+    return tree.ErrStandby
+  }
+  ctx, cancel := e.context()
+  defer cancel()
+  e.publishing.Lock()
+  defer e.publishing.Unlock()
+  e.RLock()
+  stale := m.stale
+  e.RUnlock()
+  if(stale) {
+    signal(e.stale)
+    return tree.ErrStandby
+  }
+  version, err := e.b.Append(ctx, e.id, m.t.GetName(), record)
+  if err == ErrNotLeader {
+    signal(e.lost)
+    return tree.ErrStandby
+  } else if err != nil {
+    // The record may have been stored all the same, and a follower may already have it,
+    // so nothing more is published until it is read back
+    e.record(err)
+    e.Lock()
+    m.stale = true
+    e.Unlock()
+    signal(e.stale)
+    return err
+  }
+  e.Lock()
+  m.version = version
+  m.records++
+  e.Unlock()
+  return nil
+}
+
+// Wake Run without waiting for it
+func signal(c chan struct{}) {
+  select {
+  case c <- struct{}{}:
+  default:
+  }
+}
+
+// Read back the records of each tree with one that may or may not have been stored
+func (e *Elector) recoverStale() {
+  if(!e.Status().Leader) {
+    return
+  }
+  ctx, cancel := e.context()
+  defer cancel()
+  for _, m := range(e.members) {
+    e.RLock()
+    stale := m.stale
+    e.RUnlock()
+    if(!stale) {
+      continue
+    }
+    if err := e.recoverMember(ctx, m); err == ErrNotLeader {
+      signal(e.lost)
+      return
+    } else if err != nil {
+      e.record(err)
+      glog.Errorf("Not publishing to %v until the record that failed is read back, retrying at the next renewal: %v\n", m.t.GetName(), err)
+    }
+  }
+}
+
+// Read back the records stored for m's tree since its last known version, and make the changes they record,
+// so the tree matches what followers may have replayed before it publishes anything more
+// A record that was stored but doesn't apply leaves the tree where followers can't follow, so is reset by a checkpoint
+func (e *Elector) recoverMember(ctx context.Context, m *member) error {
+  // Nothing is appended while m is stale, so the records after its version are the one that failed, if it was stored
+  e.RLock()
+  after := m.version
+  e.RUnlock()
+  records, err := e.b.Records(ctx, m.t.GetName(), after)
+  if err != nil {
+    return fmt.Errorf("reading back records after version %v: %v", after, err)
+  }
+  for _, r := range(records) {
+    if err := m.t.Apply(r.Data); err != nil {
+      glog.Errorf("Record version %v of %v was stored but doesn't apply, resetting followers with a checkpoint: %v\n", r.Version, m.t.GetName(), err)
+      return e.checkpointMember(ctx, m)
+    }
+    glog.Warningf("Record version %v of %v was stored despite the error, made its change\n", r.Version, m.t.GetName())
+    e.Lock()
+    m.version = r.Version
+    m.records++
+    e.Unlock()
+  }
+  e.Lock()
+  m.stale = false
+  e.Unlock()
+  return nil
+}
+
+// Give up the lease, once Run has returned and the queues are integrated, so a successor needn't wait for it to run out
+// Every change was published as it was made, so there is nothing left to publish
+func (e *Elector) Resign() {
+  if(!e.Status().Leader) {
+    return
+  }
+  ctx, cancel := e.context()
+  defer cancel()
+  if err := e.b.Release(ctx, e.id); err != nil {
+    glog.Errorf("Couldn't release the sequencer lease, it runs out in %v: %v\n", time.Until(e.deadline).Round(time.Second), err)
+    return
+  }
+  glog.Infof("%v released the sequencer lease\n", e.id)
+}
+
+func (e *Elector) record(err error) {
+  e.Lock()
+  defer e.Unlock()
+  e.lastErr = err
+  if(err == nil) {
+    e.lastContact = time.Now()
+  }
+}
+
+// Where submissions should go, empty if the leader didn't say or there is none
+func (e *Elector) LeaderURL() string {
+  return e.Status().LeaderURL
+}
+
+func (e *Elector) TTL() time.Duration {
+  return e.ttl
+}
+
+func (e *Elector) Status() Status {
+  e.RLock()
+  defer e.RUnlock()
+  st := Status{Leader: e.leader, Holder: e.holder.Holder, LeaderURL: e.holder.URL, LastContact: e.lastContact}
+  if(e.lastErr != nil) {
+    st.LastError = e.lastErr.Error()
+  }
+  return st
+}
@@ -0,0 +1,343 @@
+package election
+
+import (
+  "bytes"
+  "context"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "strings"
+  "testing"
+  "time"
+  "revocation-server/sequencer"
+  "revocation-server/signer"
+  "revocation-server/tree"
+  "revocation-server/tree/treetest"
+)
+
+func openTestBackend(t *testing.T) (*FileBackend, func()) {
+  dir, err := ioutil.TempDir("","election")
+  if err != nil {t.Fatal(err)}
+  b, err := OpenFile(dir)
+  if err != nil {
+    os.RemoveAll(dir)
+    t.Fatal(err)
+  }
+  return b, func() {os.RemoveAll(dir)}
+}
+
+// A replica sequencing one tree, its trees share s with the other replicas like the real ones share a key
+func newTestReplica(b Backend, id string, s *signer.Signer, ttl time.Duration) (*Elector, *tree.MerkleTree) {
+  t := treetest.NewTreeWith(s)
+  e := New(b,id,"https://"+id,ttl)
+  e.Add(t,sequencer.New(t,time.Hour))
+  return e, t
+}
+
+func TestFileLease(t *testing.T) {
+  b, cleanup := openTestBackend(t)
+  defer cleanup()
+  ctx := context.Background()
+  ttl := 200*time.Millisecond
+
+  if l, err := b.Acquire(ctx,"a","https://a",ttl); err != nil || l.Holder != "a" {
+    t.Fatalf("Acquire(a) = %+v,%v, want a to take the free lease",l,err)
+  }
+  if l, err := b.Acquire(ctx,"b","https://b",ttl); err != nil || l.Holder != "a" || l.URL != "https://a" {
+    t.Fatalf("Acquire(b) = %+v,%v, want a to keep the lease",l,err)
+  }
+  // Renewing pushes the expiry back, so a still holds it after the first ttl
+  time.Sleep(ttl/2)
+  if l, err := b.Acquire(ctx,"a","https://a",ttl); err != nil || l.Holder != "a" {
+    t.Fatalf("renewing Acquire(a) = %+v,%v, want a",l,err)
+  }
+  time.Sleep(ttl/2+ttl/4)
+  if l, err := b.Acquire(ctx,"b","https://b",ttl); err != nil || l.Holder != "a" {
+    t.Fatalf("Acquire(b) after renewal = %+v,%v, want a to keep the lease",l,err)
+  }
+  if _, err := b.Save(ctx,"a","tree",[]byte("a1"),false); err != nil {
+    t.Fatalf("Save by the holder: %v",err)
+  }
+
+  time.Sleep(ttl)
+  if _, err := b.Save(ctx,"a","tree",[]byte("a2"),false); err != ErrNotLeader {
+    t.Errorf("Save after the lease expired = %v, want ErrNotLeader",err)
+  }
+  if l, err := b.Acquire(ctx,"b","https://b",ttl); err != nil || l.Holder != "b" {
+    t.Fatalf("Acquire(b) after expiry = %+v,%v, want b to take the lease",l,err)
+  }
+  if _, err := b.Save(ctx,"a","tree",[]byte("a3"),false); err != ErrNotLeader {
+    t.Errorf("Save by a non-holder = %v, want ErrNotLeader",err)
+  }
+  if state, version, err := b.Load(ctx,"tree",0); err != nil || string(state) != "a1" || version != 1 {
+    t.Errorf("Load = %q,%v,%v, want only the holder's save, a1 at version 1",state,version,err)
+  }
+  if version, err := b.Save(ctx,"b","tree",[]byte("b1"),false); err != nil || version != 2 {
+    t.Errorf("Save by the new holder = %v,%v, want version 2",version,err)
+  }
+  if state, _, err := b.Load(ctx,"tree",2); err != nil || state != nil {
+    t.Errorf("Load after the latest version = %q,%v, want nothing",state,err)
+  }
+
+  // Only the holder can release the lease
+  if err := b.Release(ctx,"a"); err != nil {t.Fatal(err)}
+  if l, err := b.Acquire(ctx,"a","https://a",ttl); err != nil || l.Holder != "b" {
+    t.Fatalf("Acquire(a) after a's release = %+v,%v, want b to keep the lease",l,err)
+  }
+  if err := b.Release(ctx,"b"); err != nil {t.Fatal(err)}
+  if l, err := b.Acquire(ctx,"a","https://a",ttl); err != nil || l.Holder != "a" {
+    t.Fatalf("Acquire(a) after b's release = %+v,%v, want a",l,err)
+  }
+}
+
+func TestStandbySync(t *testing.T) {
+  b, cleanup := openTestBackend(t)
+  defer cleanup()
+  s := treetest.NewSigner(t)
+  leader, lt := newTestReplica(b,"a",s,time.Minute)
+  follower, ft := newTestReplica(b,"b",s,time.Minute)
+  started := ft.GetSth().LogRootSignature
+
+  leader.step()
+  follower.step()
+  if(!leader.Status().Leader || follower.Status().Leader) {
+    t.Fatalf("leader %+v, follower %+v, want only a sequencing",leader.Status(),follower.Status())
+  }
+  // Taking over signs the root again, the follower serves that rather than one of its own
+  if sth := ft.GetSth().LogRootSignature; !bytes.Equal(sth,lt.GetSth().LogRootSignature) || bytes.Equal(sth,started) {
+    t.Errorf("follower serves a root the leader didn't sign on taking over")
+  }
+  if _, err := ft.AddNode(tree.Revocation{Serial: 7, RevokedAt: time.Now()}); err != tree.ErrStandby {
+    t.Errorf("AddNode on standby = %v, want ErrStandby",err)
+  }
+
+  // The submission is published before AddNode returns, without waiting for a renewal
+  sub, err := lt.AddNode(tree.Revocation{Serial: 5, RevokedAt: time.Now()})
+  if err != nil {t.Fatal(err)}
+  follower.step()
+  if _, ok := ft.GetReceipt(sub.Receipt.ID); !ok {
+    t.Errorf("follower doesn't have receipt %v for a submission the leader accepted",sub.Receipt.ID)
+  }
+
+  if err := lt.IntegrateQueue(); err != nil {t.Fatal(err)}
+  leader.step()
+  follower.step()
+  if(ft.GetRevision() != lt.GetRevision() || ft.GetRevision() == 0) {
+    t.Errorf("follower at revision %v, leader at %v",ft.GetRevision(),lt.GetRevision())
+  }
+  if revoked, err := ft.GetRevocationValue(5); err != nil || !revoked {
+    t.Errorf("follower GetRevocationValue(5) = %v,%v, want true",revoked,err)
+  }
+  if receipt, ok := ft.GetReceipt(sub.Receipt.ID); !ok || receipt.Status != tree.ReceiptIntegrated {
+    t.Errorf("follower receipt = %+v,%v, want it integrated",receipt,ok)
+  }
+}
+
+func TestSignUntil(t *testing.T) {
+  b, cleanup := openTestBackend(t)
+  defer cleanup()
+  ttl := 300*time.Millisecond
+  e, mt := newTestReplica(b,"a",treetest.NewSigner(t),ttl)
+
+  e.step()
+  if(!e.Status().Leader) {t.Fatalf("didn't take the free lease: %+v",e.Status())}
+  if _, err := mt.AddNode(tree.Revocation{Serial: 5, RevokedAt: time.Now()}); err != nil {t.Fatal(err)}
+
+  // Past deadline-ttl/3 the lease hasn't run out, but the tree must not sign a root a successor might also sign
+  time.Sleep(ttl-ttl/3+ttl/10)
+  if err := mt.IntegrateQueue(); err == nil {
+    t.Fatalf("IntegrateQueue signed revision %v after the signing deadline",mt.GetRevision())
+  }
+  if(mt.GetRevision() != 0) {
+    t.Errorf("revision %v after a refused signature, want 0",mt.GetRevision())
+  }
+
+  // Renewing moves the deadline, and the requeued revocation is integrated
+  e.step()
+  if err := mt.IntegrateQueue(); err != nil {t.Fatalf("IntegrateQueue after renewal: %v",err)}
+  if revoked, err := mt.GetRevocationValue(5); err != nil || !revoked {
+    t.Errorf("GetRevocationValue(5) = %v,%v, want true",revoked,err)
+  }
+}
+
+func TestFileRecords(t *testing.T) {
+  b, cleanup := openTestBackend(t)
+  defer cleanup()
+  ctx := context.Background()
+  if _, err := b.Acquire(ctx,"a","https://a",time.Minute); err != nil {t.Fatal(err)}
+  if _, err := b.Append(ctx,"b","tree",[]byte("b1")); err != ErrNotLeader {
+    t.Errorf("Append by a non-holder = %v, want ErrNotLeader",err)
+  }
+  appendRecord := func(data string) {
+    if _, err := b.Append(ctx,"a","tree",[]byte(data)); err != nil {t.Fatal(err)}
+  }
+  checkpoint := func(state string, reset bool) {
+    if _, err := b.Save(ctx,"a","tree",[]byte(state),reset); err != nil {t.Fatal(err)}
+  }
+  // Records after each version, or ErrCompacted as "dropped"
+  check := func(step string, want map[uint64]string) {
+    for after, records := range(want) {
+      rs, err := b.Records(ctx,"tree",after)
+      got := ""
+      if(err == ErrCompacted) {
+        got = "dropped"
+      } else if err != nil {
+        t.Fatal(err)
+      }
+      for _, r := range(rs) {
+        got += fmt.Sprintf("%v:%s ",r.Version,r.Data)
+      }
+      if(strings.TrimSpace(got) != records) {
+        t.Errorf("%v: Records after %v = %q, want %q",step,after,got,records)
+      }
+    }
+  }
+
+  appendRecord("r1")
+  appendRecord("r2")
+  checkpoint("c3",false)
+  appendRecord("r4")
+  check("first checkpoint",map[uint64]string{0: "1:r1 2:r2 4:r4", 2: "4:r4", 3: "4:r4", 4: ""})
+  // Records up to the checkpoint replaced are dropped, those since are kept for followers still replaying them
+  checkpoint("c5",false)
+  check("second checkpoint",map[uint64]string{0: "dropped", 2: "dropped", 3: "4:r4", 5: ""})
+  if state, version, err := b.Load(ctx,"tree",3); err != nil || string(state) != "c5" || version != 5 {
+    t.Errorf("Load = %q,%v,%v, want c5 at version 5",state,version,err)
+  }
+  // A reset drops every record, so every follower loads the checkpoint
+  checkpoint("c6",true)
+  appendRecord("r7")
+  check("reset",map[uint64]string{4: "dropped", 5: "dropped", 6: "7:r7"})
+}
+
+// Counts Load calls, which followers only make for a checkpoint
+type countingBackend struct {
+  Backend
+  loads int
+}
+
+func (c *countingBackend) Load(ctx context.Context, name string, after uint64) ([]byte, uint64, error) {
+  c.loads++
+  return c.Backend.Load(ctx,name,after)
+}
+
+func TestCheckpoint(t *testing.T) {
+  fb, cleanup := openTestBackend(t)
+  defer cleanup()
+  b := &countingBackend{Backend: fb}
+  s := treetest.NewSigner(t)
+  leader, lt := newTestReplica(b,"a",s,time.Minute)
+  follower, ft := newTestReplica(b,"b",s,time.Minute)
+  revoke := func(serial uint64) {
+    if _, err := lt.AddNode(tree.Revocation{Serial: serial, RevokedAt: time.Now()}); err != nil {t.Fatal(err)}
+    if err := lt.IntegrateQueue(); err != nil {t.Fatal(err)}
+  }
+  // Follow, checking whether the follower loaded a checkpoint to catch up
+  follow := func(step string, load bool) {
+    loads := b.loads
+    follower.step()
+    if(ft.GetRevision() != lt.GetRevision() || !bytes.Equal(ft.GetSth().LogRootSignature,lt.GetSth().LogRootSignature)) {
+      t.Errorf("%v: follower at revision %v, leader at %v",step,ft.GetRevision(),lt.GetRevision())
+    }
+    if((b.loads > loads) != load) {
+      t.Errorf("%v: follower loaded a checkpoint %v times, want loading %v",step,b.loads-loads,load)
+    }
+    if(follower.members[0].version != leader.members[0].version) {
+      t.Errorf("%v: follower at version %v, leader at %v",step,follower.members[0].version,leader.members[0].version)
+    }
+  }
+
+  leader.step()
+  revoke(5)
+  follow("first follow",true)
+  revoke(6)
+  follow("records since",false)
+
+  // A checkpoint after checkpointRecords keeps the records since the one before, so the follower goes on replaying
+  leader.members[0].records = checkpointRecords
+  leader.step()
+  revoke(7)
+  follow("after a checkpoint",false)
+
+  // A record that may or may not have been stored but wasn't is read back as nothing, and followers go on replaying
+  leader.members[0].stale = true
+  leader.step()
+  revoke(8)
+  follow("after reading back",false)
+
+  // A replica starting later loads the checkpoint and replays the records since
+  late, lateTree := newTestReplica(b,"c",s,time.Minute)
+  late.step()
+  for serial, want := range(map[uint64]bool{5: true, 6: true, 7: true, 8: true, 9: false}) {
+    if got, _ := lateTree.GetRevocationValue(serial); got != want {
+      t.Errorf("late replica GetRevocationValue(%v) = %v, want %v",serial,got,want)
+    }
+  }
+}
+
+// Stores a record and then fails Append, as a backend that timed out after writing might
+type storingFailBackend struct {
+  Backend
+  fail bool
+}
+
+func (s *storingFailBackend) Append(ctx context.Context, id string, name string, record []byte) (uint64, error) {
+  version, err := s.Backend.Append(ctx,id,name,record)
+  if(s.fail && err == nil) {
+    s.fail = false
+    return 0, fmt.Errorf("timed out after storing version %v",version)
+  }
+  return version, err
+}
+
+func TestAppendStoredDespiteError(t *testing.T) {
+  fb, cleanup := openTestBackend(t)
+  defer cleanup()
+  b := &storingFailBackend{Backend: fb}
+  s := treetest.NewSigner(t)
+  leader, lt := newTestReplica(b,"a",s,time.Minute)
+  follower, ft := newTestReplica(b,"b",s,time.Minute)
+  leader.step()
+  follower.step()
+
+  if _, err := lt.AddNode(tree.Revocation{Serial: 5, RevokedAt: time.Now()}); err != nil {t.Fatal(err)}
+  b.fail = true
+  if err := lt.IntegrateQueue(); err == nil {
+    t.Fatal("IntegrateQueue succeeded though publishing its batch failed")
+  }
+  // The follower replays the batch that was stored, and serves its root
+  follower.step()
+  if(ft.GetRevision() != 1) {
+    t.Fatalf("follower at revision %v, want the stored batch's 1",ft.GetRevision())
+  }
+  served := ft.GetSth().LogRootSignature
+
+  // Until the record is read back the leader publishes nothing, so it can't sign revision 1 again
+  if _, err := lt.AddNode(tree.Revocation{Serial: 6, RevokedAt: time.Now()}); err != tree.ErrStandby {
+    t.Errorf("AddNode before reading back = %v, want ErrStandby",err)
+  }
+  if err := lt.IntegrateQueue(); err == nil {
+    t.Errorf("IntegrateQueue before reading back signed revision %v",lt.GetRevision())
+  }
+  select {
+  case <-leader.stale:
+  default:
+    t.Fatal("Run wasn't woken to read the record back")
+  }
+
+  // Reading it back makes the change the follower already made, with the same root
+  leader.recoverStale()
+  if(lt.GetRevision() != 1 || !bytes.Equal(lt.GetSth().LogRootSignature,served)) {
+    t.Errorf("leader at revision %v with a different root from the one the follower served",lt.GetRevision())
+  }
+  if revoked, err := lt.GetRevocationValue(5); err != nil || !revoked {
+    t.Errorf("leader GetRevocationValue(5) = %v,%v, want true",revoked,err)
+  }
+
+  if _, err := lt.AddNode(tree.Revocation{Serial: 6, RevokedAt: time.Now()}); err != nil {t.Fatal(err)}
+  if err := lt.IntegrateQueue(); err != nil {t.Fatal(err)}
+  follower.step()
+  if(ft.GetRevision() != lt.GetRevision() || !bytes.Equal(ft.GetSth().LogRootSignature,lt.GetSth().LogRootSignature)) {
+    t.Errorf("follower at revision %v, leader at %v",ft.GetRevision(),lt.GetRevision())
+  }
+}
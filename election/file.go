@@ -0,0 +1,303 @@
+package election
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "syscall"
+  "time"
+)
+
+// A directory shared by the replicas, such as an NFS mount, or local for replicas on one host
+// Every call holds an flock on lease.lock, the lease is kept in lease.json and each tree's latest checkpoint in <tree>.state,
+// with its version in <tree>.version, records in <tree>.records/ by version, and the last version dropped in <tree>.dropped
+// Expiry is judged by each replica's clock, which must agree to well within the ttl
+type FileBackend struct {
+  dir string
+}
+
+type fileLease struct {
+  Holder string
+  URL string
+  Expires time.Time
+}
+
+func OpenFile(dir string) (*FileBackend, error) {
+  info, err := os.Stat(dir)
+  if err != nil {
+    return nil, err
+  }
+  if(!info.IsDir()) {
+    return nil, fmt.Errorf("%v is not a directory", dir)
+  }
+  return &FileBackend{dir: dir}, nil
+}
+
+func (f *FileBackend) Acquire(ctx context.Context, id string, url string, ttl time.Duration) (Lease, error) {
+  var l fileLease
+  err := f.locked(true, func() error {
+    var err error
+    if l, err = f.readLease(); err != nil {
+      return err
+    }
+    now := time.Now()
+    if(l.Holder != id && now.Before(l.Expires)) {
+      return nil
+    }
+    l = fileLease{Holder: id, URL: url, Expires: now.Add(ttl)}
+    b, err := json.Marshal(l)
+    if err != nil {
+      return err
+    }
+    return f.write("lease.json", b)
+  })
+  return Lease{Holder: l.Holder, URL: l.URL}, err
+}
+
+func (f *FileBackend) Release(ctx context.Context, id string) error {
+  return f.locked(true, func() error {
+    l, err := f.readLease()
+    if err != nil || l.Holder != id {
+      return err
+    }
+    b, err := json.Marshal(fileLease{})
+    if err != nil {
+      return err
+    }
+    return f.write("lease.json", b)
+  })
+}
+
+func (f *FileBackend) Save(ctx context.Context, id string, name string, state []byte, reset bool) (uint64, error) {
+  var version uint64
+  err := f.locked(true, func() error {
+    if err := f.holds(id); err != nil {
+      return err
+    }
+    previous, err := f.readNumber(name+".version")
+    if err != nil {
+      return err
+    }
+    if version, err = f.head(name); err != nil {
+      return err
+    }
+    version++
+    // The version is written last, so it never names a state that isn't there yet
+    if err := f.write(name+".state", state); err != nil {
+      return err
+    }
+    if err := f.write(name+".version", []byte(strconv.FormatUint(version, 10))); err != nil {
+      return err
+    }
+    drop := previous
+    if(reset) {
+      drop = version
+    }
+    return f.drop(name, drop)
+  })
+  return version, err
+}
+
+func (f *FileBackend) Append(ctx context.Context, id string, name string, record []byte) (uint64, error) {
+  var version uint64
+  err := f.locked(true, func() error {
+    if err := f.holds(id); err != nil {
+      return err
+    }
+    var err error
+    if version, err = f.head(name); err != nil {
+      return err
+    }
+    version++
+    if err := os.MkdirAll(filepath.Join(f.dir, name+".records"), 0700); err != nil {
+      return err
+    }
+    return f.write(recordFile(name, version), record)
+  })
+  return version, err
+}
+
+func (f *FileBackend) Records(ctx context.Context, name string, after uint64) ([]Record, error) {
+  var records []Record
+  err := f.locked(false, func() error {
+    dropped, err := f.readNumber(name+".dropped")
+    if err != nil {
+      return err
+    }
+    if(after < dropped) {
+      return ErrCompacted
+    }
+    versions, err := f.recordVersions(name)
+    if err != nil {
+      return err
+    }
+    for _, v := range(versions) {
+      if(v <= after) {
+        continue
+      }
+      b, err := ioutil.ReadFile(filepath.Join(f.dir, recordFile(name, v)))
+      if err != nil {
+        return err
+      }
+      records = append(records, Record{Version: v, Data: b})
+    }
+    return nil
+  })
+  return records, err
+}
+
+func (f *FileBackend) Load(ctx context.Context, name string, after uint64) ([]byte, uint64, error) {
+  var state []byte
+  var version uint64
+  err := f.locked(false, func() error {
+    var err error
+    if version, err = f.readNumber(name+".version"); err != nil || version <= after {
+      return err
+    }
+    state, err = ioutil.ReadFile(filepath.Join(f.dir, name+".state"))
+    return err
+  })
+  if(state == nil) {
+    return nil, 0, err
+  }
+  return state, version, err
+}
+
+func (f *FileBackend) Close() error {
+  return nil
+}
+
+// Run fn holding an exclusive or shared flock on lease.lock
+func (f *FileBackend) locked(exclusive bool, fn func() error) error {
+  lock, err := os.OpenFile(filepath.Join(f.dir, "lease.lock"), os.O_CREATE|os.O_RDWR, 0600)
+  if err != nil {
+    return err
+  }
+  defer lock.Close()
+  how := syscall.LOCK_SH
+  if(exclusive) {
+    how = syscall.LOCK_EX
+  }
+  if err := syscall.Flock(int(lock.Fd()), how); err != nil {
+    return fmt.Errorf("locking %v: %v", lock.Name(), err)
+  }
+  defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+  return fn()
+}
+
+// The lease, which is free (has no holder) if nobody has taken it yet
+func (f *FileBackend) readLease() (fileLease, error) {
+  var l fileLease
+  b, err := ioutil.ReadFile(filepath.Join(f.dir, "lease.json"))
+  if os.IsNotExist(err) {
+    return l, nil
+  } else if err != nil {
+    return l, err
+  }
+  return l, json.Unmarshal(b, &l)
+}
+
+// Fail with ErrNotLeader unless id holds the lease
+func (f *FileBackend) holds(id string) error {
+  l, err := f.readLease()
+  if err != nil {
+    return err
+  }
+  if(l.Holder != id || time.Now().After(l.Expires)) {
+    return ErrNotLeader
+  }
+  return nil
+}
+
+// Number kept in the named file, 0 if there is none yet
+func (f *FileBackend) readNumber(name string) (uint64, error) {
+  b, err := ioutil.ReadFile(filepath.Join(f.dir, name))
+  if os.IsNotExist(err) {
+    return 0, nil
+  } else if err != nil {
+    return 0, err
+  }
+  return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// Latest version of the named tree, of a record or its checkpoint, 0 if there is neither
+func (f *FileBackend) head(name string) (uint64, error) {
+  head, err := f.readNumber(name+".version")
+  if err != nil {
+    return 0, err
+  }
+  versions, err := f.recordVersions(name)
+  if(err == nil && len(versions) > 0 && versions[len(versions)-1] > head) {
+    head = versions[len(versions)-1]
+  }
+  return head, err
+}
+
+// Versions of the named tree's records, in order
+func (f *FileBackend) recordVersions(name string) ([]uint64, error) {
+  files, err := ioutil.ReadDir(filepath.Join(f.dir, name+".records"))
+  if os.IsNotExist(err) {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+  var versions []uint64
+  for _, file := range(files) {
+    if v, err := strconv.ParseUint(file.Name(), 10, 64); err == nil {
+      versions = append(versions, v)
+    }
+  }
+  sort.Slice(versions, func(i, j int) bool {return versions[i] < versions[j]})
+  return versions, nil
+}
+
+// Drop the named tree's records up to version, noting that first so Records never serves what is left of them
+func (f *FileBackend) drop(name string, version uint64) error {
+  if err := f.write(name+".dropped", []byte(strconv.FormatUint(version, 10))); err != nil {
+    return err
+  }
+  versions, err := f.recordVersions(name)
+  if err != nil {
+    return err
+  }
+  for _, v := range(versions) {
+    if(v <= version) {
+      if err := os.Remove(filepath.Join(f.dir, recordFile(name, v))); err != nil {
+        return err
+      }
+    }
+  }
+  return nil
+}
+
+// File of the named tree's record at version, zero padded so they list in order
+func recordFile(name string, version uint64) string {
+  return filepath.Join(name+".records", fmt.Sprintf("%020d", version))
+}
+
+// Replace the named file only once the new contents are written out in full, like tree.SaveFile
+func (f *FileBackend) write(name string, b []byte) error {
+  path := filepath.Join(f.dir, name)
+  tmp, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+  if err != nil {
+    return err
+  }
+  if _, err := tmp.Write(b); err != nil {
+    tmp.Close()
+    return err
+  }
+  if err := tmp.Sync(); err != nil {
+    tmp.Close()
+    return err
+  }
+  if err := tmp.Close(); err != nil {
+    return err
+  }
+  return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,204 @@
+package election
+
+import (
+  "context"
+  "database/sql"
+  "time"
+  _ "github.com/go-sql-driver/mysql"
+)
+
+// Tables in a MySQL database shared by the replicas, created if they don't exist
+// Expiry is judged by the database's clock, so replicas' clocks don't need to agree
+// Each tree's latest checkpoint is stored whole in a LONGBLOB, so max_allowed_packet must be larger than the biggest saved tree,
+// but only checkpoints are that big: every change in between is a row of tree_records holding one submission or batch
+type MySQLBackend struct {
+  db *sql.DB
+}
+
+// The lease is the one row of sequencer_lease
+const leaseName = "sequencer"
+
+var schema = []string{
+  `CREATE TABLE IF NOT EXISTS sequencer_lease (
+    name VARCHAR(64) NOT NULL PRIMARY KEY,
+    holder VARCHAR(255) NOT NULL,
+    url VARCHAR(1024) NOT NULL,
+    expires DATETIME(6) NOT NULL
+  )`,
+  `CREATE TABLE IF NOT EXISTS tree_state (
+    name VARCHAR(64) NOT NULL PRIMARY KEY,
+    version BIGINT UNSIGNED NOT NULL,
+    dropped BIGINT UNSIGNED NOT NULL,
+    state LONGBLOB NOT NULL
+  )`,
+  `CREATE TABLE IF NOT EXISTS tree_records (
+    name VARCHAR(64) NOT NULL,
+    version BIGINT UNSIGNED NOT NULL,
+    record LONGBLOB NOT NULL,
+    PRIMARY KEY (name, version)
+  )`,
+}
+
+// dsn as in github.com/go-sql-driver/mysql, such as user:password@tcp(db:3306)/revocations
+func OpenMySQL(dsn string) (*MySQLBackend, error) {
+  db, err := sql.Open("mysql", dsn)
+  if err != nil {
+    return nil, err
+  }
+  for _, s := range(schema) {
+    if _, err := db.Exec(s); err != nil {
+      db.Close()
+      return nil, err
+    }
+  }
+  return &MySQLBackend{db: db}, nil
+}
+
+func (m *MySQLBackend) Acquire(ctx context.Context, id string, url string, ttl time.Duration) (Lease, error) {
+  var l Lease
+  err := m.inTx(ctx, func(tx *sql.Tx) error {
+    var expired bool
+    err := tx.QueryRowContext(ctx, "SELECT holder, url, expires < UTC_TIMESTAMP(6) FROM sequencer_lease WHERE name = ? FOR UPDATE", leaseName).Scan(&l.Holder, &l.URL, &expired)
+    if(err == sql.ErrNoRows) {
+      expired = true
+    } else if err != nil {
+      return err
+    }
+    if(l.Holder != id && !expired) {
+      return nil
+    }
+    l = Lease{Holder: id, URL: url}
+    _, err = tx.ExecContext(ctx, `INSERT INTO sequencer_lease (name, holder, url, expires) VALUES (?, ?, ?, UTC_TIMESTAMP(6) + INTERVAL ? MICROSECOND)
+      ON DUPLICATE KEY UPDATE holder = VALUES(holder), url = VALUES(url), expires = VALUES(expires)`, leaseName, id, url, ttl.Microseconds())
+    return err
+  })
+  return l, err
+}
+
+func (m *MySQLBackend) Release(ctx context.Context, id string) error {
+  _, err := m.db.ExecContext(ctx, "UPDATE sequencer_lease SET holder = '', url = '', expires = UTC_TIMESTAMP(6) WHERE name = ? AND holder = ?", leaseName, id)
+  return err
+}
+
+// The lease row stays locked until the state is written, so the lease can't change hands halfway through
+func (m *MySQLBackend) Save(ctx context.Context, id string, name string, state []byte, reset bool) (uint64, error) {
+  var version uint64
+  err := m.inTx(ctx, func(tx *sql.Tx) error {
+    if err := m.holds(ctx, tx, id); err != nil {
+      return err
+    }
+    var previous uint64
+    err := tx.QueryRowContext(ctx, "SELECT version FROM tree_state WHERE name = ?", name).Scan(&previous)
+    if err != nil && err != sql.ErrNoRows {
+      return err
+    }
+    if version, err = m.head(ctx, tx, name); err != nil {
+      return err
+    }
+    version++
+    drop := previous
+    if(reset) {
+      drop = version
+    }
+    if _, err := tx.ExecContext(ctx, `INSERT INTO tree_state (name, version, dropped, state) VALUES (?, ?, ?, ?)
+      ON DUPLICATE KEY UPDATE version = VALUES(version), dropped = VALUES(dropped), state = VALUES(state)`, name, version, drop, state); err != nil {
+      return err
+    }
+    _, err = tx.ExecContext(ctx, "DELETE FROM tree_records WHERE name = ? AND version <= ?", name, drop)
+    return err
+  })
+  return version, err
+}
+
+// Like Save, the lease row stays locked until the record is written
+func (m *MySQLBackend) Append(ctx context.Context, id string, name string, record []byte) (uint64, error) {
+  var version uint64
+  err := m.inTx(ctx, func(tx *sql.Tx) error {
+    if err := m.holds(ctx, tx, id); err != nil {
+      return err
+    }
+    var err error
+    if version, err = m.head(ctx, tx, name); err != nil {
+      return err
+    }
+    version++
+    _, err = tx.ExecContext(ctx, "INSERT INTO tree_records (name, version, record) VALUES (?, ?, ?)", name, version, record)
+    return err
+  })
+  return version, err
+}
+
+// Both queries read the same snapshot of the tables, so records can't be dropped between checking and reading them
+func (m *MySQLBackend) Records(ctx context.Context, name string, after uint64) ([]Record, error) {
+  var records []Record
+  err := m.inTx(ctx, func(tx *sql.Tx) error {
+    var dropped uint64
+    err := tx.QueryRowContext(ctx, "SELECT dropped FROM tree_state WHERE name = ?", name).Scan(&dropped)
+    if err != nil && err != sql.ErrNoRows {
+      return err
+    }
+    if(after < dropped) {
+      return ErrCompacted
+    }
+    rows, err := tx.QueryContext(ctx, "SELECT version, record FROM tree_records WHERE name = ? AND version > ? ORDER BY version", name, after)
+    if err != nil {
+      return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+      var r Record
+      if err := rows.Scan(&r.Version, &r.Data); err != nil {
+        return err
+      }
+      records = append(records, r)
+    }
+    return rows.Err()
+  })
+  return records, err
+}
+
+func (m *MySQLBackend) Load(ctx context.Context, name string, after uint64) ([]byte, uint64, error) {
+  var state []byte
+  var version uint64
+  err := m.db.QueryRowContext(ctx, "SELECT state, version FROM tree_state WHERE name = ? AND version > ?", name, after).Scan(&state, &version)
+  if(err == sql.ErrNoRows) {
+    return nil, 0, nil
+  }
+  return state, version, err
+}
+
+func (m *MySQLBackend) Close() error {
+  return m.db.Close()
+}
+
+// Run fn in a transaction, committed if fn returns nil and rolled back otherwise
+func (m *MySQLBackend) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+  tx, err := m.db.BeginTx(ctx, nil)
+  if err != nil {
+    return err
+  }
+  if err := fn(tx); err != nil {
+    tx.Rollback()
+    return err
+  }
+  return tx.Commit()
+}
+
+// Fail with ErrNotLeader unless id holds the lease, locking its row until tx ends
+func (m *MySQLBackend) holds(ctx context.Context, tx *sql.Tx, id string) error {
+  var holder string
+  err := tx.QueryRowContext(ctx, "SELECT holder FROM sequencer_lease WHERE name = ? AND expires > UTC_TIMESTAMP(6) FOR UPDATE", leaseName).Scan(&holder)
+  if(err == sql.ErrNoRows || (err == nil && holder != id)) {
+    return ErrNotLeader
+  }
+  return err
+}
+
+// Latest version of the named tree, of a record or its checkpoint, 0 if there is neither
+func (m *MySQLBackend) head(ctx context.Context, tx *sql.Tx, name string) (uint64, error) {
+  var head uint64
+  err := tx.QueryRowContext(ctx, `SELECT GREATEST(
+    COALESCE((SELECT version FROM tree_state WHERE name = ?), 0),
+    COALESCE((SELECT MAX(version) FROM tree_records WHERE name = ?), 0))`, name, name).Scan(&head)
+  return head, err
+}
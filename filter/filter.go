@@ -0,0 +1,187 @@
+package filter
+
+import (
+  "crypto"
+  "crypto/sha256"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "math"
+  "github.com/google/certificate-transparency-go/tls"
+  "revocation-server/signer"
+)
+
+//
+// Package Filter
+// Bloom filter cascade (as in CRLite) over the revoked serials in the tree
+// Lets clients check revocation status offline without downloading the whole tree
+// Level 0 holds the revoked serials, level 1 holds the known-issued serials that are false positives of level 0,
+// level 2 the revoked serials that are false positives of level 1, and so on until a level has no false positives
+//
+
+// Stop adding levels past this point, only reached if the input sets overlap
+const maxLevels = 64
+
+// False positive rate used for every level after the first, see the CRLite paper
+const levelFpRate = 0.5
+
+type Level struct {
+  NumHashes uint8
+  Bits []byte `tls:"minlen:1,maxlen:4294967295"`
+}
+
+type Cascade struct {
+  Levels []Level `tls:"minlen:0,maxlen:4294967295"`
+}
+
+// Signed object published by the server
+// The signature covers the TLS serialization of FilterHeadV1, which binds the filter to a signed tree root
+type SignedFilter struct {
+  Revision uint64
+  RootHash []byte
+  Filter []byte //TLS serialized Cascade
+  Signature []byte
+}
+
+// FilterHeadV1 holds the TLS-deserialization of the following structure
+// (described in RFC5246 section 4 notation):
+// struct {
+//   uint64 revision;
+//   opaque root_hash<0..128>;
+//   opaque filter_hash<0..128>;
+// } FilterHeadV1;
+type FilterHeadV1 struct {
+  Revision uint64
+  RootHash []byte `tls:"minlen:0,maxlen:128"`
+  FilterHash []byte `tls:"minlen:0,maxlen:128"`
+}
+
+// Build the cascade so that every serial in revoked tests positive and every serial in issued tests negative
+// Serials not in either set may give either answer
+func Build(revoked []uint64, issued []uint64) (*Cascade,error) {
+  c := &Cascade{}
+  include, exclude := revoked, issued
+
+  // first level is sized so the false positives left for level 1 are roughly balanced with the revoked set
+  fpRate := levelFpRate
+  if(len(issued) > 0) {
+    fpRate = math.Min(levelFpRate, float64(len(revoked))*math.Sqrt(levelFpRate)/float64(len(issued)))
+    fpRate = math.Max(fpRate, 1e-9)
+  }
+
+  for len(c.Levels) < maxLevels {
+    l := newLevel(len(include), fpRate)
+    depth := len(c.Levels)
+    for _,s := range(include) {
+      l.add(depth,s)
+    }
+    c.Levels = append(c.Levels,l)
+
+    var fps []uint64
+    for _,s := range(exclude) {
+      if(l.contains(depth,s)) {
+        fps = append(fps,s)
+      }
+    }
+    if(len(fps)==0) {
+      return c,nil
+    }
+    include, exclude = fps, include
+    fpRate = levelFpRate
+  }
+  return nil,errors.New("Filter cascade did not converge, revoked and issued sets overlap")
+}
+
+// Client side query, true means the serial is revoked
+func (c *Cascade) Contains(serial uint64) bool {
+  for i,l := range(c.Levels) {
+    if(!l.contains(i,serial)) {
+      // falling out at an even level means the serial was never in the revoked set
+      return i%2==1
+    }
+  }
+  return len(c.Levels)%2==1
+}
+
+func (c *Cascade) MarshalBinary() ([]byte,error) {
+  return tls.Marshal(*c)
+}
+
+func (c *Cascade) UnmarshalBinary(b []byte) error {
+  rest, err := tls.Unmarshal(b,c)
+  if err != nil {return err}
+  if(len(rest) > 0) {return errors.New("trailing data after filter cascade")}
+  return nil
+}
+
+// Sign the cascade, binding it to the root hash of the tree at revision
+func Sign(c *Cascade, revision uint64, rootHash []byte, s *signer.Signer) (*SignedFilter,error) {
+  fb, err := c.MarshalBinary()
+  if err != nil {return nil,err}
+  head, err := marshalHead(revision,rootHash,fb)
+  if err != nil {return nil,err}
+  sig, err := s.Sign(head)
+  if err != nil {return nil,err}
+  return &SignedFilter{revision,rootHash,fb,sig},nil
+}
+
+// Check the signature on the filter against the log's public key and return the cascade for querying
+// The caller should also check RootHash against a signed tree head it trusts for Revision
+func (f *SignedFilter) Verify(pub crypto.PublicKey) (*Cascade,error) {
+  head, err := marshalHead(f.Revision,f.RootHash,f.Filter)
+  if err != nil {return nil,err}
+  if err := signer.VerifySignature(pub,crypto.SHA256,head,f.Signature); err != nil {
+    return nil,fmt.Errorf("Invalid filter signature: %v",err)
+  }
+  var c Cascade
+  if err := c.UnmarshalBinary(f.Filter); err != nil {return nil,err}
+  return &c,nil
+}
+
+func marshalHead(revision uint64, rootHash []byte, filter []byte) ([]byte,error) {
+  h := sha256.Sum256(filter)
+  return tls.Marshal(FilterHeadV1{revision,rootHash,h[:]})
+}
+
+// Optimal bloom filter size for n elements at false positive rate p
+func newLevel(n int, p float64) Level {
+  if(n < 1) {n = 1}
+  m := math.Ceil(-float64(n)*math.Log(p)/(math.Ln2*math.Ln2))
+  k := math.Round(m/float64(n)*math.Ln2)
+  if(k < 1) {k = 1}
+  if(k > 32) {k = 32}
+  nbytes := int(math.Ceil(m/8))
+  return Level{uint8(k),make([]byte,nbytes)}
+}
+
+// k bit positions for serial from a single sha256, using double hashing
+// depth is mixed in so each level hashes independently
+func (l Level) positions(depth int, serial uint64) []uint64 {
+  var in [9]byte
+  in[0] = byte(depth)
+  binary.BigEndian.PutUint64(in[1:],serial)
+  d := sha256.Sum256(in[:])
+  h1 := binary.BigEndian.Uint64(d[0:8])
+  h2 := binary.BigEndian.Uint64(d[8:16])
+  m := uint64(len(l.Bits))*8
+  pos := make([]uint64,l.NumHashes)
+  for i := range(pos) {
+    pos[i] = (h1 + uint64(i)*h2) % m
+  }
+  return pos
+}
+
+func (l Level) add(depth int, serial uint64) {
+  for _,p := range(l.positions(depth,serial)) {
+    l.Bits[p/8] |= 1 << (p%8)
+  }
+}
+
+func (l Level) contains(depth int, serial uint64) bool {
+  for _,p := range(l.positions(depth,serial)) {
+    if(l.Bits[p/8] & (1 << (p%8)) == 0) {
+      return false
+    }
+  }
+  return true
+}
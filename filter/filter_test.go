@@ -0,0 +1,106 @@
+package filter
+
+import (
+  "crypto"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "strings"
+  "testing"
+  "revocation-server/signer"
+)
+
+// Serials from..to-1, every step-th
+func serials(from uint64, to uint64, step uint64) []uint64 {
+  var s []uint64
+  for i := from; i < to; i += step {
+    s = append(s,i)
+  }
+  return s
+}
+
+func TestBuild(t *testing.T) {
+  tests := []struct {
+    name string
+    revoked []uint64
+    issued []uint64 //not revoked
+    err string //empty if the cascade builds
+  }{
+    {"nothing", nil, nil, ""},
+    {"revoked without a registry", serials(0,100,1), nil, ""},
+    {"nothing revoked", nil, serials(0,1000,1), ""},
+    {"one revoked", []uint64{7}, serials(8,5000,1), ""},
+    {"tenth revoked", serials(0,20000,10), serials(1,20000,10), ""},
+    {"half revoked", serials(0,4000,2), serials(1,4000,2), ""},
+    {"sets overlap", []uint64{1,2,3}, []uint64{3,4,5}, "did not converge"},
+  }
+  for _,test := range(tests) {
+    c, err := Build(test.revoked,test.issued)
+    if(test.err != "") {
+      if(err == nil || !strings.Contains(err.Error(),test.err)) {
+        t.Errorf("%v: Build = %v, want an error containing %q",test.name,err,test.err)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("%v: Build = %v",test.name,err)
+      continue
+    }
+    // A client only has the serialized cascade
+    b, err := c.MarshalBinary()
+    if err != nil {t.Fatal(err)}
+    var decoded Cascade
+    if err := decoded.UnmarshalBinary(b); err != nil {t.Fatalf("%v: UnmarshalBinary = %v",test.name,err)}
+    for _,s := range(test.revoked) {
+      if(!decoded.Contains(s)) {
+        t.Errorf("%v: revoked serial %v not in the filter",test.name,s)
+        break
+      }
+    }
+    for _,s := range(test.issued) {
+      if(decoded.Contains(s)) {
+        t.Errorf("%v: issued serial %v in the filter",test.name,s)
+        break
+      }
+    }
+  }
+}
+
+func TestSignedFilter(t *testing.T) {
+  key, err := ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+  if err != nil {t.Fatal(err)}
+  other, err := ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+  if err != nil {t.Fatal(err)}
+  c, err := Build([]uint64{4,5},[]uint64{6,7})
+  if err != nil {t.Fatal(err)}
+  signed, err := Sign(c,3,[]byte("root hash"),signer.NewSigner(0,key,crypto.SHA256))
+  if err != nil {t.Fatal(err)}
+
+  tests := []struct {
+    name string
+    edit func(f *SignedFilter)
+    pub crypto.PublicKey
+    ok bool
+  }{
+    {"as signed", func(f *SignedFilter) {}, key.Public(), true},
+    {"another key", func(f *SignedFilter) {}, other.Public(), false},
+    {"revision changed", func(f *SignedFilter) {f.Revision++}, key.Public(), false},
+    {"root hash changed", func(f *SignedFilter) {f.RootHash = []byte("other root")}, key.Public(), false},
+    {"filter changed", func(f *SignedFilter) {
+      f.Filter = append([]byte(nil),f.Filter...)
+      f.Filter[len(f.Filter)-1] ^= 1
+    }, key.Public(), false},
+  }
+  for _,test := range(tests) {
+    f := *signed
+    test.edit(&f)
+    got, err := f.Verify(test.pub)
+    if(test.ok != (err == nil)) {
+      t.Errorf("%v: Verify = %v, want ok %v",test.name,err,test.ok)
+      continue
+    }
+    if(test.ok && (!got.Contains(4) || got.Contains(6))) {
+      t.Errorf("%v: verified cascade doesn't match the one signed",test.name)
+    }
+  }
+}
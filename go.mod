@@ -4,9 +4,14 @@ go 1.14
 
 require (
 	bitbucket.org/creachadair/shell v0.0.6
+	github.com/ghodss/yaml v1.0.0
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
+	github.com/golang/protobuf v1.3.1
 	github.com/google/certificate-transparency-go v1.1.0
-	github.com/kelseyhightower/envconfig v1.4.0 // indirect
+	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/prometheus/client_golang v0.9.4
 	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
+	google.golang.org/genproto v0.0.0-20190605220351-eb0b1bdb6ae6
+	google.golang.org/grpc v1.21.1
 )
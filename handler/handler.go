@@ -4,10 +4,21 @@ import (
   "encoding/json"
   "encoding/asn1"
   "encoding/binary"
+  "encoding/base64"
+  "encoding/pem"
+  "strings"
   "net/http"
   "revocation-server/types"
   "revocation-server/tree"
   "revocation-server/crypto/ocsp"
+  "revocation-server/crypto/crl"
+  "revocation-server/filter"
+  "revocation-server/registry"
+  "revocation-server/ctfeed"
+  "revocation-server/srt"
+  "revocation-server/api"
+  "revocation-server/metrics"
+  "revocation-server/sequencer"
   "fmt"
   "github.com/golang/glog"
   "crypto/x509"
@@ -15,16 +26,49 @@ import (
   "crypto/ecdsa"
   "io/ioutil"
   "time"
+  "sync"
 )
 
 type Handler struct {
   t *tree.MerkleTree
+  issued *registry.Registry //nil if issued serials are not tracked
+  feed *ctfeed.Follower //nil if not following a ct log
   cert *x509.Certificate
   key *ecdsa.PrivateKey
+  filters *filterCache
+  challenges *challengeStore //outstanding self revocation challenges
+  maxBatch int //most serials accepted in one bulk submission, 0 for no limit
+  sequencers []*sequencer.Sequencer //run by admin/integrate
+  leader func() string //url of the replica sequencing, when this one is on standby, may be nil
+  closing chan struct{} //closed by CloseWatches
+  closeWatches *sync.Once
 }
 
-func NewHandler(t *tree.MerkleTree, cert *x509.Certificate, key *ecdsa.PrivateKey) Handler {
-  return Handler{t,cert,key}
+// Filter for the latest revision, the cascade is only rebuilt once the tree or the issuance registry changes
+type filterCache struct {
+  sync.Mutex
+  f *filter.SignedFilter
+  issuedRevision uint64 //registry revision f was built from
+}
+
+// issued may be nil, in which case every serial not in the tree is reported as Good
+// feed may be nil, in which case revocations can't be submitted by certificate hash
+func NewHandler(t *tree.MerkleTree, issued *registry.Registry, feed *ctfeed.Follower, cert *x509.Certificate, key *ecdsa.PrivateKey) Handler {
+  return Handler{t: t, issued: issued, feed: feed, cert: cert, key: key, filters: &filterCache{}, challenges: newChallengeStore(), closing: make(chan struct{}), closeWatches: &sync.Once{}}
+}
+
+// Bound the serials in one post-multiple-revocations or import-crl request, 0 for no limit
+func (h *Handler) SetMaxBatch(n int) {
+  h.maxBatch = n
+}
+
+// Bulk submissions over the batch size are refused outright, the client should split them
+func (h *Handler) checkBatch(rw *http.ResponseWriter, n int) bool {
+  if(h.maxBatch > 0 && n > h.maxBatch) {
+    writeCodedError(rw, http.StatusRequestEntityTooLarge, api.CodeBatchTooLarge, fmt.Sprintf("%v serials in one request, at most %v are accepted", n, h.maxBatch), nil)
+    return false
+  }
+  return true
 }
 
 // get-sth, post-revocation, get-inclusion-proof are json-encoded
@@ -33,7 +77,7 @@ func NewHandler(t *tree.MerkleTree, cert *x509.Certificate, key *ecdsa.PrivateKe
 
 // Something to know is that for json decoding to work correctly, all struct var's must be capitalized
 type GetInclusionProofRequest struct {
-  Serial uint64
+  Serial uint64 `query:"serial"`
 }
 
 type GetInclusionProofResponse struct {
@@ -43,8 +87,28 @@ type GetInclusionProofResponse struct {
 // Ocsp Request/Response types defined in revocation-server/ocsp
 // asn.1/der encoded
 
+// Reason is an RFC 5280 reason code, 0 (unspecified) if left out
+// certificateHold puts the serial on hold until it is revoked or released with post-release
 type PostRevocationRequest struct {
   Serial uint64
+  Reason int
+}
+
+// Release a serial from hold, it is removed from the tree at the next integration
+type PostReleaseRequest struct {
+  Serial uint64
+}
+
+// Second of 0 means the current revision of the tree
+type GetConsistencyProofRequest struct {
+  First uint64 `query:"first"`
+  Second uint64 `query:"second"`
+}
+
+// Height is the depth of the leaves, for tree.VerifyConsistencyProof
+type GetConsistencyProofResponse struct {
+  Height int
+  Proof tree.ConsistencyProof
 }
 
 // for mass-revocation event, or for testing
@@ -52,18 +116,61 @@ type PostMultipleRevocationsRequest struct {
   Serials []uint64
 }
 
+// CertHash is the sha256 of the DER encoded certificate, as logged in the followed ct log
+// Certificate is the DER certificate itself, which is also found when the log only has its precertificate
+// One of the two is given
+type PostRevocationByHashRequest struct {
+  CertHash []byte `json:",omitempty"`
+  Certificate []byte `json:",omitempty"`
+}
+
+// Serials the CA has issued, recorded in the issuance registry
+type PostIssuanceRequest struct {
+  Serials []uint64
+}
+
 type ProofResponse struct {
   Proof [][]byte
 }
 
+type ImportCrlResponse struct {
+  Imported int
+  AlreadyRevoked int //entries for serials already revoked, or already queued
+  Released int //removeFromCRL entries of a delta crl, queued as releases of held serials
+  Skipped int //removeFromCRL entries of a complete crl, which only have meaning in a delta crl
+  Invalid []tree.SerialError `json:",omitempty"` //entries with a reason a revocation can't have, by index in the crl, left out of the import
+}
+
+// Crl's are DER encoded, see RFC 5280
+// Revision of 0 means the current revision of the tree
+type GetDeltaCrlRequest struct {
+  BaseRevision uint64 `query:"base_revision"`
+  Revision uint64 `query:"revision"`
+}
+
 func writeWrongMethodResponse(rw *http.ResponseWriter, allowed string) {
 	(*rw).Header().Add("Allow", allowed)
-	(*rw).WriteHeader(http.StatusMethodNotAllowed)
+	writeCodedError(rw, http.StatusMethodNotAllowed, api.CodeMethodNotAllowed, fmt.Sprintf("Method must be %v", allowed), nil)
 }
 
+// Error whose code follows from the status, see writeCodedError
 func writeErrorResponse(rw *http.ResponseWriter, status int, body string) {
-	(*rw).WriteHeader(status)
-	(*rw).Write([]byte(body))
+	writeCodedError(rw, status, api.CodeFor(status), body, nil)
+}
+
+// Error with a machine readable code, and details the client can act on (may be nil)
+// /v1 wraps them in an api.ErrorResponse, /new-ct writes details as json if there are any, otherwise the message
+func writeCodedError(rw *http.ResponseWriter, status int, code string, msg string, details interface{}) {
+  api.WriteError(*rw, status, code, msg, details)
+}
+
+// GET parameters come from the query string on /v1, and a json body on /new-ct
+// Everything else has a json body
+func decodeRequest(req *http.Request, v interface{}) error {
+  if(api.IsV1(req) && req.Method == "GET") {
+    return api.DecodeQuery(req.URL.Query(), v)
+  }
+  return json.NewDecoder(req.Body).Decode(v)
 }
 
 func (h *Handler) GetSth(rw http.ResponseWriter, req *http.Request) {
@@ -77,6 +184,7 @@ func (h *Handler) GetSth(rw http.ResponseWriter, req *http.Request) {
   sthData = h.t.GetSth()
   if(sthData==nil) {
     writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Sth is nil pointer"))
+    return
   }
 
   // convert to json
@@ -94,10 +202,9 @@ func (h *Handler) GetInclusionProof(rw http.ResponseWriter, req *http.Request) {
     return
   }
 
-  decoder := json.NewDecoder(req.Body)
   var p GetInclusionProofRequest
-  if err := decoder.Decode(&p); err != nil {
-    writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Invalid InclusionProofRequest: %v", err))
+  if err := decodeRequest(req, &p); err != nil {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid InclusionProofRequest: %v", err))
     return
   }
     
@@ -105,6 +212,7 @@ func (h *Handler) GetInclusionProof(rw http.ResponseWriter, req *http.Request) {
   proof, err := h.t.GetInclusionProof(serial)
   if err != nil {
     writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Unable to get inclusion proof from storage: %v", err))
+    return
   }
   proofResponse := &GetInclusionProofResponse{proof}
 
@@ -116,6 +224,36 @@ func (h *Handler) GetInclusionProof(rw http.ResponseWriter, req *http.Request) {
   }
 }
 
+// Changes between two revisions, and the hashes needed to check them against both signed roots
+func (h *Handler) GetConsistencyProof(rw http.ResponseWriter, req *http.Request) {
+  glog.V(1).Infoln("Received GetConsistencyProof Request")
+  if req.Method != "GET" {
+    writeWrongMethodResponse(&rw, "GET")
+    return
+  }
+
+  var c GetConsistencyProofRequest
+  if err := decodeRequest(req, &c); err != nil {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid GetConsistencyProof Request: %v", err))
+    return
+  }
+  if(c.Second == 0) {
+    c.Second = h.t.GetRevision()
+  }
+
+  proof, err := h.t.GetConsistencyProof(c.First, c.Second)
+  if err != nil {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Unable to get consistency proof: %v", err))
+    return
+  }
+
+  encoder := json.NewEncoder(rw)
+  if err := encoder.Encode(GetConsistencyProofResponse{h.t.GetHeight(), *proof}); err != nil {
+    writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode ConsistencyProof to return: %v", err))
+    return
+  }
+}
+
 func (h *Handler) PostRevocation(rw http.ResponseWriter, req *http.Request) {
   glog.V(1).Infoln("Received PostRevocation Request")
   if req.Method != "POST" {
@@ -123,18 +261,50 @@ func (h *Handler) PostRevocation(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	decoder := json.NewDecoder(req.Body)
 	var a PostRevocationRequest
-	if err := decoder.Decode(&a); err != nil {
+	if err := decodeRequest(req, &a); err != nil {
 		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid AddRevocation Request: %v", err))
 		return
 	}
+  if(!ValidReason(a.Reason)) {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid revocation reason %v", a.Reason))
+    return
+  }
 
-	if err := h.t.AddNode(a.Serial); err != nil {
-		writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Unable to store revocation: %v", err))
+	submission, err := h.t.AddNode(tree.Revocation{Serial: a.Serial, Reason: a.Reason, RevokedAt: time.Now()})
+	if err != nil {
+		h.writeSubmissionError(&rw, err, "Unable to store revocation")
 		return
 	}
-	rw.WriteHeader(http.StatusOK)
+	h.writeReceipt(&rw, submission)
+}
+
+// Reason codes a revocation can be submitted with
+// 7 is unused by RFC 5280, and removeFromCRL is only used by post-release
+func ValidReason(reason int) bool {
+  return reason >= ocsp.Unspecified && reason <= ocsp.AACompromise && reason != 7 && reason != ocsp.RemoveFromCRL
+}
+
+// Release a serial that was revoked with reason certificateHold
+func (h *Handler) PostRelease(rw http.ResponseWriter, req *http.Request) {
+  glog.V(1).Infoln("Received PostRelease Request")
+  if req.Method != "POST" {
+    writeWrongMethodResponse(&rw, "POST")
+    return
+  }
+
+  var a PostReleaseRequest
+  if err := decodeRequest(req, &a); err != nil {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid PostRelease Request: %v", err))
+    return
+  }
+
+  submission, err := h.t.AddNode(tree.Revocation{Serial: a.Serial, Reason: ocsp.RemoveFromCRL, RevokedAt: time.Now()})
+  if err != nil {
+    h.writeSubmissionError(&rw, err, "Unable to release serial")
+    return
+  }
+  h.writeReceipt(&rw, submission)
 }
 
 func (h *Handler) PostMultipleRevocations(rw http.ResponseWriter, req *http.Request) {
@@ -144,32 +314,121 @@ func (h *Handler) PostMultipleRevocations(rw http.ResponseWriter, req *http.Requ
 		return
 	}
 
-	decoder := json.NewDecoder(req.Body)
 	var a PostMultipleRevocationsRequest
-	if err := decoder.Decode(&a); err != nil {
+	if err := decodeRequest(req, &a); err != nil {
 		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid AddRevocations Request: %v", err))
 		return
 	}
 
-  for _,s := range(a.Serials) {
-	  if err := h.t.AddNode(s); err != nil {
-		  writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Unable to store revocation: %v", err))
-		  return
-	  }
+  if(!h.checkBatch(&rw, len(a.Serials))) {
+    return
+  }
+
+  // Queue the whole batch or none of it
+  now := time.Now()
+  revocations := make([]tree.Revocation, len(a.Serials))
+  for i,s := range(a.Serials) {
+    revocations[i] = tree.Revocation{Serial: s, Reason: ocsp.Unspecified, RevokedAt: now}
+  }
+  submissions, err := h.t.AddNodes(revocations)
+  if serr, ok := err.(*tree.SubmissionError); ok {
+    writeCodedError(&rw, http.StatusBadRequest, api.CodeInvalidSubmission, serr.Error(), serr)
+    return
+  } else if err != nil {
+    h.writeSubmissionError(&rw, err, "Unable to store revocations")
+    return
+  }
+
+  var resp PostMultipleRevocationsResponse
+  for _,s := range(submissions) {
+    result := SubmissionResult{Serial: s.Receipt.Serial, Status: s.Status}
+    if(s.Receipt.ID != "") {
+      result.Timestamp, err = srt.Sign(s.Receipt, h.t.GetSigner())
+      if err != nil {
+        writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Unable to sign receipt: %v", err))
+        return
+      }
+    }
+    resp.Results = append(resp.Results, result)
+  }
+
+  encoder := json.NewEncoder(rw)
+  if err := encoder.Encode(resp); err != nil {
+    writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode receipts to return: %v", err))
+    return
   }
-	rw.WriteHeader(http.StatusOK)
 }
 
+// Revoke a certificate seen in the ct log by its hash, rather than its serial
+func (h *Handler) PostRevocationByHash(rw http.ResponseWriter, req *http.Request) {
+  glog.V(1).Infoln("Received PostRevocationByHash Request")
+  if req.Method != "POST" {
+    writeWrongMethodResponse(&rw, "POST")
+    return
+  }
+  if(h.feed == nil) {
+    writeCodedError(&rw, http.StatusNotFound, api.CodeNotEnabled, "Not following a ct log, revoke by serial instead", nil)
+    return
+  }
+
+  var a PostRevocationByHashRequest
+  if err := decodeRequest(req, &a); err != nil {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid PostRevocationByHash Request: %v", err))
+    return
+  }
+
+  var serial uint64
+  if(len(a.Certificate) > 0) {
+    var ok bool
+    var err error
+    serial, ok, err = h.feed.LookupCertificate(a.Certificate)
+    if err != nil {
+      writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid PostRevocationByHash Request: %v", err))
+      return
+    }
+    if(!ok) {
+      writeErrorResponse(&rw, http.StatusNotFound, "Certificate, or its precertificate, not seen in ct log")
+      return
+    }
+  } else {
+    var ok bool
+    serial, ok = h.feed.LookupSerial(a.CertHash)
+    if(!ok) {
+      writeErrorResponse(&rw, http.StatusNotFound, fmt.Sprintf("No certificate with hash %x seen in ct log", a.CertHash))
+      return
+    }
+  }
+  glog.V(3).Infof("Certificate has serial %v\n", serial)
+
+  submission, err := h.t.AddNode(tree.Revocation{Serial: serial, Reason: ocsp.Unspecified, RevokedAt: time.Now()})
+  if err != nil {
+    h.writeSubmissionError(&rw, err, "Unable to store revocation")
+    return
+  }
+  h.writeReceipt(&rw, submission)
+}
+
+// On /v1 the request is POSTed, or base64 encoded in the request parameter of a GET, as in RFC 6960 appendix A
 func (h *Handler) GetOcsp(rw http.ResponseWriter, req *http.Request) {
   glog.V(1).Infoln("Received GetOcsp Request")
-  if req.Method != "GET" {
-		writeWrongMethodResponse(&rw, "GET")
+  if(req.Method != "GET" && !(api.IsV1(req) && req.Method == "POST")) {
+    if(api.IsV1(req)) {
+      writeWrongMethodResponse(&rw, "GET, POST")
+    } else {
+      writeWrongMethodResponse(&rw, "GET")
+    }
 		return
 	}
 
+  // Counted as an error unless a response is written
+  outcome := "error"
+  defer func() {
+    metrics.OcspResponses.WithLabelValues(outcome).Inc()
+  }()
+
   glog.V(3).Infoln("Reading request body")
   var parsed *ocsp.Request
-  body, err := ioutil.ReadAll(req.Body)
+  body, err := readOcspRequest(req)
   if err != nil {
 		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("error reading body: %v", err))
 		return
@@ -187,21 +446,11 @@ func (h *Handler) GetOcsp(rw http.ResponseWriter, req *http.Request) {
   serial := uint64(binary.BigEndian.Uint64(serialb))
   glog.V(3).Infof("Got serial from request %v\n",serialb)
 
-  // Check if revoked
-  revoked,err := h.t.GetRevocationValue(serial)
-  if err != nil {
-		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Error while checking revocation value corresponding to serial: %v", err))
-		return
-	}
-
+  // Check if revoked, and get the reason and proof from the same root
+  leaf := h.t.GetLeafStatus(serial)
+  revoked, revocation, proof := leaf.Present, leaf.Revocation, leaf.Proof
   glog.V(3).Infof("Revocation value is %v\n",revoked)
 
-  // Get proof
-  proof, err := h.t.GetInclusionProof(serial)
-  if err != nil {
-    writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Unable to get inclusion proof from storage: %v", err))
-  }
-
   glog.V(3).Infof("Length of proof = %v bytes\n",len(proof))
 
   // chose oid for "Transparency Information X.509v3 extension"
@@ -221,30 +470,386 @@ func (h *Handler) GetOcsp(rw http.ResponseWriter, req *http.Request) {
   proofextarray := []pkix.Extension{proofext}
 
   // Marshal response
+  // Serials the CA never issued are unknown (RFC 6960 2.2), when issued serials are tracked
   var status int
   if(revoked == true) {
     status = ocsp.Revoked
   } else {
     status = ocsp.Good
+    if(h.issued != nil) {
+      issued, err := h.issued.IsIssued(serial)
+      if err != nil {
+        writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Error while checking issuance registry: %v", err))
+        return
+      }
+      if(!issued) {
+        status = ocsp.Unknown
+      }
+    }
   }
 
+  thisUpdate, nextUpdate := leaf.ThisUpdate, leaf.NextUpdate
   rtemplate := ocsp.Response{
     Status:           status,
 		SerialNumber:     serialb,
 		Certificate:      h.cert,
-		RevocationReason: ocsp.Unspecified,
+		RevocationReason: revocation.Reason,
 		IssuerHash:       parsed.HashAlgorithm,
-		RevokedAt:        time.Time{}, //nil time, our implementation does not support time of revocation
-		ThisUpdate:       h.t.LastUpdated,
-		NextUpdate: h.t.NextUpdate,
+		RevokedAt:        revocation.RevokedAt,
+		ThisUpdate:       thisUpdate,
+		NextUpdate:       nextUpdate,
 		Extensions: exts,
     ExtraExtensions: proofextarray,
   }
 
+  signStart := time.Now()
   resp, err := ocsp.CreateResponse(h.cert,rtemplate,h.key)
+  metrics.ObserveSigning("ocsp", signStart)
   if err != nil {
     writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Error marshalling response to asn1: %v", err))
+    return
   }
 
+  rw.Header().Set("Content-Type", api.ContentOcsp)
   rw.Write(resp)
+  outcome = ocspStatus(status)
+}
+
+// Label for the status of an OCSP response in metrics
+func ocspStatus(status int) string {
+  switch status {
+  case ocsp.Good:
+    return "good"
+  case ocsp.Revoked:
+    return "revoked"
+  default:
+    return "unknown"
+  }
+}
+
+func readOcspRequest(req *http.Request) ([]byte, error) {
+  if(!api.IsV1(req) || req.Method == "POST") {
+    return ioutil.ReadAll(req.Body)
+  }
+  var q struct {
+    Request string `query:"request"`
+  }
+  if err := api.DecodeQuery(req.URL.Query(), &q); err != nil {
+    return nil, err
+  }
+  // Either base64 alphabet, padded or not, since the padding is often lost to url encoding
+  encoded := strings.TrimRight(q.Request, "=")
+  if(strings.ContainsAny(encoded, "-_")) {
+    return base64.RawURLEncoding.DecodeString(encoded)
+  }
+  return base64.RawStdEncoding.DecodeString(encoded)
+}
+
+// Complete crl of every serial revoked (or on hold) as of the current revision
+// crl number is the revision of the tree
+func (h *Handler) GetCrl(rw http.ResponseWriter, req *http.Request) {
+  glog.V(1).Infoln("Received GetCrl Request")
+  if req.Method != "GET" {
+    writeWrongMethodResponse(&rw, "GET")
+    return
+  }
+
+  revocations, revision := h.t.GetRevocations()
+  thisUpdate, nextUpdate, err := h.t.GetUpdateTimesAt(revision)
+  if err != nil {
+    writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Unable to get the update times of revision %v: %v", revision, err))
+    return
+  }
+  var entries []crl.Entry
+  for _,r := range(revocations) {
+    entries = append(entries, crl.Entry{Serial: r.Serial, RevokedAt: r.RevokedAt, Reason: r.Reason})
+  }
+
+  template := crl.Template{
+    Number: revision,
+    ThisUpdate: thisUpdate,
+    NextUpdate: nextUpdate,
+    Entries: entries,
+  }
+  writeCrl(&rw, req, h, template)
+}
+
+// Delta crl listing serials changed after BaseRevision, up to and including Revision
+// The delta is relative to the complete crl numbered BaseRevision
+// Serials released from hold are listed with reason removeFromCRL (RFC 5280 5.3.1)
+func (h *Handler) GetDeltaCrl(rw http.ResponseWriter, req *http.Request) {
+  glog.V(1).Infoln("Received GetDeltaCrl Request")
+  if req.Method != "GET" {
+    writeWrongMethodResponse(&rw, "GET")
+    return
+  }
+
+  var d GetDeltaCrlRequest
+  if err := decodeRequest(req, &d); err != nil {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid GetDeltaCrl Request: %v", err))
+    return
+  }
+
+  if(d.Revision == 0) {
+    d.Revision = h.t.GetRevision()
+  }
+  if(d.BaseRevision >= d.Revision) {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Base revision %v must be before revision %v", d.BaseRevision, d.Revision))
+    return
+  }
+
+  batches, err := h.t.GetBatches(d.BaseRevision,d.Revision)
+  if err != nil {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Unable to get revocations between revisions: %v", err))
+    return
+  }
+
+  // Times come from the signed root of Revision, like the complete crl of that revision
+  thisUpdate, nextUpdate, err := h.t.GetUpdateTimesAt(d.Revision)
+  if err != nil {
+    writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Unable to get the update times of revision %v: %v", d.Revision, err))
+    return
+  }
+  template := crl.Template{
+    Number: d.Revision,
+    Delta: true,
+    BaseNumber: d.BaseRevision,
+    ThisUpdate: thisUpdate,
+    NextUpdate: nextUpdate,
+    Entries: crlEntries(batches),
+  }
+  writeCrl(&rw, req, h, template)
+}
+
+// One entry per serial whose state changed across the batches
+// A release carries reason removeFromCRL and the time it was submitted
+func crlEntries(batches []tree.Batch) []crl.Entry {
+  var entries []crl.Entry
+  for _,c := range(tree.NetChanges(batches)) {
+    r := c.New
+    entries = append(entries, crl.Entry{Serial: r.Serial, RevokedAt: r.RevokedAt, Reason: r.Reason})
+  }
+  return entries
+}
+
+// DER, unless a /v1 client asked for PEM
+func writeCrl(rw *http.ResponseWriter, req *http.Request, h *Handler, template crl.Template) {
+  start := time.Now()
+  resp, err := crl.CreateCRL(h.cert, template, h.key)
+  metrics.ObserveSigning("crl", start)
+  if err != nil {
+    writeErrorResponse(rw, http.StatusInternalServerError, fmt.Sprintf("Error creating crl: %v", err))
+    return
+  }
+  if(api.ContentType(req) == api.ContentPem) {
+    (*rw).Header().Set("Content-Type", api.ContentPem)
+    pem.Encode(*rw, &pem.Block{Type: "X509 CRL", Bytes: resp})
+    return
+  }
+  (*rw).Header().Set("Content-Type", api.ContentCrl)
+  (*rw).Write(resp)
+}
+
+// Admin endpoint to bootstrap the tree from a CA's existing crl
+// Body is a DER or PEM encoded crl, which must be signed by the configured issuer cert
+// In a delta crl removeFromCRL entries release held serials, in a complete crl they are skipped
+// Entries with an invalid reason are reported and left out, the rest are queued in a single AddNodes call,
+// so either all of them are imported or none of them
+func (h *Handler) ImportCrl(rw http.ResponseWriter, req *http.Request) {
+  glog.V(1).Infoln("Received ImportCrl Request")
+  if req.Method != "POST" {
+    writeWrongMethodResponse(&rw, "POST")
+    return
+  }
+
+  body, err := ioutil.ReadAll(req.Body)
+  if err != nil {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("error reading body: %v", err))
+    return
+  }
+
+  list, err := crl.ParseCRL(body, h.cert)
+  if err != nil {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid crl: %v", err))
+    return
+  }
+  glog.V(2).Infof("Parsed crl number %v (delta %v) with %v entries\n", list.Number, list.Delta, len(list.Entries))
+
+  var result ImportCrlResponse
+  var revocations []tree.Revocation
+  for i,e := range(list.Entries) {
+    switch {
+    case e.Reason == ocsp.RemoveFromCRL && !list.Delta:
+      result.Skipped++
+      continue
+    case e.Reason != ocsp.RemoveFromCRL && !ValidReason(e.Reason):
+      result.Invalid = append(result.Invalid, tree.SerialError{Index: i, Serial: e.Serial, Err: fmt.Sprintf("Invalid revocation reason %v", e.Reason)})
+      continue
+    }
+    revocations = append(revocations, tree.Revocation{Serial: e.Serial, Reason: e.Reason, RevokedAt: e.RevokedAt})
+  }
+  if(!h.checkBatch(&rw, len(revocations))) {
+    return
+  }
+
+  submissions, err := h.t.AddNodes(revocations)
+  if serr, ok := err.(*tree.SubmissionError); ok {
+    writeCodedError(&rw, http.StatusBadRequest, api.CodeInvalidSubmission, serr.Error(), serr)
+    return
+  } else if err != nil {
+    h.writeSubmissionError(&rw, err, "Unable to store revocations")
+    return
+  }
+  for _,s := range(submissions) {
+    switch {
+    case s.Status != tree.SubmissionQueued:
+      result.AlreadyRevoked++
+    case s.Receipt.Reason == ocsp.RemoveFromCRL:
+      result.Released++
+    default:
+      result.Imported++
+    }
+  }
+
+  encoder := json.NewEncoder(rw)
+  if err := encoder.Encode(result); err != nil {
+    writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode ImportCrl response: %v", err))
+    return
+  }
+}
+
+// Signed bloom filter cascade of the revoked serials, bound to the root hash at the current revision
+// See filter.SignedFilter.Verify and filter.Cascade.Contains for the client side
+func (h *Handler) GetFilter(rw http.ResponseWriter, req *http.Request) {
+  glog.V(1).Infoln("Received GetFilter Request")
+  if req.Method != "GET" {
+    writeWrongMethodResponse(&rw, "GET")
+    return
+  }
+
+  // Only serials known to be issued can be tested negative, so the filter needs the registry
+  if(h.issued == nil) {
+    writeCodedError(&rw, http.StatusNotFound, api.CodeNotEnabled, "Filters need the issuance registry, which is not enabled", nil)
+    return
+  }
+
+  h.filters.Lock()
+  defer h.filters.Unlock()
+  if(h.filters.f == nil || h.filters.f.Revision != h.t.GetRevision() || h.filters.issuedRevision != h.issued.GetTree().GetRevision()) {
+    f, issuedRevision, err := h.buildFilter()
+    if err != nil {
+      writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Unable to build filter: %v", err))
+      return
+    }
+    h.filters.f, h.filters.issuedRevision = f, issuedRevision
+  }
+
+  encoder := json.NewEncoder(rw)
+  if err := encoder.Encode(*h.filters.f); err != nil {
+    writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode filter to return: %v", err))
+    return
+  }
+}
+
+// Cascade of the revoked serials against the issued ones that aren't revoked, and the registry revision they were read at
+func (h *Handler) buildFilter() (*filter.SignedFilter, uint64, error) {
+  revoked, revision, rootHash := h.t.GetRevokedSerials()
+  glog.V(2).Infof("Building filter for revision %v with %v revoked serials\n", revision, len(revoked))
+
+  isRevoked := make(map[uint64]bool, len(revoked))
+  for _,s := range(revoked) {
+    isRevoked[s] = true
+  }
+
+  // Only serials known to be issued and not revoked need to test negative
+  var issued []uint64
+  all, issuedRevision := h.issued.GetIssuedSerials()
+  for _,s := range(all) {
+    if(!isRevoked[s]) {
+      issued = append(issued, s)
+    }
+  }
+
+  c, err := filter.Build(revoked, issued)
+  if err != nil {
+    return nil, 0, err
+  }
+  glog.V(2).Infof("Filter has %v levels\n", len(c.Levels))
+  f, err := filter.Sign(c, revision, rootHash, h.t.GetSigner())
+  return f, issuedRevision, err
+}
+
+func (h *Handler) PostIssuance(rw http.ResponseWriter, req *http.Request) {
+  glog.V(1).Infoln("Received PostIssuance Request")
+  if req.Method != "POST" {
+    writeWrongMethodResponse(&rw, "POST")
+    return
+  }
+  if(h.issued == nil) {
+    writeCodedError(&rw, http.StatusNotFound, api.CodeNotEnabled, "Issuance registry is not enabled", nil)
+    return
+  }
+
+  var p PostIssuanceRequest
+  if err := decodeRequest(req, &p); err != nil {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid PostIssuance Request: %v", err))
+    return
+  }
+
+  if err := h.issued.AddIssued(p.Serials); err != nil {
+    h.writeSubmissionError(&rw, err, "Unable to store issuance")
+    return
+  }
+  rw.WriteHeader(http.StatusOK)
+}
+
+// Signed root of the issuance registry, its Metadata is registry.MetadataFor the handler's issuer
+func (h *Handler) GetIssuanceSth(rw http.ResponseWriter, req *http.Request) {
+  glog.V(1).Infoln("Received GetIssuanceSth Request")
+  if req.Method != "GET" {
+    writeWrongMethodResponse(&rw, "GET")
+    return
+  }
+  if(h.issued == nil) {
+    writeCodedError(&rw, http.StatusNotFound, api.CodeNotEnabled, "Issuance registry is not enabled", nil)
+    return
+  }
+
+  sthData := h.issued.GetTree().GetSth()
+  encoder := json.NewEncoder(rw)
+  if err := encoder.Encode(*sthData); err != nil {
+    writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode STH to return: %v", err))
+    return
+  }
+}
+
+// Same request/response as get-inclusion-proof, against the issuance registry
+func (h *Handler) GetIssuanceProof(rw http.ResponseWriter, req *http.Request) {
+  glog.V(1).Infoln("Received GetIssuanceProof Request")
+  if req.Method != "GET" {
+    writeWrongMethodResponse(&rw, "GET")
+    return
+  }
+  if(h.issued == nil) {
+    writeCodedError(&rw, http.StatusNotFound, api.CodeNotEnabled, "Issuance registry is not enabled", nil)
+    return
+  }
+
+  var p GetInclusionProofRequest
+  if err := decodeRequest(req, &p); err != nil {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid InclusionProofRequest: %v", err))
+    return
+  }
+
+  proof, err := h.issued.GetTree().GetInclusionProof(p.Serial)
+  if err != nil {
+    writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Unable to get inclusion proof from storage: %v", err))
+    return
+  }
+
+  encoder := json.NewEncoder(rw)
+  if err := encoder.Encode(GetInclusionProofResponse{proof}); err != nil {
+    writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode InclusionProof to return: %v", err))
+    return
+  }
 }
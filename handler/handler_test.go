@@ -0,0 +1,390 @@
+package handler
+
+import (
+  "bytes"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/json"
+  "math/big"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+  "revocation-server/api"
+  "revocation-server/crypto/crl"
+  "revocation-server/crypto/ocsp"
+  "revocation-server/filter"
+  "revocation-server/registry"
+  "revocation-server/srt"
+  "revocation-server/tree"
+  "revocation-server/tree/treetest"
+)
+
+// A self signed issuer, signing the tree's roots and the crl's with the same key like the server does
+func newTestIssuer(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+  key, err := ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+  if err != nil {t.Fatal(err)}
+  template := &x509.Certificate{
+    SerialNumber: big.NewInt(1),
+    Subject: pkix.Name{CommonName: "Test CA"},
+    NotBefore: time.Now().Add(-time.Hour),
+    NotAfter: time.Now().Add(time.Hour),
+    IsCA: true,
+    BasicConstraintsValid: true,
+    KeyUsage: x509.KeyUsageCertSign|x509.KeyUsageCRLSign,
+  }
+  der, err := x509.CreateCertificate(rand.Reader,template,template,&key.PublicKey,key)
+  if err != nil {t.Fatal(err)}
+  cert, err := x509.ParseCertificate(der)
+  if err != nil {t.Fatal(err)}
+  return cert, key
+}
+
+func newTestHandler(t *testing.T) (Handler, *tree.MerkleTree) {
+  cert, key := newTestIssuer(t)
+  mt := treetest.NewTreeWith(treetest.SignerFor(key))
+  return NewHandler(mt,nil,nil,cert,key), mt
+}
+
+// Queue rs and integrate them as one batch, the next revision
+func integrate(t *testing.T, mt *tree.MerkleTree, rs ...tree.Revocation) {
+  if _, err := mt.AddNodes(rs); err != nil {t.Fatal(err)}
+  if err := mt.IntegrateQueue(); err != nil {t.Fatal(err)}
+}
+
+func serve(handler http.HandlerFunc, method string, body []byte) *httptest.ResponseRecorder {
+  rw := httptest.NewRecorder()
+  handler(rw,httptest.NewRequest(method,"/",bytes.NewReader(body)))
+  return rw
+}
+
+// Call handler with a json body, failing unless it answers 200
+func call(t *testing.T, handler http.HandlerFunc, method string, body interface{}) []byte {
+  b, err := json.Marshal(body)
+  if err != nil {t.Fatal(err)}
+  rw := serve(handler,method,b)
+  if(rw.Code != http.StatusOK) {
+    t.Fatalf("%v %+v = %v %s",method,body,rw.Code,rw.Body.Bytes())
+  }
+  return rw.Body.Bytes()
+}
+
+func TestCrlUpdateTimes(t *testing.T) {
+  h, mt := newTestHandler(t)
+  mt.SetUpdateInterval(10*time.Minute)
+  now := time.Now()
+  integrate(t,mt,tree.Revocation{Serial: 5, Reason: ocsp.KeyCompromise, RevokedAt: now},tree.Revocation{Serial: 7, Reason: ocsp.CertificateHold, RevokedAt: now})
+  integrate(t,mt,tree.Revocation{Serial: 6, RevokedAt: now},tree.Revocation{Serial: 7, Reason: ocsp.RemoveFromCRL, RevokedAt: now})
+  // A later root of the same revision moves both times on
+  time.Sleep(1100*time.Millisecond)
+  if err := mt.SignRoot(); err != nil {t.Fatal(err)}
+
+  complete, err := crl.ParseCRL(call(t,h.GetCrl,"GET",nil),h.cert)
+  if err != nil {t.Fatal(err)}
+  delta, err := crl.ParseCRL(call(t,h.GetDeltaCrl,"GET",GetDeltaCrlRequest{BaseRevision: 1, Revision: 2}),h.cert)
+  if err != nil {t.Fatal(err)}
+  if(!delta.Delta || delta.Number != 2 || delta.BaseNumber != 1) {
+    t.Errorf("delta crl is number %v on base %v (delta %v), want 2 on base 1",delta.Number,delta.BaseNumber,delta.Delta)
+  }
+  if(!delta.ThisUpdate.Equal(complete.ThisUpdate) || !delta.NextUpdate.Equal(complete.NextUpdate)) {
+    t.Errorf("delta crl of revision 2 updated %v, next %v, complete crl %v, next %v",delta.ThisUpdate,delta.NextUpdate,complete.ThisUpdate,complete.NextUpdate)
+  }
+  want := map[uint64]int{6: ocsp.Unspecified, 7: ocsp.RemoveFromCRL}
+  if(len(delta.Entries) != len(want)) {
+    t.Errorf("delta crl has %v entries, want %v",len(delta.Entries),len(want))
+  }
+  for _,e := range(delta.Entries) {
+    if reason, ok := want[e.Serial]; !ok || reason != e.Reason {
+      t.Errorf("delta crl lists serial %v with reason %v",e.Serial,e.Reason)
+    }
+  }
+
+  // An earlier revision keeps the times of its own root
+  old, err := crl.ParseCRL(call(t,h.GetDeltaCrl,"GET",GetDeltaCrlRequest{BaseRevision: 0, Revision: 1}),h.cert)
+  if err != nil {t.Fatal(err)}
+  if(!old.ThisUpdate.Before(complete.ThisUpdate) || old.NextUpdate.Sub(old.ThisUpdate) != 10*time.Minute) {
+    t.Errorf("delta crl of revision 1 updated %v, next %v, want a root from before %v valid for 10m",old.ThisUpdate,old.NextUpdate,complete.ThisUpdate)
+  }
+}
+
+func TestImportCrl(t *testing.T) {
+  h, mt := newTestHandler(t)
+  revokedAt := time.Date(2020,1,2,3,4,5,0,time.UTC)
+  sign := func(template crl.Template) []byte {
+    template.ThisUpdate, template.NextUpdate = time.Now(), time.Now().Add(time.Hour)
+    der, err := crl.CreateCRL(h.cert,template,h.key)
+    if err != nil {t.Fatal(err)}
+    return der
+  }
+  entry := func(serial uint64, reason int) crl.Entry {
+    return crl.Entry{Serial: serial, RevokedAt: revokedAt, Reason: reason}
+  }
+  importCrl := func(der []byte) ImportCrlResponse {
+    var result ImportCrlResponse
+    rw := serve(h.ImportCrl,"POST",der)
+    if(rw.Code != http.StatusOK) {t.Fatalf("ImportCrl = %v %s",rw.Code,rw.Body.Bytes())}
+    if err := json.Unmarshal(rw.Body.Bytes(),&result); err != nil {t.Fatal(err)}
+    if err := mt.IntegrateQueue(); err != nil {t.Fatal(err)}
+    return result
+  }
+
+  complete := sign(crl.Template{Number: 1, Entries: []crl.Entry{
+    entry(5,ocsp.KeyCompromise),
+    entry(7,ocsp.CertificateHold),
+    entry(8,ocsp.CertificateHold),
+    entry(9,7),
+    entry(10,11),
+    entry(11,ocsp.RemoveFromCRL),
+  }})
+  result := importCrl(complete)
+  if(result.Imported != 3 || result.Skipped != 1 || result.Released != 0 || result.AlreadyRevoked != 0) {
+    t.Errorf("complete crl import = %+v, want 3 imported and 1 skipped",result)
+  }
+  if(len(result.Invalid) != 2 || result.Invalid[0].Index != 3 || result.Invalid[0].Serial != 9 || result.Invalid[1].Index != 4 || result.Invalid[1].Serial != 10) {
+    t.Errorf("invalid entries = %+v, want entries 3 and 4 (serials 9 and 10)",result.Invalid)
+  }
+
+  delta := sign(crl.Template{Number: 2, Delta: true, BaseNumber: 1, Entries: []crl.Entry{
+    entry(5,ocsp.KeyCompromise),
+    entry(7,ocsp.RemoveFromCRL),
+    entry(8,ocsp.Superseded),
+  }})
+  result = importCrl(delta)
+  if(result.Imported != 1 || result.Released != 1 || result.AlreadyRevoked != 1 || result.Skipped != 0 || len(result.Invalid) != 0) {
+    t.Errorf("delta crl import = %+v, want 1 imported, 1 released and 1 already revoked",result)
+  }
+
+  tests := []struct {
+    serial uint64
+    present bool
+    reason int
+  }{
+    {5, true, ocsp.KeyCompromise},
+    {7, false, 0},
+    {8, true, ocsp.Superseded},
+    {9, false, 0},
+    {10, false, 0},
+    {11, false, 0},
+  }
+  for _,test := range(tests) {
+    r, ok := mt.GetRevocation(test.serial)
+    if(ok != test.present || (ok && (r.Reason != test.reason || !r.RevokedAt.Equal(revokedAt)))) {
+      t.Errorf("serial %v after import = %+v,%v, want present %v with reason %v revoked at %v",test.serial,r,ok,test.present,test.reason,revokedAt)
+    }
+  }
+
+  // A release of a serial that isn't on hold means the delta isn't on top of what was imported, nothing is queued
+  rw := serve(h.ImportCrl,"POST",sign(crl.Template{Number: 3, Delta: true, BaseNumber: 2, Entries: []crl.Entry{entry(12,ocsp.KeyCompromise),entry(13,ocsp.RemoveFromCRL)}}))
+  if(rw.Code != http.StatusBadRequest) {
+    t.Errorf("delta releasing a serial not on hold = %v %s, want 400",rw.Code,rw.Body.Bytes())
+  }
+  if(mt.GetQueueLength() != 0) {
+    t.Errorf("%v revocations queued by a refused import",mt.GetQueueLength())
+  }
+
+  // Only crl's signed by the issuer are imported
+  other, key := newTestIssuer(t)
+  forged, err := crl.CreateCRL(other,crl.Template{Number: 4, ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour), Entries: []crl.Entry{entry(14,ocsp.KeyCompromise)}},key)
+  if err != nil {t.Fatal(err)}
+  if rw := serve(h.ImportCrl,"POST",forged); rw.Code != http.StatusBadRequest {
+    t.Errorf("crl from another issuer = %v %s, want 400",rw.Code,rw.Body.Bytes())
+  }
+}
+
+func TestGetFilter(t *testing.T) {
+  h, mt := newTestHandler(t)
+  if rw := serve(h.GetFilter,"GET",nil); rw.Code != http.StatusNotFound {
+    t.Errorf("GetFilter without the issuance registry = %v %s, want 404",rw.Code,rw.Body.Bytes())
+  }
+
+  issued := registry.New(1000,time.Hour,mt.GetSigner())
+  h.issued = issued
+  if err := issued.AddIssued([]uint64{4,5,6}); err != nil {t.Fatal(err)}
+  if err := issued.GetTree().IntegrateQueue(); err != nil {t.Fatal(err)}
+  integrate(t,mt,tree.Revocation{Serial: 5, RevokedAt: time.Now()})
+
+  // Tested against the latest issued serials, and rebuilt once the registry moves on
+  check := func(want map[uint64]bool) {
+    var f filter.SignedFilter
+    if err := json.Unmarshal(call(t,h.GetFilter,"GET",nil),&f); err != nil {t.Fatal(err)}
+    c, err := f.Verify(h.key.Public())
+    if err != nil {t.Fatal(err)}
+    if(f.Revision != mt.GetRevision()) {
+      t.Errorf("filter at revision %v, tree at %v",f.Revision,mt.GetRevision())
+    }
+    for serial, revoked := range(want) {
+      if(c.Contains(serial) != revoked) {
+        t.Errorf("filter Contains(%v) = %v, want %v",serial,!revoked,revoked)
+      }
+    }
+  }
+  check(map[uint64]bool{4: false, 5: true, 6: false})
+  if err := issued.AddIssued([]uint64{7}); err != nil {t.Fatal(err)}
+  if err := issued.GetTree().IntegrateQueue(); err != nil {t.Fatal(err)}
+  integrate(t,mt,tree.Revocation{Serial: 6, RevokedAt: time.Now()})
+  check(map[uint64]bool{4: false, 5: true, 6: true, 7: false})
+}
+
+// A standby replica answers not_leader without using up the challenge, which still works once it is leader
+func TestSelfRevocationStandby(t *testing.T) {
+  h, mt := newTestHandler(t)
+  h.SetLeader(func() string {return "https://leader"})
+  leafKey, err := ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+  if err != nil {t.Fatal(err)}
+  template := &x509.Certificate{SerialNumber: big.NewInt(42), Subject: pkix.Name{CommonName: "subscriber"}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+  leaf, err := x509.CreateCertificate(rand.Reader,template,h.cert,&leafKey.PublicKey,h.key)
+  if err != nil {t.Fatal(err)}
+
+  var challenge GetRevocationChallengeResponse
+  if err := json.Unmarshal(call(t,h.GetRevocationChallenge,"GET",nil),&challenge); err != nil {t.Fatal(err)}
+  signature, err := SignSelfRevocation(challenge.Challenge,leaf,leafKey)
+  if err != nil {t.Fatal(err)}
+  body, err := json.Marshal(PostSelfRevocationRequest{Certificate: leaf, Challenge: challenge.Challenge, Signature: signature})
+  if err != nil {t.Fatal(err)}
+
+  mt.SetStandby(true)
+  tests := []struct {
+    name string
+    handler http.HandlerFunc
+    method string
+    body []byte
+  }{
+    {"challenge", h.GetRevocationChallenge, "GET", nil},
+    {"self-revocation", h.PostSelfRevocation, "POST", body},
+  }
+  for _,test := range(tests) {
+    rw := serve(test.handler,test.method,test.body)
+    var details NotLeaderDetails
+    if(rw.Code != http.StatusServiceUnavailable || json.Unmarshal(rw.Body.Bytes(),&details) != nil || details.Leader != "https://leader") {
+      t.Errorf("%v on standby = %v %s, want 503 naming the leader",test.name,rw.Code,rw.Body.Bytes())
+    }
+  }
+
+  mt.SetStandby(false)
+  if rw := serve(h.PostSelfRevocation,"POST",body); rw.Code != http.StatusOK {
+    t.Fatalf("self-revocation once leader = %v %s, want the challenge still redeemable",rw.Code,rw.Body.Bytes())
+  }
+  if err := mt.IntegrateQueue(); err != nil {t.Fatal(err)}
+  if r, ok := mt.GetRevocation(42); !ok || r.Reason != ocsp.KeyCompromise {
+    t.Errorf("serial 42 after self-revocation = %+v,%v, want revoked for keyCompromise",r,ok)
+  }
+  if rw := serve(h.PostSelfRevocation,"POST",body); rw.Code != http.StatusForbidden {
+    t.Errorf("second use of the challenge = %v %s, want 403",rw.Code,rw.Body.Bytes())
+  }
+}
+
+// A full challenge store says so, with when the oldest challenge expires, rather than blaming the revocation queue
+func TestRevocationChallengesFull(t *testing.T) {
+  h, _ := newTestHandler(t)
+  expires := time.Now().Add(90*time.Second)
+  for i := 0; i < maxChallenges; i++ {
+    h.challenges.order = append(h.challenges.order,issuedChallenge{string(rune(i)),expires})
+  }
+  rw := httptest.NewRecorder()
+  api.V1(h.GetRevocationChallenge)(rw,httptest.NewRequest("GET","/",nil))
+  var resp api.ErrorResponse
+  if err := json.Unmarshal(rw.Body.Bytes(),&resp); err != nil {t.Fatal(err)}
+  if(rw.Code != http.StatusServiceUnavailable || resp.Error.Code != api.CodeChallengesFull) {
+    t.Errorf("challenge while full = %v %s, want 503 with %v",rw.Code,rw.Body.Bytes(),api.CodeChallengesFull)
+  }
+  if retry := rw.Header().Get("Retry-After"); retry != "90" && retry != "89" {
+    t.Errorf("Retry-After %q, want the 90 seconds until the oldest challenge expires",retry)
+  }
+}
+
+// Submissions are promised one mmd out, another behind a queued change to the same serial one more,
+// and get-revocation-status follows their receipts from queued to integrated
+func TestRevocationStatus(t *testing.T) {
+  h, mt := newTestHandler(t)
+  submit := func(reason int) srt.SignedRevocationTimestamp {
+    var ts srt.SignedRevocationTimestamp
+    if err := json.Unmarshal(call(t,h.PostRevocation,"POST",PostRevocationRequest{Serial: 5, Reason: reason}),&ts); err != nil {t.Fatal(err)}
+    if err := ts.Verify(mt.GetSigner().Public()); err != nil {t.Fatal(err)}
+    return ts
+  }
+  status := func(id string) tree.Receipt {
+    var r tree.Receipt
+    if err := json.Unmarshal(call(t,h.GetRevocationStatus,"GET",GetRevocationStatusRequest{ReceiptID: id}),&r); err != nil {t.Fatal(err)}
+    return r
+  }
+  held := submit(ocsp.CertificateHold)
+  revoked := submit(ocsp.KeyCompromise)
+  for _,test := range([]struct{
+    ts srt.SignedRevocationTimestamp
+    mmds int
+  }{{held,1},{revoked,2}}) {
+    if got := test.ts.IntegrateBy.Sub(test.ts.SubmittedAt); got != time.Duration(test.mmds)*treetest.Mmd {
+      t.Errorf("reason %v promised %v after submission, want %v mmds",test.ts.Reason,got,test.mmds)
+    }
+  }
+
+  if r := status(held.ReceiptID); r.Status != tree.ReceiptQueued || !r.IntegrateBy.Equal(held.IntegrateBy) {
+    t.Errorf("status before integration = %+v, want queued until %v",r,held.IntegrateBy)
+  }
+  // The revocation waits for the batch after the hold
+  if err := mt.IntegrateQueue(); err != nil {t.Fatal(err)}
+  if r := status(held.ReceiptID); r.Status != tree.ReceiptIntegrated || r.Revision != 1 {
+    t.Errorf("hold status after the first batch = %+v, want integrated at revision 1",r)
+  }
+  if r := status(revoked.ReceiptID); r.Status != tree.ReceiptQueued {
+    t.Errorf("revocation status after the first batch = %+v, want queued",r)
+  }
+  if err := mt.IntegrateQueue(); err != nil {t.Fatal(err)}
+
+  // On /v1 the receipt id is a query parameter
+  rw := httptest.NewRecorder()
+  api.V1(h.GetRevocationStatus)(rw,httptest.NewRequest("GET","/?receipt_id="+revoked.ReceiptID,nil))
+  var r tree.Receipt
+  if(rw.Code != http.StatusOK || json.Unmarshal(rw.Body.Bytes(),&r) != nil || r.Status != tree.ReceiptIntegrated || r.Revision != 2) {
+    t.Errorf("/v1 revocation status = %v %s, want integrated at revision 2",rw.Code,rw.Body.Bytes())
+  }
+  b, _ := json.Marshal(GetRevocationStatusRequest{ReceiptID: "unknown"})
+  if rw := serve(h.GetRevocationStatus,"GET",b); rw.Code != http.StatusNotFound {
+    t.Errorf("status of an unknown receipt = %v %s, want 404",rw.Code,rw.Body.Bytes())
+  }
+}
+
+// Serials never issued are good without the issuance registry, and unknown with it (RFC 6960 2.2)
+func TestGetOcspUnknown(t *testing.T) {
+  h, mt := newTestHandler(t)
+  integrate(t,mt,tree.Revocation{Serial: 5, Reason: ocsp.KeyCompromise, RevokedAt: time.Now()})
+  status := func(serial uint64) int {
+    req, err := ocsp.CreateRequest(h.cert,serial)
+    if err != nil {t.Fatal(err)}
+    rw := serve(h.GetOcsp,"GET",req)
+    if(rw.Code != http.StatusOK) {
+      t.Fatalf("GetOcsp(%v) = %v %s",serial,rw.Code,rw.Body.Bytes())
+    }
+    resp, err := ocsp.ParseResponse(rw.Body.Bytes(),h.cert,serial)
+    if err != nil {t.Fatal(err)}
+    return resp.Status
+  }
+
+  for serial, want := range(map[uint64]int{4: ocsp.Good, 5: ocsp.Revoked, 9: ocsp.Good}) {
+    if got := status(serial); got != want {
+      t.Errorf("without the registry serial %v is %v, want %v",serial,got,want)
+    }
+  }
+
+  issued := registry.New(1000,time.Hour,mt.GetSigner())
+  if err := issued.AddIssued([]uint64{4,5}); err != nil {t.Fatal(err)}
+  if err := issued.GetTree().IntegrateQueue(); err != nil {t.Fatal(err)}
+  h.issued = issued
+  for serial, want := range(map[uint64]int{4: ocsp.Good, 5: ocsp.Revoked, 9: ocsp.Unknown}) {
+    if got := status(serial); got != want {
+      t.Errorf("with the registry serial %v is %v, want %v",serial,got,want)
+    }
+  }
+  // Issued but not yet integrated into the registry is still unknown
+  if err := issued.AddIssued([]uint64{9}); err != nil {t.Fatal(err)}
+  if got := status(9); got != ocsp.Unknown {
+    t.Errorf("serial 9 before the registry integrates it is %v, want unknown",got)
+  }
+  if err := issued.GetTree().IntegrateQueue(); err != nil {t.Fatal(err)}
+  if got := status(9); got != ocsp.Good {
+    t.Errorf("serial 9 once the registry integrates it is %v, want good",got)
+  }
+}
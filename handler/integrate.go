@@ -0,0 +1,71 @@
+package handler
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "github.com/golang/glog"
+  "revocation-server/api"
+  "revocation-server/sequencer"
+  "revocation-server/types"
+)
+
+// Admin endpoint to integrate and sign a new root right away, for incident response
+// Every tree's queue is integrated, not waiting for the integration interval
+
+// Tree is revocations or issuance-registry, Sth is its latest root, the last good one if Error is set
+type IntegratedTree struct {
+  Tree string
+  Revision uint64
+  Sth *types.SignedLogRoot
+  Error string `json:",omitempty"`
+}
+
+type IntegrateResponse struct {
+  Trees []IntegratedTree
+}
+
+// Trees integrated by admin/integrate, each sequencer must be running for it to succeed
+func (h *Handler) SetSequencers(seqs ...*sequencer.Sequencer) {
+  h.sequencers = seqs
+}
+
+// Responds 503 if any tree fails to integrate, with the result for each tree as details
+func (h *Handler) Integrate(rw http.ResponseWriter, req *http.Request) {
+  glog.V(1).Infoln("Received Integrate Request")
+  if req.Method != "POST" {
+    writeWrongMethodResponse(&rw, "POST")
+    return
+  }
+
+  var resp IntegrateResponse
+  var failed error
+  for _,s := range(h.sequencers) {
+    t := s.Tree()
+    err := s.IntegrateNow(req.Context())
+    if err == sequencer.ErrNotRunning {
+      writeCodedError(&rw, http.StatusServiceUnavailable, api.CodeShuttingDown, fmt.Sprintf("Sequencer for %v has stopped, the server is shutting down", t.GetName()), nil)
+      return
+    } else if err == sequencer.ErrStandby {
+      h.writeNotLeader(&rw, fmt.Sprintf("Can't integrate %v: %v", t.GetName(), err))
+      return
+    }
+    result := IntegratedTree{Tree: t.GetName(), Revision: t.GetRevision(), Sth: t.GetSth()}
+    if err != nil {
+      glog.Errorf("Requested integration of %v failed: %v\n", t.GetName(), err)
+      result.Error = err.Error()
+      failed = err
+    }
+    resp.Trees = append(resp.Trees, result)
+  }
+  if failed != nil {
+    writeCodedError(&rw, http.StatusServiceUnavailable, api.CodeIntegrationFailed, fmt.Sprintf("Integration failed, the last good root is still served: %v", failed), resp)
+    return
+  }
+
+  encoder := json.NewEncoder(rw)
+  if err := encoder.Encode(resp); err != nil {
+    writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode Integrate response: %v", err))
+    return
+  }
+}
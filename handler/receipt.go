@@ -0,0 +1,125 @@
+package handler
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "github.com/golang/glog"
+  "revocation-server/limit"
+  "revocation-server/api"
+  "revocation-server/srt"
+  "revocation-server/tree"
+)
+
+// Submissions return a signed revocation timestamp, promising to integrate by a deadline like a CT SCT (see package srt)
+// The receipt id in it can be looked up with get-revocation-status until the revocation lands in the tree
+
+// Status is queued, duplicate (already queued or in the tree) or already-revoked
+// Timestamp is for the submission that queued the change, which for duplicates is the earlier one
+type SubmissionResult struct {
+  Serial uint64
+  Status string
+  Timestamp *srt.SignedRevocationTimestamp `json:",omitempty"`
+}
+
+// One result per serial, in the order they were submitted
+type PostMultipleRevocationsResponse struct {
+  Results []SubmissionResult
+}
+
+type GetRevocationStatusRequest struct {
+  ReceiptID string `query:"receipt_id"`
+}
+
+// Header on single submissions saying whether the change was queued, or was a duplicate or already-revoked serial
+const submissionStatusHeader = "Submission-Status"
+
+// Write the signed revocation timestamp for a single submission
+// For duplicates and already revoked serials it is the timestamp of the earlier submission
+// If that receipt is gone (it was pruned before a restart) there is no timestamp to sign, only the SubmissionResult is written
+func (h *Handler) writeReceipt(rw *http.ResponseWriter, s tree.Submission) {
+  if(s.Receipt.ID == "") {
+    (*rw).Header().Set(submissionStatusHeader, s.Status)
+    if err := json.NewEncoder(*rw).Encode(SubmissionResult{Serial: s.Receipt.Serial, Status: s.Status}); err != nil {
+      writeErrorResponse(rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode result to return: %v", err))
+    }
+    return
+  }
+  resp, err := srt.Sign(s.Receipt, h.t.GetSigner())
+  if err != nil {
+    writeErrorResponse(rw, http.StatusInternalServerError, fmt.Sprintf("Unable to sign receipt: %v", err))
+    return
+  }
+  (*rw).Header().Set(submissionStatusHeader, s.Status)
+  encoder := json.NewEncoder(*rw)
+  if err := encoder.Encode(*resp); err != nil {
+    writeErrorResponse(rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode receipt to return: %v", err))
+    return
+  }
+}
+
+// Write the error from AddNode(s) with msg
+// Submissions the tree refused are the client's fault, a full queue is told to come back with the next root,
+// a server shutting down or unable to publish to try again (another replica, or this one once restarted), anything else is the server's
+func (h *Handler) writeSubmissionError(rw *http.ResponseWriter, err error, msg string) {
+  status, code := http.StatusInternalServerError, api.CodeInternal
+  if _, ok := err.(*tree.SubmissionError); ok {
+    status, code = http.StatusBadRequest, api.CodeInvalidSubmission
+  } else if err == tree.ErrQueueFull {
+    (*rw).Header().Set("Retry-After", limit.RetryAfter(h.t))
+    status, code = http.StatusServiceUnavailable, api.CodeQueueFull
+  } else if err == tree.ErrClosed {
+    status, code = http.StatusServiceUnavailable, api.CodeShuttingDown
+  } else if err == tree.ErrNotPublished {
+    status, code = http.StatusServiceUnavailable, api.CodeNotPublished
+  } else if err == tree.ErrStandby {
+    h.writeNotLeader(rw, fmt.Sprintf("%v: %v", msg, err))
+    return
+  }
+  writeCodedError(rw, status, code, fmt.Sprintf("%v: %v", msg, err), nil)
+}
+
+// Details of a not_leader error, Leader is empty if the replica sequencing isn't known
+type NotLeaderDetails struct {
+  Leader string `json:",omitempty"`
+}
+
+// Where to resubmit when this replica is on standby
+func (h *Handler) SetLeader(leader func() string) {
+  h.leader = leader
+}
+
+func (h *Handler) writeNotLeader(rw *http.ResponseWriter, msg string) {
+  var details NotLeaderDetails
+  if(h.leader != nil) {
+    details.Leader = h.leader()
+  }
+  writeCodedError(rw, http.StatusServiceUnavailable, api.CodeNotLeader, msg, details)
+}
+
+// Status of a submission: queued, integrated (with the revision it landed at) or rejected
+func (h *Handler) GetRevocationStatus(rw http.ResponseWriter, req *http.Request) {
+  glog.V(1).Infoln("Received GetRevocationStatus Request")
+  if req.Method != "GET" {
+    writeWrongMethodResponse(&rw, "GET")
+    return
+  }
+
+  var s GetRevocationStatusRequest
+  if err := decodeRequest(req, &s); err != nil {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid GetRevocationStatus Request: %v", err))
+    return
+  }
+
+  receipt, ok := h.t.GetReceipt(s.ReceiptID)
+  if(!ok) {
+    writeErrorResponse(&rw, http.StatusNotFound, fmt.Sprintf("No submission with receipt %v", s.ReceiptID))
+    return
+  }
+
+  encoder := json.NewEncoder(rw)
+  if err := encoder.Encode(receipt); err != nil {
+    writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode receipt to return: %v", err))
+    return
+  }
+}
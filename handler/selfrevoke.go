@@ -0,0 +1,202 @@
+package handler
+
+import (
+  "crypto"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/x509"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "sync"
+  "time"
+  "github.com/golang/glog"
+  "revocation-server/api"
+  "revocation-server/crypto/ocsp"
+  "revocation-server/limit"
+  "revocation-server/signer"
+  "revocation-server/tree"
+)
+
+// Subscribers revoking their own certificate, like ACME revokeCert (RFC 8555 7.6)
+// The subscriber fetches a challenge, signs it with the certificate's private key and posts the certificate and signature
+// The certificate must be issued by the configured issuer cert, and is revoked with reason keyCompromise
+// Challenges are kept by the replica that issued them, so on standby both endpoints answer not_leader, sending the subscriber
+// to the leader for the challenge as well as the revocation
+
+// How long a challenge can be used for, each challenge can only be used once
+const challengeLifetime = 5*time.Minute
+
+// Most challenges issued in any challengeLifetime, further requests get 503 with challenges_full until the oldest expire
+const maxChallenges = 1<<16
+
+// Prefix of every self revocation message, so the signature can't be mistaken for anything else signed by the key
+const selfRevocationContext = "revocation-server self-revocation\x00"
+
+type GetRevocationChallengeResponse struct {
+  Challenge []byte
+  Expires time.Time
+}
+
+// Certificate is DER encoded
+// Signature is by the certificate's key over SelfRevocationMessage(Challenge,Certificate), hashed with sha256 for non-ed25519 keys
+type PostSelfRevocationRequest struct {
+  Certificate []byte
+  Challenge []byte
+  Signature []byte
+}
+
+// Outstanding challenges and when they expire
+// Every challenge lives as long, so they expire in the order they were issued, oldest first in order
+type challengeStore struct {
+  sync.Mutex
+  expires map[string]time.Time
+  order []issuedChallenge //issued and not yet expired, including redeemed ones
+}
+
+type issuedChallenge struct {
+  challenge string
+  expires time.Time
+}
+
+// Returned by issue while maxChallenges are outstanding, with when the oldest expires
+type challengesFull struct {
+  until time.Time
+}
+
+func (e challengesFull) Error() string {
+  return fmt.Sprintf("%v challenges are outstanding, retry once they expire", maxChallenges)
+}
+
+func newChallengeStore() *challengeStore {
+  return &challengeStore{expires: make(map[string]time.Time)}
+}
+
+// The message a subscriber signs to revoke certificate
+func SelfRevocationMessage(challenge []byte, certificate []byte) []byte {
+  certHash := sha256.Sum256(certificate)
+  msg := append([]byte(selfRevocationContext), challenge...)
+  return append(msg, certHash[:]...)
+}
+
+// Client side: sign the challenge with the certificate's private key
+func SignSelfRevocation(challenge []byte, certificate []byte, key crypto.Signer) ([]byte, error) {
+  s := signer.NewSigner(0, key, crypto.SHA256)
+  return s.Sign(SelfRevocationMessage(challenge, certificate))
+}
+
+func (c *challengeStore) issue() ([]byte, time.Time, error) {
+  challenge := make([]byte, 32)
+  if _, err := rand.Read(challenge); err != nil {
+    return nil, time.Time{}, err
+  }
+  now := time.Now()
+  expires := now.Add(challengeLifetime)
+
+  c.Lock()
+  defer c.Unlock()
+  expired := 0
+  for expired < len(c.order) && now.After(c.order[expired].expires) {
+    delete(c.expires, c.order[expired].challenge)
+    expired++
+  }
+  c.order = c.order[expired:]
+  if(len(c.order) >= maxChallenges) {
+    return nil, time.Time{}, challengesFull{c.order[0].expires}
+  }
+  c.expires[string(challenge)] = expires
+  c.order = append(c.order, issuedChallenge{string(challenge), expires})
+  return challenge, expires, nil
+}
+
+// Remove the challenge, returns false if it was never issued or has expired
+func (c *challengeStore) redeem(challenge []byte) bool {
+  c.Lock()
+  defer c.Unlock()
+  e, ok := c.expires[string(challenge)]
+  if(!ok) {
+    return false
+  }
+  delete(c.expires, string(challenge))
+  return time.Now().Before(e)
+}
+
+func (h *Handler) GetRevocationChallenge(rw http.ResponseWriter, req *http.Request) {
+  glog.V(1).Infoln("Received GetRevocationChallenge Request")
+  if req.Method != "GET" {
+    writeWrongMethodResponse(&rw, "GET")
+    return
+  }
+  if(h.t.Standby()) {
+    h.writeSubmissionError(&rw, tree.ErrStandby, "Unable to issue challenge")
+    return
+  }
+
+  challenge, expires, err := h.challenges.issue()
+  if full, ok := err.(challengesFull); ok {
+    rw.Header().Set("Retry-After", limit.Seconds(time.Until(full.until)))
+    writeCodedError(&rw, http.StatusServiceUnavailable, api.CodeChallengesFull, err.Error(), nil)
+    return
+  } else if err != nil {
+    writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Unable to generate challenge: %v", err))
+    return
+  }
+
+  encoder := json.NewEncoder(rw)
+  if err := encoder.Encode(GetRevocationChallengeResponse{challenge, expires}); err != nil {
+    writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode challenge to return: %v", err))
+    return
+  }
+}
+
+func (h *Handler) PostSelfRevocation(rw http.ResponseWriter, req *http.Request) {
+  glog.V(1).Infoln("Received PostSelfRevocation Request")
+  if req.Method != "POST" {
+    writeWrongMethodResponse(&rw, "POST")
+    return
+  }
+
+  var a PostSelfRevocationRequest
+  if err := decodeRequest(req, &a); err != nil {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid PostSelfRevocation Request: %v", err))
+    return
+  }
+
+  leaf, err := x509.ParseCertificate(a.Certificate)
+  if err != nil {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Unable to parse certificate: %v", err))
+    return
+  }
+  if err := leaf.CheckSignatureFrom(h.cert); err != nil {
+    writeErrorResponse(&rw, http.StatusForbidden, fmt.Sprintf("Certificate was not issued by this server's issuer: %v", err))
+    return
+  }
+  if(leaf.SerialNumber.Sign() < 0 || !leaf.SerialNumber.IsUint64()) {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Serial %v does not fit in a uint64", leaf.SerialNumber))
+    return
+  }
+
+  // A standby replica can't store the revocation, so it leaves the challenge for when it takes over
+  if(h.t.Standby()) {
+    h.writeSubmissionError(&rw, tree.ErrStandby, "Unable to store revocation")
+    return
+  }
+  // Redeem the challenge before checking the signature, so each challenge gets a single attempt
+  if(!h.challenges.redeem(a.Challenge)) {
+    writeErrorResponse(&rw, http.StatusForbidden, "Unknown or expired challenge")
+    return
+  }
+  if err := signer.VerifySignature(leaf.PublicKey, crypto.SHA256, SelfRevocationMessage(a.Challenge, a.Certificate), a.Signature); err != nil {
+    writeErrorResponse(&rw, http.StatusForbidden, fmt.Sprintf("Signature does not prove possession of the certificate key: %v", err))
+    return
+  }
+
+  serial := leaf.SerialNumber.Uint64()
+  glog.V(2).Infof("Subscriber proved possession of key for serial %v, revoking\n", serial)
+  submission, err := h.t.AddNode(tree.Revocation{Serial: serial, Reason: ocsp.KeyCompromise, RevokedAt: time.Now()})
+  if err != nil {
+    h.writeSubmissionError(&rw, err, "Unable to store revocation")
+    return
+  }
+  h.writeReceipt(&rw, submission)
+}
@@ -0,0 +1,188 @@
+package handler
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "net/http"
+  "strconv"
+  "time"
+  "github.com/golang/glog"
+  "revocation-server/api"
+  "revocation-server/types"
+)
+
+// watch-roots tells clients about each new signed root as soon as it is signed, instead of them polling get-sth
+// Clients accepting text/event-stream get a server-sent event per root for as long as they stay connected,
+// anyone else long polls: the response lists the roots signed after their revision, waiting up to Wait seconds if there are none yet
+
+// Longest a long poll waits for a new root, and the default Wait
+const maxWatchWait = 60*time.Second
+
+// How often an event stream with nothing to send gets a comment, so proxies don't close it as idle
+const watchKeepAlive = 15*time.Second
+
+// FromRevision is the last revision the client has seen, the roots after it are sent first
+// Without it the event stream starts at the latest root, and a long poll returns it straight away
+// An event stream reconnecting with Last-Event-ID resumes after that revision instead
+type WatchRootsRequest struct {
+  FromRevision *uint64 `query:"from_revision"`
+  Wait uint64 `query:"wait"` //seconds, 0 for the longest wait
+}
+
+// Latest root signed at each revision after FromRevision, oldest first
+// Revision is that of the last root, or FromRevision if none were signed in time, pass it back to keep watching
+type WatchRootsResponse struct {
+  Revision uint64
+  Roots []types.SignedLogRoot
+}
+
+// End every watch, so shutting down doesn't wait on connections that never finish
+func (h *Handler) CloseWatches() {
+  h.closeWatches.Do(func() {
+    close(h.closing)
+  })
+}
+
+func (h *Handler) WatchRoots(rw http.ResponseWriter, req *http.Request) {
+  glog.V(1).Infoln("Received WatchRoots Request")
+  if req.Method != "GET" {
+    writeWrongMethodResponse(&rw, "GET")
+    return
+  }
+
+  // watch-roots requests may leave out the body, to start at the latest root
+  var w WatchRootsRequest
+  if err := decodeRequest(req, &w); err != nil && err != io.EOF {
+    writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid WatchRoots Request: %v", err))
+    return
+  }
+  if id := req.Header.Get("Last-Event-ID"); id != "" {
+    from, err := strconv.ParseUint(id, 10, 64)
+    if err != nil {
+      writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid Last-Event-ID %v", id))
+      return
+    }
+    w.FromRevision = &from
+  }
+
+  ct := api.ContentType(req)
+  if(ct == "") {
+    ct, _ = api.Negotiate(req.Header.Get("Accept"), []string{api.ContentJson, api.ContentEvents})
+  }
+  if(ct == api.ContentEvents) {
+    h.streamRoots(rw, req, w.FromRevision)
+    return
+  }
+  h.pollRoots(rw, req, w)
+}
+
+func (h *Handler) pollRoots(rw http.ResponseWriter, req *http.Request, w WatchRootsRequest) {
+  wait := maxWatchWait
+  if(w.Wait > 0 && time.Duration(w.Wait)*time.Second < wait) {
+    wait = time.Duration(w.Wait)*time.Second
+  }
+  timeout := time.NewTimer(wait)
+  defer timeout.Stop()
+
+  var roots []*types.SignedLogRoot
+  for len(roots) == 0 {
+    next := h.t.RootSigned()
+    if roots = h.rootsAfter(w.FromRevision); len(roots) > 0 {
+      break
+    }
+    select {
+    case <-next:
+      continue
+    case <-timeout.C:
+    case <-h.closing:
+    case <-req.Context().Done():
+      return
+    }
+    break
+  }
+
+  resp := WatchRootsResponse{}
+  if(len(roots) > 0) {
+    resp.Revision = rootRevision(roots[len(roots)-1])
+  } else {
+    resp.Revision = *w.FromRevision
+  }
+  for _, r := range(roots) {
+    resp.Roots = append(resp.Roots, *r)
+  }
+  encoder := json.NewEncoder(rw)
+  if err := encoder.Encode(resp); err != nil {
+    writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode roots to return: %v", err))
+    return
+  }
+}
+
+// One event per root, with the revision as its id and the json types.SignedLogRoot as its data
+// A root re-signed at the same revision is sent again
+func (h *Handler) streamRoots(rw http.ResponseWriter, req *http.Request, from *uint64) {
+  flusher, ok := rw.(http.Flusher)
+  if(!ok) {
+    writeErrorResponse(&rw, http.StatusInternalServerError, "Streaming is not supported by this connection")
+    return
+  }
+  rw.Header().Set("Content-Type", api.ContentEvents)
+  rw.Header().Set("Cache-Control", "no-cache")
+  rw.WriteHeader(http.StatusOK)
+
+  keepAlive := time.NewTicker(watchKeepAlive)
+  defer keepAlive.Stop()
+  var last *types.SignedLogRoot
+  for {
+    next := h.t.RootSigned()
+    roots := h.rootsAfter(from)
+    if(len(roots) == 0) {
+      if sth := h.t.GetSth(); sth != last && last != nil {
+        roots = append(roots, sth)
+      }
+    }
+    for _, r := range(roots) {
+      b, err := json.Marshal(r)
+      if err != nil {
+        glog.Errorf("Couldn't encode root for event stream: %v\n", err)
+        return
+      }
+      revision := rootRevision(r)
+      if _, err := fmt.Fprintf(rw, "id: %v\nevent: root\ndata: %s\n\n", revision, b); err != nil {
+        return
+      }
+      from, last = &revision, r
+    }
+    flusher.Flush()
+
+    select {
+    case <-next:
+    case <-keepAlive.C:
+      if _, err := fmt.Fprint(rw, ": keepalive\n\n"); err != nil {
+        return
+      }
+      flusher.Flush()
+    case <-req.Context().Done():
+      return
+    case <-h.closing:
+      return
+    }
+  }
+}
+
+// Roots signed after revision from, or the latest root if from is nil
+func (h *Handler) rootsAfter(from *uint64) []*types.SignedLogRoot {
+  if(from == nil) {
+    return []*types.SignedLogRoot{h.t.GetSth()}
+  }
+  return h.t.GetRootsAfter(*from)
+}
+
+func rootRevision(slr *types.SignedLogRoot) uint64 {
+  var root types.LogRootV1
+  if err := root.UnmarshalBinary(slr.LogRoot); err != nil {
+    glog.Errorf("Couldn't parse signed root: %v\n", err)
+    return 0
+  }
+  return root.Revision
+}
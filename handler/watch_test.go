@@ -0,0 +1,224 @@
+package handler
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+  "revocation-server/api"
+  "revocation-server/tree"
+  "revocation-server/types"
+)
+
+// Serve watch-roots under /v1 like the server does, so query parameters and the Accept header are honoured
+func newWatchServer(t *testing.T) (*httptest.Server, *tree.MerkleTree) {
+  h, mt := newTestHandler(t)
+  return httptest.NewServer(api.V1(h.WatchRoots,api.ContentJson,api.ContentEvents)), mt
+}
+
+func revisionOf(t *testing.T, slr types.SignedLogRoot) uint64 {
+  var root types.LogRootV1
+  if err := root.UnmarshalBinary(slr.LogRoot); err != nil {t.Fatal(err)}
+  return root.Revision
+}
+
+// Long poll query, returning the response and how long it took
+func poll(t *testing.T, srv *httptest.Server, query string) (WatchRootsResponse, time.Duration) {
+  start := time.Now()
+  resp, err := http.Get(srv.URL+"?"+query)
+  if err != nil {t.Fatal(err)}
+  defer resp.Body.Close()
+  if(resp.StatusCode != http.StatusOK) {
+    t.Fatalf("watch-roots?%v = %v",query,resp.StatusCode)
+  }
+  var w WatchRootsResponse
+  if err := json.NewDecoder(resp.Body).Decode(&w); err != nil {t.Fatal(err)}
+  return w, time.Since(start)
+}
+
+func TestWatchRootsPoll(t *testing.T) {
+  srv, mt := newWatchServer(t)
+  defer srv.Close()
+
+  // Without a revision the latest root comes back straight away
+  if w, took := poll(t,srv,""); len(w.Roots) != 1 || w.Revision != 0 || took > time.Second {
+    t.Errorf("watch-roots without a revision = %+v after %v, want revision 0 straight away",w,took)
+  }
+  // Nothing newer than the revision asked for waits out the timeout, and says where to carry on from
+  if w, took := poll(t,srv,"from_revision=0&wait=1"); len(w.Roots) != 0 || w.Revision != 0 || took < time.Second {
+    t.Errorf("watch-roots with nothing new = %+v after %v, want no roots after a second",w,took)
+  }
+
+  // A root signed while waiting wakes the poll
+  done := make(chan WatchRootsResponse)
+  go func() {
+    var w WatchRootsResponse
+    if resp, err := http.Get(srv.URL+"?from_revision=0&wait=30"); err == nil {
+      json.NewDecoder(resp.Body).Decode(&w)
+      resp.Body.Close()
+    }
+    done <- w
+  }()
+  time.Sleep(100*time.Millisecond)
+  integrate(t,mt,tree.Revocation{Serial: 5, RevokedAt: time.Now()})
+  select {
+  case w := <-done:
+    if(w.Revision != 1 || len(w.Roots) != 1 || revisionOf(t,w.Roots[0]) != 1) {
+      t.Errorf("woken watch-roots = %+v, want revision 1",w)
+    }
+  case <-time.After(5*time.Second):
+    t.Fatal("watch-roots wasn't woken by a new root")
+  }
+
+  // Resuming from an earlier revision returns every root since, oldest first
+  integrate(t,mt,tree.Revocation{Serial: 6, RevokedAt: time.Now()})
+  w, _ := poll(t,srv,"from_revision=0")
+  if(w.Revision != 2 || len(w.Roots) != 2 || revisionOf(t,w.Roots[0]) != 1 || revisionOf(t,w.Roots[1]) != 2) {
+    t.Errorf("watch-roots from revision 0 = %+v, want revisions 1 and 2",w)
+  }
+
+  // A revision not signed yet has nothing after it until the log gets there
+  if w, took := poll(t,srv,"from_revision=10&wait=1"); len(w.Roots) != 0 || w.Revision != 10 || took < time.Second {
+    t.Errorf("watch-roots from a future revision = %+v after %v, want no roots after a second",w,took)
+  }
+  resp, err := http.Get(srv.URL+"?from_revision=latest")
+  if err != nil {t.Fatal(err)}
+  resp.Body.Close()
+  if(resp.StatusCode != http.StatusBadRequest) {
+    t.Errorf("watch-roots from an unknown revision = %v, want 400",resp.StatusCode)
+  }
+}
+
+type event struct {
+  id string
+  root types.SignedLogRoot
+}
+
+// Open an event stream with the given query and Last-Event-ID, and read its events as they come
+func stream(t *testing.T, srv *httptest.Server, query string, lastID string) (*http.Response, <-chan event) {
+  req, err := http.NewRequest("GET",srv.URL+"?"+query,nil)
+  if err != nil {t.Fatal(err)}
+  req.Header.Set("Accept",api.ContentEvents)
+  if(lastID != "") {
+    req.Header.Set("Last-Event-ID",lastID)
+  }
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {t.Fatal(err)}
+  events := make(chan event,16)
+  if(resp.StatusCode != http.StatusOK) {
+    close(events)
+    return resp, events
+  }
+  go func() {
+    defer close(events)
+    r := bufio.NewReader(resp.Body)
+    var e event
+    for {
+      line, err := r.ReadString('\n')
+      if err != nil {
+        return
+      }
+      line = strings.TrimRight(line,"\n")
+      switch {
+      case strings.HasPrefix(line,"id: "):
+        e.id = strings.TrimPrefix(line,"id: ")
+      case strings.HasPrefix(line,"data: "):
+        json.Unmarshal([]byte(strings.TrimPrefix(line,"data: ")),&e.root)
+      case line == "" && e.id != "":
+        events <- e
+        e = event{}
+      }
+    }
+  }()
+  return resp, events
+}
+
+// The next event, which should be the root of revision with the revision as its id
+func nextEvent(t *testing.T, events <-chan event, revision uint64) types.SignedLogRoot {
+  select {
+  case e, ok := <-events:
+    if(!ok) {
+      t.Fatalf("stream ended, want revision %v",revision)
+    }
+    if(e.id != strconv.FormatUint(revision,10) || revisionOf(t,e.root) != revision) {
+      t.Errorf("event id %v for revision %v, want revision %v",e.id,revisionOf(t,e.root),revision)
+    }
+    return e.root
+  case <-time.After(5*time.Second):
+    t.Fatalf("no event, want revision %v",revision)
+  }
+  return types.SignedLogRoot{}
+}
+
+func noEvent(t *testing.T, events <-chan event, why string) {
+  select {
+  case e := <-events:
+    t.Errorf("%v: got event %v",why,e.id)
+  case <-time.After(100*time.Millisecond):
+  }
+}
+
+func TestWatchRootsStream(t *testing.T) {
+  srv, mt := newWatchServer(t)
+  defer srv.Close()
+
+  // The stream starts at the latest root, then sends each new one
+  resp, events := stream(t,srv,"","")
+  defer resp.Body.Close()
+  if ct := resp.Header.Get("Content-Type"); ct != api.ContentEvents {
+    t.Errorf("Content-Type %v, want %v",ct,api.ContentEvents)
+  }
+  nextEvent(t,events,0)
+  noEvent(t,events,"before a new root")
+  integrate(t,mt,tree.Revocation{Serial: 5, RevokedAt: time.Now()})
+  first := nextEvent(t,events,1)
+  integrate(t,mt,tree.Revocation{Serial: 6, RevokedAt: time.Now()})
+  nextEvent(t,events,2)
+
+  // A root signed again at the same revision is sent again, under the same id
+  time.Sleep(1100*time.Millisecond)
+  if err := mt.SignRoot(); err != nil {t.Fatal(err)}
+  resigned := nextEvent(t,events,2)
+  if(!bytes.Equal(resigned.LogRootSignature,mt.GetSth().LogRootSignature)) {
+    t.Errorf("re-signed event isn't the tree's latest root of revision 2")
+  }
+
+  // Resuming from a revision, by query or Last-Event-ID, replays the roots after it
+  for _, resume := range([]struct{
+    name string
+    query string
+    lastID string
+  }{
+    {"from_revision", "from_revision=0", ""},
+    {"Last-Event-ID", "", "0"},
+    {"Last-Event-ID over from_revision", "from_revision=1", "0"},
+  }) {
+    resp, events := stream(t,srv,resume.query,resume.lastID)
+    if root := nextEvent(t,events,1); !bytes.Equal(root.LogRootSignature,first.LogRootSignature) {
+      t.Errorf("%v: resumed revision 1 isn't the root first sent",resume.name)
+    }
+    nextEvent(t,events,2)
+    noEvent(t,events,resume.name+" after catching up")
+    resp.Body.Close()
+  }
+
+  // A revision not signed yet sends nothing until the log gets there
+  future, events := stream(t,srv,"from_revision=3","")
+  noEvent(t,events,"from a future revision")
+  integrate(t,mt,tree.Revocation{Serial: 7, RevokedAt: time.Now()})
+  noEvent(t,events,"from a future revision at revision 3")
+  integrate(t,mt,tree.Revocation{Serial: 8, RevokedAt: time.Now()})
+  nextEvent(t,events,4)
+  future.Body.Close()
+
+  bad, _ := stream(t,srv,"","latest")
+  bad.Body.Close()
+  if(bad.StatusCode != http.StatusBadRequest) {
+    t.Errorf("stream with an unknown Last-Event-ID = %v, want 400",bad.StatusCode)
+  }
+}
@@ -0,0 +1,202 @@
+package health
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "sync"
+  "time"
+  "github.com/golang/glog"
+  "revocation-server/api"
+  "revocation-server/election"
+  "revocation-server/sequencer"
+  "revocation-server/tree"
+)
+
+//
+// Package Health
+// /healthz and /readyz, for load balancers and orchestrators
+// /healthz fails when the server can't recover without a restart: a sequencer has stopped, or storage can't be read
+// /readyz also fails while the log is behind its promises: the last root failed to sign, or the sth is older than mmd plus a grace period,
+// and with leader election while the lease backend can't be reached
+// Both respond with every check's result as json, with 200 if the checks they depend on pass and 503 otherwise
+//
+
+// How long a check may take before it counts as failed, a check blocked on the tree's lock is a failure too
+const checkTimeout = 2*time.Second
+
+// A check returns a short description of what it saw, and an error if it isn't healthy
+type Check func() (string, error)
+
+type Result struct {
+  Ok bool
+  Live bool //whether /healthz depends on it, /readyz depends on every check
+  Detail string `json:",omitempty"`
+  Error string `json:",omitempty"`
+}
+
+type Response struct {
+  Status string //ok or failing
+  Checks map[string]Result
+}
+
+type check struct {
+  name string
+  live bool
+  run Check
+}
+
+type Checker struct {
+  sync.Mutex
+  checks []check
+}
+
+func New() *Checker {
+  return &Checker{}
+}
+
+// Add a check to /readyz, and to /healthz as well if live
+func (c *Checker) Add(name string, live bool, run Check) {
+  c.Lock()
+  c.checks = append(c.checks, check{name, live, run})
+  c.Unlock()
+}
+
+// Checks for a tree and the sequencer integrating it, named after the tree
+// grace is how far past the mmd the sth may age before the log is not ready
+func (c *Checker) AddTree(t *tree.MerkleTree, s *sequencer.Sequencer, mmd time.Duration, grace time.Duration) {
+  name := t.GetName()
+  // Failed integrations are retried, so they make the log not ready rather than not live
+  c.Add(name+"-sequencer", true, func() (string, error) {
+    st := s.Status()
+    if(!st.Running) {
+      return "", fmt.Errorf("not running")
+    }
+    if(st.Standby) {
+      return "standby, another replica is sequencing", nil
+    }
+    if(st.Failures > 0) {
+      return fmt.Sprintf("%v integrations failed in a row, retrying in %v", st.Failures, time.Until(st.NextRun).Round(time.Millisecond)), nil
+    }
+    if(st.LastRun.IsZero()) {
+      return fmt.Sprintf("running since %v, not integrated yet", st.Started.Format(time.RFC3339)), nil
+    }
+    return fmt.Sprintf("last integrated %v ago", time.Since(st.LastRun).Round(time.Millisecond)), nil
+  })
+  c.Add(name+"-sign-root", false, func() (string, error) {
+    if st := s.Status(); st.Failures > 0 {
+      return "", fmt.Errorf("%v integrations failed in a row, serving revision %v: %v", st.Failures, t.GetRevision(), st.LastError)
+    }
+    if err := t.GetSignError(); err != nil {
+      return "", fmt.Errorf("last root failed to sign: %v", err)
+    }
+    return fmt.Sprintf("revision %v signed", t.GetRevision()), nil
+  })
+  c.Add(name+"-sth-age", false, func() (string, error) {
+    age, limit := time.Since(t.GetLastUpdated()), mmd+grace
+    if(age > limit) {
+      return "", fmt.Errorf("sth is %v old, over %v", age.Round(time.Millisecond), limit)
+    }
+    return fmt.Sprintf("sth is %v old, limit %v", age.Round(time.Millisecond), limit), nil
+  })
+  // The tree is held in memory, reading from it shows its lock isn't stuck
+  c.Add(name+"-storage", true, func() (string, error) {
+    if _, err := t.GetInclusionProof(0); err != nil {
+      return "", err
+    }
+    return fmt.Sprintf("%v nodes readable", t.GetTreeSize()), nil
+  })
+}
+
+// Check the replica can reach the lease backend, without which the leader steps down and standbys stop following
+// Either way reads still work, so only /readyz fails
+func (c *Checker) AddElection(e *election.Elector) {
+  c.Add("election", false, func() (string, error) {
+    st := e.Status()
+    if(st.LastError != "" && time.Since(st.LastContact) > e.TTL()) {
+      return "", fmt.Errorf("lease backend unreachable for %v: %v", time.Since(st.LastContact).Round(time.Second), st.LastError)
+    }
+    if(st.Leader) {
+      return "leader, sequencing", nil
+    }
+    if(st.Holder == "") {
+      return "standby, nobody holds the lease", nil
+    }
+    return fmt.Sprintf("standby, following %v", st.Holder), nil
+  })
+}
+
+// Run every check, each with checkTimeout to finish
+func (c *Checker) Run() map[string]Result {
+  c.Lock()
+  checks := append([]check(nil), c.checks...)
+  c.Unlock()
+
+  results := make(map[string]Result)
+  var lock sync.Mutex
+  var wg sync.WaitGroup
+  for _, ch := range(checks) {
+    wg.Add(1)
+    go func(ch check) {
+      defer wg.Done()
+      r := run(ch)
+      lock.Lock()
+      results[ch.name] = r
+      lock.Unlock()
+    }(ch)
+  }
+  wg.Wait()
+  return results
+}
+
+func run(ch check) Result {
+  type outcome struct {
+    detail string
+    err error
+  }
+  done := make(chan outcome, 1)
+  go func() {
+    detail, err := ch.run()
+    done <- outcome{detail, err}
+  }()
+  r := Result{Live: ch.live}
+  select {
+  case o := <-done:
+    r.Detail = o.detail
+    if(o.err != nil) {
+      r.Error = o.err.Error()
+    }
+  case <-time.After(checkTimeout):
+    r.Error = fmt.Sprintf("no answer within %v", checkTimeout)
+  }
+  r.Ok = r.Error == ""
+  return r
+}
+
+// /healthz, depends on live checks only
+func (c *Checker) Healthz(rw http.ResponseWriter, req *http.Request) {
+  c.serve(rw, req, true)
+}
+
+// /readyz, depends on every check
+func (c *Checker) Readyz(rw http.ResponseWriter, req *http.Request) {
+  c.serve(rw, req, false)
+}
+
+func (c *Checker) serve(rw http.ResponseWriter, req *http.Request, liveOnly bool) {
+  resp := Response{Status: "ok", Checks: c.Run()}
+  for name, r := range(resp.Checks) {
+    if(!r.Ok && (r.Live || !liveOnly)) {
+      glog.V(1).Infof("Health check %v failing: %v\n", name, r.Error)
+      resp.Status = "failing"
+    }
+  }
+  rw.Header().Set("Content-Type", api.ContentJson)
+  rw.Header().Set("Cache-Control", "no-cache")
+  if(resp.Status != "ok") {
+    rw.WriteHeader(http.StatusServiceUnavailable)
+  }
+  if err := json.NewEncoder(rw).Encode(resp); err != nil {
+    glog.Errorf("Couldn't encode health checks: %v\n", err)
+  }
+}
@@ -0,0 +1,106 @@
+package health
+
+import (
+  "encoding/json"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+  "revocation-server/sequencer"
+  "revocation-server/tree/treetest"
+)
+
+func get(t *testing.T, h http.HandlerFunc) (int, Response) {
+  rw := httptest.NewRecorder()
+  h(rw, httptest.NewRequest("GET", "/", nil))
+  var resp Response
+  if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {t.Fatal(err)}
+  return rw.Code, resp
+}
+
+func TestServe(t *testing.T) {
+  ok := func() (string, error) {return "fine", nil}
+  failing := func() (string, error) {return "", errors.New("broken")}
+  tests := []struct {
+    name string
+    live Check
+    ready Check
+    readyOk bool
+    healthz int
+    readyz int
+  }{
+    {"all passing", ok, ok, true, http.StatusOK, http.StatusOK},
+    {"ready check failing", ok, failing, false, http.StatusOK, http.StatusServiceUnavailable},
+    {"live check failing", failing, ok, true, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+  }
+  for _, test := range(tests) {
+    c := New()
+    c.Add("live", true, test.live)
+    c.Add("ready", false, test.ready)
+    for _, endpoint := range([]struct {
+      name string
+      h http.HandlerFunc
+      want int
+    }{{"healthz", c.Healthz, test.healthz}, {"readyz", c.Readyz, test.readyz}}) {
+      status, resp := get(t, endpoint.h)
+      wantStatus := "ok"
+      if(endpoint.want != http.StatusOK) {
+        wantStatus = "failing"
+      }
+      if(status != endpoint.want || resp.Status != wantStatus || len(resp.Checks) != 2) {
+        t.Errorf("%v: %v answered %v with %+v, want %v", test.name, endpoint.name, status, resp, endpoint.want)
+      }
+      // Every check is reported, including ones the endpoint doesn't depend on
+      if r := resp.Checks["ready"]; r.Live || r.Ok != test.readyOk {
+        t.Errorf("%v: %v reported %+v", test.name, endpoint.name, r)
+      }
+    }
+  }
+}
+
+func TestAddTree(t *testing.T) {
+  tr := treetest.NewTree(t)
+  s := sequencer.New(tr, time.Hour)
+
+  // The sth may only be a millisecond old under the first checker
+  stale, fresh := New(), New()
+  stale.AddTree(tr, s, 0, time.Millisecond)
+  fresh.AddTree(tr, s, time.Hour, time.Minute)
+  time.Sleep(5*time.Millisecond)
+  name := tr.GetName()
+
+  tests := []struct {
+    name string
+    c *Checker
+    running bool
+    failing []string
+  }{
+    {"sequencer not running", fresh, false, []string{name+"-sequencer"}},
+    {"running", fresh, true, nil},
+    {"sth too old", stale, true, []string{name+"-sth-age"}},
+  }
+  done := make(chan bool)
+  defer close(done)
+  for _, test := range(tests) {
+    if(test.running && !s.Status().Running) {
+      go s.Run(done)
+      for deadline := time.Now().Add(5*time.Second); !s.Status().Running; time.Sleep(time.Millisecond) {
+        if(time.Now().After(deadline)) {t.Fatal("sequencer didn't start")}
+      }
+    }
+    results := test.c.Run()
+    failing := make(map[string]bool)
+    for _, f := range(test.failing) {
+      failing[f] = true
+    }
+    for check, r := range(results) {
+      if(r.Ok == failing[check]) {
+        t.Errorf("%v: check %v = %+v, want ok %v", test.name, check, r, !failing[check])
+      }
+    }
+    if(len(results) != 4) {
+      t.Errorf("%v: %v checks, want 4", test.name, len(results))
+    }
+  }
+}
@@ -0,0 +1,234 @@
+package limit
+
+import (
+  "fmt"
+  "io"
+  "math"
+  "net"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "github.com/golang/glog"
+  "revocation-server/api"
+  "revocation-server/auth"
+  "revocation-server/tree"
+)
+
+//
+// Package Limit
+// Limits on submissions, so one client can't exhaust the server's memory or crowd out the others
+// Each client gets a token bucket: it may send burst requests at once, then rate requests a second
+// Clients are told apart by their authenticated name, otherwise by address, taken from X-Forwarded-For
+// only when the request comes through a trusted proxy
+// Checking a client's signature costs more than the request it guards, so a limiter by address alone goes in front of
+// auth.Require as well (LimitAddress), and unauthenticated floods are turned away before any signature is checked
+//
+
+// Buckets aren't swept for idle clients until there are this many
+const minSweep = 1024
+
+// Reject bodies over max bytes with 413, before they are read
+// Bodies without a Content-Length are cut off at max bytes, reading past that fails with api.ErrBodyTooLarge
+func Body(max int64, next http.HandlerFunc) http.HandlerFunc {
+  return func(rw http.ResponseWriter, req *http.Request) {
+    if(max <= 0) {
+      next(rw, req)
+      return
+    }
+    if(req.ContentLength > max) {
+      api.WriteError(rw, http.StatusRequestEntityTooLarge, api.CodeBodyTooLarge, fmt.Sprintf("Request body is larger than %v bytes", max), nil)
+      return
+    }
+    req.Body = &cutBody{http.MaxBytesReader(rw, req.Body, max), max, 0}
+    next(rw, req)
+  }
+}
+
+// A body from http.MaxBytesReader, whose error past max is told apart from a broken connection
+type cutBody struct {
+  io.ReadCloser
+  max int64
+  read int64
+}
+
+func (b *cutBody) Read(p []byte) (int,error) {
+  n, err := b.ReadCloser.Read(p)
+  b.read += int64(n)
+  if(err != nil && err != io.EOF && b.read >= b.max) {
+    return n,api.ErrBodyTooLarge
+  }
+  return n,err
+}
+
+// Seconds until the tree's next root is due, for Retry-After
+// Never less than one, the root may be late
+func RetryAfter(t *tree.MerkleTree) string {
+  return Seconds(time.Until(t.GetNextUpdate()))
+}
+
+// Whole seconds in d rounded up, at least one, for Retry-After
+func Seconds(d time.Duration) string {
+  secs := math.Ceil(d.Seconds())
+  if(secs < 1) {
+    secs = 1
+  }
+  return strconv.Itoa(int(secs))
+}
+
+// Proxies trusted to set X-Forwarded-For, from a comma separated list of CIDRs or addresses
+func ParseProxies(s string) ([]*net.IPNet,error) {
+  var proxies []*net.IPNet
+  for _,p := range(strings.Split(s,",")) {
+    p = strings.TrimSpace(p)
+    if(p == "") {
+      continue
+    }
+    if(!strings.Contains(p,"/")) {
+      ip := net.ParseIP(p)
+      if(ip == nil) {
+        return nil,fmt.Errorf("%q is not an address or CIDR",p)
+      }
+      bits := 8*net.IPv6len
+      if ip4 := ip.To4(); ip4 != nil {
+        ip, bits = ip4, 8*net.IPv4len
+      }
+      proxies = append(proxies,&net.IPNet{IP: ip, Mask: net.CIDRMask(bits,bits)})
+      continue
+    }
+    _, n, err := net.ParseCIDR(p)
+    if err != nil {
+      return nil,err
+    }
+    proxies = append(proxies,n)
+  }
+  return proxies,nil
+}
+
+// Per client token buckets
+type Limiter struct {
+  rate float64 //tokens added per second
+  burst float64 //most tokens a bucket holds
+  proxies []*net.IPNet
+  buckets map[string]*bucket
+  swept int //buckets left by the last sweep
+  sync.Mutex
+}
+
+type bucket struct {
+  tokens float64
+  at time.Time //when tokens was last brought up to date
+}
+
+// Allow each client rate requests a second, after a burst of up to burst, rate 0 for no limit
+// burst 0 is a second's worth, at least one
+// Requests from proxies are counted against the address they forwarded for
+func NewLimiter(rate float64, burst int, proxies []*net.IPNet) *Limiter {
+  b := float64(burst)
+  if(b <= 0) {
+    b = math.Max(1,math.Ceil(rate))
+  }
+  return &Limiter{rate: rate, burst: b, proxies: proxies, buckets: make(map[string]*bucket)}
+}
+
+// Wrap a handler so clients out of tokens get 429, must run inside auth.Require to know the client
+// Retry-After is the seconds until the client has a token again
+func (l *Limiter) Limit(next http.HandlerFunc) http.HandlerFunc {
+  return l.limit(l.ClientKey, next)
+}
+
+// Like Limit, but by address whether or not the client authenticated, to run in front of auth.Require
+func (l *Limiter) LimitAddress(next http.HandlerFunc) http.HandlerFunc {
+  return l.limit(l.Address, next)
+}
+
+func (l *Limiter) limit(key func(*http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+  return func(rw http.ResponseWriter, req *http.Request) {
+    client := key(req)
+    if ok, wait := l.Allow(client); !ok {
+      glog.V(1).Infof("Client %v is over its rate for %v\n", client, req.URL.Path)
+      rw.Header().Set("Retry-After", Seconds(wait))
+      api.WriteError(rw, http.StatusTooManyRequests, api.CodeRateLimited, fmt.Sprintf("More than %v requests a second, retry in %v", l.rate, wait.Round(time.Millisecond)), nil)
+      return
+    }
+    next(rw, req)
+  }
+}
+
+// Take a token from client's bucket, or return false and how long until it has one
+// Used directly by callers that aren't http handlers
+func (l *Limiter) Allow(client string) (bool,time.Duration) {
+  if(l.rate <= 0) {
+    return true,0
+  }
+  now := time.Now()
+  l.Lock()
+  defer l.Unlock()
+  b, ok := l.buckets[client]
+  if(!ok) {
+    l.sweep(now)
+    b = &bucket{tokens: l.burst, at: now}
+    l.buckets[client] = b
+  }
+  b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.at).Seconds()*l.rate)
+  b.at = now
+  if(b.tokens < 1) {
+    return false,time.Duration((1-b.tokens)/l.rate*float64(time.Second))
+  }
+  b.tokens--
+  return true,0
+}
+
+// Drop buckets that have filled up again, they are the same as no bucket
+// Only runs once the buckets have doubled since the last sweep, so each new client pays for it at most once
+func (l *Limiter) sweep(now time.Time) {
+  if(len(l.buckets) < minSweep || len(l.buckets) < 2*l.swept) {
+    return
+  }
+  for client,b := range(l.buckets) {
+    if(b.tokens+now.Sub(b.at).Seconds()*l.rate >= l.burst) {
+      delete(l.buckets,client)
+    }
+  }
+  l.swept = len(l.buckets)
+}
+
+// The authenticated client's name, or else the address the request came from
+func (l *Limiter) ClientKey(req *http.Request) string {
+  if c, ok := auth.ClientFromContext(req.Context()); ok && c.Name != "" {
+    return c.Name
+  }
+  return l.Address(req)
+}
+
+// The request's remote address, or if that is a trusted proxy, the last address in X-Forwarded-For it wasn't added by one
+// Addresses before that could have been made up by the client
+func (l *Limiter) Address(req *http.Request) string {
+  addr, _, err := net.SplitHostPort(req.RemoteAddr)
+  if err != nil {
+    addr = req.RemoteAddr
+  }
+  forwarded := strings.Split(strings.Join(req.Header["X-Forwarded-For"],","),",")
+  for i := len(forwarded)-1; i >= 0 && l.trusted(addr); i-- {
+    next := strings.TrimSpace(forwarded[i])
+    if(net.ParseIP(next) == nil) {
+      break
+    }
+    addr = next
+  }
+  return addr
+}
+
+func (l *Limiter) trusted(addr string) bool {
+  ip := net.ParseIP(addr)
+  if(ip == nil) {
+    return false
+  }
+  for _,p := range(l.proxies) {
+    if(p.Contains(ip)) {
+      return true
+    }
+  }
+  return false
+}
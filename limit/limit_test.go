@@ -0,0 +1,219 @@
+package limit
+
+import (
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+  "revocation-server/api"
+)
+
+func TestAllow(t *testing.T) {
+  tests := []struct {
+    name string
+    rate float64
+    burst int
+    requests int
+    allowed int
+  }{
+    {"no limit", 0, 0, 100, 100},
+    {"burst", 0.01, 5, 8, 5},
+    {"burst defaults to a second's worth", 3.5, 0, 8, 4},
+    {"burst at least one", 0.01, 0, 3, 1},
+  }
+  for _,test := range(tests) {
+    l := NewLimiter(test.rate,test.burst,nil)
+    allowed := 0
+    var wait time.Duration
+    for i := 0; i < test.requests; i++ {
+      ok, w := l.Allow("client")
+      if(ok) {
+        allowed++
+      } else {
+        wait = w
+      }
+    }
+    if(allowed != test.allowed) {
+      t.Errorf("%v: allowed %v of %v requests, want %v",test.name,allowed,test.requests,test.allowed)
+    }
+    if(allowed < test.requests && (wait <= 0 || wait > time.Duration(float64(time.Second)/test.rate))) {
+      t.Errorf("%v: told to wait %v at %v a second",test.name,wait,test.rate)
+    }
+    // Clients have their own buckets
+    if ok, _ := l.Allow("other"); !ok {
+      t.Errorf("%v: another client was limited",test.name)
+    }
+  }
+
+  // Tokens come back at the rate
+  l := NewLimiter(100,1,nil)
+  if ok, _ := l.Allow("client"); !ok {t.Fatal("first request limited")}
+  ok, wait := l.Allow("client")
+  if(ok) {
+    t.Fatal("second request allowed at once")
+  }
+  time.Sleep(wait+time.Millisecond)
+  if ok, _ := l.Allow("client"); !ok {
+    t.Errorf("request limited after waiting %v",wait)
+  }
+}
+
+func TestLimit(t *testing.T) {
+  l := NewLimiter(0.01,1,nil)
+  h := l.Limit(func(rw http.ResponseWriter, req *http.Request) {})
+  tests := []struct {
+    remote string
+    status int
+  }{
+    {"192.0.2.1:1000", http.StatusOK},
+    {"192.0.2.1:2000", http.StatusTooManyRequests},
+    {"192.0.2.2:1000", http.StatusOK},
+  }
+  for _,test := range(tests) {
+    req := httptest.NewRequest("POST","/revoke",nil)
+    req.RemoteAddr = test.remote
+    rw := httptest.NewRecorder()
+    h(rw,req)
+    if(rw.Code != test.status) {
+      t.Errorf("request from %v: status %v, want %v",test.remote,rw.Code,test.status)
+    }
+    if(rw.Code == http.StatusTooManyRequests && rw.Header().Get("Retry-After") != "100") {
+      t.Errorf("request from %v: Retry-After %q, want 100",test.remote,rw.Header().Get("Retry-After"))
+    }
+  }
+}
+
+// In front of auth.Require, behind a trusted proxy, each forwarded address has its own limit
+func TestLimitAddress(t *testing.T) {
+  proxies, err := ParseProxies("198.51.100.0/24")
+  if err != nil {t.Fatal(err)}
+  l := NewLimiter(0.01,1,proxies)
+  h := l.LimitAddress(func(rw http.ResponseWriter, req *http.Request) {})
+  tests := []struct {
+    forwarded string
+    status int
+  }{
+    {"192.0.2.1", http.StatusOK},
+    {"192.0.2.1", http.StatusTooManyRequests},
+    {"192.0.2.2", http.StatusOK},
+  }
+  for _,test := range(tests) {
+    req := httptest.NewRequest("POST","/revoke",nil)
+    req.RemoteAddr = "198.51.100.1:1000"
+    req.Header.Set("X-Forwarded-For",test.forwarded)
+    rw := httptest.NewRecorder()
+    h(rw,req)
+    if(rw.Code != test.status) {
+      t.Errorf("request forwarded for %v: status %v, want %v",test.forwarded,rw.Code,test.status)
+    }
+  }
+}
+
+func TestParseProxies(t *testing.T) {
+  tests := []struct {
+    in string
+    want []string
+    err bool
+  }{
+    {"", nil, false},
+    {"10.0.0.0/8, 192.0.2.7 ,", []string{"10.0.0.0/8","192.0.2.7/32"}, false},
+    {"2001:db8::1,2001:db8::/32", []string{"2001:db8::1/128","2001:db8::/32"}, false},
+    {"10.0.0.0/8,proxy", nil, true},
+    {"10.0.0.0/33", nil, true},
+  }
+  for _,test := range(tests) {
+    proxies, err := ParseProxies(test.in)
+    if(test.err) {
+      if(err == nil) {
+        t.Errorf("ParseProxies(%q) succeeded",test.in)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("ParseProxies(%q) = %v",test.in,err)
+      continue
+    }
+    var got []string
+    for _,p := range(proxies) {
+      got = append(got,p.String())
+    }
+    if(!reflect.DeepEqual(got,test.want)) {
+      t.Errorf("ParseProxies(%q) = %v, want %v",test.in,got,test.want)
+    }
+  }
+}
+
+func TestAddress(t *testing.T) {
+  proxies, err := ParseProxies("10.0.0.0/8")
+  if err != nil {t.Fatal(err)}
+  l := NewLimiter(1,1,proxies)
+  tests := []struct {
+    name string
+    remote string
+    forwarded []string
+    want string
+  }{
+    {"direct", "192.0.2.1:1000", nil, "192.0.2.1"},
+    {"untrusted forwarder", "192.0.2.1:1000", []string{"198.51.100.1"}, "192.0.2.1"},
+    {"through a proxy", "10.0.0.1:1000", []string{"198.51.100.1"}, "198.51.100.1"},
+    {"through two proxies", "10.0.0.1:1000", []string{"198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+    {"client made up the start", "10.0.0.1:1000", []string{"203.0.113.9, 198.51.100.1"}, "198.51.100.1"},
+    {"headers joined", "10.0.0.1:1000", []string{"203.0.113.9","198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+    {"garbage from the proxy", "10.0.0.1:1000", []string{"unknown"}, "10.0.0.1"},
+    {"no port", "192.0.2.1", nil, "192.0.2.1"},
+  }
+  for _,test := range(tests) {
+    req := httptest.NewRequest("GET","/",nil)
+    req.RemoteAddr = test.remote
+    req.Header["X-Forwarded-For"] = test.forwarded
+    if got := l.Address(req); got != test.want {
+      t.Errorf("%v: Address = %v, want %v",test.name,got,test.want)
+    }
+  }
+}
+
+func TestBody(t *testing.T) {
+  tests := []struct {
+    name string
+    max int64
+    body string
+    chunked bool
+    status int
+    err error
+  }{
+    {"under the max", 10, "0123456789", false, http.StatusOK, nil},
+    {"over the max", 10, "0123456789a", false, http.StatusRequestEntityTooLarge, nil},
+    {"no limit", 0, strings.Repeat("a",100), false, http.StatusOK, nil},
+    {"chunked under the max", 10, "0123456789", true, http.StatusOK, nil},
+    {"chunked over the max", 10, "0123456789a", true, http.StatusOK, api.ErrBodyTooLarge},
+  }
+  for _,test := range(tests) {
+    var readErr error
+    h := Body(test.max,func(rw http.ResponseWriter, req *http.Request) {
+      _, readErr = ioutil.ReadAll(req.Body)
+    })
+    req := httptest.NewRequest("POST","/revoke",strings.NewReader(test.body))
+    if(test.chunked) {
+      req.ContentLength = -1
+    }
+    rw := httptest.NewRecorder()
+    h(rw,req)
+    if(rw.Code != test.status) {
+      t.Errorf("%v: status %v, want %v",test.name,rw.Code,test.status)
+    }
+    if(readErr != test.err) {
+      t.Errorf("%v: reading the body = %v, want %v",test.name,readErr,test.err)
+    }
+  }
+}
+
+func TestSeconds(t *testing.T) {
+  for d, want := range(map[time.Duration]string{-time.Second: "1", 0: "1", 1500*time.Millisecond: "2", time.Minute: "60"}) {
+    if got := Seconds(d); got != want {
+      t.Errorf("Seconds(%v) = %v, want %v",d,got,want)
+    }
+  }
+}
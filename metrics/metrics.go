@@ -0,0 +1,158 @@
+package metrics
+
+import (
+  "net/http"
+  "strconv"
+  "sync"
+  "time"
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+//
+// Package Metrics
+// Prometheus metrics for the trees, sequencer, signing and http endpoints, served on /metrics
+// Trees are told apart by the tree label: revocations, or the metadata of other trees such as the issuance registry
+// Gauges describing a tree are read from it at scrape time, see Track
+//
+
+const namespace = "revocation"
+
+var (
+  IntegrationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+    Namespace: namespace,
+    Name: "integration_duration_seconds",
+    Help: "Time taken by IntegrateQueue, including signing the new root.",
+    Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+  }, []string{"tree"})
+
+  BatchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+    Namespace: namespace,
+    Name: "batch_size",
+    Help: "Leaves changed by each IntegrateQueue.",
+    Buckets: prometheus.ExponentialBuckets(1, 4, 11),
+  }, []string{"tree"})
+
+  IntegrationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Namespace: namespace,
+    Name: "integration_failures_total",
+    Help: "IntegrateQueue calls that failed and were retried, leaving the last good root in place.",
+  }, []string{"tree"})
+
+  OcspResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Namespace: namespace,
+    Name: "ocsp_responses_total",
+    Help: "OCSP requests answered, by certificate status (good, revoked or unknown), or error if no response could be made.",
+  }, []string{"status"})
+
+  SigningDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+    Namespace: namespace,
+    Name: "signing_duration_seconds",
+    Help: "Time taken to sign, by what was signed: log (roots, timestamps and filters with the log key), ocsp or crl (with the issuer key).",
+    Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+  }, []string{"signer"})
+
+  Leader = prometheus.NewGauge(prometheus.GaugeOpts{
+    Namespace: namespace,
+    Name: "leader",
+    Help: "1 while this replica sequences the trees, which is always without leader election, 0 on standby.",
+  })
+
+  HttpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+    Namespace: namespace,
+    Name: "http_request_duration_seconds",
+    Help: "Time taken to respond to http requests, by endpoint and status code.",
+    Buckets: prometheus.DefBuckets,
+  }, []string{"endpoint", "code"})
+)
+
+// What the tree gauges are read from, implemented by tree.MerkleTree
+type TreeStats interface {
+  GetName() string
+  GetQueueLength() int
+  GetTreeSize() uint64
+  GetRevision() uint64
+  GetLastUpdated() time.Time
+}
+
+var (
+  queueDepth = prometheus.NewDesc(namespace+"_queue_depth", "Changes waiting to be integrated.", []string{"tree"}, nil)
+  treeNodes = prometheus.NewDesc(namespace+"_tree_nodes", "Nodes stored in the tree.", []string{"tree"}, nil)
+  sthRevision = prometheus.NewDesc(namespace+"_sth_revision", "Revision of the latest signed root.", []string{"tree"}, nil)
+  sthAge = prometheus.NewDesc(namespace+"_sth_age_seconds", "Time since the latest root was signed.", []string{"tree"}, nil)
+)
+
+// Trees whose gauges are reported, by name
+type treeCollector struct {
+  sync.Mutex
+  trees map[string]TreeStats
+}
+
+var trees = &treeCollector{trees: make(map[string]TreeStats)}
+
+func init() {
+  prometheus.MustRegister(IntegrationDuration, BatchSize, IntegrationFailures, OcspResponses, SigningDuration, Leader, HttpDuration, trees)
+}
+
+// Report queue depth, node count, revision and sth age for t, replacing any tree tracked under the same name
+func Track(t TreeStats) {
+  trees.Lock()
+  trees.trees[t.GetName()] = t
+  trees.Unlock()
+}
+
+func (c *treeCollector) Describe(ch chan<- *prometheus.Desc) {
+  ch <- queueDepth
+  ch <- treeNodes
+  ch <- sthRevision
+  ch <- sthAge
+}
+
+func (c *treeCollector) Collect(ch chan<- prometheus.Metric) {
+  c.Lock()
+  defer c.Unlock()
+  for name, t := range(c.trees) {
+    ch <- prometheus.MustNewConstMetric(queueDepth, prometheus.GaugeValue, float64(t.GetQueueLength()), name)
+    ch <- prometheus.MustNewConstMetric(treeNodes, prometheus.GaugeValue, float64(t.GetTreeSize()), name)
+    ch <- prometheus.MustNewConstMetric(sthRevision, prometheus.GaugeValue, float64(t.GetRevision()), name)
+    ch <- prometheus.MustNewConstMetric(sthAge, prometheus.GaugeValue, time.Since(t.GetLastUpdated()).Seconds(), name)
+  }
+}
+
+// Record how long a signature by signer took, from start
+func ObserveSigning(signer string, start time.Time) {
+  SigningDuration.WithLabelValues(signer).Observe(time.Since(start).Seconds())
+}
+
+// Wrap next to record its latency under endpoint
+func Instrument(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+  return func(rw http.ResponseWriter, req *http.Request) {
+    start := time.Now()
+    sw := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+    next(sw, req)
+    HttpDuration.WithLabelValues(endpoint, strconv.Itoa(sw.status)).Observe(time.Since(start).Seconds())
+  }
+}
+
+// The /metrics endpoint
+func Handler() http.Handler {
+  return promhttp.Handler()
+}
+
+// Records the status written by the wrapped handler
+// Flush is passed through so event streams still work
+type statusWriter struct {
+  http.ResponseWriter
+  status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+  w.status = status
+  w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Flush() {
+  if f, ok := w.ResponseWriter.(http.Flusher); ok {
+    f.Flush()
+  }
+}
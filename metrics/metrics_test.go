@@ -0,0 +1,137 @@
+package metrics_test
+
+import (
+  "bufio"
+  "bytes"
+  "net/http"
+  "net/http/httptest"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+  "revocation-server/crypto/ocsp"
+  "revocation-server/handler"
+  "revocation-server/metrics"
+  "revocation-server/registry"
+  "revocation-server/tree"
+)
+
+// Outside package metrics, so the metrics can be driven by a real tree and handler, which import it
+
+// Scrape /metrics, by series name with its labels as written, e.g. revocation_sth_revision{tree="revocations"}
+func scrape(t *testing.T) map[string]float64 {
+  rw := httptest.NewRecorder()
+  metrics.Handler().ServeHTTP(rw,httptest.NewRequest("GET","/metrics",nil))
+  if(rw.Code != http.StatusOK) {
+    t.Fatalf("/metrics = %v",rw.Code)
+  }
+  series := make(map[string]float64)
+  s := bufio.NewScanner(rw.Body)
+  for s.Scan() {
+    line := s.Text()
+    if(strings.HasPrefix(line,"#")) {
+      continue
+    }
+    i := strings.LastIndex(line," ")
+    v, err := strconv.ParseFloat(line[i+1:],64)
+    if err != nil {t.Fatalf("can't parse %q: %v",line,err)}
+    series[line[:i]] = v
+  }
+  return series
+}
+
+func TestTreeMetrics(t *testing.T) {
+  mt, _, _, _, err := tree.Initialize(tree.Config{MaxCerts: 1000, KeyPath: "../testdata/key.pem", CertPath: "../testdata/root.cert", Mmd: "1h"})
+  if err != nil {t.Fatal(err)}
+  metrics.Track(mt)
+  // Histograms count every tree named revocations in this binary, so are checked by how much they move
+  before := scrape(t)
+  now := time.Now()
+  if _, err := mt.AddNodes([]tree.Revocation{{Serial: 4, RevokedAt: now},{Serial: 5, RevokedAt: now},{Serial: 6, RevokedAt: now}}); err != nil {t.Fatal(err)}
+  if got := scrape(t)[`revocation_queue_depth{tree="revocations"}`]; got != 3 {
+    t.Errorf("queue depth before integrating = %v, want 3",got)
+  }
+  if err := mt.IntegrateQueue(); err != nil {t.Fatal(err)}
+  if _, err := mt.AddNode(tree.Revocation{Serial: 7, RevokedAt: now}); err != nil {t.Fatal(err)}
+
+  got := scrape(t)
+  for name, want := range(map[string]float64{
+    `revocation_queue_depth{tree="revocations"}`: 1,
+    `revocation_sth_revision{tree="revocations"}`: 1,
+    `revocation_tree_nodes{tree="revocations"}`: float64(mt.GetTreeSize()),
+  }) {
+    if v, ok := got[name]; !ok || v != want {
+      t.Errorf("%v = %v (reported %v), want %v",name,v,ok,want)
+    }
+  }
+  for name, want := range(map[string]float64{
+    `revocation_batch_size_count{tree="revocations"}`: 1,
+    `revocation_batch_size_sum{tree="revocations"}`: 3,
+    `revocation_integration_duration_seconds_count{tree="revocations"}`: 1,
+  }) {
+    if moved := got[name]-before[name]; moved != want {
+      t.Errorf("%v moved by %v, want %v",name,moved,want)
+    }
+  }
+  if age, ok := got[`revocation_sth_age_seconds{tree="revocations"}`]; !ok || age < 0 || age > 5 {
+    t.Errorf("sth age = %v (reported %v), want the few seconds since integrating",age,ok)
+  }
+}
+
+func TestOcspMetrics(t *testing.T) {
+  mt, key, cert, _, err := tree.Initialize(tree.Config{MaxCerts: 1000, KeyPath: "../testdata/key.pem", CertPath: "../testdata/root.cert", Mmd: "1h"})
+  if err != nil {t.Fatal(err)}
+  issued := registry.New(1000,time.Hour,mt.GetSigner())
+  if err := issued.AddIssued([]uint64{4,5}); err != nil {t.Fatal(err)}
+  if err := issued.GetTree().IntegrateQueue(); err != nil {t.Fatal(err)}
+  if _, err := mt.AddNode(tree.Revocation{Serial: 5, Reason: ocsp.KeyCompromise, RevokedAt: time.Now()}); err != nil {t.Fatal(err)}
+  if err := mt.IntegrateQueue(); err != nil {t.Fatal(err)}
+  h := handler.NewHandler(mt,issued,nil,cert,key)
+
+  query := func(body []byte) {
+    rw := httptest.NewRecorder()
+    h.GetOcsp(rw,httptest.NewRequest("GET","/",bytes.NewReader(body)))
+  }
+  request := func(serial uint64) []byte {
+    req, err := ocsp.CreateRequest(cert,serial)
+    if err != nil {t.Fatal(err)}
+    return req
+  }
+  query(request(4))
+  query(request(4))
+  query(request(5))
+  query(request(9))
+  query([]byte("not an ocsp request"))
+
+  got := scrape(t)
+  for status, want := range(map[string]float64{"good": 2, "revoked": 1, "unknown": 1, "error": 1}) {
+    name := `revocation_ocsp_responses_total{status="`+status+`"}`
+    if(got[name] != want) {
+      t.Errorf("%v = %v, want %v",name,got[name],want)
+    }
+  }
+}
+
+func TestInstrument(t *testing.T) {
+  notFound := metrics.Instrument("get-sth",func(rw http.ResponseWriter, req *http.Request) {
+    http.Error(rw,"no sth",http.StatusNotFound)
+  })
+  ok := metrics.Instrument("get-crl",func(rw http.ResponseWriter, req *http.Request) {
+    rw.Write([]byte("crl"))
+  })
+  for i := 0; i < 2; i++ {
+    notFound(httptest.NewRecorder(),httptest.NewRequest("GET","/",nil))
+  }
+  ok(httptest.NewRecorder(),httptest.NewRequest("GET","/",nil))
+
+  got := scrape(t)
+  for name, want := range(map[string]float64{
+    `revocation_http_request_duration_seconds_count{code="404",endpoint="get-sth"}`: 2,
+    `revocation_http_request_duration_seconds_count{code="200",endpoint="get-crl"}`: 1,
+    `revocation_http_request_duration_seconds_count{code="200",endpoint="get-sth"}`: 0,
+  }) {
+    if(got[name] != want) {
+      t.Errorf("%v = %v, want %v",name,got[name],want)
+    }
+  }
+}
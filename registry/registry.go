@@ -0,0 +1,66 @@
+package registry
+
+import (
+  "time"
+  "revocation-server/signer"
+  "revocation-server/tree"
+)
+
+//
+// Package Registry
+// Records which serials the CA has actually issued, so the ocsp handler can answer unknown (RFC 6960) for the rest
+// Issued serials are committed to a tree of their own, with its own signed roots and inclusion proofs
+// The tree shares the revocation tree's key, its roots are told apart by Metadata
+// Registries of the issuers section are named after their issuer, see MetadataFor
+//
+
+var Metadata = []byte("issuance-registry")
+
+// Metadata of the named issuer's registry, Metadata for the server's own issuer which has no name
+func MetadataFor(issuer string) []byte {
+  if(issuer == "") {
+    return Metadata
+  }
+  return []byte(issuer+"-"+string(Metadata))
+}
+
+type Registry struct {
+  t *tree.MerkleTree
+}
+
+func New(maxCerts uint64, mmd time.Duration, s *signer.Signer) *Registry {
+  return NewFor("",maxCerts,mmd,s)
+}
+
+// Registry of the named issuer's serials, signed with that issuer's key
+func NewFor(issuer string, maxCerts uint64, mmd time.Duration, s *signer.Signer) *Registry {
+  return &Registry{tree.New(maxCerts,mmd,s,MetadataFor(issuer))}
+}
+
+// Queue serials as issued, they are committed at the next IntegrateQueue of the registry tree
+// Either every serial is queued or none are
+func (r *Registry) AddIssued(serials []uint64) error {
+  now := time.Now()
+  issued := make([]tree.Revocation,len(serials))
+  for i,s := range(serials) {
+    issued[i] = tree.Revocation{Serial: s, RevokedAt: now} //RevokedAt holds the time the issuance was recorded
+  }
+  _, err := r.t.AddNodes(issued)
+  return err
+}
+
+// true if the serial has been committed to the registry
+func (r *Registry) IsIssued(serial uint64) (bool,error) {
+  return r.t.GetRevocationValue(serial)
+}
+
+// Every committed serial, along with the registry revision they were read at
+func (r *Registry) GetIssuedSerials() ([]uint64,uint64) {
+  serials, revision, _ := r.t.GetRevokedSerials()
+  return serials, revision
+}
+
+// Underlying tree, for sequencing and for serving sth's and proofs
+func (r *Registry) GetTree() *tree.MerkleTree {
+  return r.t
+}
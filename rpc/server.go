@@ -0,0 +1,273 @@
+package rpc
+
+import (
+  "context"
+  "crypto/x509"
+  "encoding/json"
+  "fmt"
+  "net"
+  "time"
+  "github.com/golang/glog"
+  "github.com/golang/protobuf/proto"
+  "github.com/golang/protobuf/ptypes"
+  "google.golang.org/genproto/googleapis/rpc/errdetails"
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/credentials"
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc/peer"
+  "google.golang.org/grpc/status"
+  "revocation-server/auth"
+  "revocation-server/crypto/ocsp"
+  "revocation-server/handler"
+  "revocation-server/limit"
+  "revocation-server/srt"
+  "revocation-server/tree"
+  "revocation-server/types"
+)
+
+//
+// Package Rpc
+// The RevocationLog grpc service (revocationlog.proto), for internal services
+// Served from the same tree as the http api, with the same authentication, rate limits and size limits
+// revocationlog.pb.go is generated, see the top of revocationlog.proto
+//
+
+// Metadata key carrying the request signature, see auth.AuthenticateCall
+const SignatureMetadata = "jws-signature"
+
+type Server struct {
+  t *tree.MerkleTree
+  authn *auth.Authenticator
+  addresses *limit.Limiter //by peer address, before authenticating
+  limiter *limit.Limiter //by client, once authenticated
+  maxBatch int //most revocations in one SubmitRevocations call, 0 for no limit
+  done chan struct{} //closed by Shutdown, ends WatchRoots streams
+}
+
+func NewServer(t *tree.MerkleTree, authn *auth.Authenticator, addresses, limiter *limit.Limiter, maxBatch int) *Server {
+  return &Server{t, authn, addresses, limiter, maxBatch, make(chan struct{})}
+}
+
+// End every WatchRoots stream, so grpc.Server.GracefulStop doesn't wait on them
+func (s *Server) Shutdown() {
+  close(s.done)
+}
+
+func (s *Server) GetSTH(ctx context.Context, in *GetSTHRequest) (*SignedLogRoot, error) {
+  glog.V(1).Infoln("Received GetSTH call")
+  return signedLogRoot(s.t.GetSth()), nil
+}
+
+func (s *Server) GetInclusionProof(ctx context.Context, in *GetInclusionProofRequest) (*GetInclusionProofResponse, error) {
+  glog.V(1).Infoln("Received GetInclusionProof call")
+  proof, err := s.t.GetInclusionProof(in.Serial)
+  if err != nil {
+    return nil, status.Errorf(codes.Internal, "Unable to get inclusion proof from storage: %v", err)
+  }
+  return &GetInclusionProofResponse{Proof: proof}, nil
+}
+
+func (s *Server) GetConsistencyProof(ctx context.Context, in *GetConsistencyProofRequest) (*GetConsistencyProofResponse, error) {
+  glog.V(1).Infoln("Received GetConsistencyProof call")
+  second := in.Second
+  if(second == 0) {
+    second = s.t.GetRevision()
+  }
+  p, err := s.t.GetConsistencyProof(in.First, second)
+  if err != nil {
+    return nil, status.Errorf(codes.InvalidArgument, "Unable to get consistency proof: %v", err)
+  }
+
+  resp := &GetConsistencyProofResponse{
+    Height: int32(s.t.GetHeight()),
+    First: p.First,
+    Second: p.Second,
+    Hashes: p.Hashes,
+  }
+  for _, c := range(p.Changes) {
+    resp.Changes = append(resp.Changes, &LeafChange{Serial: c.Serial, Old: LeafState(c.Old), New: LeafState(c.New)})
+  }
+  return resp, nil
+}
+
+// Needs the revoke scope, and takes a token from the caller's rate limit like an http submission
+// The peer's address is limited first, so floods are turned away before their signatures are checked
+func (s *Server) SubmitRevocations(ctx context.Context, in *SubmitRevocationsRequest) (*SubmitRevocationsResponse, error) {
+  glog.V(1).Infoln("Received SubmitRevocations call")
+  const method = "/revocationlog.RevocationLog/SubmitRevocations"
+  addr := peerAddress(ctx)
+  if ok, wait := s.addresses.Allow(addr); !ok {
+    return nil, retryIn(codes.ResourceExhausted, fmt.Sprintf("Address %v is over its submission rate", addr), wait)
+  }
+  body, err := proto.Marshal(in)
+  if err != nil {
+    return nil, status.Errorf(codes.InvalidArgument, "Unable to marshal request: %v", err)
+  }
+  c, how, err := s.authn.AuthenticateCall(auth.ScopeRevoke, peerCertificates(ctx), signature(ctx), method, body)
+  if err != nil {
+    glog.V(1).Infof("Rejected call to %v: %v\n", method, err)
+    s.authn.RecordRejection("", "", method, int(codes.Unauthenticated), body, err)
+    return nil, status.Errorf(codes.Unauthenticated, "Unauthenticated: %v", err)
+  }
+
+  resp, err := s.submit(ctx, c, in)
+  record, _ := json.Marshal(in)
+  s.authn.Record(c.Name, how, method, int(status.Code(err)), record)
+  return resp, err
+}
+
+func (s *Server) submit(ctx context.Context, c *auth.Client, in *SubmitRevocationsRequest) (*SubmitRevocationsResponse, error) {
+  if(len(in.Revocations) == 0) {
+    return nil, status.Error(codes.InvalidArgument, "No revocations to submit")
+  }
+  if(s.maxBatch > 0 && len(in.Revocations) > s.maxBatch) {
+    return nil, status.Errorf(codes.InvalidArgument, "%v revocations in one call, at most %v are accepted", len(in.Revocations), s.maxBatch)
+  }
+  client := c.Name
+  if(client == "") {
+    client = peerAddress(ctx)
+  }
+  if ok, wait := s.limiter.Allow(client); !ok {
+    return nil, retryIn(codes.ResourceExhausted, fmt.Sprintf("Client %v is over its submission rate", client), wait)
+  }
+
+  now := time.Now()
+  revocations := make([]tree.Revocation, len(in.Revocations))
+  for i, r := range(in.Revocations) {
+    if(!handler.ValidReason(int(r.Reason)) && r.Reason != ocsp.RemoveFromCRL) {
+      return nil, status.Errorf(codes.InvalidArgument, "Revocation %v has invalid reason %v", i, r.Reason)
+    }
+    revocations[i] = tree.Revocation{Serial: r.Serial, Reason: int(r.Reason), RevokedAt: now}
+  }
+
+  submissions, err := s.t.AddNodes(revocations)
+  if serr, ok := err.(*tree.SubmissionError); ok {
+    return nil, submissionError(serr)
+  } else if err == tree.ErrQueueFull {
+    return nil, s.retryLater(codes.Unavailable, err.Error())
+  } else if err == tree.ErrClosed || err == tree.ErrStandby || err == tree.ErrNotPublished {
+    return nil, status.Error(codes.Unavailable, err.Error())
+  } else if err != nil {
+    return nil, status.Errorf(codes.Internal, "Unable to store revocations: %v", err)
+  }
+
+  resp := &SubmitRevocationsResponse{}
+  for _, sub := range(submissions) {
+    result := &SubmissionResult{Serial: sub.Receipt.Serial, Status: sub.Status}
+    if(sub.Receipt.ID != "") {
+      t, err := srt.Sign(sub.Receipt, s.t.GetSigner())
+      if err != nil {
+        return nil, status.Errorf(codes.Internal, "Unable to sign receipt: %v", err)
+      }
+      result.Timestamp = &SignedRevocationTimestamp{
+        ReceiptId: t.ReceiptID,
+        Serial: t.Serial,
+        Reason: int32(t.Reason),
+        SubmittedAtNanos: t.SubmittedAt.UnixNano(),
+        IntegrateByNanos: t.IntegrateBy.UnixNano(),
+        Signature: t.Signature,
+      }
+    }
+    resp.Results = append(resp.Results, result)
+  }
+  return resp, nil
+}
+
+func (s *Server) WatchRoots(in *WatchRootsRequest, stream RevocationLog_WatchRootsServer) error {
+  glog.V(1).Infoln("Received WatchRoots call")
+  for {
+    next := s.t.RootSigned()
+    if err := stream.Send(signedLogRoot(s.t.GetSth())); err != nil {
+      return err
+    }
+    select {
+    case <-next:
+    case <-stream.Context().Done():
+      return stream.Context().Err()
+    case <-s.done:
+      return status.Error(codes.Unavailable, "Server is shutting down")
+    }
+  }
+}
+
+// Serve the service on addr until the returned server is stopped
+func Serve(addr string, s *Server, opts ...grpc.ServerOption) (*grpc.Server, error) {
+  lis, err := net.Listen("tcp", addr)
+  if err != nil {
+    return nil, err
+  }
+  gs := grpc.NewServer(opts...)
+  RegisterRevocationLogServer(gs, s)
+  go func() {
+    if err := gs.Serve(lis); err != nil {
+      glog.Errorf("Problem serving grpc: %v\n", err)
+    }
+  }()
+  return gs, nil
+}
+
+func signedLogRoot(slr *types.SignedLogRoot) *SignedLogRoot {
+  return &SignedLogRoot{LogRoot: slr.LogRoot, LogRootSignature: slr.LogRootSignature}
+}
+
+// Every serial that couldn't be queued, in a SubmissionErrors detail
+func submissionError(serr *tree.SubmissionError) error {
+  details := &SubmissionErrors{}
+  for _, e := range(serr.Errors) {
+    details.Errors = append(details.Errors, &SerialError{Index: int32(e.Index), Serial: e.Serial, Err: e.Err})
+  }
+  st, err := status.New(codes.InvalidArgument, serr.Error()).WithDetails(details)
+  if err != nil {
+    return status.Error(codes.InvalidArgument, serr.Error())
+  }
+  return st.Err()
+}
+
+// Error telling the client to retry once the next root is signed, in a RetryInfo detail
+func (s *Server) retryLater(code codes.Code, msg string) error {
+  return retryIn(code, msg, time.Until(s.t.GetNextUpdate()))
+}
+
+// An error with code telling the client to retry after delay, at least a second
+func retryIn(code codes.Code, msg string, delay time.Duration) error {
+  if(delay < time.Second) {
+    delay = time.Second
+  }
+  st, err := status.New(code, msg).WithDetails(&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(delay.Round(time.Second))})
+  if err != nil {
+    return status.Error(code, msg)
+  }
+  return st.Err()
+}
+
+func peerCertificates(ctx context.Context) []*x509.Certificate {
+  p, ok := peer.FromContext(ctx)
+  if(!ok) {
+    return nil
+  }
+  if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+    return info.State.PeerCertificates
+  }
+  return nil
+}
+
+func peerAddress(ctx context.Context) string {
+  p, ok := peer.FromContext(ctx)
+  if(!ok) {
+    return ""
+  }
+  host, _, err := net.SplitHostPort(p.Addr.String())
+  if err != nil {
+    return p.Addr.String()
+  }
+  return host
+}
+
+func signature(ctx context.Context) string {
+  md, ok := metadata.FromIncomingContext(ctx)
+  if(!ok || len(md.Get(SignatureMetadata)) == 0) {
+    return ""
+  }
+  return md.Get(SignatureMetadata)[0]
+}
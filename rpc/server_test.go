@@ -0,0 +1,161 @@
+package rpc
+
+import (
+  "context"
+  "io/ioutil"
+  "net"
+  "path/filepath"
+  "testing"
+  "time"
+  "google.golang.org/genproto/googleapis/rpc/errdetails"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/peer"
+  "google.golang.org/grpc/status"
+  "revocation-server/auth"
+  "revocation-server/crypto/ocsp"
+  "revocation-server/limit"
+  "revocation-server/srt"
+  "revocation-server/tree"
+  "revocation-server/tree/treetest"
+)
+
+func newServer(t *testing.T) *Server {
+  tr := treetest.NewTree(t)
+  tr.SetMaxQueue(4)
+  return NewServer(tr, auth.Open(nil), limit.NewLimiter(0.01, 16, nil), limit.NewLimiter(0.01, 4, nil), 3)
+}
+
+func fromAddress(addr string) context.Context {
+  return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 1000}})
+}
+
+func revocations(serials ...uint64) *SubmitRevocationsRequest {
+  in := &SubmitRevocationsRequest{}
+  for _, serial := range(serials) {
+    in.Revocations = append(in.Revocations, &Revocation{Serial: serial, Reason: ocsp.KeyCompromise})
+  }
+  return in
+}
+
+func TestSubmitRevocations(t *testing.T) {
+  s := newServer(t)
+  tests := []struct {
+    name string
+    from string
+    in *SubmitRevocationsRequest
+    code codes.Code
+    statuses []string //of each result, when the call succeeds
+  }{
+    {"queued", "192.0.2.1", revocations(4, 5), codes.OK, []string{tree.SubmissionQueued, tree.SubmissionQueued}},
+    {"duplicate", "192.0.2.1", revocations(4), codes.OK, []string{tree.SubmissionDuplicate}},
+    {"nothing to submit", "192.0.2.1", revocations(), codes.InvalidArgument, nil},
+    {"batch too large", "192.0.2.1", revocations(6, 7, 8, 9), codes.InvalidArgument, nil},
+    {"invalid reason", "192.0.2.1", &SubmitRevocationsRequest{Revocations: []*Revocation{{Serial: 6, Reason: 7}}}, codes.InvalidArgument, nil},
+    {"serial above the max", "192.0.2.1", revocations(6, 5000), codes.InvalidArgument, nil},
+    // The four calls above that got past the size checks used up its burst
+    {"rate limited", "192.0.2.1", revocations(6), codes.ResourceExhausted, nil},
+    {"queue full", "192.0.2.2", revocations(6, 7, 8), codes.Unavailable, nil},
+  }
+  for _, test := range(tests) {
+    resp, err := s.SubmitRevocations(fromAddress(test.from), test.in)
+    if(status.Code(err) != test.code) {
+      t.Errorf("%v: SubmitRevocations = %v, want code %v", test.name, err, test.code)
+      continue
+    }
+    if err != nil {
+      // Clients are told when to retry, and which serials failed
+      st := status.Convert(err)
+      for _, d := range(st.Details()) {
+        switch d := d.(type) {
+        case *errdetails.RetryInfo:
+          if(d.RetryDelay.Seconds < 1) {
+            t.Errorf("%v: told to retry in %v", test.name, d.RetryDelay)
+          }
+        case *SubmissionErrors:
+          if(len(d.Errors) != 1 || d.Errors[0].Index != 1 || d.Errors[0].Serial != 5000) {
+            t.Errorf("%v: serial errors %v", test.name, d.Errors)
+          }
+        }
+      }
+      if(len(st.Details()) == 0 && (test.code == codes.ResourceExhausted || test.code == codes.Unavailable || test.name == "serial above the max")) {
+        t.Errorf("%v: %v has no details", test.name, err)
+      }
+      continue
+    }
+    if(len(resp.Results) != len(test.statuses)) {
+      t.Errorf("%v: %v results, want %v", test.name, len(resp.Results), len(test.statuses))
+      continue
+    }
+    for i, r := range(resp.Results) {
+      if(r.Status != test.statuses[i]) {
+        t.Errorf("%v: result %v is %v, want %v", test.name, i, r.Status, test.statuses[i])
+      }
+      if(r.Timestamp == nil) {
+        continue
+      }
+      ts := &srt.SignedRevocationTimestamp{
+        ReceiptID: r.Timestamp.ReceiptId,
+        Serial: r.Timestamp.Serial,
+        Reason: int(r.Timestamp.Reason),
+        SubmittedAt: time.Unix(0, r.Timestamp.SubmittedAtNanos),
+        IntegrateBy: time.Unix(0, r.Timestamp.IntegrateByNanos),
+        Signature: r.Timestamp.Signature,
+      }
+      if err := ts.Verify(s.t.GetSigner().Public()); err != nil {
+        t.Errorf("%v: timestamp for serial %v: %v", test.name, r.Serial, err)
+      }
+    }
+  }
+}
+
+// Calls that fail to authenticate still take a token from their address, so floods of them are turned away
+// before their signatures are checked
+func TestSubmitRevocationsLimitsAddresses(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "clients.json")
+  if err := ioutil.WriteFile(path, []byte(`{"Clients":[]}`), 0600); err != nil {t.Fatal(err)}
+  authn, err := auth.Load(path, nil)
+  if err != nil {t.Fatal(err)}
+  s := NewServer(treetest.NewTree(t), authn, limit.NewLimiter(0.01, 2, nil), limit.NewLimiter(0.01, 4, nil), 3)
+  for i, want := range([]codes.Code{codes.Unauthenticated, codes.Unauthenticated, codes.ResourceExhausted}) {
+    if _, err := s.SubmitRevocations(fromAddress("192.0.2.1"), revocations(4)); status.Code(err) != want {
+      t.Errorf("call %v: SubmitRevocations = %v, want code %v", i, err, want)
+    }
+  }
+  if _, err := s.SubmitRevocations(fromAddress("192.0.2.2"), revocations(4)); status.Code(err) != codes.Unauthenticated {
+    t.Errorf("call from another address: SubmitRevocations = %v, want code %v", err, codes.Unauthenticated)
+  }
+}
+
+func TestGetConsistencyProof(t *testing.T) {
+  s := newServer(t)
+  ctx := fromAddress("192.0.2.1")
+  if _, err := s.SubmitRevocations(ctx, revocations(4, 5)); err != nil {t.Fatal(err)}
+  if err := s.t.IntegrateQueue(); err != nil {t.Fatal(err)}
+  sth, err := s.GetSTH(ctx, &GetSTHRequest{})
+  if err != nil {t.Fatal(err)}
+  if(string(sth.LogRootSignature) != string(s.t.GetSth().LogRootSignature)) {
+    t.Errorf("GetSTH isn't the tree's latest root")
+  }
+
+  tests := []struct {
+    first uint64
+    second uint64
+    code codes.Code
+    changes int
+  }{
+    {0, 0, codes.OK, 2}, //second defaults to the latest revision
+    {0, 1, codes.OK, 2},
+    {1, 1, codes.OK, 0},
+    {0, 2, codes.InvalidArgument, 0},
+  }
+  for _, test := range(tests) {
+    resp, err := s.GetConsistencyProof(ctx, &GetConsistencyProofRequest{First: test.first, Second: test.second})
+    if(status.Code(err) != test.code) {
+      t.Errorf("GetConsistencyProof(%v,%v) = %v, want code %v", test.first, test.second, err, test.code)
+      continue
+    }
+    if(err == nil && (len(resp.Changes) != test.changes || resp.Second != 1 || int(resp.Height) != s.t.GetHeight())) {
+      t.Errorf("GetConsistencyProof(%v,%v) = %+v, want %v changes to revision 1", test.first, test.second, resp, test.changes)
+    }
+  }
+}
@@ -1,25 +1,244 @@
 package sequencer
 
 import (
+  "context"
+  "errors"
+  "revocation-server/metrics"
   "revocation-server/tree"
+  "sync"
   "time"
   "github.com/golang/glog"
 )
 
-func Run(done chan bool, t *tree.MerkleTree, mmd time.Duration) error {
-  ticker := time.NewTicker(mmd)
-  defer ticker.Stop()
+// First wait before retrying a failed IntegrateQueue, doubled after each failure in a row up to the interval
+const minBackoff = time.Second
+
+// Returned by IntegrateNow when Run isn't running
+var ErrNotRunning = errors.New("Sequencer is not running")
+
+// Returned by IntegrateNow on standby, when another replica is sequencing the tree
+var ErrStandby = errors.New("Sequencer is on standby, another replica is sequencing")
+
+// Integrates a tree's queue once every interval (the mmd unless set shorter), and keeps track of how that is going for health checks
+// The queue is also integrated as soon as it reaches the tree's batch trigger, and on IntegrateNow
+// With a resign interval, a root older than that is signed again with a new timestamp, so responses stay fresh between integrations
+// On standby Run keeps going but neither integrates nor signs, see SetStandby
+// A failed integration leaves the last good root in place and its batch queued, and is retried with backoff
+type Sequencer struct {
+  sync.RWMutex
+  t *tree.MerkleTree
+  interval time.Duration
+  resign time.Duration //0 to only sign roots when integrating
+  resignFailures int //SignRoot failures since the last root was signed
+  forced chan chan error //IntegrateNow requests, answered with the result of the integration
+  standby bool
+  running bool
+  started time.Time
+  lastRun time.Time //end of the last IntegrateQueue
+  lastSuccess time.Time //end of the last IntegrateQueue that signed a root
+  lastErr error //result of the last IntegrateQueue
+  failures int //IntegrateQueue failures since the last success
+  nextRun time.Time
+}
+
+// What health checks are told about a sequencer
+type Status struct {
+  Running bool //false before Run, and once it has returned
+  Standby bool
+  Started time.Time
+  LastRun time.Time
+  LastSuccess time.Time
+  LastError string `json:",omitempty"` //error of the last IntegrateQueue, empty if it succeeded
+  Failures int //failures in a row, 0 if the last IntegrateQueue succeeded
+  NextRun time.Time
+}
+
+func New(t *tree.MerkleTree, mmd time.Duration) *Sequencer {
+  return &Sequencer{t: t, interval: mmd, forced: make(chan chan error)}
+}
+
+// Integrate every d instead of every mmd, d must not be longer than the mmd
+// Must be called before Run
+func (s *Sequencer) SetInterval(d time.Duration) {
+  s.Lock()
+  s.interval = d
+  s.Unlock()
+}
+
+// Sign the latest root again once it is d old, 0 to never re-sign
+// Must be called before Run
+func (s *Sequencer) SetResignInterval(d time.Duration) {
+  s.Lock()
+  s.resign = d
+  s.Unlock()
+}
+
+// Stop or resume integrating and signing, for replicas that only sequence while they hold the lease
+func (s *Sequencer) SetStandby(standby bool) {
+  s.Lock()
+  s.standby = standby
+  s.Unlock()
+}
+
+func Run(done chan bool, t *tree.MerkleTree, mmd time.Duration) {
+  New(t,mmd).Run(done)
+}
+
+// Integrate every interval until done, and whenever the batch trigger or IntegrateNow asks for it
+// Failures are retried sooner, and while retrying the batch trigger is ignored so a full queue doesn't hammer the signer
+func (s *Sequencer) Run(done chan bool) {
+  s.Lock()
+  s.running, s.started = true, time.Now()
+  s.nextRun = s.started.Add(s.interval)
+  s.Unlock()
+  defer func() {
+    s.Lock()
+    s.running = false
+    s.Unlock()
+  }()
+
+  timer := time.NewTimer(s.interval)
+  defer timer.Stop()
+  next := func(wait time.Duration) {
+    if(!timer.Stop()) {
+      select {
+      case <-timer.C:
+      default:
+      }
+    }
+    timer.Reset(wait)
+  }
+  // Fires when the latest root may need signing again, its channel is nil (never ready) without a resign interval
+  var refresh *time.Timer
+  var refreshed <-chan time.Time
+  if(s.resign > 0) {
+    refresh = time.NewTimer(s.resign)
+    defer refresh.Stop()
+    refreshed = refresh.C
+  }
   for {
     select {
     case <-done:
       glog.Infoln("Shutting down sequencer")
-      return nil
-    case <-ticker.C:
-      glog.Infoln("Sequencing and signing all nodes added since last mmd")
-      err := t.IntegrateQueue()
-      if(err != nil) {
-        return err
+      return
+    case <-timer.C:
+      if(s.Status().Standby) {
+        timer.Reset(s.interval)
+        continue
+      }
+      glog.Infoln("Sequencing and signing all nodes added since the last interval")
+      wait, _ := s.integrate()
+      timer.Reset(wait)
+    case <-s.t.BatchReady():
+      if st := s.Status(); st.Failures > 0 || st.Standby {
+        continue
+      }
+      glog.Infof("Queue of %v reached %v changes, integrating early\n",s.t.GetName(),s.t.GetQueueLength())
+      wait, _ := s.integrate()
+      next(wait)
+    case <-refreshed:
+      refresh.Reset(s.refresh())
+    case reply := <-s.forced:
+      if(s.Status().Standby) {
+        reply <- ErrStandby
+        continue
       }
+      glog.Infof("Integrating %v on request\n",s.t.GetName())
+      wait, err := s.integrate()
+      next(wait)
+      reply <- err
     }
   }
 }
+
+// Integrate and sign a root right away, without waiting for the interval
+// Returns the result of the integration, or ErrNotRunning if there's no Run to do it
+func (s *Sequencer) IntegrateNow(ctx context.Context) error {
+  if(!s.Status().Running) {
+    return ErrNotRunning
+  }
+  reply := make(chan error,1)
+  select {
+  case s.forced <- reply:
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+  select {
+  case err := <-reply:
+    return err
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+}
+
+// One IntegrateQueue, returning how long to wait before the next and its error
+func (s *Sequencer) integrate() (time.Duration,error) {
+  err := s.t.IntegrateQueue()
+  s.Lock()
+  defer s.Unlock()
+  s.lastRun, s.lastErr = time.Now(), err
+  wait := s.interval
+  if(err != nil) {
+    s.failures++
+    wait = backoff(s.failures,s.interval)
+    metrics.IntegrationFailures.WithLabelValues(s.t.GetName()).Inc()
+    glog.Errorf("Failed to integrate %v (%v in a row), serving revision %v until a retry in %v: %v\n",s.t.GetName(),s.failures,s.t.GetRevision(),wait,err)
+  } else {
+    if(s.failures > 0) {
+      glog.Infof("Integrated %v after %v failures\n",s.t.GetName(),s.failures)
+    }
+    s.failures, s.lastSuccess = 0, s.lastRun
+  }
+  s.nextRun = s.lastRun.Add(wait)
+  return wait,err
+}
+
+// Sign the latest root again if it is at least the resign interval old, returning how long to wait before checking again
+// Roots signed by integrations in the meantime put the re-sign off
+func (s *Sequencer) refresh() time.Duration {
+  if(s.Status().Standby) {
+    return s.resign
+  }
+  age := time.Since(s.t.GetLastUpdated())
+  if(age < s.resign) {
+    return s.resign-age
+  }
+  glog.V(1).Infof("Root of %v is %v old, signing it again\n",s.t.GetName(),age.Round(time.Second))
+  err := s.t.SignRoot()
+  s.Lock()
+  defer s.Unlock()
+  if(err != nil) {
+    s.resignFailures++
+    wait := backoff(s.resignFailures,s.resign)
+    glog.Errorf("Failed to sign the root of %v again (%v in a row), retrying in %v: %v\n",s.t.GetName(),s.resignFailures,wait,err)
+    return wait
+  }
+  s.resignFailures = 0
+  return s.resign
+}
+
+// minBackoff doubled for each failure after the first, never more than interval
+func backoff(failures int, interval time.Duration) time.Duration {
+  wait := minBackoff
+  for i := 1; i < failures && wait < interval; i++ {
+    wait *= 2
+  }
+  if(wait > interval) {
+    wait = interval
+  }
+  return wait
+}
+
+func (s *Sequencer) Tree() *tree.MerkleTree {
+  return s.t
+}
+
+func (s *Sequencer) Status() Status {
+  s.RLock()
+  defer s.RUnlock()
+  st := Status{Running: s.running, Standby: s.standby, Started: s.started, LastRun: s.lastRun, LastSuccess: s.lastSuccess, Failures: s.failures, NextRun: s.nextRun}
+  if(s.lastErr != nil) {
+    st.LastError = s.lastErr.Error()
+  }
+  return st
+}
@@ -0,0 +1,154 @@
+package sequencer
+
+import (
+  "context"
+  "errors"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+  "revocation-server/tree"
+  "revocation-server/tree/treetest"
+)
+
+// Poll until ok, failing after a few seconds
+func waitFor(t *testing.T, what string, ok func() bool) {
+  for deadline := time.Now().Add(5*time.Second); !ok(); time.Sleep(time.Millisecond) {
+    if(time.Now().After(deadline)) {
+      t.Fatalf("timed out waiting for %v",what)
+    }
+  }
+}
+
+func TestBackoff(t *testing.T) {
+  tests := []struct {
+    failures int
+    interval time.Duration
+    want time.Duration
+  }{
+    {1, time.Hour, time.Second},
+    {2, time.Hour, 2*time.Second},
+    {5, time.Hour, 16*time.Second},
+    {20, time.Hour, time.Hour},
+    {3, 3*time.Second, 3*time.Second},
+    {1, 100*time.Millisecond, 100*time.Millisecond},
+  }
+  for _,test := range(tests) {
+    if got := backoff(test.failures,test.interval); got != test.want {
+      t.Errorf("backoff(%v,%v) = %v, want %v",test.failures,test.interval,got,test.want)
+    }
+  }
+}
+
+func TestIntegrateNow(t *testing.T) {
+  tr := treetest.NewTree(t)
+  // Batches fail to publish while failing is set
+  var mu sync.Mutex
+  failing := false
+  tr.SetPublish(func(record []byte) error {
+    mu.Lock()
+    defer mu.Unlock()
+    if(failing && strings.HasPrefix(string(record),`{"Batch"`)) {
+      return errors.New("backend down")
+    }
+    return nil
+  })
+  setFailing := func(f bool) {
+    mu.Lock()
+    failing = f
+    mu.Unlock()
+  }
+  s := New(tr,time.Hour)
+  ctx := context.Background()
+  if err := s.IntegrateNow(ctx); err != ErrNotRunning {
+    t.Fatalf("IntegrateNow before Run = %v, want ErrNotRunning",err)
+  }
+  done := make(chan bool)
+  defer close(done)
+  go s.Run(done)
+  waitFor(t,"Run to start",func() bool {return s.Status().Running})
+
+  tests := []struct {
+    name string
+    standby bool
+    failing bool
+    err string //empty if the integration succeeds
+    integrated bool
+    queued int
+    failures int
+  }{
+    {"integrated", false, false, "", true, 0, 0},
+    {"on standby", true, false, ErrStandby.Error(), false, 1, 0},
+    // The batch stays queued, so the failures' revocations pile up
+    {"failed", false, true, "backend down", false, 1, 1},
+    {"failed again", false, true, "backend down", false, 2, 2},
+    {"recovered", false, false, "", true, 0, 0},
+  }
+  for i,test := range(tests) {
+    revision := tr.GetRevision()
+    if(test.integrated) {
+      revision++
+    }
+    if _, err := tr.AddNode(tree.Revocation{Serial: uint64(i+1), RevokedAt: time.Now()}); err != nil {t.Fatal(err)}
+    s.SetStandby(test.standby)
+    setFailing(test.failing)
+    err := s.IntegrateNow(ctx)
+    if(test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(),test.err))) {
+      t.Errorf("%v: IntegrateNow = %v, want %q",test.name,err,test.err)
+    }
+    st := s.Status()
+    if(tr.GetRevision() != revision || tr.GetQueueLength() != test.queued || st.Failures != test.failures || (st.LastError != "") != (test.failures > 0)) {
+      t.Errorf("%v: revision %v with %v queued, status %+v, want revision %v with %v queued after %v failures",test.name,tr.GetRevision(),tr.GetQueueLength(),st,revision,test.queued,test.failures)
+    }
+    if(test.failures > 0 && st.NextRun.Sub(st.LastRun) != backoff(test.failures,time.Hour)) {
+      t.Errorf("%v: next run %v after the last, want the backoff %v",test.name,st.NextRun.Sub(st.LastRun),backoff(test.failures,time.Hour))
+    }
+    // Leave the queue empty after standby
+    if(test.standby) {
+      s.SetStandby(false)
+      if err := s.IntegrateNow(ctx); err != nil {t.Fatal(err)}
+    }
+  }
+}
+
+func TestBatchTrigger(t *testing.T) {
+  tr := treetest.NewTree(t)
+  tr.SetBatchTrigger(3)
+  s := New(tr,time.Hour)
+  done := make(chan bool)
+  defer close(done)
+  go s.Run(done)
+  waitFor(t,"Run to start",func() bool {return s.Status().Running})
+  for serial := uint64(1); serial <= 2; serial++ {
+    if _, err := tr.AddNode(tree.Revocation{Serial: serial, RevokedAt: time.Now()}); err != nil {t.Fatal(err)}
+  }
+  time.Sleep(20*time.Millisecond)
+  if(tr.GetRevision() != 0) {
+    t.Fatalf("integrated 2 changes, under the trigger of 3")
+  }
+  if _, err := tr.AddNode(tree.Revocation{Serial: 3, RevokedAt: time.Now()}); err != nil {t.Fatal(err)}
+  waitFor(t,"the queue to be integrated early",func() bool {return tr.GetRevision() == 1 && tr.GetQueueLength() == 0})
+}
+
+func TestResign(t *testing.T) {
+  tr := treetest.NewTree(t)
+  s := New(tr,time.Hour)
+  s.SetResignInterval(20*time.Millisecond)
+  done := make(chan bool)
+  defer close(done)
+  go s.Run(done)
+  signed := tr.GetLastUpdated()
+  waitFor(t,"the root to be signed again",func() bool {return tr.GetLastUpdated().After(signed)})
+  if(tr.GetRevision() != 0) {
+    t.Errorf("re-signing moved the tree to revision %v",tr.GetRevision())
+  }
+
+  // Not on standby
+  s.SetStandby(true)
+  time.Sleep(30*time.Millisecond)
+  signed = tr.GetLastUpdated()
+  time.Sleep(60*time.Millisecond)
+  if(!tr.GetLastUpdated().Equal(signed)) {
+    t.Errorf("root signed again on standby")
+  }
+}
@@ -3,8 +3,10 @@ package signer
 import (
 	"crypto"
 	"crypto/rand"
+	"time"
 
 	"github.com/golang/glog"
+	"revocation-server/metrics"
 	"revocation-server/types"
 	"golang.org/x/crypto/ed25519"
 )
@@ -52,6 +54,7 @@ func (s *Signer) Public() crypto.PublicKey {
 // Sign obtains a signature over the input data; this typically (but not always)
 // involves first hashing the input data.
 func (s *Signer) Sign(data []byte) ([]byte, error) {
+	defer metrics.ObserveSigning("log", time.Now())
 	if s.Hash == noHash {
 		return s.Signer.Sign(rand.Reader, data, noHash)
 	}
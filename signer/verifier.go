@@ -0,0 +1,57 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// VerifySignature checks that sig is a valid signature over data by pub, where
+// hash is the hash the Signer applied to data before signing. It is the
+// counterpart of Signer.Sign for clients that only hold the public key.
+func VerifySignature(pub crypto.PublicKey, hash crypto.Hash, data, sig []byte) error {
+	if pub == nil {
+		return errors.New("signer: nil public key")
+	}
+	if k, ok := pub.(ed25519.PublicKey); ok {
+		if !ed25519.Verify(k, data, sig) {
+			return errors.New("signer: ed25519 verification failed")
+		}
+		return nil
+	}
+
+	if hash == noHash {
+		return errors.New("signer: a hash is required for non-ed25519 keys")
+	}
+	h := hash.New()
+	h.Write(data)
+	digest := h.Sum(nil)
+
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		var ecdsaSig struct {
+			R, S *big.Int
+		}
+		rest, err := asn1.Unmarshal(sig, &ecdsaSig)
+		if err != nil {
+			return fmt.Errorf("signer: failed to unmarshal ECDSA signature: %v", err)
+		}
+		if len(rest) != 0 {
+			return errors.New("signer: trailing data after ECDSA signature")
+		}
+		if !ecdsa.Verify(k, digest, ecdsaSig.R, ecdsaSig.S) {
+			return errors.New("signer: ECDSA verification failed")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+	default:
+		return fmt.Errorf("signer: unsupported public key type %T", pub)
+	}
+}
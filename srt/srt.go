@@ -0,0 +1,157 @@
+package srt
+
+import (
+  "crypto"
+  "errors"
+  "fmt"
+  "time"
+  "github.com/google/certificate-transparency-go/tls"
+  "revocation-server/crypto/ocsp"
+  "revocation-server/signer"
+  "revocation-server/tree"
+  "revocation-server/types"
+)
+
+//
+// Package SRT
+// Signed Revocation Timestamps, returned for every submission
+// Like a CT SCT, the log signs a promise that the revocation will be in the tree by a deadline (one mmd after submission)
+// A root signed after the deadline whose inclusion proof shows the serial was never changed is then proof the log misbehaved
+//
+
+// RevocationTimestampV1 holds the TLS-deserialization of the following structure
+// (described in RFC5246 section 4 notation):
+// struct {
+//   opaque receipt_id<1..255>;
+//   uint64 serial;
+//   uint8 reason;
+//   uint64 submitted_nanos;
+//   uint64 deadline_nanos;
+// } RevocationTimestampV1;
+type RevocationTimestampV1 struct {
+  ReceiptID []byte `tls:"minlen:1,maxlen:255"`
+  Serial uint64
+  Reason uint8
+  SubmittedNanos uint64
+  DeadlineNanos uint64
+}
+
+// Signature is by the log key over the TLS serialization of RevocationTimestampV1
+// Reason is removeFromCRL for a release
+type SignedRevocationTimestamp struct {
+  ReceiptID string
+  Serial uint64
+  Reason int
+  SubmittedAt time.Time
+  IntegrateBy time.Time
+  Signature []byte
+}
+
+// Returned by CheckPromise when one root can't show whether the promise was kept
+// A held serial may have been released since, or a released serial held or revoked again,
+// consistency proofs from the first root after the deadline are needed to tell
+var ErrInconclusive = errors.New("Root does not show whether the promise was kept")
+
+// Evidence that the log did not integrate a revocation it promised to
+// Anyone holding the log's public key and knowing its height can check it with Check
+// The height isn't part of the evidence, whoever presents it could pick one that makes a mismatched proof verify
+type Misbehaviour struct {
+  Timestamp SignedRevocationTimestamp
+  Root types.SignedLogRoot //signed at or after the deadline
+  Proof [][]byte //inclusion proof for the serial in Root
+}
+
+func Sign(r tree.Receipt, s *signer.Signer) (*SignedRevocationTimestamp,error) {
+  t := &SignedRevocationTimestamp{
+    ReceiptID: r.ID,
+    Serial: r.Serial,
+    Reason: r.Reason,
+    SubmittedAt: r.SubmittedAt,
+    IntegrateBy: r.IntegrateBy,
+  }
+  b, err := t.marshal()
+  if err != nil {return nil,err}
+  t.Signature, err = s.Sign(b)
+  if err != nil {return nil,err}
+  return t,nil
+}
+
+// Check the signature against the log's public key
+func (t *SignedRevocationTimestamp) Verify(pub crypto.PublicKey) error {
+  b, err := t.marshal()
+  if err != nil {return err}
+  if err := signer.VerifySignature(pub,crypto.SHA256,b,t.Signature); err != nil {
+    return fmt.Errorf("Invalid revocation timestamp signature: %v",err)
+  }
+  return nil
+}
+
+func (t *SignedRevocationTimestamp) marshal() ([]byte,error) {
+  if(t.Reason < 0 || t.Reason > 255) {
+    return nil,fmt.Errorf("Invalid reason %v",t.Reason)
+  }
+  return tls.Marshal(RevocationTimestampV1{
+    []byte(t.ReceiptID),
+    t.Serial,
+    uint8(t.Reason),
+    uint64(t.SubmittedAt.UnixNano()),
+    uint64(t.IntegrateBy.UnixNano()),
+  })
+}
+
+// Check whether the log kept the promise in t, using a root it signed at or after the deadline
+// and the inclusion proof for the serial in that root
+// height should come from the log's configuration, see tree.HeightForMaxCerts
+// Returns the evidence if the promise was broken, nil if it was kept,
+// and an error (possibly ErrInconclusive) if the inputs don't show either
+func CheckPromise(pub crypto.PublicKey, height int, t *SignedRevocationTimestamp, slr *types.SignedLogRoot, proof [][]byte) (*Misbehaviour,error) {
+  m := &Misbehaviour{*t,*slr,proof}
+  kept, err := m.judge(pub,height)
+  if err != nil {return nil,err}
+  if(kept) {
+    return nil,nil
+  }
+  return m,nil
+}
+
+// Check the evidence holds up: every signature is valid and the root shows the promise was broken
+// height should come from the log's configuration, as for CheckPromise, never from whoever presents the evidence
+func (m *Misbehaviour) Check(pub crypto.PublicKey, height int) error {
+  kept, err := m.judge(pub,height)
+  if err != nil {return err}
+  if(kept) {
+    return errors.New("Root shows the promise was kept")
+  }
+  return nil
+}
+
+func (m *Misbehaviour) judge(pub crypto.PublicKey, height int) (bool,error) {
+  if err := m.Timestamp.Verify(pub); err != nil {return false,err}
+  if err := signer.VerifySignature(pub,crypto.SHA256,m.Root.LogRoot,m.Root.LogRootSignature); err != nil {
+    return false,fmt.Errorf("Invalid log root signature: %v",err)
+  }
+  var root types.LogRootV1
+  if err := root.UnmarshalBinary(m.Root.LogRoot); err != nil {return false,err}
+  if(root.TimestampNanos < uint64(m.Timestamp.IntegrateBy.UnixNano())) {
+    return false,fmt.Errorf("Root at revision %v was signed before the deadline",root.Revision)
+  }
+
+  state, err := tree.InclusionProofState(height,root.RootHash,m.Timestamp.Serial,m.Proof)
+  if err != nil {return false,err}
+
+  // Revocation is permanent, a hold can only become a revocation, and a release can be undone
+  switch m.Timestamp.Reason {
+  case ocsp.RemoveFromCRL:
+    if(state != tree.Absent) {
+      return false,ErrInconclusive
+    }
+    return true,nil
+  case ocsp.CertificateHold:
+    if(state == tree.Absent) {
+      return false,ErrInconclusive
+    }
+    return true,nil
+  default:
+    return state == tree.Revoked,nil
+  }
+}
@@ -0,0 +1,91 @@
+package srt
+
+import (
+  "strings"
+  "testing"
+  "time"
+  "revocation-server/crypto/ocsp"
+  "revocation-server/tree"
+  "revocation-server/tree/treetest"
+)
+
+func TestCheckPromise(t *testing.T) {
+  s := treetest.NewSigner(t)
+  tr := treetest.NewTreeWith(s)
+  submitted := time.Now().Add(-time.Minute)
+  if _, err := tr.AddNodes([]tree.Revocation{{Serial: 4, RevokedAt: submitted},{Serial: 7, Reason: ocsp.CertificateHold, RevokedAt: submitted}}); err != nil {t.Fatal(err)}
+  if err := tr.IntegrateQueue(); err != nil {t.Fatal(err)}
+  sth := tr.GetSth()
+  other := treetest.NewTree(t)
+
+  promise := func(serial uint64, reason int, deadline time.Time) *SignedRevocationTimestamp {
+    ts, err := Sign(tree.Receipt{ID: "receipt", Serial: serial, Reason: reason, SubmittedAt: submitted, IntegrateBy: deadline},s)
+    if err != nil {t.Fatal(err)}
+    return ts
+  }
+  deadline := submitted.Add(time.Second)
+  tampered := promise(4,ocsp.KeyCompromise,deadline)
+  tampered.Serial = 5
+
+  tests := []struct {
+    name string
+    ts *SignedRevocationTimestamp
+    proofFor uint64
+    root *tree.MerkleTree
+    broken bool
+    err string //empty if CheckPromise decides
+  }{
+    {"revocation integrated", promise(4,ocsp.KeyCompromise,deadline), 4, tr, false, ""},
+    {"revocation missing", promise(5,ocsp.KeyCompromise,deadline), 5, tr, true, ""},
+    {"hold integrated", promise(7,ocsp.CertificateHold,deadline), 7, tr, false, ""},
+    {"hold revoked since", promise(4,ocsp.CertificateHold,deadline), 4, tr, false, ""},
+    {"hold missing or released since", promise(5,ocsp.CertificateHold,deadline), 5, tr, false, "does not show"},
+    {"release integrated", promise(5,ocsp.RemoveFromCRL,deadline), 5, tr, false, ""},
+    {"release missing or held again", promise(7,ocsp.RemoveFromCRL,deadline), 7, tr, false, "does not show"},
+    {"root signed before the deadline", promise(5,ocsp.KeyCompromise,time.Now().Add(time.Hour)), 5, tr, false, "before the deadline"},
+    {"timestamp edited", tampered, 5, tr, false, "Invalid revocation timestamp signature"},
+    {"root signed by another key", promise(5,ocsp.KeyCompromise,deadline), 5, other, false, "Invalid log root signature"},
+  }
+  for _,test := range(tests) {
+    proof, err := tr.GetInclusionProof(test.proofFor)
+    if err != nil {t.Fatal(err)}
+    root := sth
+    if(test.root != tr) {
+      root = test.root.GetSth()
+    }
+    m, err := CheckPromise(s.Public(),tr.GetHeight(),test.ts,root,proof)
+    if(test.err != "") {
+      if(err == nil || !strings.Contains(err.Error(),test.err)) {
+        t.Errorf("%v: CheckPromise = %v, want an error containing %q",test.name,err,test.err)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("%v: CheckPromise = %v",test.name,err)
+      continue
+    }
+    if((m != nil) != test.broken) {
+      t.Errorf("%v: CheckPromise found misbehaviour %v, want %v",test.name,m != nil,test.broken)
+      continue
+    }
+    if(m == nil) {
+      continue
+    }
+    // The evidence stands on its own given the log's height, but not at another height
+    // or once the proof is swapped for another serial's
+    if err := m.Check(s.Public(),tr.GetHeight()); err != nil {
+      t.Errorf("%v: Check = %v",test.name,err)
+    }
+    if err := m.Check(s.Public(),tr.GetHeight()-1); err == nil {
+      t.Errorf("%v: Check accepted the evidence at height %v",test.name,tr.GetHeight()-1)
+    }
+    m.Proof, _ = tr.GetInclusionProof(4)
+    if err := m.Check(s.Public(),tr.GetHeight()); err == nil {
+      t.Errorf("%v: Check accepted a proof for serial 4",test.name)
+    }
+  }
+
+  if _, err := Sign(tree.Receipt{ID: "receipt", Serial: 4, Reason: 256},s); err == nil {
+    t.Errorf("Sign accepted reason 256")
+  }
+}
@@ -0,0 +1,201 @@
+package tlsconfig
+
+import (
+  "crypto/tls"
+  "crypto/x509"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "strings"
+  "sync"
+  "github.com/golang/glog"
+  "revocation-server/api"
+)
+
+//
+// Package Tlsconfig
+// TLS for the submission and admin apis, and for grpc
+// The certificate and client CAs are read from disk again on Reload (SIGHUP), each handshake uses the latest ones,
+// so certificates can be rotated without dropping connections or restarting the server
+// OCSP stays on plain http, as OCSP clients expect, see RequireTLS
+//
+
+// Client certificate policies, for Options.ClientAuth
+const (
+  ClientAuthNone = "none"
+  ClientAuthRequest = "request" //ask for a certificate, connections without one are still accepted
+  ClientAuthRequire = "require" //refuse connections without a certificate
+)
+
+type Options struct {
+  CertFile string
+  KeyFile string
+  MinVersion string //1.0, 1.1, 1.2 or 1.3
+  Ciphers string //comma separated names from tls.CipherSuites, empty for Go's defaults. TLS 1.3 suites aren't configurable
+  ClientAuth string //none, request or require
+  ClientCAFile string //PEM CAs client certificates must chain to, empty to accept any certificate (auth matches them by hash)
+}
+
+type Reloader struct {
+  opts Options
+  base *tls.Config
+  sync.RWMutex
+  cert *tls.Certificate
+  clientCAs *x509.CertPool
+}
+
+// Check opts and load the certificate and client CAs
+func New(opts Options) (*Reloader, error) {
+  base, err := opts.base()
+  if err != nil {
+    return nil, err
+  }
+  r := &Reloader{opts: opts, base: base}
+  if err := r.Reload(); err != nil {
+    return nil, err
+  }
+  return r, nil
+}
+
+// Check the version, cipher and client auth settings, without reading any files
+func (opts Options) Check() error {
+  _, err := opts.base()
+  return err
+}
+
+func (opts Options) base() (*tls.Config, error) {
+  min, err := ParseMinVersion(opts.MinVersion)
+  if err != nil {
+    return nil, err
+  }
+  ciphers, err := ParseCiphers(opts.Ciphers)
+  if err != nil {
+    return nil, err
+  }
+  // HTTP/2 (RFC 7540 9.2.2) needs one of these below TLS 1.3
+  if(ciphers != nil && min < tls.VersionTLS13) {
+    h2 := false
+    for _, id := range(ciphers) {
+      h2 = h2 || id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+    }
+    if(!h2) {
+      return nil, fmt.Errorf("cipher suites must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 for HTTP/2")
+    }
+  }
+  clientAuth, err := parseClientAuth(opts.ClientAuth, opts.ClientCAFile != "")
+  if err != nil {
+    return nil, err
+  }
+  return &tls.Config{
+    MinVersion: min,
+    CipherSuites: ciphers,
+    ClientAuth: clientAuth,
+    NextProtos: []string{"h2", "http/1.1"},
+  }, nil
+}
+
+// Read the certificate, key and client CAs again, keeping the old ones if any can't be read
+func (r *Reloader) Reload() error {
+  cert, err := tls.LoadX509KeyPair(r.opts.CertFile, r.opts.KeyFile)
+  if err != nil {
+    return fmt.Errorf("loading tls certificate: %v", err)
+  }
+  var pool *x509.CertPool
+  if(r.opts.ClientCAFile != "") {
+    b, err := ioutil.ReadFile(r.opts.ClientCAFile)
+    if err != nil {
+      return fmt.Errorf("loading client CAs: %v", err)
+    }
+    pool = x509.NewCertPool()
+    if(!pool.AppendCertsFromPEM(b)) {
+      return fmt.Errorf("no certificates found in %v", r.opts.ClientCAFile)
+    }
+  }
+  r.Lock()
+  r.cert, r.clientCAs = &cert, pool
+  r.Unlock()
+  glog.Infof("Loaded tls certificate %v\n", r.opts.CertFile)
+  return nil
+}
+
+// Config for http and grpc servers, each handshake gets the certificate and client CAs loaded last
+func (r *Reloader) Config() *tls.Config {
+  c := r.base.Clone()
+  c.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+    r.RLock()
+    defer r.RUnlock()
+    conn := r.base.Clone()
+    conn.Certificates = []tls.Certificate{*r.cert}
+    conn.ClientCAs = r.clientCAs
+    return conn, nil
+  }
+  return c
+}
+
+// Refuse requests that didn't arrive over TLS with 403, for endpoints that must only be served over TLS
+func RequireTLS(next http.HandlerFunc) http.HandlerFunc {
+  return func(rw http.ResponseWriter, req *http.Request) {
+    if(req.TLS == nil) {
+      api.WriteError(rw, http.StatusForbidden, api.CodeForbidden, "Endpoint is only served over https", nil)
+      return
+    }
+    next(rw, req)
+  }
+}
+
+func ParseMinVersion(v string) (uint16, error) {
+  switch v {
+  case "1.0":
+    return tls.VersionTLS10, nil
+  case "1.1":
+    return tls.VersionTLS11, nil
+  case "", "1.2":
+    return tls.VersionTLS12, nil
+  case "1.3":
+    return tls.VersionTLS13, nil
+  default:
+    return 0, fmt.Errorf("unknown tls version %q, use 1.0, 1.1, 1.2 or 1.3", v)
+  }
+}
+
+// Cipher suite ids for a comma separated list of names, nil for an empty list
+// Suites Go considers insecure are refused
+func ParseCiphers(names string) ([]uint16, error) {
+  if(strings.TrimSpace(names) == "") {
+    return nil, nil
+  }
+  known := make(map[string]uint16)
+  for _, s := range(tls.CipherSuites()) {
+    known[s.Name] = s.ID
+  }
+  var ids []uint16
+  for _, name := range(strings.Split(names, ",")) {
+    name = strings.TrimSpace(name)
+    id, ok := known[name]
+    if(!ok) {
+      return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+    }
+    ids = append(ids, id)
+  }
+  return ids, nil
+}
+
+// Without client CAs certificates are only asked for, auth matches them against registered hashes
+func parseClientAuth(policy string, haveCAs bool) (tls.ClientAuthType, error) {
+  switch policy {
+  case "", ClientAuthNone:
+    return tls.NoClientCert, nil
+  case ClientAuthRequest:
+    if(haveCAs) {
+      return tls.VerifyClientCertIfGiven, nil
+    }
+    return tls.RequestClientCert, nil
+  case ClientAuthRequire:
+    if(haveCAs) {
+      return tls.RequireAndVerifyClientCert, nil
+    }
+    return tls.RequireAnyClientCert, nil
+  default:
+    return tls.NoClientCert, fmt.Errorf("unknown client auth %q, use none, request or require", policy)
+  }
+}
@@ -0,0 +1,142 @@
+package tlsconfig
+
+import (
+  "bytes"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/pem"
+  "io/ioutil"
+  "math/big"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestCheck(t *testing.T) {
+  tests := []struct {
+    name string
+    opts Options
+    min uint16
+    clientAuth tls.ClientAuthType
+    err string //empty if the options are valid
+  }{
+    {"defaults", Options{}, tls.VersionTLS12, tls.NoClientCert, ""},
+    {"tls 1.3", Options{MinVersion: "1.3"}, tls.VersionTLS13, tls.NoClientCert, ""},
+    {"unknown version", Options{MinVersion: "1.4"}, 0, 0, "unknown tls version"},
+    {"ciphers for http/2", Options{Ciphers: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}, tls.VersionTLS12, tls.NoClientCert, ""},
+    {"no cipher for http/2", Options{Ciphers: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}, 0, 0, "for HTTP/2"},
+    {"any ciphers under tls 1.3", Options{MinVersion: "1.3", Ciphers: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}, tls.VersionTLS13, tls.NoClientCert, ""},
+    {"insecure cipher", Options{Ciphers: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_RSA_WITH_RC4_128_SHA"}, 0, 0, `unknown or insecure cipher suite "TLS_RSA_WITH_RC4_128_SHA"`},
+    {"request without CAs", Options{ClientAuth: ClientAuthRequest}, tls.VersionTLS12, tls.RequestClientCert, ""},
+    {"request with CAs", Options{ClientAuth: ClientAuthRequest, ClientCAFile: "ca.pem"}, tls.VersionTLS12, tls.VerifyClientCertIfGiven, ""},
+    {"require without CAs", Options{ClientAuth: ClientAuthRequire}, tls.VersionTLS12, tls.RequireAnyClientCert, ""},
+    {"require with CAs", Options{ClientAuth: ClientAuthRequire, ClientCAFile: "ca.pem"}, tls.VersionTLS12, tls.RequireAndVerifyClientCert, ""},
+    {"unknown client auth", Options{ClientAuth: "optional"}, 0, 0, "unknown client auth"},
+  }
+  for _, test := range(tests) {
+    if err := test.opts.Check(); (err == nil) != (test.err == "") {
+      t.Errorf("%v: Check = %v", test.name, err)
+    }
+    c, err := test.opts.base()
+    if(test.err != "") {
+      if(err == nil || !strings.Contains(err.Error(), test.err)) {
+        t.Errorf("%v: Check = %v, want an error containing %q", test.name, err, test.err)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("%v: Check = %v", test.name, err)
+      continue
+    }
+    if(c.MinVersion != test.min || c.ClientAuth != test.clientAuth) {
+      t.Errorf("%v: min version %x and client auth %v, want %x and %v", test.name, c.MinVersion, c.ClientAuth, test.min, test.clientAuth)
+    }
+  }
+}
+
+// Write a new self-signed certificate and its key to dir, returning the certificate's DER
+func writeCert(t *testing.T, dir string, name string) []byte {
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {t.Fatal(err)}
+  template := &x509.Certificate{
+    SerialNumber: big.NewInt(1),
+    Subject: pkix.Name{CommonName: name},
+    NotBefore: time.Now().Add(-time.Hour),
+    NotAfter: time.Now().Add(time.Hour),
+  }
+  der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+  if err != nil {t.Fatal(err)}
+  keyDer, err := x509.MarshalECPrivateKey(key)
+  if err != nil {t.Fatal(err)}
+  if err := ioutil.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {t.Fatal(err)}
+  if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {t.Fatal(err)}
+  return der
+}
+
+func TestReload(t *testing.T) {
+  dir, err := ioutil.TempDir("", "tlsconfig")
+  if err != nil {t.Fatal(err)}
+  defer os.RemoveAll(dir)
+  first := writeCert(t, dir, "first")
+  opts := Options{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+  r, err := New(opts)
+  if err != nil {t.Fatal(err)}
+  c := r.Config()
+  served := func() []byte {
+    conn, err := c.GetConfigForClient(&tls.ClientHelloInfo{})
+    if err != nil {t.Fatal(err)}
+    return conn.Certificates[0].Certificate[0]
+  }
+  if(!bytes.Equal(served(), first)) {
+    t.Fatalf("serving another certificate than the one loaded")
+  }
+
+  // Rotated, the same config serves the new certificate
+  second := writeCert(t, dir, "second")
+  if err := r.Reload(); err != nil {t.Fatal(err)}
+  if(!bytes.Equal(served(), second)) {
+    t.Errorf("still serving the first certificate after Reload")
+  }
+
+  // A broken file leaves the last good certificate in place
+  if err := ioutil.WriteFile(opts.KeyFile, []byte("not a key"), 0600); err != nil {t.Fatal(err)}
+  if err := r.Reload(); err == nil {
+    t.Errorf("Reload accepted a broken key")
+  }
+  if(!bytes.Equal(served(), second)) {
+    t.Errorf("broken Reload replaced the certificate")
+  }
+
+  opts.ClientCAFile = opts.KeyFile
+  if _, err := New(opts); err == nil || !strings.Contains(err.Error(), "loading tls certificate") {
+    t.Errorf("New with a broken key = %v", err)
+  }
+  writeCert(t, dir, "third")
+  if _, err := New(opts); err == nil || !strings.Contains(err.Error(), "no certificates found") {
+    t.Errorf("New with a key for client CAs = %v", err)
+  }
+}
+
+func TestRequireTLS(t *testing.T) {
+  h := RequireTLS(func(rw http.ResponseWriter, req *http.Request) {})
+  for _, secure := range([]bool{false, true}) {
+    req := httptest.NewRequest("POST", "/v1/revoke", nil)
+    want := http.StatusForbidden
+    if(secure) {
+      req.TLS, want = &tls.ConnectionState{}, http.StatusOK
+    }
+    rw := httptest.NewRecorder()
+    h(rw, req)
+    if(rw.Code != want) {
+      t.Errorf("over tls %v: status %v, want %v", secure, rw.Code, want)
+    }
+  }
+}
@@ -0,0 +1,279 @@
+package tree
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "sort"
+  "sync"
+  "revocation-server/rfc6962"
+)
+
+//
+// Consistency proofs between two revisions of the tree
+// A proof lists every leaf that changed between the revisions, and the hashes of the subtrees that didn't
+// From these the verifier recomputes both roots, so the log can't change a leaf without listing it,
+// and every listed change must be an AllowedTransition
+// Proofs ending at the current revision take their hashes from the nodes, older ones rehash every serial in the
+// tree at that revision, so they are worked out one at a time, and every proof is cached
+//
+
+// Most proofs kept by a tree's proofCache
+const maxCachedProofs = 256
+
+// Consistency proofs already made, by first and second revision, dropping the oldest once there are maxCachedProofs
+// A proof between two revisions never changes, unless Sync replaces the tree's history
+type proofCache struct {
+  sync.Mutex
+  proofs map[[2]uint64]*ConsistencyProof
+  order [][2]uint64
+}
+
+func newProofCache() *proofCache {
+  return &proofCache{proofs: make(map[[2]uint64]*ConsistencyProof)}
+}
+
+func (c *proofCache) reset() {
+  c.Lock()
+  defer c.Unlock()
+  c.proofs = make(map[[2]uint64]*ConsistencyProof)
+  c.order = nil
+}
+
+func (c *proofCache) get(first uint64, second uint64) (*ConsistencyProof,bool) {
+  c.Lock()
+  defer c.Unlock()
+  p, ok := c.proofs[[2]uint64{first,second}]
+  return p,ok
+}
+
+func (c *proofCache) add(p *ConsistencyProof) {
+  key := [2]uint64{p.First,p.Second}
+  c.Lock()
+  defer c.Unlock()
+  if _, ok := c.proofs[key]; ok {
+    return
+  }
+  if(len(c.order) >= maxCachedProofs) {
+    delete(c.proofs,c.order[0])
+    c.order = c.order[1:]
+  }
+  c.proofs[key] = p
+  c.order = append(c.order,key)
+}
+
+type ConsistencyProof struct {
+  First uint64
+  Second uint64
+  Changes []LeafChange //sorted by serial
+  Hashes [][]byte //hashes of the unchanged subtrees next to the changed paths, left to right
+}
+
+type LeafChange struct {
+  Serial uint64
+  Old LeafState
+  New LeafState
+}
+
+// Depth of the leaves, needed to verify consistency proofs
+func (t *MerkleTree) GetHeight() int {
+  return t.height
+}
+
+// Proof that revision second follows from revision first by the listed changes
+// The proof is shared with other callers and must not be modified
+func (t *MerkleTree) GetConsistencyProof(first uint64, second uint64) (*ConsistencyProof,error) {
+  if p, ok := t.proofs.get(first,second); ok {
+    return p,nil
+  }
+  p, err := t.proveConsistency(first,second)
+  if err != nil {
+    return nil,err
+  }
+  t.proofs.add(p)
+  return p,nil
+}
+
+func (t *MerkleTree) proveConsistency(first uint64, second uint64) (*ConsistencyProof,error) {
+  t.RLock()
+  if(second > t.updatedTimes) {
+    t.RUnlock()
+    return nil,fmt.Errorf("Revision %v has not been produced yet, current revision is %v",second,t.updatedTimes)
+  }
+  if(first > second) {
+    t.RUnlock()
+    return nil,fmt.Errorf("First revision %v is after second revision %v",first,second)
+  }
+  if(second == t.updatedTimes) {
+    // The nodes hold every hash at second, so only the changed paths are walked
+    p := &ConsistencyProof{First: first, Second: second}
+    for _,c := range(NetChanges(t.batches[first:])) {
+      p.Changes = append(p.Changes,LeafChange{c.New.Serial,stateOf(c.Old),stateOf(&c.New)})
+    }
+    p.Hashes = t.proveNodes(t.Root,0,p.Changes,[][]byte{})
+    t.RUnlock()
+    return p,nil
+  }
+  t.RUnlock()
+
+  // An older revision is rebuilt from the current leaves, one at a time so requests for them can't take every cpu
+  t.rebuilding.Lock()
+  defer t.rebuilding.Unlock()
+  if p, ok := t.proofs.get(first,second); ok {
+    return p,nil
+  }
+  // Snapshot the current leaves and every batch after first
+  t.RLock()
+  if(t.updatedTimes < second) {
+    t.RUnlock()
+    return nil,fmt.Errorf("Revision %v is no longer in the tree, it was restored from an earlier state",second)
+  }
+  states := make(map[uint64]LeafState,len(t.revocations))
+  for s,r := range(t.revocations) {
+    states[s] = stateOf(&r)
+  }
+  batches := make([]Batch,t.updatedTimes-first)
+  copy(batches,t.batches[first:])
+  t.RUnlock()
+
+  // Roll the leaves back to revision second, each serial changes at most once per batch
+  later := batches[second-first:]
+  for i:=len(later)-1;i>=0;i-- {
+    for _,c := range(later[i].Changes) {
+      if(c.Old == nil) {
+        delete(states,c.New.Serial)
+      } else {
+        states[c.New.Serial] = stateOf(c.Old)
+      }
+    }
+  }
+
+  p := &ConsistencyProof{First: first, Second: second}
+  for _,c := range(NetChanges(batches[:second-first])) {
+    p.Changes = append(p.Changes,LeafChange{c.New.Serial,stateOf(c.Old),stateOf(&c.New)})
+  }
+
+  serials := make([]uint64,0,len(states))
+  for s := range(states) {
+    serials = append(serials,s)
+  }
+  sort.Slice(serials, func(i, j int) bool {return serials[i] < serials[j]})
+
+  p.Hashes = t.proveSubtree(0,p.Changes,serials,states,[][]byte{})
+  return p,nil
+}
+
+// Append the hashes needed to recompute the subtree at depth under n holding changes, at the tree's current revision
+// n is nil for an empty subtree
+func (t *MerkleTree) proveNodes(n *Node, depth int, changes []LeafChange, hashes [][]byte) [][]byte {
+  if(len(changes) == 0) {
+    if(n == nil) {
+      return append(hashes,t.zeroHashes[depth])
+    }
+    return append(hashes,n.Hash)
+  }
+  if(depth == t.height) {
+    return hashes
+  }
+  var left, right *Node
+  if(n != nil) {
+    left, right = n.Left, n.Right
+  }
+  mask := uint64(1) << uint(t.height-1-depth)
+  cs := sort.Search(len(changes), func(i int) bool {return changes[i].Serial&mask > 0})
+  hashes = t.proveNodes(left,depth+1,changes[:cs],hashes)
+  return t.proveNodes(right,depth+1,changes[cs:],hashes)
+}
+
+// Append the hashes needed to recompute the subtree at depth holding changes and serials
+// Both are sorted and lie within the subtree
+func (t *MerkleTree) proveSubtree(depth int, changes []LeafChange, serials []uint64, states map[uint64]LeafState, hashes [][]byte) [][]byte {
+  if(len(changes) == 0) {
+    return append(hashes,t.subtreeHash(depth,serials,states))
+  }
+  if(depth == t.height) { //the changed leaf itself, the verifier knows its hashes
+    return hashes
+  }
+  mask := uint64(1) << uint(t.height-1-depth)
+  cs := sort.Search(len(changes), func(i int) bool {return changes[i].Serial&mask > 0})
+  ss := sort.Search(len(serials), func(i int) bool {return serials[i]&mask > 0})
+  hashes = t.proveSubtree(depth+1,changes[:cs],serials[:ss],states,hashes)
+  return t.proveSubtree(depth+1,changes[cs:],serials[ss:],states,hashes)
+}
+
+// Hash of the subtree at depth holding the (sorted) serials
+func (t *MerkleTree) subtreeHash(depth int, serials []uint64, states map[uint64]LeafState) []byte {
+  if(len(serials) == 0) {
+    return t.zeroHashes[depth]
+  }
+  if(depth == t.height) {
+    return t.leafHash(states[serials[0]])
+  }
+  mask := uint64(1) << uint(t.height-1-depth)
+  ss := sort.Search(len(serials), func(i int) bool {return serials[i]&mask > 0})
+  return t.hashFunc.HashChildren(t.subtreeHash(depth+1,serials[:ss],states),t.subtreeHash(depth+1,serials[ss:],states))
+}
+
+// Check p takes a tree of the given height from oldRoot to newRoot
+// oldRoot and newRoot should come from signed roots at revisions p.First and p.Second,
+// and height from the log's configuration rather than the log itself
+func VerifyConsistencyProof(height int, oldRoot []byte, newRoot []byte, p *ConsistencyProof) error {
+  if(height < 1 || height > 64) {
+    return fmt.Errorf("Invalid tree height %v",height)
+  }
+  for i,c := range(p.Changes) {
+    if(height < 64 && c.Serial >> uint(height) != 0) {
+      return fmt.Errorf("Serial %v does not fit in a tree of height %v",c.Serial,height)
+    }
+    if(i > 0 && c.Serial <= p.Changes[i-1].Serial) {
+      return errors.New("Changes are not sorted by serial")
+    }
+    if(!AllowedTransition(c.Old,c.New)) {
+      return fmt.Errorf("Serial %v changed from %v to %v, which is not allowed",c.Serial,c.Old,c.New)
+    }
+  }
+
+  v := proofVerifier{height, rfc6962.DefaultHasher, precomputeHashes(rfc6962.DefaultHasher,height), p.Hashes}
+  o, n, err := v.walk(0,p.Changes)
+  if err != nil {return err}
+  if(len(v.hashes) != 0) {
+    return fmt.Errorf("%v unused hashes in proof",len(v.hashes))
+  }
+  if(!bytes.Equal(o,nodesHash(oldRoot,v.zeroHashes[0]))) {
+    return errors.New("Proof does not reproduce the first root")
+  }
+  if(!bytes.Equal(n,nodesHash(newRoot,v.zeroHashes[0]))) {
+    return errors.New("Proof does not reproduce the second root")
+  }
+  return nil
+}
+
+type proofVerifier struct {
+  height int
+  hasher *rfc6962.Hasher
+  zeroHashes [][]byte
+  hashes [][]byte //not yet consumed
+}
+
+// Old and new hash of the subtree at depth holding changes, mirrors proveSubtree
+func (v *proofVerifier) walk(depth int, changes []LeafChange) ([]byte,[]byte,error) {
+  if(len(changes) == 0) {
+    if(len(v.hashes) == 0) {
+      return nil,nil,errors.New("Proof is too short")
+    }
+    h := v.hashes[0]
+    v.hashes = v.hashes[1:]
+    return h,h,nil
+  }
+  if(depth == v.height) {
+    c := changes[0]
+    return leafHash(v.hasher,v.zeroHashes,c.Old),leafHash(v.hasher,v.zeroHashes,c.New),nil
+  }
+  mask := uint64(1) << uint(v.height-1-depth)
+  cs := sort.Search(len(changes), func(i int) bool {return changes[i].Serial&mask > 0})
+  lo, ln, err := v.walk(depth+1,changes[:cs])
+  if err != nil {return nil,nil,err}
+  ro, rn, err := v.walk(depth+1,changes[cs:])
+  if err != nil {return nil,nil,err}
+  return v.hasher.HashChildren(lo,ro),v.hasher.HashChildren(ln,rn),nil
+}
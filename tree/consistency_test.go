@@ -0,0 +1,127 @@
+package tree
+
+import (
+  "strings"
+  "testing"
+  "time"
+  "revocation-server/crypto/ocsp"
+  "revocation-server/types"
+)
+
+func rootHashAt(t *testing.T, tr *MerkleTree, revision uint64) []byte {
+  var root types.LogRootV1
+  if err := root.UnmarshalBinary(tr.roots[revision].LogRoot); err != nil {t.Fatal(err)}
+  return root.RootHash
+}
+
+// Revisions 1 to 3: holds, a release, a hold made permanent, and a serial held again after its release
+func newHoldingTree(t *testing.T) *MerkleTree {
+  tr := newTestTree(t)
+  now := time.Now()
+  batches := [][]Revocation{
+    {{Serial: 4, RevokedAt: now},{Serial: 7, Reason: ocsp.CertificateHold, RevokedAt: now},{Serial: 9, Reason: ocsp.CertificateHold, RevokedAt: now}},
+    {{Serial: 7, Reason: ocsp.RemoveFromCRL, RevokedAt: now},{Serial: 9, Reason: ocsp.KeyCompromise, RevokedAt: now},{Serial: 1000, RevokedAt: now}},
+    {{Serial: 7, Reason: ocsp.CertificateHold, RevokedAt: now},{Serial: 5, RevokedAt: now}},
+  }
+  for _,b := range(batches) {
+    if _, err := tr.AddNodes(b); err != nil {t.Fatal(err)}
+    if err := tr.IntegrateQueue(); err != nil {t.Fatal(err)}
+  }
+  return tr
+}
+
+func TestConsistencyProof(t *testing.T) {
+  tr := newHoldingTree(t)
+  // Every pair of revisions, older ones rebuilt from the leaves
+  for second := uint64(0); second <= 3; second++ {
+    for first := uint64(0); first <= second; first++ {
+      p, err := tr.GetConsistencyProof(first,second)
+      if err != nil {t.Fatal(err)}
+      if err := VerifyConsistencyProof(tr.GetHeight(),rootHashAt(t,tr,first),rootHashAt(t,tr,second),p); err != nil {
+        t.Errorf("proof from %v to %v: %v",first,second,err)
+      }
+    }
+  }
+
+  tests := []struct {
+    first uint64
+    second uint64
+    want []LeafChange
+  }{
+    {1, 2, []LeafChange{{7,Held,Absent},{9,Held,Revoked},{1000,Absent,Revoked}}},
+    // 7 is held at both ends, so isn't listed
+    {1, 3, []LeafChange{{5,Absent,Revoked},{9,Held,Revoked},{1000,Absent,Revoked}}},
+    {0, 2, []LeafChange{{4,Absent,Revoked},{9,Absent,Revoked},{1000,Absent,Revoked}}},
+    {2, 2, nil},
+  }
+  for _,test := range(tests) {
+    p, err := tr.GetConsistencyProof(test.first,test.second)
+    if err != nil {t.Fatal(err)}
+    if(len(p.Changes) != len(test.want)) {
+      t.Errorf("proof from %v to %v lists %+v, want %+v",test.first,test.second,p.Changes,test.want)
+      continue
+    }
+    for i := range(test.want) {
+      if(p.Changes[i] != test.want[i]) {
+        t.Errorf("proof from %v to %v lists %+v, want %+v",test.first,test.second,p.Changes,test.want)
+        break
+      }
+    }
+  }
+
+  if _, err := tr.GetConsistencyProof(2,4); err == nil {
+    t.Errorf("GetConsistencyProof(2,4) past the latest revision succeeded")
+  }
+  if _, err := tr.GetConsistencyProof(3,2); err == nil {
+    t.Errorf("GetConsistencyProof(3,2) succeeded")
+  }
+}
+
+func TestVerifyConsistencyProof(t *testing.T) {
+  tr := newHoldingTree(t)
+  oldRoot, newRoot := rootHashAt(t,tr,1), rootHashAt(t,tr,3)
+  proof, err := tr.GetConsistencyProof(1,3)
+  if err != nil {t.Fatal(err)}
+  // Each test edits its own copy
+  edited := func(edit func(p *ConsistencyProof)) *ConsistencyProof {
+    p := &ConsistencyProof{First: proof.First, Second: proof.Second}
+    p.Changes = append(p.Changes,proof.Changes...)
+    p.Hashes = append(p.Hashes,proof.Hashes...)
+    edit(p)
+    return p
+  }
+
+  tests := []struct {
+    name string
+    height int
+    old []byte
+    new []byte
+    proof *ConsistencyProof
+    err string
+  }{
+    {"as made", tr.GetHeight(), oldRoot, newRoot, proof, ""},
+    {"roots swapped", tr.GetHeight(), newRoot, oldRoot, proof, "first root"},
+    {"wrong height", tr.GetHeight()+1, oldRoot, newRoot, proof, "too short"},
+    {"change left out", tr.GetHeight(), oldRoot, newRoot, edited(func(p *ConsistencyProof) {p.Changes = p.Changes[1:]}), ""},
+    {"held listed as revoked", tr.GetHeight(), oldRoot, newRoot, edited(func(p *ConsistencyProof) {p.Changes[1].Old = Absent}), "first root"},
+    {"revocation undone", tr.GetHeight(), oldRoot, newRoot, edited(func(p *ConsistencyProof) {p.Changes[0] = LeafChange{5,Revoked,Absent}}), "not allowed"},
+    {"not sorted", tr.GetHeight(), oldRoot, newRoot, edited(func(p *ConsistencyProof) {p.Changes[0], p.Changes[1] = p.Changes[1], p.Changes[0]}), "not sorted"},
+    {"serial too big", tr.GetHeight(), oldRoot, newRoot, edited(func(p *ConsistencyProof) {p.Changes[2].Serial = 1<<uint(tr.GetHeight())}), "does not fit"},
+    {"hash missing", tr.GetHeight(), oldRoot, newRoot, edited(func(p *ConsistencyProof) {p.Hashes = p.Hashes[1:]}), ""},
+    {"hash added", tr.GetHeight(), oldRoot, newRoot, edited(func(p *ConsistencyProof) {p.Hashes = append(p.Hashes,p.Hashes[0])}), "unused hashes"},
+    {"invalid height", 0, oldRoot, newRoot, proof, "Invalid tree height"},
+  }
+  for _,test := range(tests) {
+    err := VerifyConsistencyProof(test.height,test.old,test.new,test.proof)
+    switch {
+    case test.proof == proof && test.height == tr.GetHeight() && test.err == "":
+      if err != nil {
+        t.Errorf("%v: VerifyConsistencyProof = %v",test.name,err)
+      }
+    case err == nil:
+      t.Errorf("%v: VerifyConsistencyProof accepted the proof",test.name)
+    case !strings.Contains(err.Error(),test.err):
+      t.Errorf("%v: VerifyConsistencyProof = %v, want an error containing %q",test.name,err,test.err)
+    }
+  }
+}
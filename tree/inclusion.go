@@ -0,0 +1,53 @@
+package tree
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "revocation-server/rfc6962"
+)
+
+// The root revision 0 was signed with before consistency proofs, the hash of no data rather than of an empty subtree
+// A tree restored at that root keeps signing it until its first batch, and verifiers take it for the empty tree
+var legacyEmptyRoot = rfc6962.DefaultHasher.EmptyRoot()
+
+// The hash of the nodes a signed root hash stands for, empty for legacyEmptyRoot
+func nodesHash(signed []byte, empty []byte) []byte {
+  if(bytes.Equal(signed,legacyEmptyRoot)) {
+    return empty
+  }
+  return signed
+}
+
+// Height of the tree the server builds for maxCerts, for clients verifying proofs
+func HeightForMaxCerts(maxCerts uint64) int {
+  return getMaxHeight(maxCerts)
+}
+
+// Work out which state the serial's leaf is in from an inclusion proof (as returned by GetInclusionProof)
+// Returns an error if the proof doesn't lead to root for any state
+// height should come from the log's configuration rather than the length of the proof
+func InclusionProofState(height int, root []byte, serial uint64, proof [][]byte) (LeafState,error) {
+  if(len(proof) != height) {
+    return Absent,fmt.Errorf("Proof has %v hashes, want %v",len(proof),height)
+  }
+  if(height < 64 && serial >> uint(height) != 0) {
+    return Absent,fmt.Errorf("Serial %v does not fit in a tree of height %v",serial,height)
+  }
+  hasher := rfc6962.DefaultHasher
+  zeroHashes := precomputeHashes(hasher,height)
+  for _,s := range([]LeafState{Absent,Revoked,Held}) {
+    h := leafHash(hasher,zeroHashes,s)
+    for i,sibling := range(proof) { //proof[0] is the leaf's sibling
+      if((serial >> uint(i)) & 1 == 1) {
+        h = hasher.HashChildren(sibling,h)
+      } else {
+        h = hasher.HashChildren(h,sibling)
+      }
+    }
+    if(bytes.Equal(h,nodesHash(root,zeroHashes[0]))) {
+      return s,nil
+    }
+  }
+  return Absent,errors.New("Inclusion proof does not lead to the root for any leaf value")
+}
@@ -0,0 +1,161 @@
+package tree
+
+import (
+  "crypto/rand"
+  "encoding/hex"
+  "fmt"
+  "time"
+  "github.com/golang/glog"
+)
+
+//
+// Receipts for submitted revocations
+// Every queued revocation gets a receipt, which clients can look up to see when (and whether) it was integrated
+// Once integrated or rejected a receipt is kept for the tree's receipt retention, then forgotten
+//
+
+// Default for SetReceiptRetention
+const DefaultReceiptRetention = 7*24*time.Hour
+
+// Status of a receipt
+const (
+  ReceiptQueued = "queued"
+  ReceiptIntegrated = "integrated"
+  ReceiptRejected = "rejected" //no longer an allowed transition by the time it was integrated
+)
+
+type Receipt struct {
+  ID string
+  Serial uint64
+  Reason int
+  SubmittedAt time.Time
+  IntegrateBy time.Time //the latest a root including the revocation will be signed
+  Status string
+  Revision uint64 //revision of the first root including the revocation, once integrated
+  SettledAt time.Time `json:",omitempty"` //when it was integrated or rejected
+}
+
+// Outcome of a single revocation passed to AddNodes
+const (
+  SubmissionQueued = "queued"
+  SubmissionDuplicate = "duplicate" //the same change is already queued or in the tree, Receipt is the earlier submission's
+  SubmissionAlreadyRevoked = "already-revoked" //Receipt is the revocation in the tree
+)
+
+type Submission struct {
+  Receipt Receipt
+  Status string
+}
+
+// A revocation AddNodes could not queue, Index is its position in the batch
+type SerialError struct {
+  Index int
+  Serial uint64
+  Err string
+}
+
+// Returned by AddNodes when any revocation in the batch can't be queued, in which case none are
+type SubmissionError struct {
+  Errors []SerialError
+}
+
+func (e *SubmissionError) Error() string {
+  if(len(e.Errors) == 1) {
+    return fmt.Sprintf("Serial %v: %v",e.Errors[0].Serial,e.Errors[0].Err)
+  }
+  return fmt.Sprintf("%v revocations could not be queued, first is serial %v: %v",len(e.Errors),e.Errors[0].Serial,e.Errors[0].Err)
+}
+
+// Random receipt ids, generated before taking the lock so AddNodes can't fail halfway through
+func newReceiptIds(n int) ([]string,error) {
+  ids := make([]string,n)
+  for i := range(ids) {
+    b := make([]byte,16)
+    if _, err := rand.Read(b); err != nil {return nil,err}
+    ids[i] = hex.EncodeToString(b)
+  }
+  return ids,nil
+}
+
+// Each queued or in flight change to the same serial integrates in a later batch, and pushes the deadline back one mmd
+// batch holds revocations about to be added to the queue
+// Caller must hold the lock
+func (t *MerkleTree) newReceipt(id string, r Revocation, batch []Revocation) *Receipt {
+  ahead := 0
+  for _,q := range([][]Revocation{t.inflight,t.queue,batch}) {
+    for _,e := range(q) {
+      if(e.Serial == r.Serial) {
+        ahead++
+      }
+    }
+  }
+  now := time.Now()
+  receipt := &Receipt{
+    ID: id,
+    Serial: r.Serial,
+    Reason: r.Reason,
+    SubmittedAt: now,
+    IntegrateBy: now.Add(t.mmd*time.Duration(1+ahead)),
+    Status: ReceiptQueued,
+  }
+  t.receipts[id] = receipt
+  return receipt
+}
+
+// Caller must hold the lock, and have already incremented updatedTimes for the batch
+func (t *MerkleTree) settleReceipt(receipt *Receipt, status string, at time.Time) {
+  if(receipt == nil) {
+    return
+  }
+  receipt.Status = status
+  receipt.SettledAt = at
+  if(status == ReceiptIntegrated) {
+    receipt.Revision = t.updatedTimes
+  }
+  t.settled = append(t.settled,receipt)
+}
+
+// Forget receipts settled more than the retention ago, they can no longer be looked up by id
+// Revocations still point at their receipt, so a duplicate submission is still given it
+// Caller must hold the lock
+func (t *MerkleTree) pruneReceipts(now time.Time) {
+  if(t.receiptRetention <= 0) {
+    return
+  }
+  pruned := 0
+  for pruned < len(t.settled) && now.Sub(t.settled[pruned].SettledAt) > t.receiptRetention {
+    delete(t.receipts,t.settled[pruned].ID)
+    pruned++
+  }
+  t.settled = t.settled[pruned:]
+  if(pruned > 0) {
+    glog.V(2).Infof("Pruned %v receipts settled over %v ago from %v\n",pruned,t.receiptRetention,t.GetName())
+  }
+}
+
+// Keep receipts for d once integrated or rejected, 0 to keep them forever
+func (t *MerkleTree) SetReceiptRetention(d time.Duration) {
+  t.Lock()
+  t.receiptRetention = d
+  t.Unlock()
+}
+
+// Receipt of the earlier submission that took serial to its current state
+// Every revocation gets a receipt from AddNodes, but in case there is none this stands in for it
+func earlierReceipt(serial uint64, receipt *Receipt) Receipt {
+  if(receipt != nil) {
+    return *receipt
+  }
+  return Receipt{Serial: serial, Status: ReceiptIntegrated}
+}
+
+// Current state of the submission with the given receipt id
+func (t *MerkleTree) GetReceipt(id string) (Receipt,bool) {
+  t.RLock()
+  defer t.RUnlock()
+  r, ok := t.receipts[id]
+  if(!ok) {
+    return Receipt{},false
+  }
+  return *r,true
+}
@@ -0,0 +1,112 @@
+package tree
+
+import (
+  "testing"
+  "time"
+  "revocation-server/crypto/ocsp"
+)
+
+// Each change to a serial already queued or staged integrates one batch later, so its deadline is one mmd further off
+func TestIntegrateBy(t *testing.T) {
+  tr := newTestTree(t)
+  hold := func(serial uint64) Revocation {return Revocation{Serial: serial, Reason: ocsp.CertificateHold}}
+  release := func(serial uint64) Revocation {return Revocation{Serial: serial, Reason: ocsp.RemoveFromCRL}}
+  submit := func(rs ...Revocation) []Receipt {
+    subs, err := tr.AddNodes(rs)
+    if err != nil {t.Fatal(err)}
+    var receipts []Receipt
+    for _,s := range(subs) {
+      receipts = append(receipts,s.Receipt)
+    }
+    return receipts
+  }
+  check := func(what string, r Receipt, mmds int) {
+    if got := r.IntegrateBy.Sub(r.SubmittedAt); got != time.Duration(mmds)*tr.mmd {
+      t.Errorf("%v: integrate by %v after submission, want %v mmds of %v",what,got,mmds,tr.mmd)
+    }
+  }
+
+  check("first change",submit(hold(4))[0],1)
+  check("change behind a queued one",submit(release(4))[0],2)
+  check("change behind two",submit(hold(4))[0],3)
+  check("another serial",submit(hold(5))[0],1)
+  batch := submit(hold(6),release(6))
+  check("first change in a batch",batch[0],1)
+  check("change behind one in the same batch",batch[1],2)
+
+  // IntegrateQueue taking the queue leaves it staged, still ahead of anything submitted for the same serial
+  tr.inflight, tr.queue = tr.queue, nil
+  check("change behind a staged one",submit(release(5))[0],2)
+  check("change behind three staged",submit(release(4))[0],4)
+}
+
+// Receipts go from queued to integrated at the revision that took them, or rejected if the change is no longer allowed,
+// and are forgotten once they have been settled for the retention
+func TestReceiptLifecycle(t *testing.T) {
+  tr := newTestTree(t)
+  tr.SetReceiptRetention(time.Hour)
+  sub, err := tr.AddNode(Revocation{Serial: 4, RevokedAt: time.Now()})
+  if err != nil {t.Fatal(err)}
+  if r, ok := tr.GetReceipt(sub.Receipt.ID); !ok || r.Status != ReceiptQueued || r.Revision != 0 || !r.SettledAt.IsZero() {
+    t.Errorf("receipt before integration = %+v,%v, want queued",r,ok)
+  }
+  if err := tr.IntegrateQueue(); err != nil {t.Fatal(err)}
+  integrated, ok := tr.GetReceipt(sub.Receipt.ID)
+  if(!ok || integrated.Status != ReceiptIntegrated || integrated.Revision != 1 || integrated.SettledAt.IsZero()) {
+    t.Errorf("receipt after integration = %+v,%v, want integrated at revision 1",integrated,ok)
+  }
+
+  // AddNodes won't queue a second revocation, but one restored or replayed onto the queue is rejected when integrated
+  ids, err := newReceiptIds(1)
+  if err != nil {t.Fatal(err)}
+  tr.Lock()
+  again := Revocation{Serial: 4, RevokedAt: time.Now()}
+  again.receipt = tr.newReceipt(ids[0],again,nil)
+  tr.queue = append(tr.queue,again)
+  tr.Unlock()
+  revokeSerials(t,tr,5)
+  rejected, ok := tr.GetReceipt(ids[0])
+  if(!ok || rejected.Status != ReceiptRejected || rejected.Revision != 0 || rejected.SettledAt.IsZero()) {
+    t.Errorf("receipt of a second revocation = %+v,%v, want rejected",rejected,ok)
+  }
+
+  // Receipts settled over the retention ago are pruned at the next integration, oldest first, later ones are kept
+  five, _ := tr.GetRevocation(5)
+  tr.Lock()
+  tr.receipts[sub.Receipt.ID].SettledAt = time.Now().Add(-2*time.Hour)
+  tr.Unlock()
+  revokeSerials(t,tr,6)
+  for id, want := range(map[string]bool{sub.Receipt.ID: false, ids[0]: true, five.receipt.ID: true}) {
+    if _, ok := tr.GetReceipt(id); ok != want {
+      t.Errorf("receipt %v kept %v after pruning the first batch, want %v",id,ok,want)
+    }
+  }
+  tr.Lock()
+  for _,id := range([]string{ids[0],five.receipt.ID}) {
+    tr.receipts[id].SettledAt = time.Now().Add(-2*time.Hour)
+  }
+  tr.Unlock()
+  revokeSerials(t,tr,7)
+  for _,id := range([]string{ids[0],five.receipt.ID}) {
+    if _, ok := tr.GetReceipt(id); ok {
+      t.Errorf("receipt %v kept after pruning the second batch",id)
+    }
+  }
+
+  // The revocation still has its receipt, for duplicate submissions
+  dup, err := tr.AddNode(Revocation{Serial: 4, RevokedAt: time.Now()})
+  if(err != nil || dup.Status != SubmissionAlreadyRevoked || dup.Receipt.ID != sub.Receipt.ID) {
+    t.Errorf("revoking 4 again after pruning = %+v,%v, want already revoked with receipt %v",dup,err,sub.Receipt.ID)
+  }
+
+  // Without a retention nothing is pruned
+  tr.SetReceiptRetention(0)
+  six, _ := tr.GetRevocation(6)
+  tr.Lock()
+  tr.receipts[six.receipt.ID].SettledAt = time.Now().Add(-24*time.Hour)
+  tr.Unlock()
+  revokeSerials(t,tr,8)
+  if _, ok := tr.GetReceipt(six.receipt.ID); !ok {
+    t.Errorf("receipt pruned without a retention")
+  }
+}
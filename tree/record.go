@@ -0,0 +1,222 @@
+package tree
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "time"
+  "github.com/golang/glog"
+  "revocation-server/types"
+)
+
+// A tree sequenced by one replica is followed by the others through records, which SetPublish's function publishes
+// in order and Apply replays: the submissions AddNodes queued, each batch IntegrateQueue took off the queue with the
+// root signed for it, and each root SignRoot signed again
+// A record is published before what it records is acknowledged or served, so a follower is never missing anything
+// a client was told, and Apply checks each root like Restore does, once per record rather than every root each time
+// A saved tree (see Checkpoint) stands in for the records published before it, so a new follower doesn't replay them all
+
+// Returned by AddNodes when SetPublish's function failed, the submissions weren't queued
+var ErrNotPublished = errors.New("Submissions couldn't be published to the other replicas, so weren't queued")
+
+// What the replica sequencing a tree publishes for each change to it, only one field is set
+type record struct {
+  Queued *queuedRecord `json:",omitempty"`
+  Batch *batchRecord `json:",omitempty"`
+  Root *types.SignedLogRoot `json:",omitempty"` //the latest revision signed again
+}
+
+// Submissions AddNodes added to the back of the queue
+type queuedRecord struct {
+  Revocations []savedRevocation
+  Receipts []Receipt
+}
+
+// A batch IntegrateQueue took off the front of the queue, and the root signed for it
+// Every revocation taken is in exactly one of Changed, Deferred and Rejected, by its index among those taken
+type batchRecord struct {
+  Taken int
+  Changed []int //change their serial, in the order taken
+  Deferred []int //their serial already changes in this batch, they go back on the front of the queue for the next
+  Rejected []int //not allowed transitions, their receipts are rejected
+  IntegratedAt time.Time
+  Root *types.SignedLogRoot
+}
+
+// Have AddNodes, IntegrateQueue and SignRoot call publish with a record of each change before making it,
+// for other replicas to Apply in the same order
+// If publish fails nothing changes: AddNodes takes the submissions back off the queue, and returns ErrStandby
+// if publish did, otherwise ErrNotPublished, and IntegrateQueue puts the batch back on the queue
+// publish must not wait on anything that waits on IntegrateQueue, which can't take the queue until AddNodes returns
+func (t *MerkleTree) SetPublish(publish func(record []byte) error) {
+  t.Lock()
+  t.publish = publish
+  t.Unlock()
+}
+
+// Call the function set by SetPublish with r, if there is one
+func (t *MerkleTree) publishRecord(r record) error {
+  t.RLock()
+  publish := t.publish
+  t.RUnlock()
+  if(publish == nil) {
+    return nil
+  }
+  b, err := json.Marshal(r)
+  if err != nil {
+    return err
+  }
+  return publish(b)
+}
+
+// Publish newly queued submissions, taking them back off the queue if that fails
+// Caller must hold submitting, so the submissions are still queued
+func (t *MerkleTree) publishSubmissions(submissions []Submission) error {
+  queued := make(map[string]bool)
+  for _,s := range(submissions) {
+    if(s.Status == SubmissionQueued) {
+      queued[s.Receipt.ID] = true
+    }
+  }
+  if(len(queued) == 0) {
+    return nil
+  }
+  var q queuedRecord
+  t.RLock()
+  for _,r := range(t.queue) {
+    if(r.receipt != nil && queued[r.receipt.ID]) {
+      q.Revocations = append(q.Revocations,saveRevocation(r))
+      q.Receipts = append(q.Receipts,*r.receipt)
+    }
+  }
+  t.RUnlock()
+  err := t.publishRecord(record{Queued: &q})
+  if(err == nil) {
+    return nil
+  }
+  glog.Warningf("Couldn't publish %v submissions to %v, taking them back: %v\n",len(queued),t.GetName(),err)
+  t.Lock()
+  kept := make([]Revocation,0,len(t.queue))
+  for _,r := range(t.queue) {
+    if(r.receipt != nil && queued[r.receipt.ID]) {
+      delete(t.receipts,r.receipt.ID)
+      continue
+    }
+    kept = append(kept,r)
+  }
+  t.queue = kept
+  t.saves++
+  t.Unlock()
+  if(err == ErrStandby) {
+    return ErrStandby
+  }
+  return ErrNotPublished
+}
+
+// Save the tree for save once no record is between being published and being applied, and hold records back
+// until save returns, so the state covers exactly the records published so far
+func (t *MerkleTree) Checkpoint(save func(state []byte) error) error {
+  t.recording.Lock()
+  defer t.recording.Unlock()
+  var buf bytes.Buffer
+  if err := t.Save(&buf); err != nil {
+    return err
+  }
+  return save(buf.Bytes())
+}
+
+// Replay a record published by the replica sequencing the tree, which must be the next one after t's state
+// Roots are checked against the tree's key and the leaves, t is left as it was if the record doesn't fit
+// Anyone waiting on RootSigned is woken if the root moved on
+func (t *MerkleTree) Apply(b []byte) error {
+  var r record
+  if err := json.Unmarshal(b,&r); err != nil {
+    return fmt.Errorf("Couldn't decode record: %v",err)
+  }
+  t.signing.Lock()
+  defer t.signing.Unlock()
+  switch {
+  case r.Queued != nil:
+    return t.applyQueued(r.Queued)
+  case r.Batch != nil:
+    return t.applyBatch(r.Batch)
+  case r.Root != nil:
+    return t.applyRoot(r.Root)
+  default:
+    return errors.New("Record is empty")
+  }
+}
+
+func (t *MerkleTree) applyQueued(q *queuedRecord) error {
+  receipts := make(map[string]*Receipt,len(q.Receipts))
+  for i := range(q.Receipts) {
+    receipts[q.Receipts[i].ID] = &q.Receipts[i]
+  }
+  t.Lock()
+  defer t.Unlock()
+  for _,sr := range(q.Revocations) {
+    if(sr.Serial > t.maxSerial) {
+      return fmt.Errorf("Queued serial %v is above the max serial %v",sr.Serial,t.maxSerial)
+    }
+  }
+  for _,sr := range(q.Revocations) {
+    r := sr.Revocation
+    r.receipt = receipts[sr.ReceiptID]
+    if(r.receipt != nil) {
+      t.receipts[r.receipt.ID] = r.receipt
+    }
+    t.queue = append(t.queue,r)
+  }
+  t.saves++
+  return nil
+}
+
+func (t *MerkleTree) applyBatch(b *batchRecord) error {
+  t.RLock()
+  queued := len(t.queue)
+  var taken []Revocation
+  if(b.Taken >= 0 && b.Taken <= queued) {
+    taken = append(taken,t.queue[:b.Taken]...)
+  }
+  revision, treeSize := t.updatedTimes+1, t.nodesCreated
+  t.RUnlock()
+  if(b.Taken < 0 || b.Taken > queued) {
+    return fmt.Errorf("Batch takes %v revocations, but %v are queued",b.Taken,queued)
+  }
+  logRoot, err := t.checkRoot(b.Root,revision)
+  if err != nil {
+    return err
+  }
+  changes, deferred, rejected, err := t.batchOf(taken,b)
+  if err != nil {
+    return err
+  }
+  staged := t.stage(changes)
+  treeSize = treeSize + staged.added - staged.removed
+  if(!bytes.Equal(staged.root.hash,logRoot.RootHash) || treeSize != logRoot.TreeSize) {
+    return fmt.Errorf("Batch leads to root %x of %v nodes, but revision %v was signed as %x of %v nodes",staged.root.hash,treeSize,revision,logRoot.RootHash,logRoot.TreeSize)
+  }
+
+  t.Lock()
+  t.commitBatch(staged,treeSize,changes,deferred,rejected,t.queue[b.Taken:],b.IntegratedAt,logRoot,b.Root)
+  t.Unlock()
+  return nil
+}
+
+func (t *MerkleTree) applyRoot(slr *types.SignedLogRoot) error {
+  t.RLock()
+  revision, rootHash, treeSize := t.updatedTimes, t.merkleRoot, t.nodesCreated
+  t.RUnlock()
+  logRoot, err := t.checkRoot(slr,revision)
+  if err != nil {
+    return err
+  }
+  if(!bytes.Equal(logRoot.RootHash,rootHash) || logRoot.TreeSize != treeSize) {
+    return fmt.Errorf("Root signed again for revision %v is %x of %v nodes, not %x of %v nodes",revision,logRoot.RootHash,logRoot.TreeSize,rootHash,treeSize)
+  }
+  t.Lock()
+  t.publishRoot(logRoot,slr)
+  t.Unlock()
+  return nil
+}
@@ -0,0 +1,107 @@
+package tree
+
+import (
+  "bytes"
+  "crypto"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "encoding/json"
+  "strings"
+  "testing"
+  "time"
+  "revocation-server/crypto/ocsp"
+  "revocation-server/signer"
+)
+
+// Decode r, let edit change it, and encode it again
+func editRecord(t *testing.T, b []byte, edit func(r *record)) []byte {
+  var r record
+  if err := json.Unmarshal(b,&r); err != nil {t.Fatal(err)}
+  edit(&r)
+  b, err := json.Marshal(r)
+  if err != nil {t.Fatal(err)}
+  return b
+}
+
+func TestApply(t *testing.T) {
+  leader := newTestTree(t)
+  var records [][]byte
+  leader.SetPublish(func(r []byte) error {
+    records = append(records,r)
+    return nil
+  })
+  now := time.Now()
+  if _, err := leader.AddNodes([]Revocation{{Serial: 4, RevokedAt: now},{Serial: 7, Reason: ocsp.CertificateHold, RevokedAt: now}}); err != nil {t.Fatal(err)}
+  released, err := leader.AddNode(Revocation{Serial: 7, Reason: ocsp.RemoveFromCRL, RevokedAt: now})
+  if err != nil {t.Fatal(err)}
+  // The release is deferred, as 7 is already held in this batch
+  if err := leader.IntegrateQueue(); err != nil {t.Fatal(err)}
+  if err := leader.SignRoot(); err != nil {t.Fatal(err)}
+  if _, err := leader.AddNode(Revocation{Serial: 9, RevokedAt: now}); err != nil {t.Fatal(err)}
+  if err := leader.IntegrateQueue(); err != nil {t.Fatal(err)}
+  if(len(records) != 6) {
+    t.Fatalf("leader published %v records, want 3 queued, 2 batches and 1 root",len(records))
+  }
+  const firstBatch = 2
+
+  follower := New(1000,time.Hour,leader.GetSigner(),nil)
+  for _,r := range(records[:firstBatch]) {
+    if err := follower.Apply(r); err != nil {t.Fatal(err)}
+  }
+  key, err := ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+  if err != nil {t.Fatal(err)}
+  otherKey := New(1000,time.Hour,signer.NewSigner(0,key,crypto.SHA256),nil)
+
+  tests := []struct {
+    name string
+    record []byte
+    err string
+  }{
+    {"queued serial above the max", editRecord(t,records[0],func(r *record) {r.Queued.Revocations[0].Serial = 1<<20}), "above the max serial"},
+    {"root signed by another key", editRecord(t,records[firstBatch],func(r *record) {r.Batch.Root = otherKey.GetSth()}), "isn't signed by this tree's key"},
+    {"root of a later revision", records[firstBatch+3], "Root at revision 1 is for revision 2"},
+    {"root signed again before its batch", records[firstBatch+1], "Root at revision 0 is for revision 1"},
+    {"more taken than queued", editRecord(t,records[firstBatch],func(r *record) {r.Batch.Taken = 4}), "3 are queued"},
+    {"no such revocation", editRecord(t,records[firstBatch],func(r *record) {r.Batch.Changed = append(r.Batch.Changed,5)}), "no such revocation"},
+    {"revocation left out", editRecord(t,records[firstBatch],func(r *record) {r.Batch.Deferred = nil}), "accounts for 2 of the 3"},
+    {"deferred change made now", editRecord(t,records[firstBatch],func(r *record) {
+      r.Batch.Changed, r.Batch.Deferred = append(r.Batch.Changed,r.Batch.Deferred...), nil
+    }), "isn't allowed"},
+    {"change dropped", editRecord(t,records[firstBatch],func(r *record) {
+      r.Batch.Deferred, r.Batch.Changed = append(r.Batch.Deferred,r.Batch.Changed[0]), r.Batch.Changed[1:]
+    }), "Batch leads to root"},
+    {"empty", []byte("{}"), "Record is empty"},
+  }
+  for _,test := range(tests) {
+    err := follower.Apply(test.record)
+    if(err == nil || !strings.Contains(err.Error(),test.err)) {
+      t.Errorf("%v: Apply = %v, want an error containing %q",test.name,err,test.err)
+    }
+    if(follower.GetRevision() != 0 || follower.GetQueueLength() != 3) {
+      t.Errorf("%v: follower at revision %v with %v queued after a refused record, want 0 with 3",test.name,follower.GetRevision(),follower.GetQueueLength())
+    }
+  }
+
+  // The genuine records bring the follower to the leader's state
+  for _,r := range(records[firstBatch:]) {
+    if err := follower.Apply(r); err != nil {t.Fatal(err)}
+  }
+  if(!bytes.Equal(follower.GetSth().LogRootSignature,leader.GetSth().LogRootSignature) || follower.GetRevision() != 2 || follower.GetQueueLength() != 0) {
+    t.Errorf("follower at revision %v with %v queued, want the leader's latest root at revision 2",follower.GetRevision(),follower.GetQueueLength())
+  }
+  if got, want := follower.GetLastUpdated(), leader.GetLastUpdated(); !got.Equal(want) {
+    t.Errorf("follower last updated %v, leader %v",got,want)
+  }
+  for serial, want := range(map[uint64]bool{4: true, 7: false, 9: true}) {
+    if got, _ := follower.GetRevocationValue(serial); got != want {
+      t.Errorf("follower GetRevocationValue(%v) = %v, want %v",serial,got,want)
+    }
+  }
+  if receipt, ok := follower.GetReceipt(released.Receipt.ID); !ok || receipt.Status != ReceiptIntegrated || receipt.Revision != 2 {
+    t.Errorf("follower receipt for the release = %+v,%v, want it integrated at revision 2",receipt,ok)
+  }
+  if batches, err := follower.GetBatches(0,2); err != nil || len(batches) != 2 || len(batches[0].Changes) != 2 || len(batches[1].Changes) != 2 {
+    t.Errorf("follower batches = %+v,%v, want 2 changes in each",batches,err)
+  }
+}
@@ -0,0 +1,382 @@
+package tree
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "os"
+  "sort"
+  "time"
+  "github.com/golang/glog"
+  "revocation-server/signer"
+  "revocation-server/types"
+)
+
+// A tree is saved as its batches, signed roots, queue and receipts not yet pruned, everything else is rebuilt from them
+// Restore checks every saved root is signed by the tree's key, then replays the batches and checks the leaves they lead to
+// against the latest root, so which serials are revoked or held can't be edited without the key
+// The update times served in ocsp responses and crl's are taken from the latest signed root, so they can't be either
+// Reasons, revocation times, the queue and receipts aren't covered by any signature, whoever can write the saved state can change them
+
+const stateVersion = 1
+
+// Returned by AddNodes once Close has been called
+var ErrClosed = errors.New("Tree is not accepting submissions, the server is shutting down")
+
+// Returned by AddNodes while the tree is on standby, see SetStandby
+var ErrStandby = errors.New("Tree is read only on this replica, submissions go to the replica sequencing it")
+
+// A revocation with the id of the receipt it was submitted with, which isn't part of Revocation's json
+type savedRevocation struct {
+  Revocation
+  ReceiptID string `json:",omitempty"`
+}
+
+type savedChange struct {
+  Old *savedRevocation `json:",omitempty"`
+  New savedRevocation
+}
+
+type savedBatch struct {
+  Revision uint64
+  Changes []savedChange
+  IntegratedAt time.Time
+}
+
+type state struct {
+  Version int
+  Metadata []byte
+  MaxSerial uint64
+  Batches []savedBatch //batches[i] has revision i+1
+  Roots []*types.SignedLogRoot //roots[i] has revision i
+  Queue []savedRevocation
+  Receipts []Receipt
+}
+
+// Returned by SignRoot and IntegrateQueue past the time set by SetSignUntil
+var ErrSignExpired = errors.New("Not signing roots, this replica's sequencer lease may have run out")
+
+// Refuse further submissions with ErrClosed, the queue can still be integrated
+func (t *MerkleTree) Close() {
+  t.Lock()
+  t.closed = true
+  t.Unlock()
+}
+
+// Refuse submissions with ErrStandby while another replica sequences the tree, this one only follows it with Apply and Sync
+func (t *MerkleTree) SetStandby(standby bool) {
+  t.Lock()
+  t.standby = standby
+  t.Unlock()
+}
+
+// Whether the tree is on standby, see SetStandby
+func (t *MerkleTree) Standby() bool {
+  t.RLock()
+  defer t.RUnlock()
+  return t.standby
+}
+
+// Refuse to sign roots after until, so a replica that may have lost its lease can't sign a root its successor also signs
+// The zero time lifts the limit
+func (t *MerkleTree) SetSignUntil(until time.Time) {
+  t.Lock()
+  t.signUntil = until
+  t.Unlock()
+}
+
+// Changes whenever submissions are queued or a root is signed, so a saved tree only needs saving again once this moves on
+func (t *MerkleTree) GetSaveSeq() uint64 {
+  t.RLock()
+  defer t.RUnlock()
+  return t.saves
+}
+
+// Write the tree's state as json, for Restore
+func (t *MerkleTree) Save(w io.Writer) error {
+  t.RLock()
+  s := state{
+    Version: stateVersion,
+    Metadata: t.metadata,
+    MaxSerial: t.maxSerial,
+    Roots: t.roots,
+  }
+  for _,b := range(t.batches) {
+    sb := savedBatch{Revision: b.Revision, IntegratedAt: b.IntegratedAt}
+    for _,c := range(b.Changes) {
+      sc := savedChange{New: saveRevocation(c.New)}
+      if(c.Old != nil) {
+        old := saveRevocation(*c.Old)
+        sc.Old = &old
+      }
+      sb.Changes = append(sb.Changes,sc)
+    }
+    s.Batches = append(s.Batches,sb)
+  }
+  // A batch being integrated isn't in the batches yet, so it is saved as the front of the queue
+  for _,queue := range([][]Revocation{t.inflight,t.queue}) {
+    for _,r := range(queue) {
+      s.Queue = append(s.Queue,saveRevocation(r))
+    }
+  }
+  for _,r := range(t.receipts) {
+    s.Receipts = append(s.Receipts,*r)
+  }
+  t.RUnlock()
+  return json.NewEncoder(w).Encode(s)
+}
+
+func saveRevocation(r Revocation) savedRevocation {
+  s := savedRevocation{Revocation: r}
+  if(r.receipt != nil) {
+    s.ReceiptID = r.receipt.ID
+  }
+  return s
+}
+
+// Load state written by Save into t, which must be new and have the same metadata and max serial as the saved tree
+// t is left unusable if this fails
+func (t *MerkleTree) Restore(r io.Reader) error {
+  var s state
+  if err := json.NewDecoder(r).Decode(&s); err != nil {
+    return fmt.Errorf("Couldn't decode saved tree: %v",err)
+  }
+  if(s.Version != stateVersion) {
+    return fmt.Errorf("Saved tree has version %v, expected %v",s.Version,stateVersion)
+  }
+  if(!bytes.Equal(s.Metadata,t.metadata) || s.MaxSerial != t.maxSerial) {
+    return fmt.Errorf("Saved tree %q holds serials up to %v, not %q up to %v",s.Metadata,s.MaxSerial,t.metadata,t.maxSerial)
+  }
+  if(len(s.Roots) != len(s.Batches)+1) {
+    return fmt.Errorf("Saved tree has %v batches but %v roots",len(s.Batches),len(s.Roots))
+  }
+  logRoots, err := t.checkRoots(s.Roots)
+  if err != nil {
+    return err
+  }
+
+  t.Lock()
+  defer t.Unlock()
+  if(t.updatedTimes != 0 || len(t.queue) != 0) {
+    return errors.New("Can only restore into a new tree")
+  }
+
+  receipts := make(map[string]*Receipt,len(s.Receipts))
+  for i := range(s.Receipts) {
+    receipts[s.Receipts[i].ID] = &s.Receipts[i]
+  }
+  restore := func(sr savedRevocation) Revocation {
+    r := sr.Revocation
+    r.receipt = receipts[sr.ReceiptID]
+    return r
+  }
+
+  // Replay the batches, each must lead to the root signed at its revision, as delta crl's and consistency proofs are served from them
+  if(!bytes.Equal(nodesHash(logRoots[0].RootHash,t.zeroHashes[0]),t.Root.Hash) || logRoots[0].TreeSize != 0) {
+    return fmt.Errorf("Saved root at revision 0 is %x of %v nodes, not the empty tree",logRoots[0].RootHash,logRoots[0].TreeSize)
+  }
+  batches := make([]Batch,len(s.Batches))
+  revocations := make(map[uint64]Revocation)
+  nodes := uint64(0)
+  for i,sb := range(s.Batches) {
+    b := Batch{Revision: sb.Revision, IntegratedAt: sb.IntegratedAt}
+    if(b.Revision != uint64(i+1)) {
+      return fmt.Errorf("Saved batch %v is for revision %v",i+1,b.Revision)
+    }
+    changed := make(map[uint64]bool,len(sb.Changes))
+    for _,sc := range(sb.Changes) {
+      c := Change{New: restore(sc.New)}
+      if(sc.Old != nil) {
+        old := restore(*sc.Old)
+        c.Old = &old
+      }
+      if(c.New.Serial > t.maxSerial) {
+        return fmt.Errorf("Saved batch %v changes serial %v, above the max serial %v",b.Revision,c.New.Serial,t.maxSerial)
+      }
+      if(changed[c.New.Serial]) {
+        return fmt.Errorf("Saved batch %v changes serial %v twice",b.Revision,c.New.Serial)
+      }
+      changed[c.New.Serial] = true
+      var was *Revocation
+      if r, ok := revocations[c.New.Serial]; ok {
+        was = &r
+      }
+      if(stateOf(was) != stateOf(c.Old)) {
+        return fmt.Errorf("Saved batch %v changes serial %v from %v, but it was %v",b.Revision,c.New.Serial,stateOf(c.Old),stateOf(was))
+      }
+      b.Changes = append(b.Changes,c)
+    }
+
+    staged := t.stage(b.Changes)
+    nodes = nodes + staged.added - staged.removed
+    root := logRoots[b.Revision]
+    if(!bytes.Equal(nodesHash(root.RootHash,t.zeroHashes[0]),staged.root.hash) || root.TreeSize != nodes) {
+      return fmt.Errorf("Saved batch %v leads to root %x of %v nodes, but revision %v was signed as %x of %v nodes",b.Revision,staged.root.hash,nodes,b.Revision,root.RootHash,root.TreeSize)
+    }
+    t.applyStaged(t.Root,staged.root)
+    for _,c := range(b.Changes) {
+      if(stateOf(&c.New) == Absent) {
+        delete(revocations,c.New.Serial)
+      } else {
+        revocations[c.New.Serial] = c.New
+      }
+    }
+    batches[i] = b
+  }
+
+  // The root as signed, so a tree saved at legacyEmptyRoot doesn't sign a second root for revision 0
+  latest, root := s.Roots[len(s.Roots)-1], logRoots[len(logRoots)-1]
+  t.merkleRoot = root.RootHash
+  t.nodesCreated = nodes
+  t.updatedTimes = uint64(len(batches))
+  t.batches = batches
+  t.revocations = revocations
+  t.roots = s.Roots
+  t.slr = latest
+  t.LastUpdated = time.Unix(0,int64(root.TimestampNanos)).UTC()
+  t.NextUpdate = t.LastUpdated.Add(t.updateInterval)
+  t.receipts = receipts
+  t.settled = settledReceipts(s.Receipts,batches)
+  for _,q := range(s.Queue) {
+    t.queue = append(t.queue,restore(q))
+  }
+  glog.Infof("Restored %v at revision %v, with %v revoked or held serials and %v queued changes\n",t.GetName(),t.updatedTimes,len(revocations),len(t.queue))
+  return nil
+}
+
+// The settled receipts among receipts, oldest first, for pruneReceipts
+// Receipts saved before SettledAt was recorded take it from the batch they were integrated in, or else now
+func settledReceipts(receipts []Receipt, batches []Batch) []*Receipt {
+  var settled []*Receipt
+  now := time.Now()
+  for i := range(receipts) {
+    r := &receipts[i]
+    if(r.Status == ReceiptQueued) {
+      continue
+    }
+    if(r.SettledAt.IsZero()) {
+      if(r.Revision > 0 && r.Revision <= uint64(len(batches))) {
+        r.SettledAt = batches[r.Revision-1].IntegratedAt
+      } else {
+        r.SettledAt = now
+      }
+    }
+    settled = append(settled,r)
+  }
+  sort.Slice(settled, func(i, j int) bool {return settled[i].SettledAt.Before(settled[j].SettledAt)})
+  return settled
+}
+
+// Check roots[i] is a root of this tree at revision i, signed by its key, and parse them
+func (t *MerkleTree) checkRoots(roots []*types.SignedLogRoot) ([]*types.LogRootV1,error) {
+  logRoots := make([]*types.LogRootV1,len(roots))
+  for i,slr := range(roots) {
+    root, err := t.checkRoot(slr,uint64(i))
+    if err != nil {
+      return nil,fmt.Errorf("Saved root: %v",err)
+    }
+    logRoots[i] = root
+  }
+  return logRoots,nil
+}
+
+// Check slr is a root of this tree at revision, signed by its key
+func (t *MerkleTree) checkRoot(slr *types.SignedLogRoot, revision uint64) (*types.LogRootV1,error) {
+  if(slr == nil) {
+    return nil,fmt.Errorf("Root at revision %v is missing",revision)
+  }
+  if err := signer.VerifySignature(t.s.Public(),t.s.Hash,slr.LogRoot,slr.LogRootSignature); err != nil {
+    return nil,fmt.Errorf("Root at revision %v isn't signed by this tree's key: %v",revision,err)
+  }
+  var root types.LogRootV1
+  if err := root.UnmarshalBinary(slr.LogRoot); err != nil {
+    return nil,fmt.Errorf("Couldn't parse root at revision %v: %v",revision,err)
+  }
+  if(root.Revision != revision || !bytes.Equal(root.Metadata,t.metadata)) {
+    return nil,fmt.Errorf("Root at revision %v is for revision %v of tree %q",revision,root.Revision,root.Metadata)
+  }
+  return &root,nil
+}
+
+// Replace t's state with one written by Save, such as a checkpoint of the leader's for a standby replica
+// The state is restored into a new tree first, so t is left as it was if that fails
+// Anyone waiting on RootSigned is woken, as the roots may have moved on
+func (t *MerkleTree) Sync(r io.Reader) error {
+  t.signing.Lock()
+  defer t.signing.Unlock()
+  fresh := t.empty()
+  if err := fresh.Restore(r); err != nil {
+    return err
+  }
+
+  t.Lock()
+  defer t.Unlock()
+  t.Root, t.merkleRoot = fresh.Root, fresh.merkleRoot
+  t.nodesCreated, t.updatedTimes = fresh.nodesCreated, fresh.updatedTimes
+  t.slr, t.roots, t.signErr = fresh.slr, fresh.roots, nil
+  t.LastUpdated, t.NextUpdate = fresh.LastUpdated, fresh.NextUpdate
+  t.queue, t.batches, t.revocations, t.receipts = fresh.queue, fresh.batches, fresh.revocations, fresh.receipts
+  t.settled = fresh.settled
+  t.proofs.reset()
+  t.saves++
+  close(t.rootSigned)
+  t.rootSigned = make(chan struct{})
+  return nil
+}
+
+// A tree with t's settings and nothing in it, not even a signed root
+func (t *MerkleTree) empty() *MerkleTree {
+  t.RLock()
+  defer t.RUnlock()
+  root := Node{nil,nil,nil,t.zeroHashes[0]}
+  return &MerkleTree{
+    Root: &root,
+    merkleRoot: root.Hash,
+    hashFunc: t.hashFunc,
+    height: t.height,
+    maxSerial: t.maxSerial,
+    s: t.s,
+    metadata: t.metadata,
+    mmd: t.mmd,
+    updateInterval: t.updateInterval,
+    zeroHashes: t.zeroHashes,
+    queue: []Revocation{},
+    revocations: make(map[uint64]Revocation),
+    receipts: make(map[string]*Receipt),
+    receiptRetention: t.receiptRetention,
+    proofs: newProofCache(),
+    rootSigned: make(chan struct{}),
+    batchReady: make(chan struct{},1),
+  }
+}
+
+// Save to path, replacing any earlier save only once the new one is written out in full
+func (t *MerkleTree) SaveFile(path string) error {
+  tmp := path+".tmp"
+  f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+  if err != nil {return err}
+  if err := t.Save(f); err != nil {
+    f.Close()
+    return err
+  }
+  if err := f.Sync(); err != nil {
+    f.Close()
+    return err
+  }
+  if err := f.Close(); err != nil {return err}
+  return os.Rename(tmp,path)
+}
+
+// Restore from path, returning false if nothing was saved there yet
+func (t *MerkleTree) RestoreFile(path string) (bool,error) {
+  f, err := os.Open(path)
+  if os.IsNotExist(err) {
+    return false,nil
+  } else if err != nil {
+    return false,err
+  }
+  defer f.Close()
+  return true,t.Restore(f)
+}
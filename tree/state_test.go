@@ -0,0 +1,179 @@
+package tree
+
+import (
+  "bytes"
+  "encoding/json"
+  "strings"
+  "testing"
+  "time"
+  "revocation-server/crypto/ocsp"
+  "revocation-server/types"
+)
+
+// Save t, letting edit change the saved json first
+func saveEdited(t *testing.T, tr *MerkleTree, edit func(s map[string]interface{})) *bytes.Buffer {
+  var buf bytes.Buffer
+  if err := tr.Save(&buf); err != nil {t.Fatal(err)}
+  var s map[string]interface{}
+  if err := json.Unmarshal(buf.Bytes(),&s); err != nil {t.Fatal(err)}
+  edit(s)
+  b, err := json.Marshal(s)
+  if err != nil {t.Fatal(err)}
+  return bytes.NewBuffer(b)
+}
+
+func TestRestore(t *testing.T) {
+  tr := newTestTree(t)
+  revokeSerials(t,tr,4,5)
+  if _, err := tr.AddNode(Revocation{Serial: 6, RevokedAt: time.Now()}); err != nil {t.Fatal(err)}
+  var latest types.LogRootV1
+  if err := latest.UnmarshalBinary(tr.GetSth().LogRoot); err != nil {t.Fatal(err)}
+  signedAt := time.Unix(0,int64(latest.TimestampNanos)).UTC()
+
+  tests := []struct {
+    name string
+    edit func(s map[string]interface{})
+    err string //empty if the restore succeeds
+  }{
+    {"unchanged", func(s map[string]interface{}) {}, ""},
+    {"update times edited", func(s map[string]interface{}) {
+      // Saved by earlier versions, they must not be served
+      s["LastUpdated"] = time.Now().Add(24*time.Hour)
+      s["NextUpdate"] = time.Now().Add(48*time.Hour)
+    }, ""},
+    {"root signature edited", func(s map[string]interface{}) {
+      roots := s["Roots"].([]interface{})
+      roots[1].(map[string]interface{})["LogRootSignature"] = roots[0].(map[string]interface{})["LogRootSignature"]
+    }, "isn't signed by this tree's key"},
+    {"serial added to a batch", func(s map[string]interface{}) {
+      changes := s["Batches"].([]interface{})[0].(map[string]interface{})["Changes"].([]interface{})
+      extra := map[string]interface{}{"New": map[string]interface{}{"Serial": 9, "Reason": 0, "RevokedAt": time.Now()}}
+      s["Batches"].([]interface{})[0].(map[string]interface{})["Changes"] = append(changes,extra)
+    }, "Saved batch 1 leads to root"},
+    {"root dropped", func(s map[string]interface{}) {
+      s["Roots"] = s["Roots"].([]interface{})[:1]
+    }, "1 batches but 1 roots"},
+  }
+  for _,test := range(tests) {
+    restored := New(1000,time.Hour,tr.GetSigner(),nil)
+    err := restored.Restore(saveEdited(t,tr,test.edit))
+    if(test.err != "") {
+      if(err == nil || !strings.Contains(err.Error(),test.err)) {
+        t.Errorf("%v: Restore = %v, want an error containing %q",test.name,err,test.err)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("%v: Restore = %v",test.name,err)
+      continue
+    }
+    thisUpdate, nextUpdate := restored.GetUpdateTimes()
+    if(!thisUpdate.Equal(signedAt) || !nextUpdate.Equal(signedAt.Add(time.Hour))) {
+      t.Errorf("%v: restored update times %v, %v, want the latest root's %v and an hour later",test.name,thisUpdate,nextUpdate,signedAt)
+    }
+    if(restored.GetRevision() != 1 || restored.GetQueueLength() != 1) {
+      t.Errorf("%v: restored revision %v with %v queued, want 1 with 1",test.name,restored.GetRevision(),restored.GetQueueLength())
+    }
+    for serial, want := range(map[uint64]bool{4: true, 5: true, 6: false}) {
+      if got, _ := restored.GetRevocationValue(serial); got != want {
+        t.Errorf("%v: restored GetRevocationValue(%v) = %v, want %v",test.name,serial,got,want)
+      }
+    }
+  }
+}
+
+// Every batch is replayed against the root signed at its revision, not only the last, since delta crl's and consistency proofs
+// are served from them
+func TestRestoreChecksEveryBatch(t *testing.T) {
+  tr := newTestTree(t)
+  revokeSerials(t,tr,4)
+  if _, err := tr.AddNode(Revocation{Serial: 5, Reason: ocsp.CertificateHold, RevokedAt: time.Now()}); err != nil {t.Fatal(err)}
+  if err := tr.IntegrateQueue(); err != nil {t.Fatal(err)}
+  revokeSerials(t,tr,5,6)
+  changes := func(s map[string]interface{}, batch int) []interface{} {
+    return s["Batches"].([]interface{})[batch].(map[string]interface{})["Changes"].([]interface{})
+  }
+  setChanges := func(s map[string]interface{}, batch int, c []interface{}) {
+    s["Batches"].([]interface{})[batch].(map[string]interface{})["Changes"] = c
+  }
+
+  tests := []struct {
+    name string
+    edit func(s map[string]interface{})
+    err string
+  }{
+    {"batches swapped, leading to the same final root", func(s map[string]interface{}) {
+      first, second := changes(s,0), changes(s,1)
+      setChanges(s,0,second)
+      setChanges(s,1,first)
+    }, "Saved batch 1 leads to root"},
+    {"old value edited", func(s map[string]interface{}) {
+      for _,c := range(changes(s,2)) {
+        delete(c.(map[string]interface{}),"Old")
+      }
+    }, "Saved batch 3 changes serial 5 from absent, but it was held"},
+    {"serial changed twice", func(s map[string]interface{}) {
+      c := changes(s,2)
+      setChanges(s,2,append(c,c[0]))
+    }, "changes serial 5 twice"},
+    {"batch out of place", func(s map[string]interface{}) {
+      s["Batches"].([]interface{})[1].(map[string]interface{})["Revision"] = 3
+    }, "Saved batch 2 is for revision 3"},
+  }
+  for _,test := range(tests) {
+    restored := New(1000,time.Hour,tr.GetSigner(),nil)
+    if err := restored.Restore(saveEdited(t,tr,test.edit)); err == nil || !strings.Contains(err.Error(),test.err) {
+      t.Errorf("%v: Restore = %v, want an error containing %q",test.name,err,test.err)
+    }
+  }
+  restored := New(1000,time.Hour,tr.GetSigner(),nil)
+  if err := restored.Restore(saveEdited(t,tr,func(s map[string]interface{}) {})); err != nil {
+    t.Fatalf("Restore unchanged: %v",err)
+  }
+  if(restored.GetRevision() != 3 || restored.GetTreeSize() != tr.GetTreeSize()) {
+    t.Errorf("restored revision %v of %v nodes, want 3 of %v",restored.GetRevision(),restored.GetTreeSize(),tr.GetTreeSize())
+  }
+}
+
+// A tree saved at revision 0 by a release that signed legacyEmptyRoot restores, keeps that root for revision 0,
+// and proofs from it verify
+func TestRestoreLegacyEmptyRoot(t *testing.T) {
+  old := newTestTree(t)
+  old.Lock()
+  old.merkleRoot = legacyEmptyRoot
+  old.Unlock()
+  if err := old.SignRoot(); err != nil {t.Fatal(err)}
+  var buf bytes.Buffer
+  if err := old.Save(&buf); err != nil {t.Fatal(err)}
+
+  tr := New(1000,time.Hour,old.GetSigner(),nil)
+  if err := tr.Restore(&buf); err != nil {t.Fatalf("Restore of a legacy empty root: %v",err)}
+  absent, err := tr.GetInclusionProof(4)
+  if err != nil {t.Fatal(err)}
+  // Signing again on restore mustn't put a second root at revision 0
+  if err := tr.SignRoot(); err != nil {t.Fatal(err)}
+  var root types.LogRootV1
+  if err := root.UnmarshalBinary(tr.GetSth().LogRoot); err != nil {t.Fatal(err)}
+  if(root.Revision != 0 || !bytes.Equal(root.RootHash,legacyEmptyRoot)) {
+    t.Fatalf("restored tree signed %x at revision %v, want the legacy empty root at 0",root.RootHash,root.Revision)
+  }
+  if state, err := InclusionProofState(tr.GetHeight(),root.RootHash,4,absent); err != nil || state != Absent {
+    t.Errorf("InclusionProofState against the legacy root = %v,%v, want absent",state,err)
+  }
+
+  // The first batch signs the nodes' root, proofs from revision 0 take the legacy root for the empty tree
+  revokeSerials(t,tr,4)
+  var next types.LogRootV1
+  if err := next.UnmarshalBinary(tr.GetSth().LogRoot); err != nil {t.Fatal(err)}
+  if(next.Revision != 1 || !bytes.Equal(next.RootHash,tr.Root.Hash)) {
+    t.Errorf("revision %v root %x, want revision 1 at the nodes' root %x",next.Revision,next.RootHash,tr.Root.Hash)
+  }
+  p, err := tr.GetConsistencyProof(0,1)
+  if err != nil {t.Fatal(err)}
+  if err := VerifyConsistencyProof(tr.GetHeight(),legacyEmptyRoot,next.RootHash,p); err != nil {
+    t.Errorf("proof from the legacy root: %v",err)
+  }
+  if err := VerifyConsistencyProof(tr.GetHeight(),tr.zeroHashes[0],next.RootHash,p); err != nil {
+    t.Errorf("proof from the empty root: %v",err)
+  }
+}
@@ -6,21 +6,26 @@ import (
   "github.com/golang/glog"
   "revocation-server/rfc6962"
   "errors"
+  "fmt"
   "revocation-server/signer"
   "revocation-server/types"
+  "revocation-server/crypto/ocsp"
   "crypto"
   "crypto/ecdsa"
   "crypto/x509"
   "sync"
+  "sort"
   "io/ioutil"
   "encoding/pem"
+  "revocation-server/metrics"
+  "revocation-server/audit"
 )
 
 //
 // Package Tree
 // Holds code relating to the in-memory merkle tree implementation for revocation server
 // Uses optimization: non-revoked values are not stored
-// If a node is present in the tree, it's serial number is revoked
+// If a node is present in the tree, it's serial number is revoked or on hold
 //
 
 
@@ -36,13 +41,38 @@ type MerkleTree struct {
   updatedTimes uint64 //how many times we have updated mth, is updated by IntegrateQueue
 
   s *signer.Signer //contains hash/signer algo's for generating SLR's 
+  metadata []byte //included in every SLR, distinguishes trees that share a signer
   slr *types.SignedLogRoot //updated by SignRoot
+  signErr error //result of the last SignRoot
+  rootSigned chan struct{} //closed and replaced by SignRoot, wakes anyone waiting for a new root
+  roots []*types.SignedLogRoot //latest root signed at each revision, roots[i] has revision i
   mmd time.Duration
-  LastUpdated time.Time //updated by SignRoot, UTC time in response
-  NextUpdate time.Time //updated by SignRoot, UTC time in response
+  updateInterval time.Duration //longest a root stays the latest, see SetUpdateInterval
+  LastUpdated time.Time //timestamp of the latest signed root, ThisUpdate in ocsp responses and crl's
+  NextUpdate time.Time //LastUpdated plus updateInterval, NextUpdate in ocsp responses and crl's
 
   zeroHashes [][]byte //precomputed values for zero-leaf or zero-children hashes
-  queue []uint64 //Added nodes not yet incorporated in the tree
+  queue []Revocation //Added nodes not yet incorporated in the tree
+  inflight []Revocation //the batch IntegrateQueue took off the queue and is integrating, nil between batches
+  closed bool //set by Close, AddNodes refuses every submission
+  standby bool //set by SetStandby, AddNodes refuses every submission as another replica is sequencing
+  saves uint64 //bumped whenever what Save writes changes, see GetSaveSeq
+  maxQueue int //AddNodes refuses submissions that would grow the queue past this, 0 for no limit
+  batchTrigger int //AddNodes signals batchReady once the queue holds this many changes, 0 to never signal
+  batchReady chan struct{} //buffered, so a signal waits for the sequencer without blocking AddNodes
+  batches []Batch //record of each IntegrateQueue call, batches[i] has revision i+1
+  revocations map[uint64]Revocation //reason and time for each serial in the tree, updated by IntegrateQueue
+  receipts map[string]*Receipt //every submission by receipt id, see receipt.go
+  settled []*Receipt //receipts that were integrated or rejected, oldest first, until pruneReceipts forgets them
+  receiptRetention time.Duration //see SetReceiptRetention
+  audit *audit.Logger //submissions, batches and roots are recorded here, may be nil
+  proofs *proofCache //consistency proofs already made
+  rebuilding sync.Mutex //held while a consistency proof rebuilds an older revision, see GetConsistencyProof
+  signing sync.Mutex //held by SignRoot and IntegrateQueue, so roots are signed and published one at a time
+  signUntil time.Time //roots aren't signed after this, zero for no limit, see SetSignUntil
+  publish func(record []byte) error //called with a record of each change before it is made, see SetPublish
+  submitting sync.RWMutex //read locked by AddNodes until its submissions are published, so IntegrateQueue can't take them before then
+  recording sync.RWMutex //read locked from publishing a record until what it records is made, see Checkpoint
   sync.RWMutex //multiple goroutines have access to this struct, more reads than writes
 }
 
@@ -53,47 +83,145 @@ type Node struct {
   Hash []byte
 }
 
+// A serial to be revoked, along with the details reported in ocsp responses and crl's
+// Reason is one of the reason codes in crypto/ocsp
+// A reason of certificateHold puts the serial on hold, and removeFromCRL releases a held serial
+type Revocation struct {
+  Serial uint64
+  Reason int
+  RevokedAt time.Time
+  receipt *Receipt //set by AddNodes
+}
+
+// Value of a leaf in the tree
+type LeafState uint8
+
+const (
+  Absent LeafState = iota //not revoked, no leaf is stored
+  Revoked
+  Held //revoked with reason certificateHold, can still be released
+)
+
+func (s LeafState) String() string {
+  switch s {
+  case Absent:
+    return "absent"
+  case Revoked:
+    return "revoked"
+  case Held:
+    return "held"
+  default:
+    return fmt.Sprintf("LeafState(%d)",uint8(s))
+  }
+}
+
+// A single change to a serial's leaf
+// Old is nil if the serial was absent, New has reason removeFromCRL if the serial was released
+type Change struct {
+  Old *Revocation
+  New Revocation
+}
+
+// Record of the leaves changed by a single IntegrateQueue call
+// Used to produce delta crl's and consistency proofs between two revisions of the tree
+type Batch struct {
+  Revision uint64 //revision of the root signed after this batch
+  Changes []Change
+  IntegratedAt time.Time
+}
+
 type Config struct { //input parameters for Initialize
   MaxCerts uint64 //uint64 holds up to 18 quintillian certs
   KeyPath string
   CertPath string
   Mmd string
+  Metadata []byte //placed in every root, nil for the server's own issuer, see New
 }
 
 // MerkleTree Methods
+// Sign the current root again, with a new timestamp
 func (t *MerkleTree) SignRoot() error {
-  var newLogRoot *types.LogRootV1
-  var newSLR *types.SignedLogRoot
+  t.recording.RLock()
+  defer t.recording.RUnlock()
+  t.signing.Lock()
+  defer t.signing.Unlock()
+  t.RLock()
+  rootHash, treeSize, versionNum := t.merkleRoot, t.nodesCreated, t.updatedTimes
+  t.RUnlock()
+  newLogRoot, newSLR, err := t.signRoot(rootHash,treeSize,versionNum)
+  if(err != nil){return err}
+  if err := t.publishRecord(record{Root: newSLR}); err != nil {
+    return fmt.Errorf("Couldn't publish the root signed again for revision %v: %v",versionNum,err)
+  }
 
-  versionNum := t.updatedTimes
-  newLogRoot = &types.LogRootV1{
-    RootHash: t.merkleRoot,
+  // mutex
+  t.Lock()
+  t.publishRoot(newLogRoot,newSLR)
+  t.Unlock()
+  t.recordRoot(newLogRoot,newSLR)
+  return nil
+}
+
+// Sign a root without publishing it, the result is kept for health checks
+func (t *MerkleTree) signRoot(rootHash []byte, treeSize uint64, versionNum uint64) (*types.LogRootV1,*types.SignedLogRoot,error) {
+  newLogRoot := &types.LogRootV1{
+    RootHash: rootHash,
     TimestampNanos: uint64(time.Now().UnixNano()),
-    TreeSize: t.nodesCreated, //number of nodes for treeSize
+    TreeSize: treeSize, //number of nodes for treeSize
     Revision: versionNum,
+    Metadata: t.metadata,
   }
 
-  newSLR, err := t.s.SignLogRoot(newLogRoot)
-  if(newSLR==nil) {
-    return errors.New("newSLR is nil pointer")
+  var newSLR *types.SignedLogRoot
+  var err error
+  t.RLock()
+  signUntil := t.signUntil
+  t.RUnlock()
+  if(!signUntil.IsZero() && time.Now().After(signUntil)) {
+    err = ErrSignExpired
+  } else {
+    newSLR, err = t.s.SignLogRoot(newLogRoot)
+  }
+  if(err == nil && newSLR == nil) {
+    err = errors.New("newSLR is nil pointer")
   }
-  if(err != nil){return err}
-
-  // mutex
   t.Lock()
-  t.slr = newSLR
-  t.LastUpdated = time.Now()
-  t.NextUpdate = time.Now().Add(t.mmd)
+  t.signErr = err
   t.Unlock()
-  return nil
+  return newLogRoot,newSLR,err
 }
 
-func Initialize(cfg Config) (*MerkleTree,*ecdsa.PrivateKey,*x509.Certificate,*time.Duration,error) {
-  glog.V(2).Infoln("Loading Tree Parameters")
-  h := getMaxHeight(cfg.MaxCerts)
+// Serve newSLR as the latest root, and wake anyone waiting for it
+// Update times come from the signed timestamp, so ocsp responses and crl's agree with the root they are served from
+// Caller must hold the lock, and have updated updatedTimes to the root's revision
+func (t *MerkleTree) publishRoot(newLogRoot *types.LogRootV1, newSLR *types.SignedLogRoot) {
+  versionNum := t.updatedTimes
+  t.slr = newSLR
+  if(uint64(len(t.roots)) == versionNum) {
+    t.roots = append(t.roots,newSLR)
+  } else {
+    t.roots[versionNum] = newSLR
+  }
+  t.LastUpdated = time.Unix(0,int64(newLogRoot.TimestampNanos)).UTC()
+  t.NextUpdate = t.LastUpdated.Add(t.updateInterval)
+  t.saves++
+  close(t.rootSigned)
+  t.rootSigned = make(chan struct{})
+}
 
-  glog.V(3).Infof("Tree height = %v\n",h)
-  
+func (t *MerkleTree) recordRoot(newLogRoot *types.LogRootV1, newSLR *types.SignedLogRoot) {
+  t.record(func(l *audit.Logger) error {
+    return l.LogRoot(t.GetName(),audit.Root{
+      Revision: newLogRoot.Revision,
+      RootHash: newLogRoot.RootHash,
+      TreeSize: newLogRoot.TreeSize,
+      TimestampNanos: newLogRoot.TimestampNanos,
+      Signature: newSLR.LogRootSignature,
+    })
+  })
+}
+
+func Initialize(cfg Config) (*MerkleTree,*ecdsa.PrivateKey,*x509.Certificate,*time.Duration,error) {
   glog.V(2).Infoln("Reading in key file")
   key, err := getKeyFromFile(cfg.KeyPath) //private key for slr's
   if(err != nil){return nil,nil,nil,nil,err}
@@ -101,20 +229,37 @@ func Initialize(cfg Config) (*MerkleTree,*ecdsa.PrivateKey,*x509.Certificate,*ti
   glog.V(2).Infoln("Reading in cert file")
   cert, err := getCertFromFile(cfg.CertPath)
 
-  glog.V(2).Infoln("Generating empty log root")
-  hasher := rfc6962.DefaultHasher //for hashing leaves/nodes
-  rootHash := hasher.EmptyRoot()
-  root := Node{nil,nil,nil,rootHash}
-  maxSerial := uint64(math.Pow(2.0,float64(h))-1)
-
-  glog.V(3).Infof("Maximum serial supported by height is %v\n",maxSerial)
-
   glog.V(2).Infoln("Parsing mmd string")
   mmdDuration,err := time.ParseDuration(cfg.Mmd)
   if err != nil {return nil,nil,nil,nil,err}
   glog.V(2).Infof("mmd parsed as %v seconds\n",mmdDuration.Seconds())
 
   s := signer.NewSigner(0,key,crypto.SHA256)
+  t := New(cfg.MaxCerts,mmdDuration,s,cfg.Metadata)
+
+  return t, key, cert, &mmdDuration, nil
+}
+
+// Create an empty tree holding serials up to maxCerts, with roots signed by s
+// metadata is placed in every signed root so roots of different trees using the same key can't be mixed up
+func New(maxCerts uint64, mmd time.Duration, s *signer.Signer, metadata []byte) *MerkleTree {
+  glog.V(2).Infoln("Loading Tree Parameters")
+  h := getMaxHeight(maxCerts)
+
+  glog.V(3).Infof("Tree height = %v\n",h)
+
+  glog.V(2).Infoln("Precomputing zero hashes")
+  hasher := rfc6962.DefaultHasher //for hashing leaves/nodes
+  zeroHashes := precomputeHashes(hasher,h)
+
+  // The empty root is the hash of an empty subtree at depth 0, so it is reproduced when every leaf is released
+  // and consistency proofs from revision 0 verify. Trees saved with legacyEmptyRoot keep it, see Restore
+  glog.V(2).Infoln("Generating empty log root")
+  rootHash := zeroHashes[0]
+  root := Node{nil,nil,nil,rootHash}
+  maxSerial := uint64(math.Pow(2.0,float64(h))-1)
+
+  glog.V(3).Infof("Maximum serial supported by height is %v\n",maxSerial)
 
   t := MerkleTree{
     Root: &root,
@@ -124,19 +269,24 @@ func Initialize(cfg Config) (*MerkleTree,*ecdsa.PrivateKey,*x509.Certificate,*ti
     maxSerial: maxSerial,
     nodesCreated: uint64(0),
     updatedTimes: uint64(0),
-    mmd: mmdDuration,
+    mmd: mmd,
+    updateInterval: mmd,
     s: s,
-    queue: []uint64{},
+    metadata: metadata,
+    zeroHashes: zeroHashes,
+    queue: []Revocation{},
+    revocations: make(map[uint64]Revocation),
+    receipts: make(map[string]*Receipt),
+    receiptRetention: DefaultReceiptRetention,
+    proofs: newProofCache(),
+    rootSigned: make(chan struct{}),
+    batchReady: make(chan struct{},1),
   }
 
   glog.V(2).Infoln("Signing empty root")
   t.SignRoot()
 
-  glog.V(2).Infoln("Precomputing zero hashes")
-  zeroHashes := precomputeHashes(t.hashFunc,h)
-  t.zeroHashes = zeroHashes
-  
-  return &t, key, cert, &mmdDuration, nil
+  return &t
 }
 
 func (t *MerkleTree) GetSth() *types.SignedLogRoot {
@@ -146,13 +296,65 @@ func (t *MerkleTree) GetSth() *types.SignedLogRoot {
   return slr
 }
 
+// Latest signed root at each revision after the given one, oldest first
+// Lets a client that has seen revision after catch up on the roots it missed
+func (t *MerkleTree) GetRootsAfter(after uint64) []*types.SignedLogRoot {
+  t.RLock()
+  defer t.RUnlock()
+  if(after >= uint64(len(t.roots))) {
+    return nil
+  }
+  return append([]*types.SignedLogRoot(nil),t.roots[after+1:]...)
+}
+
+// Closed once a root newer than the current sth is signed
+// Take the channel before reading the sth, so a root signed in between isn't missed
+func (t *MerkleTree) RootSigned() <-chan struct{} {
+  t.RLock()
+  defer t.RUnlock()
+  return t.rootSigned
+}
+
 // Loop through tree to see if leaf is present
 // true = revoked
 func (t *MerkleTree) GetRevocationValue(serial uint64) (bool,error) {
+  t.RLock()
+  defer t.RUnlock()
+  return t.revocationValue(serial),nil
+}
+
+// What an ocsp response says about a serial, all read at the same revision
+type LeafStatus struct {
+  Present bool //revoked or held
+  Revocation Revocation //reason and time, when present
+  Proof [][]byte //inclusion proof against the latest signed root
+  ThisUpdate time.Time
+  NextUpdate time.Time
+}
+
+// Everything an ocsp response needs about serial, so the leaf, its reason and proof can't come from different roots
+func (t *MerkleTree) GetLeafStatus(serial uint64) LeafStatus {
+  t.RLock()
+  defer t.RUnlock()
+  r := t.revocations[serial]
+  return LeafStatus{
+    Present: t.revocationValue(serial),
+    Revocation: r,
+    Proof: t.inclusionProof(serial),
+    ThisUpdate: t.LastUpdated,
+    NextUpdate: t.NextUpdate,
+  }
+}
+
+// Caller must hold the lock
+func (t *MerkleTree) revocationValue(serial uint64) bool {
+  if(serial > t.maxSerial) { //would otherwise alias a lower serial, can't be in the tree
+    return false
+  }
   mask := uint64(math.Pow(2,float64(t.height-1)))
   curNode := t.Root
   glog.V(4).Infoln("Traversing tree, starting at root")
-  for i:=0;i<(t.height-1);i++ {
+  for i:=0;i<t.height;i++ {
     if(mask&serial>0) { 
       glog.V(4).Infoln("Right")
       curNode = curNode.Right
@@ -163,125 +365,733 @@ func (t *MerkleTree) GetRevocationValue(serial uint64) (bool,error) {
 
     if(curNode==nil) {
       glog.V(4).Infoln("Current node is nil pointer, must be non-revoked")
-      return false,nil
+      return false
     }
 
     mask = mask >> 1
   }
 
   // if we make it to a leaf node it is revoked
-  return true,nil
+  return true
+}
+
+// Reason and time of revocation for a serial in the tree
+// ok is false if the serial has not been integrated
+func (t *MerkleTree) GetRevocation(serial uint64) (Revocation,bool) {
+  t.RLock()
+  r, ok := t.revocations[serial]
+  t.RUnlock()
+  return r, ok
+}
+
+// Returned by AddNodes when the queue can't take the submissions until the next IntegrateQueue
+var ErrQueueFull = errors.New("Queue is full, retry after the next root is signed")
+
+// Bound the number of queued changes, 0 for no limit
+func (t *MerkleTree) SetMaxQueue(n int) {
+  t.Lock()
+  t.maxQueue = n
+  t.Unlock()
+}
+
+// Signal BatchReady whenever the queue reaches n changes, 0 to only integrate on the sequencer's interval
+func (t *MerkleTree) SetBatchTrigger(n int) {
+  t.Lock()
+  t.batchTrigger = n
+  t.Unlock()
+}
+
+// Receives once the queue has reached the batch trigger, for the sequencer to integrate early
+func (t *MerkleTree) BatchReady() <-chan struct{} {
+  return t.batchReady
 }
 
 // Add node to the queue to be incorporated 
-func (t *MerkleTree) AddNode(serial uint64) error {
-  if(serial > t.maxSerial) {
-    return errors.New("Request serial exceeds maximum serial storable by tree. Increase MaxCerts in config file")
-  }
+func (t *MerkleTree) AddNode(r Revocation) (Submission,error) {
+  submissions, err := t.AddNodes([]Revocation{r})
+  if err != nil {return Submission{},err}
+  return submissions[0],nil
+}
+
+// Add several nodes to the queue at once, used for bulk imports
+// Either every revocation is queued or none are, if any can't be queued the error is a *SubmissionError listing each one
+// If they would overflow the queue the error is ErrQueueFull, once the tree is closed ErrClosed, and on a standby replica ErrStandby
+// The queue is a set: a change the queue (or tree) already leads to is not queued again, the earlier receipt is returned instead
+// Revocations of serials that are already revoked are reported the same way
+// A release (reason removeFromCRL) is only accepted for a serial that is on hold, or queued to be put on hold
+// With SetPublish they are only queued once published, if that fails the error is ErrStandby or ErrNotPublished
+func (t *MerkleTree) AddNodes(rs []Revocation) ([]Submission,error) {
+  t.recording.RLock()
+  defer t.recording.RUnlock()
+  t.submitting.RLock()
+  defer t.submitting.RUnlock()
+  submissions, err := t.queueNodes(rs)
+  if err != nil {return nil,err}
+  if err := t.publishSubmissions(submissions); err != nil {return nil,err}
+
+  t.record(func(l *audit.Logger) error {
+    subs := make([]audit.Submission,len(submissions))
+    for i,s := range(submissions) {
+      subs[i] = audit.Submission{ReceiptID: s.Receipt.ID, Serial: s.Receipt.Serial, Reason: s.Receipt.Reason, Status: s.Status}
+    }
+    return l.LogSubmissions(t.GetName(),subs)
+  })
+  return submissions,nil
+}
+
+func (t *MerkleTree) queueNodes(rs []Revocation) ([]Submission,error) {
+  ids, err := newReceiptIds(len(rs))
+  if err != nil {return nil,err}
 
   // mutex
   t.Lock()
-  t.queue = append(t.queue,serial)
+  defer t.Unlock()
+  if(t.closed) {
+    return nil,ErrClosed
+  }
+  if(t.standby) {
+    return nil,ErrStandby
+  }
+
+  // Where each submitted serial ends up once the queue is integrated, and the receipt that takes it there
+  type projection struct {
+    state LeafState
+    receipt *Receipt
+  }
+  proj := make(map[uint64]*projection)
+  for _,r := range(rs) {
+    if _, ok := proj[r.Serial]; ok {
+      continue
+    }
+    p := &projection{state: Absent}
+    if c, ok := t.revocations[r.Serial]; ok {
+      p.state, p.receipt = stateOf(&c), c.receipt
+    }
+    proj[r.Serial] = p
+  }
+  // The batch being integrated comes first, it is either committed or put back on the front of the queue
+  for _,queue := range([][]Revocation{t.inflight,t.queue}) {
+    for _,q := range(queue) {
+      if p, ok := proj[q.Serial]; ok && AllowedTransition(p.state,stateOf(&q)) {
+        p.state, p.receipt = stateOf(&q), q.receipt
+      }
+    }
+  }
+
+  submissions := make([]Submission,len(rs))
+  var queued []Revocation
+  var errs []SerialError
+  for i,r := range(rs) {
+    if(r.Serial > t.maxSerial) {
+      errs = append(errs,SerialError{i,r.Serial,fmt.Sprintf("Serial exceeds maximum serial storable by tree (%v). Increase MaxCerts in config file",t.maxSerial)})
+      continue
+    }
+    p := proj[r.Serial]
+    next := stateOf(&r)
+    committed, inTree := t.revocations[r.Serial]
+    switch {
+    case inTree && stateOf(&committed) == Revoked && next != Absent:
+      submissions[i] = Submission{earlierReceipt(r.Serial,committed.receipt),SubmissionAlreadyRevoked}
+    case p.state == next && (next != Absent || p.receipt != nil):
+      submissions[i] = Submission{earlierReceipt(r.Serial,p.receipt),SubmissionDuplicate}
+    case AllowedTransition(p.state,next):
+      r.receipt = t.newReceipt(ids[i],r,queued)
+      queued = append(queued,r)
+      p.state, p.receipt = next, r.receipt
+      submissions[i] = Submission{*r.receipt,SubmissionQueued}
+    case p.state == Revoked && next != Absent: //a revocation is queued, so a hold can't apply
+      submissions[i] = Submission{earlierReceipt(r.Serial,p.receipt),SubmissionDuplicate}
+    case p.state == Revoked:
+      errs = append(errs,SerialError{i,r.Serial,"Serial is revoked, only held serials can be released"})
+    default:
+      errs = append(errs,SerialError{i,r.Serial,"Serial is not on hold, only held serials can be released"})
+    }
+  }
+  if(len(errs) > 0) {
+    for _,r := range(queued) {
+      delete(t.receipts,r.receipt.ID)
+    }
+    return nil,&SubmissionError{errs}
+  }
+  if(t.maxQueue > 0 && len(t.inflight)+len(t.queue)+len(queued) > t.maxQueue) {
+    for _,r := range(queued) {
+      delete(t.receipts,r.receipt.ID)
+    }
+    return nil,ErrQueueFull
+  }
+
+  t.queue = append(t.queue,queued...)
+  t.saves++
   glog.V(3).Infof("Queue = %v\n",t.queue)
-  t.Unlock()
-  return nil
+  if(t.batchTrigger > 0 && len(t.queue) >= t.batchTrigger) {
+    select {
+    case t.batchReady <- struct{}{}:
+    default: //already signalled
+    }
+  }
+  return submissions,nil
+}
+
+// State of a serial's leaf after r is applied, r is nil for a serial not in the tree
+func stateOf(r *Revocation) LeafState {
+  switch {
+  case r == nil || r.Reason == ocsp.RemoveFromCRL:
+    return Absent
+  case r.Reason == ocsp.CertificateHold:
+    return Held
+  default:
+    return Revoked
+  }
+}
+
+// Leaves may only change absent->revoked, absent->held, held->revoked or held->absent
+// Revocation is permanent, only a hold can be undone
+func AllowedTransition(old LeafState, new LeafState) bool {
+  switch old {
+  case Absent:
+    return new == Revoked || new == Held
+  case Held:
+    return new == Revoked || new == Absent
+  default:
+    return false
+  }
 }
 
 // Starting from root, loop through serial in binary to place node in tree
 // 1 == right, 0 == left
 // runs in parallel with normal log operation
+// Each serial changes at most once per batch, later changes to the same serial are requeued for the next batch
+// Changes that aren't allowed transitions, such as revoking a serial twice, are dropped
+// If the new root can't be signed or published the tree is left unchanged and the batch goes back on the front of the queue
 func (t *MerkleTree) IntegrateQueue() error {
+  t.recording.RLock()
+  defer t.recording.RUnlock()
+  t.signing.Lock()
+  defer t.signing.Unlock()
+  start := time.Now()
   // Reset the queue, work with a copy to allow nodes to be added while integration is happening
   // mutex
+  // Submissions still being published stay queued, they may yet be taken back
+  t.submitting.Lock()
   t.Lock()
   queueCopy := t.queue[:]
-  t.queue = []uint64{}
+  t.queue = []Revocation{}
+  t.inflight = queueCopy
+  oldRoot := append([]byte(nil),t.merkleRoot...)
   t.Unlock()
+  t.submitting.Unlock()
 
-  // Add leaf + required internal nodes to tree
-  var integratedNodes []*Node = make([]*Node,len(queueCopy)) //save pointers of added nodes for hashing later
-  nodesIncreased := uint64(0) //number of nodes we added to the tree this batch
-  for j,v := range(queueCopy) {
-    mask := uint64(math.Pow(2,float64(t.height-1)))
-    curNode := t.Root
-    var newNode *Node
-    for i:=0;i<t.height;i++ {
-      if(mask&v>0) { 
-        if(curNode.Right==nil) {
-          newNode = &Node{curNode,nil,nil,nil}
-          nodesIncreased += 1
-          curNode.Right = newNode
-        }
-        glog.V(4).Infoln("Integrating: right")
-        curNode = curNode.Right
-      } else {
-        if(curNode.Left==nil) {
-          newNode = &Node{curNode,nil,nil,nil}
-          nodesIncreased += 1
-          curNode.Left = newNode
-        }
-        glog.V(4).Infoln("Integrating: left")
-        curNode = curNode.Left
-      }
-      mask = mask>>1
-      if(i==t.height-1) { //leaf node
-        integratedNodes[j] = newNode
-      }
-    }
+  // Put the whole batch back at the front of the queue, for the next attempt
+  requeue := func(err error) error {
+    t.Lock()
+    t.queue = append(queueCopy,t.queue...)
+    t.inflight = nil
+    t.Unlock()
+    return fmt.Errorf("%v, requeued %v revocations",err,len(queueCopy))
+  }
+
+  // Work out the change to each serial
+  batch := t.splitBatch(queueCopy)
+  changes, deferred, rejected, err := t.batchOf(queueCopy,batch)
+  if err != nil {
+    return requeue(err)
+  }
+
+  // Work out the new root beside the tree and sign it, nothing readers see changes until it is signed
+  staged := t.stage(changes)
+  newRoot := staged.root.hash
+  t.RLock()
+  treeSize := t.nodesCreated + staged.added - staged.removed
+  revision := t.updatedTimes+1
+  t.RUnlock()
+  glog.V(2).Infoln("Signing root")
+  logRoot, slr, err := t.signRoot(newRoot,treeSize,revision)
+  if(err != nil) {
+    return requeue(fmt.Errorf("Couldn't sign revision %v: %v",revision,err))
+  }
+  // Followers get the batch before anyone is served its root
+  batch.IntegratedAt, batch.Root = time.Now(), slr
+  if err := t.publishRecord(record{Batch: batch}); err != nil {
+    return requeue(fmt.Errorf("Couldn't publish revision %v: %v",revision,err))
   }
 
-  // update nodesCreated
   // mutex
   t.Lock()
-  t.nodesCreated += nodesIncreased
+  t.commitBatch(staged,treeSize,changes,deferred,rejected,t.queue,batch.IntegratedAt,logRoot,slr)
   t.Unlock()
-  glog.V(2).Infof("Integrated %v nodes to tree, hashing up\n",nodesIncreased)
-
-  // Hash up impacted nodes
-  leafHash := t.hashFunc.HashLeaf([]byte{1})
-  for _,v := range(integratedNodes) {
-    curNode := v
-    curNode.Hash = leafHash
-    curHeight := t.height-1
-    for i:=0;i<t.height;i++ {
-      curNode = curNode.Parent
-      var leftHash,rightHash []byte
 
-      if(curNode.Left==nil) {
-        leftHash = t.zeroHashes[curHeight+1]
+  t.record(func(l *audit.Logger) error {
+    b := audit.Batch{Revision: revision, OldRoot: oldRoot, NewRoot: newRoot}
+    for _,c := range(changes) {
+      b.Changes = append(b.Changes,audit.Change{Serial: c.New.Serial, Old: stateOf(c.Old).String(), New: stateOf(&c.New).String(), Reason: c.New.Reason})
+    }
+    for _,r := range(rejected) {
+      if(r != nil) {
+        b.Rejected = append(b.Rejected,r.ID)
+      }
+    }
+    return l.LogBatch(t.GetName(),b)
+  })
+  t.recordRoot(logRoot,slr)
+
+  metrics.BatchSize.WithLabelValues(t.GetName()).Observe(float64(len(changes)))
+  metrics.IntegrationDuration.WithLabelValues(t.GetName()).Observe(time.Since(start).Seconds())
+  return nil
+}
+
+// Split revocations taken off the queue: each changes its serial, or waits for the next batch if its serial already
+// changes in this one, or is rejected if the change isn't allowed
+// Only IntegrateQueue and Apply write t.revocations, holding the signing lock, so it can be read here without the lock
+func (t *MerkleTree) splitBatch(taken []Revocation) *batchRecord {
+  b := &batchRecord{Taken: len(taken)}
+  changed := make(map[uint64]LeafState) //state of serials already changed this batch
+  for i,r := range(taken) {
+    if s, ok := changed[r.Serial]; ok {
+      if(AllowedTransition(s,stateOf(&r))) {
+        b.Deferred = append(b.Deferred,i)
       } else {
-        leftHash = curNode.Left.Hash
+        glog.V(3).Infof("Serial %v can't change from %v to %v, skipping\n",r.Serial,s,stateOf(&r))
+        b.Rejected = append(b.Rejected,i)
       }
+      continue
+    }
+    oldState := Absent
+    if current, ok := t.revocations[r.Serial]; ok {
+      oldState = stateOf(&current)
+    }
+    if(!AllowedTransition(oldState,stateOf(&r))) {
+      glog.V(3).Infof("Serial %v can't change from %v to %v, skipping\n",r.Serial,oldState,stateOf(&r))
+      b.Rejected = append(b.Rejected,i)
+      continue
+    }
+    b.Changed = append(b.Changed,i)
+    changed[r.Serial] = stateOf(&r)
+  }
+  return b
+}
+
+// The changes, deferred revocations and rejected receipts b makes of taken, checking it is a split splitBatch could make
+// Caller must hold the signing lock
+func (t *MerkleTree) batchOf(taken []Revocation, b *batchRecord) ([]Change,[]Revocation,[]*Receipt,error) {
+  used := make(map[int]bool)
+  pick := func(i int) (Revocation,error) {
+    if(i < 0 || i >= len(taken) || used[i]) {
+      return Revocation{},fmt.Errorf("Batch uses revocation %v of the %v taken off the queue twice, or there is no such revocation",i,len(taken))
+    }
+    used[i] = true
+    return taken[i],nil
+  }
+  var changes []Change
+  var deferred []Revocation
+  var rejected []*Receipt
+  changed := make(map[uint64]bool)
+  for _,i := range(b.Changed) {
+    r, err := pick(i)
+    if err != nil {
+      return nil,nil,nil,err
+    }
+    var old *Revocation
+    if current, ok := t.revocations[r.Serial]; ok {
+      old = &current
+    }
+    if(changed[r.Serial] || !AllowedTransition(stateOf(old),stateOf(&r))) {
+      return nil,nil,nil,fmt.Errorf("Batch changes serial %v from %v to %v, which isn't allowed",r.Serial,stateOf(old),stateOf(&r))
+    }
+    changed[r.Serial] = true
+    changes = append(changes,Change{old,r})
+  }
+  for _,i := range(b.Deferred) {
+    r, err := pick(i)
+    if err != nil {
+      return nil,nil,nil,err
+    }
+    deferred = append(deferred,r)
+  }
+  for _,i := range(b.Rejected) {
+    r, err := pick(i)
+    if err != nil {
+      return nil,nil,nil,err
+    }
+    rejected = append(rejected,r.receipt)
+  }
+  if(len(used) != len(taken)) {
+    return nil,nil,nil,fmt.Errorf("Batch accounts for %v of the %v revocations taken off the queue",len(used),len(taken))
+  }
+  return changes,deferred,rejected,nil
+}
+
+// Apply the staged nodes, update MTH, record the batch and serve its root, all at once for readers
+// queue is what stays queued behind the deferred revocations
+// Caller must hold the signing lock and the lock
+func (t *MerkleTree) commitBatch(staged *stagedBatch, treeSize uint64, changes []Change, deferred []Revocation, rejected []*Receipt, queue []Revocation, integratedAt time.Time, logRoot *types.LogRootV1, slr *types.SignedLogRoot) {
+  t.applyStaged(t.Root,staged.root)
+  t.nodesCreated = treeSize
+  t.merkleRoot = staged.root.hash
+  t.updatedTimes = logRoot.Revision
+  t.batches = append(t.batches,Batch{
+    Revision: logRoot.Revision,
+    Changes: changes,
+    IntegratedAt: integratedAt,
+  })
+  for _,c := range(changes) {
+    if(stateOf(&c.New) == Absent) {
+      delete(t.revocations,c.New.Serial)
+    } else {
+      t.revocations[c.New.Serial] = c.New
+    }
+  }
+  t.queue = append(deferred,queue...)
+  t.inflight = nil
+  for _,c := range(changes) {
+    t.settleReceipt(c.New.receipt,ReceiptIntegrated,integratedAt)
+  }
+  for _,r := range(rejected) {
+    t.settleReceipt(r,ReceiptRejected,integratedAt)
+  }
+  t.pruneReceipts(integratedAt)
+  t.publishRoot(logRoot,slr)
+}
+
+// New hashes for the nodes on the paths a batch changes, worked out beside the tree
+type stagedNode struct {
+  hash []byte
+  present bool //false once no leaf below is revoked or held, the node is then removed
+  left *stagedNode //nil if nothing changed on that side
+  right *stagedNode
+}
 
+type stagedBatch struct {
+  root *stagedNode
+  added uint64 //nodes the batch creates
+  removed uint64 //nodes the batch removes
+}
+
+// Stage changes, each to a different serial, without touching the tree
+// Caller must hold the signing lock, so the nodes don't change underneath
+func (t *MerkleTree) stage(changes []Change) *stagedBatch {
+  sorted := append([]Change(nil),changes...)
+  sort.Slice(sorted, func(i, j int) bool {return sorted[i].New.Serial < sorted[j].New.Serial})
+  b := &stagedBatch{}
+  b.root = t.stageSubtree(t.Root,0,sorted,b)
+  glog.V(2).Infof("Staged %v leaves, %v nodes added and %v removed\n",len(changes),b.added,b.removed)
+  return b
+}
+
+// Stage the subtree at depth under n (nil if there is none yet) holding the (sorted, non empty) changes
+// Every node under a subtree that is removed lies on a changed path, so counting the nodes staged here counts every node removed
+func (t *MerkleTree) stageSubtree(n *Node, depth int, changes []Change, b *stagedBatch) *stagedNode {
+  s := &stagedNode{}
+  if(depth == t.height) {
+    state := stateOf(&changes[0].New)
+    s.hash, s.present = t.leafHash(state), state != Absent
+  } else {
+    var left, right *Node
+    if(n != nil) {
+      left, right = n.Left, n.Right
+    }
+    mask := uint64(1) << uint(t.height-1-depth)
+    cs := sort.Search(len(changes), func(i int) bool {return changes[i].New.Serial&mask > 0})
+    leftHash, leftPresent := t.childHash(left,depth+1)
+    rightHash, rightPresent := t.childHash(right,depth+1)
+    if(cs > 0) {
+      s.left = t.stageSubtree(left,depth+1,changes[:cs],b)
+      leftHash, leftPresent = s.left.hash, s.left.present
+    }
+    if(cs < len(changes)) {
+      s.right = t.stageSubtree(right,depth+1,changes[cs:],b)
+      rightHash, rightPresent = s.right.hash, s.right.present
+    }
+    s.present = leftPresent || rightPresent
+    s.hash = t.zeroHashes[depth]
+    if(s.present) {
+      s.hash = t.hashFunc.HashChildren(leftHash,rightHash)
+    }
+  }
+  if(depth > 0) { //the root is always there
+    if(n == nil && s.present) {
+      b.added++
+    } else if(n != nil && !s.present) {
+      b.removed++
+    }
+  }
+  return s
+}
+
+// Hash of the subtree at depth under n, and whether there is one
+func (t *MerkleTree) childHash(n *Node, depth int) ([]byte,bool) {
+  if(n == nil) {
+    return t.zeroHashes[depth],false
+  }
+  return n.Hash,true
+}
+
+// Copy staged hashes into n and the nodes below it, creating and removing nodes to match
+// Caller must hold the lock
+func (t *MerkleTree) applyStaged(n *Node, s *stagedNode) {
+  n.Hash = s.hash
+  n.Left = t.applyStagedChild(n,n.Left,s.left)
+  n.Right = t.applyStagedChild(n,n.Right,s.right)
+}
+
+func (t *MerkleTree) applyStagedChild(parent *Node, child *Node, s *stagedNode) *Node {
+  if(s == nil) {
+    return child
+  }
+  if(!s.present) {
+    return nil
+  }
+  if(child == nil) {
+    child = &Node{parent,nil,nil,nil}
+  }
+  t.applyStaged(child,s)
+  return child
+}
+
+// Walk down to serial's leaf, creating any missing nodes
+// Returns the leaf and the number of nodes created
+func (t *MerkleTree) insertLeaf(serial uint64) (*Node,uint64) {
+  added := uint64(0)
+  mask := uint64(math.Pow(2,float64(t.height-1)))
+  curNode := t.Root
+  for i:=0;i<t.height;i++ {
+    if(mask&serial>0) {
       if(curNode.Right==nil) {
-        rightHash = t.zeroHashes[curHeight+1]
-      } else {
-        rightHash = curNode.Right.Hash
+        curNode.Right = &Node{curNode,nil,nil,nil}
+        added += 1
+      }
+      glog.V(4).Infoln("Integrating: right")
+      curNode = curNode.Right
+    } else {
+      if(curNode.Left==nil) {
+        curNode.Left = &Node{curNode,nil,nil,nil}
+        added += 1
       }
+      glog.V(4).Infoln("Integrating: left")
+      curNode = curNode.Left
+    }
+    mask = mask>>1
+  }
+  return curNode,added
+}
+
+// Recompute the hashes of n (at depth) and each of its ancestors from their children
+func (t *MerkleTree) hashUp(n *Node, depth int) {
+  for ;n!=nil;n = n.Parent {
+    leftHash, rightHash := t.zeroHashes[depth+1], t.zeroHashes[depth+1]
+    if(n.Left!=nil) {
+      leftHash = n.Left.Hash
+    }
+    if(n.Right!=nil) {
+      rightHash = n.Right.Hash
+    }
+    n.Hash = t.hashFunc.HashChildren(leftHash,rightHash)
+    depth--
+  }
+}
+
+// Hash stored at a leaf in state s
+// An absent leaf is an empty subtree at depth height, like any other empty subtree
+func (t *MerkleTree) leafHash(s LeafState) []byte {
+  return leafHash(t.hashFunc,t.zeroHashes,s)
+}
 
-      curNode.Hash = t.hashFunc.HashChildren(leftHash,rightHash)
-      curHeight--
+func leafHash(hasher *rfc6962.Hasher, zeroHashes [][]byte, s LeafState) []byte {
+  switch s {
+  case Revoked:
+    return hasher.HashLeaf([]byte{1})
+  case Held:
+    return hasher.HashLeaf([]byte{2})
+  default:
+    return zeroHashes[len(zeroHashes)-1]
+  }
+}
+
+// Returns the batches integrated after revision from, up to and including revision to
+// Serials in these batches are the ones changed between the two revisions, see NetChanges
+func (t *MerkleTree) GetBatches(from uint64, to uint64) ([]Batch,error) {
+  t.RLock()
+  defer t.RUnlock()
+  if(to > t.updatedTimes) {
+    return nil,fmt.Errorf("Revision %v has not been produced yet, current revision is %v",to,t.updatedTimes)
+  }
+  if(from > to) {
+    return nil,fmt.Errorf("Base revision %v is after revision %v",from,to)
+  }
+  batches := make([]Batch,to-from)
+  copy(batches,t.batches[from:to])
+  return batches,nil
+}
+
+// Combine the changes in consecutive batches into a single change per serial, sorted by serial
+// Old is the serial's state before the first batch and New its state after the last
+// Serials that end up where they started, like a hold released in the same range, are left out
+func NetChanges(batches []Batch) []Change {
+  net := make(map[uint64]Change)
+  for _,b := range(batches) {
+    for _,c := range(b.Changes) {
+      if prev, ok := net[c.New.Serial]; ok {
+        c.Old = prev.Old
+      }
+      net[c.New.Serial] = c
     }
   }
+  changes := make([]Change,0,len(net))
+  for _,c := range(net) {
+    if(stateOf(c.Old) != stateOf(&c.New)) {
+      changes = append(changes,c)
+    }
+  }
+  sort.Slice(changes, func(i, j int) bool {return changes[i].New.Serial < changes[j].New.Serial})
+  return changes
+}
 
-  glog.V(2).Infoln("Tree hashing complete, updating merkleRoot")
+// Snapshot of every serial in the tree (revoked or held), taken together with the revision they produce
+func (t *MerkleTree) GetRevocations() ([]Revocation,uint64) {
+  t.RLock()
+  defer t.RUnlock()
+  rs := make([]Revocation,0,len(t.revocations))
+  for _,r := range(t.revocations) {
+    rs = append(rs,r)
+  }
+  sort.Slice(rs, func(i, j int) bool {return rs[i].Serial < rs[j].Serial})
+  return rs,t.updatedTimes
+}
 
-  // Update MTH
-  // mutex
+// Snapshot of every revoked (or held) serial, taken together with the revision and root hash they produce
+func (t *MerkleTree) GetRevokedSerials() ([]uint64,uint64,[]byte) {
+  t.RLock()
+  defer t.RUnlock()
+  serials := make([]uint64,0,len(t.revocations))
+  for s := range(t.revocations) {
+    serials = append(serials,s)
+  }
+  return serials,t.updatedTimes,t.merkleRoot
+}
+
+// Largest serial storable by the tree
+func (t *MerkleTree) GetMaxSerial() uint64 {
+  return t.maxSerial
+}
+
+// Signer used for the tree's signed log roots, for other objects the log signs
+func (t *MerkleTree) GetSigner() *signer.Signer {
+  return t.s
+}
+
+// How long each root stays the latest, the sequencer signs a new one at least this often
+// Defaults to the mmd, the latest root's NextUpdate moves to match
+func (t *MerkleTree) SetUpdateInterval(d time.Duration) {
   t.Lock()
-  t.merkleRoot = t.Root.Hash
-  t.updatedTimes++
+  t.updateInterval = d
+  t.NextUpdate = t.LastUpdated.Add(d)
   t.Unlock()
+}
 
-  // Sign the root
-  glog.V(2).Infoln("Signing root")
-  err := t.SignRoot()
-  if(err != nil){return err}
+// ThisUpdate and NextUpdate for responses served from the latest root, read together
+func (t *MerkleTree) GetUpdateTimes() (time.Time,time.Time) {
+  t.RLock()
+  defer t.RUnlock()
+  return t.LastUpdated,t.NextUpdate
+}
 
-  return nil
+// ThisUpdate and NextUpdate from the latest signed root at revision, for crl's of an earlier revision
+// Same as GetUpdateTimes for the current revision
+func (t *MerkleTree) GetUpdateTimesAt(revision uint64) (time.Time,time.Time,error) {
+  t.RLock()
+  defer t.RUnlock()
+  if(revision == t.updatedTimes) {
+    return t.LastUpdated,t.NextUpdate,nil
+  }
+  if(revision >= uint64(len(t.roots))) {
+    return time.Time{},time.Time{},fmt.Errorf("Revision %v hasn't been signed, the tree is at %v",revision,t.updatedTimes)
+  }
+  var root types.LogRootV1
+  if err := root.UnmarshalBinary(t.roots[revision].LogRoot); err != nil {
+    return time.Time{},time.Time{},err
+  }
+  thisUpdate := time.Unix(0,int64(root.TimestampNanos)).UTC()
+  return thisUpdate,thisUpdate.Add(t.updateInterval),nil
+}
+
+// When the next root is due, which may be a re-signed root of the same revision
+func (t *MerkleTree) GetNextUpdate() time.Time {
+  t.RLock()
+  defer t.RUnlock()
+  return t.NextUpdate
+}
+
+// Record submissions, batches and signed roots in l
+func (t *MerkleTree) SetAuditLog(l *audit.Logger) {
+  t.Lock()
+  t.audit = l
+  t.Unlock()
+}
+
+// Write an entry to the audit log, if there is one
+// Like audit records of requests, a failure to write is logged rather than failing the change
+func (t *MerkleTree) record(write func(l *audit.Logger) error) {
+  t.RLock()
+  l := t.audit
+  t.RUnlock()
+  if(l == nil) {
+    return
+  }
+  if err := write(l); err != nil {
+    glog.Errorf("Failed to write audit entry for %v: %v\n",t.GetName(),err)
+  }
+}
+
+// Name of the tree in metrics, its metadata or revocations for the revocation tree which has none
+func (t *MerkleTree) GetName() string {
+  if(len(t.metadata) == 0) {
+    return "revocations"
+  }
+  return string(t.metadata)
+}
+
+// Changes waiting for the next IntegrateQueue
+func (t *MerkleTree) GetQueueLength() int {
+  t.RLock()
+  defer t.RUnlock()
+  return len(t.queue)
+}
+
+// Nodes stored in the tree, the TreeSize of the next root
+func (t *MerkleTree) GetTreeSize() uint64 {
+  t.RLock()
+  defer t.RUnlock()
+  return t.nodesCreated
+}
+
+// Error from the last attempt to sign a root, nil if it succeeded
+func (t *MerkleTree) GetSignError() error {
+  t.RLock()
+  defer t.RUnlock()
+  return t.signErr
+}
+
+// When the latest root was signed
+func (t *MerkleTree) GetLastUpdated() time.Time {
+  t.RLock()
+  defer t.RUnlock()
+  return t.LastUpdated
+}
+
+// Current revision of the tree, equal to the revision in the latest signed root
+func (t *MerkleTree) GetRevision() uint64 {
+  t.RLock()
+  defer t.RUnlock()
+  return t.updatedTimes
 }
 
 func (t *MerkleTree) GetInclusionProof(serial uint64) ([][]byte,error) {
+  t.RLock()
+  defer t.RUnlock()
+  return t.inclusionProof(serial),nil
+}
+
+// Caller must hold the lock
+func (t *MerkleTree) inclusionProof(serial uint64) [][]byte {
   proof := make([][]byte,t.height)
 
   var curNode *Node
@@ -313,10 +1123,11 @@ func (t *MerkleTree) GetInclusionProof(serial uint64) ([][]byte,error) {
       }
       break;
     } else {
+      curNode = next
       mask = mask >> 1
     }
   }
-  return proof, nil
+  return proof
 }
 
 // Helper Functions
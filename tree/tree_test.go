@@ -0,0 +1,146 @@
+package tree
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+  "time"
+  "revocation-server/crypto/ocsp"
+)
+
+func newTestTree(t *testing.T) *MerkleTree {
+  tr, _, _, _, err := Initialize(Config{MaxCerts: 1000, KeyPath: "../testdata/key.pem", CertPath: "../testdata/root.cert", Mmd: "1h"})
+  if err != nil {t.Fatal(err)}
+  return tr
+}
+
+func revokeSerials(t *testing.T, tr *MerkleTree, serials ...uint64) {
+  for _,serial := range(serials) {
+    if _, err := tr.AddNode(Revocation{Serial: serial, RevokedAt: time.Now()}); err != nil {t.Fatal(err)}
+  }
+  if err := tr.IntegrateQueue(); err != nil {t.Fatal(err)}
+}
+
+// Hash a revoked leaf up through proof, deepest sibling first, to the root it proves inclusion in
+func rootFromProof(tr *MerkleTree, serial uint64, proof [][]byte) []byte {
+  hash := tr.hashFunc.HashLeaf([]byte{1})
+  for i,sibling := range(proof) {
+    if(serial>>uint(i)&1 == 1) {
+      hash = tr.hashFunc.HashChildren(sibling,hash)
+    } else {
+      hash = tr.hashFunc.HashChildren(hash,sibling)
+    }
+  }
+  return hash
+}
+
+// Lookups and proofs go all the way down to the leaves, at depth height
+// Serials 4 and 5 are siblings there, and 6 shares every node above them, so stopping short of the leaves gets them wrong
+func TestLeafDepth(t *testing.T) {
+  tr := newTestTree(t)
+  revokeSerials(t,tr,4,5,6,1000)
+
+  for serial, want := range(map[uint64]bool{4: true, 5: true, 6: true, 7: false, 1000: true, 1001: false, 0: false}) {
+    if got, err := tr.GetRevocationValue(serial); err != nil || got != want {
+      t.Errorf("GetRevocationValue(%v) = %v,%v, want %v",serial,got,err,want)
+    }
+  }
+  for _,serial := range([]uint64{4,5,6,1000}) {
+    proof, err := tr.GetInclusionProof(serial)
+    if err != nil {t.Fatal(err)}
+    if(len(proof) != tr.height) {
+      t.Fatalf("proof for %v has %v hashes, want %v",serial,len(proof),tr.height)
+    }
+    if root := rootFromProof(tr,serial,proof); !bytes.Equal(root,tr.merkleRoot) {
+      t.Errorf("inclusion proof for %v leads to %x, want root %x",serial,root,tr.merkleRoot)
+    }
+  }
+}
+
+// The queue is a set with all or nothing batches: what AddNodes makes of each submission, given what is already in the tree,
+// in the staged batch IntegrateQueue is working on, and queued
+func TestQueueNodes(t *testing.T) {
+  revoke := func(serial uint64) Revocation {return Revocation{Serial: serial, Reason: ocsp.KeyCompromise}}
+  hold := func(serial uint64) Revocation {return Revocation{Serial: serial, Reason: ocsp.CertificateHold}}
+  release := func(serial uint64) Revocation {return Revocation{Serial: serial, Reason: ocsp.RemoveFromCRL}}
+  const (
+    queued = SubmissionQueued
+    duplicate = SubmissionDuplicate
+    revoked = SubmissionAlreadyRevoked
+  )
+  tests := []struct {
+    name string
+    committed []uint64 //revoked in the tree
+    staged []Revocation //taken off the queue by IntegrateQueue, not yet committed
+    pending []Revocation //queued
+    maxQueue int
+    submit []Revocation
+    want []string //status of each submission, nil if the batch is refused
+    err string //refusal, ErrQueueFull's message or the serials' errors
+    queue int //staged and queued changes afterwards
+  }{
+    {"new serials", nil, nil, nil, 0, []Revocation{revoke(4),hold(5)}, []string{queued,queued}, "", 2},
+    {"twice in one batch", nil, nil, nil, 0, []Revocation{revoke(4),revoke(4)}, []string{queued,duplicate}, "", 1},
+    {"already queued", nil, nil, []Revocation{revoke(4)}, 0, []Revocation{revoke(4)}, []string{duplicate}, "", 1},
+    {"already in the tree", []uint64{4}, nil, nil, 0, []Revocation{revoke(4),hold(4)}, []string{revoked,revoked}, "", 0},
+    {"in the staged batch", nil, []Revocation{revoke(4)}, nil, 0, []Revocation{revoke(4)}, []string{duplicate}, "", 1},
+    {"held in the staged batch then revoked", nil, []Revocation{hold(4)}, nil, 0, []Revocation{revoke(4)}, []string{queued}, "", 2},
+    {"revoked in the staged batch then held", nil, []Revocation{revoke(4)}, nil, 0, []Revocation{hold(4)}, []string{duplicate}, "", 1},
+    {"released while held in the staged batch", nil, []Revocation{hold(4)}, nil, 0, []Revocation{release(4)}, []string{queued}, "", 2},
+    {"released without a hold", nil, nil, nil, 0, []Revocation{revoke(5),release(4)}, nil, "Serial 4: Serial is not on hold", 0},
+    {"released once revoked", []uint64{4}, nil, nil, 0, []Revocation{release(4)}, nil, "Serial 4: Serial is revoked", 0},
+    {"one serial out of range", nil, nil, nil, 0, []Revocation{revoke(4),revoke(5000),revoke(6)}, nil, "Serial 5000: Serial exceeds maximum", 0},
+    {"queue full", nil, nil, []Revocation{revoke(1)}, 2, []Revocation{revoke(4),revoke(5)}, nil, ErrQueueFull.Error(), 1},
+    {"queue full with the staged batch", nil, []Revocation{revoke(1)}, []Revocation{revoke(2)}, 2, []Revocation{revoke(4)}, nil, ErrQueueFull.Error(), 2},
+    {"duplicates don't fill the queue", nil, []Revocation{revoke(1)}, []Revocation{revoke(2)}, 2, []Revocation{revoke(1),revoke(2)}, []string{duplicate,duplicate}, "", 2},
+  }
+  for _,test := range(tests) {
+    tr := newTestTree(t)
+    if(len(test.committed) > 0) {
+      revokeSerials(t,tr,test.committed...)
+    }
+    // Receipts given for the serials so far, which duplicates must be given back
+    earlier := make(map[uint64]string)
+    for _,serial := range(test.committed) {
+      r, _ := tr.GetRevocation(serial)
+      earlier[serial] = r.receipt.ID
+    }
+    for _,rs := range([][]Revocation{test.staged,test.pending}) {
+      subs, err := tr.AddNodes(rs)
+      if err != nil {t.Fatal(err)}
+      for _,s := range(subs) {
+        earlier[s.Receipt.Serial] = s.Receipt.ID
+      }
+      if(len(test.staged) > 0 && len(tr.inflight) == 0) {
+        tr.inflight, tr.queue = tr.queue, nil
+      }
+    }
+    tr.SetMaxQueue(test.maxQueue)
+    receipts := len(tr.receipts)
+
+    subs, err := tr.AddNodes(test.submit)
+    if(test.want == nil) {
+      if(err == nil || !strings.Contains(err.Error(),test.err)) {
+        t.Errorf("%v: AddNodes = %v, want an error containing %q",test.name,err,test.err)
+      }
+      if(len(tr.receipts) != receipts) {
+        t.Errorf("%v: %v receipts left behind by a refused batch",test.name,len(tr.receipts)-receipts)
+      }
+    } else if err != nil {
+      t.Errorf("%v: AddNodes = %v",test.name,err)
+    } else {
+      for i,s := range(subs) {
+        if(s.Status != test.want[i]) {
+          t.Errorf("%v: submission %v of serial %v is %v, want %v",test.name,i,s.Receipt.Serial,s.Status,test.want[i])
+        }
+        if id, ok := earlier[s.Receipt.Serial]; s.Status != queued && (!ok || s.Receipt.ID != id) {
+          t.Errorf("%v: %v submission %v has receipt %q, want the earlier %q",test.name,s.Status,i,s.Receipt.ID,id)
+        }
+        earlier[s.Receipt.Serial] = s.Receipt.ID
+      }
+    }
+    if got := len(tr.inflight)+len(tr.queue); got != test.queue {
+      t.Errorf("%v: %v staged and queued afterwards, want %v",test.name,got,test.queue)
+    }
+  }
+}
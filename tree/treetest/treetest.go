@@ -0,0 +1,49 @@
+package treetest
+
+import (
+  "crypto"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "testing"
+  "time"
+  "revocation-server/signer"
+  "revocation-server/tree"
+)
+
+//
+// Package treetest
+// Trees and signers for the tests of packages built on the tree, each with a fresh P-256 key
+// Tests of package tree itself use its own newTestTree, as importing this from there would be a cycle
+//
+
+// What every test tree holds and how long it has to integrate a submission
+const (
+  MaxCerts = 1000
+  Mmd = time.Hour
+)
+
+func NewKey(t testing.TB) *ecdsa.PrivateKey {
+  key, err := ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+  if err != nil {t.Fatal(err)}
+  return key
+}
+
+// A signer for key, like the server's for its issuer key
+func SignerFor(key crypto.Signer) *signer.Signer {
+  return signer.NewSigner(0,key,crypto.SHA256)
+}
+
+func NewSigner(t testing.TB) *signer.Signer {
+  return SignerFor(NewKey(t))
+}
+
+// An empty tree of MaxCerts serials with roots signed by s, trees sharing s stand in for replicas sharing a key
+func NewTreeWith(s *signer.Signer) *tree.MerkleTree {
+  return tree.New(MaxCerts,Mmd,s,nil)
+}
+
+// An empty tree of MaxCerts serials with roots signed by a fresh key
+func NewTree(t testing.TB) *tree.MerkleTree {
+  return NewTreeWith(NewSigner(t))
+}